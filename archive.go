@@ -2,67 +2,746 @@ package main
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/bitrise-io/go-utils/command"
 	"github.com/bitrise-io/go-utils/errorutil"
 	"github.com/bitrise-io/go-utils/log"
 )
 
-// uncompressArchive invokes tar tool against a local archive file.
-func uncompressArchive(pth string) error {
-	cmd := command.New("tar", "-xPf", pth)
+// tarExtractArgs returns the tar tool arguments to extract the given archive file, gzip decompressed by tar if compression is featureGzip.
+// Without an extraction root, absolute entry paths are extracted as they are.
+func tarExtractArgs(pth, compression string, opts extractOptions) []string {
+	flags := "-x"
+	if compression == featureGzip {
+		flags += "z"
+	}
+	args := []string{flags + "Pf", pth}
+	if opts.Root != "" {
+		// tar strips the leading / of absolute entry paths without -P, so they are extracted under the root
+		args = []string{flags + "f", pth, "-C", opts.Root}
+	}
+	if !opts.ExtractMetadata && opts.metadataName != "" {
+		// only the metadata entry is excluded, not a cached file of the same name elsewhere in the archive
+		if isGNUTar() {
+			args = append(args, "--anchored", "--exclude="+opts.metadataName)
+		} else {
+			args = append(args, "--exclude=^"+opts.metadataName+"$")
+		}
+	}
+	// existing files are removed before extracting an entry in their place, a symlink is not written through.
+	// GNU tar does it by default, and its --unlink-first fails on the existing non-empty directories.
+	if !isGNUTar() {
+		args = append(args, "--unlink-first")
+	}
+	return args
+}
+
+var (
+	gnuTarOnce sync.Once
+	gnuTar     bool
+)
+
+// isGNUTar reports whether the tar tool is GNU tar (unlike the BSD tar of macOS), it is detected once.
+func isGNUTar() bool {
+	gnuTarOnce.Do(func() {
+		out, err := command.New("tar", "--version").RunAndReturnTrimmedCombinedOutput()
+		gnuTar = err == nil && strings.Contains(out, "GNU tar")
+	})
+	return gnuTar
+}
+
+// uncompressArchive invokes tar tool against a local archive file. A zip archive is converted to a tar stream, if zip archives are accepted.
+// Following or refusing existing symlinks, handling directory conflicts, the gzip resync and the confined extraction need the archive to be streamed,
+// so the file is extracted as a stream then, the same way as the download stream.
+// The compression is sniffed from the file: tar decompresses a gzip archive (-z), a zstd archive is decompressed by the zstd tool and streamed to tar.
+func uncompressArchive(pth string, opts extractOptions) (extractResult, error) {
+	if isZip, err := isZipFile(pth); err != nil {
+		return extractResult{}, err
+	} else if isZip {
+		log.Printf("extracting zip archive")
+		return uncompressZipArchive(pth, opts)
+	}
+
+	if info, err := os.Stat(pth); err != nil {
+		return extractResult{}, err
+	} else if err := checkArchiveSize(info.Size()); err != nil {
+		return extractResult{}, err
+	}
+	compression, err := archiveCompression(pth)
+	if err != nil {
+		return extractResult{}, err
+	}
+	// not every tar decompresses zstd, and the ones which do need the zstd tool too
+	if compression == featureZstd && !zstdAvailable() {
+		return extractResult{}, fmt.Errorf("the archive is zstd compressed, but the %s tool is not installed on the runner", zstdTool)
+	}
+
+	f, err := os.Open(pth)
+	if err != nil {
+		return extractResult{}, err
+	}
+	if opts.streamed() || compression == featureZstd {
+		// the file is closed here, extractCacheArchive only closes it on success
+		result, err := extractCacheArchive(struct{ io.Reader }{f}, opts)
+		if cerr := f.Close(); cerr != nil {
+			log.Warnf("Failed to close %s: %s", pth, cerr)
+		}
+		return result, err
+	}
+	index, err := indexArchive(f, opts.verifiesFiles(), nil)
+	if err != nil {
+		log.Debugf("failed to index the archive: %s", err)
+	}
+	opts.metadataName = index.metadataName()
+	if err := f.Close(); err != nil {
+		log.Warnf("Failed to close %s: %s", pth, err)
+	}
+
+	cmd := command.New("tar", tarExtractArgs(pth, compression, opts)...)
 	out, err := cmd.RunAndReturnTrimmedCombinedOutput()
+	result := newExtractResult(index, out, opts)
+	if info, err := os.Stat(pth); err == nil {
+		result.CompressedBytes = info.Size()
+	}
+	if err != nil && continuesPastFailures(out, result, opts) {
+		log.Warnf("%d entries failed to extract, extracted the rest of the archive", len(result.Errors))
+		err = nil
+	}
 	if err != nil {
 		errMsg := err.Error()
 		if errorutil.IsExitStatusError(err) {
 			errMsg = out
 		}
-		return fmt.Errorf("%s failed: %s", cmd.PrintableCommandArgs(), errMsg)
+		return result, fmt.Errorf("%s failed: %s", cmd.PrintableCommandArgs(), errMsg)
+	}
+	if err := handleHashMismatches(&result, opts); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// archiveInfoFileName is the name of the metadata entry written by the cache push step as the first entry of the archive.
+const archiveInfoFileName = "archive_info.json"
+
+// isArchiveInfoName reports whether the entry is named like the metadata entry. Only the archive's first entry is its metadata:
+// a cached archive_info.json elsewhere in the archive is extracted like any other file.
+func isArchiveInfoName(name string) bool {
+	return filepath.Base(name) == archiveInfoFileName
+}
+
+// isMetadataEntry reports whether the entry of the given name is the archive's metadata entry of the given name, empty if it has none.
+// The names are compared cleaned, with or without their leading /.
+func isMetadataEntry(name, metadata string) bool {
+	return metadata != "" && cleanEntryName(name) == cleanEntryName(metadata)
+}
+
+// cleanEntryName returns the cleaned entry name, without its leading /.
+func cleanEntryName(name string) string {
+	return filepath.Clean(strings.TrimLeft(name, "/"))
+}
+
+// peekMetadataName returns the name of the archive's metadata entry, read from the archive prefix buffered by br without consuming it.
+// It is empty if the first entry is not the metadata entry.
+func peekMetadataName(br *bufio.Reader) string {
+	prefix, _ := br.Peek(br.Size())
+	_, hdr, err := readFirstEntry(bytes.NewReader(prefix))
+	if err != nil || hdr == nil || !isArchiveInfoName(hdr.Name) {
+		return ""
 	}
-	return nil
+	return hdr.Name
+}
+
+// entryError describes an archive entry which failed to extract.
+type entryError struct {
+	Path     string `json:"path"`
+	Error    string `json:"error"`
+	Typeflag string `json:"typeflag"`
+}
+
+// extractOptions configures the archive extraction.
+type extractOptions struct {
+	// ExtractMetadata enables writing the archive's metadata entry to the disk.
+	ExtractMetadata bool
+	// MinFreeSpace is the free space threshold in bytes, while extracting the archive stream. 0 disables the check.
+	MinFreeSpace uint64
+	// FreeSpacePath is a path on the filesystem the free space is checked on.
+	FreeSpacePath string
+	// Root is the directory to extract the archive's entries under, empty extracts them to their own paths.
+	Root string
+	// ExistingSymlinks is the handling of regular file entries targeting an existing symlink, replace by default.
+	ExistingSymlinks string
+	// DirFileConflicts is the handling of regular file entries targeting an existing directory, empty leaves it to tar.
+	DirFileConflicts string
+	// LongPaths is the handling of entries with paths longer than the filesystem's limit, empty leaves it to tar.
+	LongPaths string
+	// GzipResync enables recovering from the damaged members of a multistream gzip archive stream.
+	GzipResync bool
+	// ConfineRoot extracts the archive by the step instead of tar, constraining every write beneath the Root.
+	ConfineRoot bool
+	// AcceptZip enables extracting zip archives, from the archive file.
+	AcceptZip bool
+	// VerifyPerFile is the handling of the regular files not matching their recorded content hash, empty does not verify them.
+	VerifyPerFile string
+	// Filter selects the entries to extract, nil extracts every entry.
+	Filter *pathFilter
+	// DryRun lists the archive's entries instead of extracting them, nothing is written to the disk.
+	DryRun bool
+	// Concurrency is the number of the confined extraction's writers, up to 1 writes the entries sequentially.
+	Concurrency int
+	// SkipIdentical is the handling of the regular files already existing identical to their entry, empty writes them.
+	SkipIdentical string
+	// StripComponents is the number of leading path components stripped of the entries' paths, the shorter entries are skipped.
+	StripComponents int
+	// EntryTimeout aborts the extraction stuck writing an entry for it, not reading the archive. 0 disables the watchdog.
+	EntryTimeout time.Duration
+	// ContinueOnError skips the entries failing to be written (like on a permission error), and extracts the rest of the archive.
+	ContinueOnError bool
+
+	// metadataName is the name of the archive's metadata entry, set by the extraction from the archive's first entry.
+	// It is empty if the archive has no metadata entry.
+	metadataName string
+}
+
+// skipsIdentical reports whether the regular files already existing identical to their entry are not written.
+func (opts extractOptions) skipsIdentical() bool {
+	return opts.SkipIdentical != "" && opts.SkipIdentical != skipIdenticalNone && !opts.DryRun
+}
+
+// verifiesFiles reports whether the regular files' recorded content hashes are verified.
+func (opts extractOptions) verifiesFiles() bool {
+	return opts.VerifyPerFile != "" && opts.VerifyPerFile != verifyPerFileNone
+}
+
+// guarded reports whether the entries are checked by the step, before tar extracts them: the existing entry targets,
+// and under an extraction root, the entries traversing out of it.
+// The confined extraction does not check them by path, it replaces the existing symlinks and refuses the existing directories.
+// A dry run does not extract the entries, there is nothing to check.
+func (opts extractOptions) guarded() bool {
+	if opts.ConfineRoot || opts.DryRun {
+		return false
+	}
+	return opts.Root != "" || opts.ExistingSymlinks == symlinksFollow || opts.ExistingSymlinks == symlinksFail || opts.DirFileConflicts != "" || opts.LongPaths != ""
+}
+
+// streamed reports whether the archive has to be read by the step, so an archive file is not passed to tar directly.
+func (opts extractOptions) streamed() bool {
+	return opts.guarded() || opts.ConfineRoot || opts.GzipResync || opts.Filter != nil || opts.DryRun || opts.skipsIdentical() || opts.watched() || opts.StripComponents > 0
+}
+
+// watched reports whether the extraction is watched for the entries stuck being written.
+func (opts extractOptions) watched() bool {
+	return opts.EntryTimeout > 0 && !opts.DryRun
+}
+
+// extractResult summarizes an archive extraction.
+type extractResult struct {
+	Entries int
+	Skipped int
+	// Identical is the number of the regular files not written, because they already existed identical to their entry.
+	Identical int
+	Errors    []entryError
+	// Index is the archive's index, it is incomplete if the archive could not be read till its end.
+	Index archiveIndex
+	// Usage is the resource usage of the pull, if reported.
+	Usage *resourceUsage
+	// Source is the way the cache was restored: from the archive stream, the downloaded archive file or the cache directory.
+	Source string
+	// CompressedBytes is the size of the (compressed) archive extracted, 0 if unknown.
+	CompressedBytes int64
+	// UncompressedBytes is the size of the regular files extracted.
+	UncompressedBytes int64
+	// CloseError is the error of closing the archive download's body after a successful extraction.
+	CloseError string
+	// DryRun tells that the entries were only listed, not extracted.
+	DryRun bool
+	// Empty tells that the archive had no entries, apart from its metadata: there was nothing to restore.
+	Empty bool
+}
+
+// addWritten adds the regular files written by the step instead of tar to the result.
+func (r *extractResult) addWritten(written archiveIndex) {
+	for name, entry := range written {
+		r.Index[name] = entry
+		r.Entries++
+		r.UncompressedBytes += entry.Size
+	}
+}
+
+// addFailures adds the entries the step failed to write and skipped to the result, they are not extracted.
+func (r *extractResult) addFailures(failed []entryError) {
+	r.Errors = append(r.Errors, failed...)
+	if r.Entries -= len(failed); r.Entries < 0 {
+		r.Entries = 0
+	}
+}
+
+// compressionRatio returns the uncompressed bytes per compressed bytes of the extraction, 0 if unknown.
+func (r extractResult) compressionRatio() float64 {
+	if r.CompressedBytes <= 0 {
+		return 0
+	}
+	return float64(r.UncompressedBytes) / float64(r.CompressedBytes)
+}
+
+// indexEntry describes an archive entry.
+type indexEntry struct {
+	Typeflag byte  `json:"typeflag"`
+	Size     int64 `json:"size"`
+	// Duration is the time tar took reading the entry from the archive stream, its write time. It is not known for archive files.
+	Duration time.Duration `json:"-"`
+	// HashMismatch describes the regular file's content not matching its recorded hash, if the hashes are verified.
+	HashMismatch string `json:"-"`
+	// Metadata tells that the entry is the archive's metadata entry.
+	Metadata bool `json:"metadata,omitempty"`
+}
+
+// archiveIndex maps the archive's entry names to the entries.
+type archiveIndex map[string]indexEntry
+
+// metadataName returns the name of the index's metadata entry, empty if the archive has none.
+func (index archiveIndex) metadataName() string {
+	for name, entry := range index {
+		if entry.Metadata {
+			return name
+		}
+	}
+	return ""
+}
+
+// isEmptyArchive reports whether the archive of the index has no entries, apart from its metadata entry.
+func isEmptyArchive(index archiveIndex) bool {
+	for _, entry := range index {
+		if !entry.Metadata {
+			return false
+		}
+	}
+	return true
 }
 
 // extractCacheArchive invokes tar tool by piping the archive to the command's input.
-func extractCacheArchive(r io.Reader) error {
-	cmd := command.New("tar", "-xPf", "/dev/stdin")
+// The archive's entries are indexed on the fly, to be able to report the failed entries' types.
+// A zip archive stream is not extracted, a zipArchiveError is returned before reading it.
+func extractCacheArchive(r io.Reader, opts extractOptions) (extractResult, error) {
+	// the extraction stops at its next read once the step exceeds its max_duration
+	// the archive is read up to the max_archive_size
+	limit := newSizeLimit()
+	counter := &countingReader{r: io.TeeReader(contextReader{ctx: stepContext, r: r}, limit)}
+	br := bufio.NewReader(counter)
+	if _, err := br.Peek(1); err == io.EOF {
+		// tar refuses an empty input, but an empty archive is not an error: there is nothing to restore
+		return extractResult{Empty: true}, nil
+	}
+	if magic, err := br.Peek(len(zipMagic)); err == nil && bytes.Equal(magic, zipMagic) {
+		return extractResult{}, &zipArchiveError{Accepted: opts.AcceptZip}
+	}
+
+	// a zstd stream is decompressed here, the rest of the extraction reads an uncompressed archive
+	archive, zstd, err := decompressStream(br)
+	if err != nil {
+		return extractResult{}, err
+	}
+	if zstd != nil {
+		zbr := bufio.NewReader(archive)
+		opts.metadataName = peekMetadataName(zbr)
+		archive = zbr
+	} else {
+		opts.metadataName = peekMetadataName(br)
+	}
+
+	pr, pw := io.Pipe()
+	indexed := make(chan archiveIndex)
+
+	var resync *gzipResyncReader
+	if opts.GzipResync && zstd == nil {
+		if magic, err := br.Peek(len(gzipMagic)); err == nil && bytes.Equal(magic, gzipMagic) {
+			resync = newGzipResyncReader(br)
+			archive = resync
+		}
+	}
+	var filter *filteredArchive
+	if opts.Filter != nil || opts.skipsIdentical() || opts.StripComponents > 0 {
+		filter = newFilteredArchive(archive, opts)
+		archive = filter
+	}
+	var guard *entryGuard
+	if opts.guarded() {
+		guard = newEntryGuard(archive, opts)
+		archive = guard
+	}
+
+	var stdin io.Reader = io.TeeReader(archive, pw)
+	var monitor *freeSpaceMonitor
+	if opts.MinFreeSpace > 0 && !opts.DryRun {
+		monitor = &freeSpaceMonitor{r: stdin, pth: opts.FreeSpacePath, threshold: opts.MinFreeSpace}
+		stdin = monitor
+	}
+	var watchdog *entryWatchdog
+	var onEntry func(string)
+	if opts.watched() {
+		watchdog = newEntryWatchdog(stdin, opts.EntryTimeout)
+		stdin = watchdog
+		onEntry = watchdog.setEntry
+	}
+
+	go func() {
+		index, err := indexArchive(pr, opts.verifiesFiles(), onEntry)
+		if err != nil {
+			log.Debugf("failed to index the archive: %s", err)
+		}
+		// tar reads the archive till its end, drain the rest to not block the command
+		if _, err := io.Copy(ioutil.Discard, pr); err != nil {
+			log.Debugf("failed to drain the archive index pipe: %s", err)
+		}
+		indexed <- index
+	}()
+
+	var out string
+	var failures *entryFailures
+	if opts.ContinueOnError {
+		failures = &entryFailures{metadata: opts.metadataName}
+	}
+	extract := func() (err error) {
+		if opts.DryRun {
+			return listArchive(stdin, opts)
+		} else if opts.ConfineRoot {
+			return extractConfined(stdin, opts, failures)
+		}
+		out, err = runTarExtract(stdin, opts)
+		return err
+	}
+	if watchdog != nil {
+		err = watchdog.run(extract)
+		if stall, ok := err.(*entryStallError); ok {
+			// the stages are blocked by the stuck extraction, the step fails without reading their results
+			return extractResult{Index: archiveIndex{}}, stall
+		}
+	} else {
+		err = extract()
+	}
+
+	if cerr := pw.Close(); cerr != nil {
+		log.Debugf("failed to close the archive index pipe: %s", cerr)
+	}
+	result := newExtractResult(<-indexed, out, opts)
+	result.DryRun = opts.DryRun
+	result.addFailures(failures.failed())
+	if err != nil && continuesPastFailures(out, result, opts) {
+		log.Warnf("%d entries failed to extract, extracted the rest of the archive", len(result.Errors))
+		err = nil
+	}
+	// the stages still reading the archive are stopped, before their counters are read
+	var gerr, ferr error
+	if guard != nil {
+		gerr = guard.close()
+		result.addWritten(guard.Written)
+	}
+	if filter != nil {
+		ferr = filter.close()
+		result.Skipped += filter.Skipped
+		result.addWritten(filter.Written)
+		// the identical files are restored as well, they are part of the index
+		for name, entry := range filter.Identical {
+			result.Index[name] = entry
+		}
+		result.Identical = len(filter.Identical)
+	}
+	result.Empty = isEmptyArchive(result.Index) && (filter == nil || filter.Skipped == 0)
+	if zstd != nil {
+		_ = zstd.Close()
+	}
+	result.CompressedBytes = counter.n
+	if resync != nil && resync.SkippedMembers > 0 {
+		log.Warnf("%d damaged gzip members skipped, %d damaged entries removed", resync.SkippedMembers, len(resync.Damaged))
+		for _, damaged := range resync.Damaged {
+			if opts.DryRun {
+				// nothing was extracted
+				continue
+			}
+			if err := os.Remove(entryTarget(damaged.Path, opts.Root)); err != nil && !os.IsNotExist(err) {
+				log.Warnf("Failed to remove damaged entry: %s", err)
+			}
+		}
+		result.Errors = append(result.Errors, resync.Damaged...)
+		if result.Entries -= len(resync.Damaged); result.Entries < 0 {
+			result.Entries = 0
+		}
+	}
+
+	if limit.err != nil {
+		return result, limit.err
+	}
+	if monitor != nil && monitor.err != nil {
+		return result, monitor.err
+	}
+	if zstd != nil && zstd.err != nil {
+		// the extraction failed on the truncated stream, the decompression's error tells why
+		return result, &compressionError{Format: featureZstd, Err: zstd.err}
+	}
+	if gerr != nil {
+		return result, gerr
+	}
+	if ferr != nil {
+		return result, ferr
+	}
+	if err != nil {
+		return result, err
+	}
+	if err := handleHashMismatches(&result, opts); err != nil {
+		return result, err
+	}
+
+	if rc, ok := r.(io.ReadCloser); ok {
+		// the archive is extracted, a failing close is only recorded in the summary
+		if err := closeBody(rc); err != nil {
+			result.CloseError = err.Error()
+		}
+	}
+	return result, nil
+}
+
+// runTarExtract runs the tar tool extracting the archive read from r, and returns its output.
+func runTarExtract(r io.Reader, opts extractOptions) (string, error) {
+	// tar only reads full records from a named pipe with -B, short reads of the stream would fail the extraction
+	cmd := command.New("tar", append(tarExtractArgs("/dev/stdin", "", opts), "-B")...)
 	cmd.SetStdin(r)
-	if out, err := cmd.RunAndReturnTrimmedCombinedOutput(); err != nil {
+	out, err := cmd.RunAndReturnTrimmedCombinedOutput()
+	if err != nil {
 		errMsg := err.Error()
 		if errorutil.IsExitStatusError(err) {
 			errMsg = out
 		}
-		return fmt.Errorf("%s failed: %s", cmd.PrintableCommandArgs(), errMsg)
+		return out, fmt.Errorf("%s failed: %s", cmd.PrintableCommandArgs(), errMsg)
 	}
+	return out, nil
+}
 
-	if rc, ok := r.(io.ReadCloser); ok {
-		return rc.Close()
+// indexArchive reads the entry names, types and sizes of the archive, without extracting it.
+// If verify is set, the regular files' content is hashed and compared to their recorded hash.
+// onEntry, if set, is called with each entry's name as it is read. On error, the entries read so far are returned.
+func indexArchive(r io.Reader, verify bool, onEntry func(string)) (archiveIndex, error) {
+	index := archiveIndex{}
+
+	tr, err := newArchiveReader(r)
+	if err != nil {
+		return index, err
+	}
+
+	// the index is read as tar reads the archive, the time between two headers is the time tar spent on the first entry
+	var prev, metadata string
+	start := time.Now()
+	for {
+		hdr, err := tr.Next()
+		if prev != "" {
+			entry := index[prev]
+			entry.Duration = time.Since(start)
+			index[prev] = entry
+		}
+		start = time.Now()
+		if err == io.EOF {
+			return index, nil
+		}
+		if err != nil {
+			return index, err
+		}
+		if onEntry != nil {
+			onEntry(hdr.Name)
+		}
+		if prev == "" && isArchiveInfoName(hdr.Name) {
+			metadata = hdr.Name
+		}
+		entry := indexEntry{Typeflag: hdr.Typeflag, Size: hdr.Size, Metadata: isMetadataEntry(hdr.Name, metadata)}
+		if entry.Typeflag == tar.TypeGNUSparse {
+			// the old GNU format's sparse file is a regular file, of its logical size
+			entry.Typeflag = tar.TypeReg
+		}
+		if verify {
+			if entry.HashMismatch, err = verifyEntryHash(hdr, tr); err != nil {
+				return index, err
+			}
+		}
+		index[hdr.Name] = entry
+		prev = hdr.Name
 	}
-	return nil
 }
 
-// readFirstEntry reads the first entry from a given archive.
-func readFirstEntry(r io.Reader) (*tar.Reader, *tar.Header, error) {
-	restoreReader := NewRestoreReader(r)
+// newExtractResult creates the extraction summary from the archive's index and the tar tool's output.
+// tar keeps extracting past the failed entries and reports each of them in a "tar: <name>: <error>" line.
+func newExtractResult(index archiveIndex, out string, opts extractOptions) extractResult {
+	result := extractResult{Index: index}
 
-	var archive io.Reader
-	var err error
+	for _, line := range strings.Split(out, "\n") {
+		entryErr, ok := parseTarError(line, index)
+		if ok {
+			result.Errors = append(result.Errors, entryErr)
+		}
+	}
+
+	for _, entry := range index {
+		if !opts.ExtractMetadata && entry.Metadata {
+			result.Skipped++
+			continue
+		}
+		if entry.Typeflag == tar.TypeReg {
+			result.UncompressedBytes += entry.Size
+		}
+	}
+
+	result.Entries = len(index) - result.Skipped - len(result.Errors)
+	if result.Entries < 0 {
+		result.Entries = 0
+	}
+	return result
+}
+
+// parseTarError parses a tar tool output line reporting a failed archive entry.
+// Lines not related to a known entry of the archive (like the final exit status) are ignored.
+func parseTarError(line string, index archiveIndex) (entryError, bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "tar: ") {
+		return entryError{}, false
+	}
+	line = strings.TrimPrefix(line, "tar: ")
+
+	// entry names might contain ": " too, so every separator is tried, from the longest name
+	for i := strings.LastIndex(line, ": "); i > 0; i = strings.LastIndex(line[:i], ": ") {
+		name := line[:i]
+		entry, ok := index[name]
+		if !ok {
+			// tar reports the absolute entries extracted under a root by their stripped path
+			if entry, ok = index["/"+name]; !ok {
+				continue
+			}
+			name = "/" + name
+		}
+		return entryError{
+			Path:     name,
+			Error:    line[i+len(": "):],
+			Typeflag: typeflagName(entry.Typeflag),
+		}, true
+	}
+	return entryError{}, false
+}
+
+// typeflagName returns a human readable name of a tar entry type.
+func typeflagName(typeflag byte) string {
+	switch typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		return "regular"
+	case tar.TypeDir:
+		return "directory"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	default:
+		return fmt.Sprintf("%q", typeflag)
+	}
+}
 
-	log.Debugf("attempt to read archive as .gzip")
+// writeErrorReport writes the failed entries of an extraction to the given path as JSON.
+func writeErrorReport(pth string, result extractResult) error {
+	report := struct {
+		ExtractedEntries int            `json:"extracted_entries"`
+		FailedEntries    int            `json:"failed_entries"`
+		Errors           []entryError   `json:"errors"`
+		ResourceUsage    *resourceUsage `json:"resource_usage,omitempty"`
+		CompressionRatio float64        `json:"compression_ratio,omitempty"`
+		CloseError       string         `json:"body_close_error,omitempty"`
+	}{
+		ExtractedEntries: result.Entries,
+		FailedEntries:    len(result.Errors),
+		Errors:           result.Errors,
+		ResourceUsage:    result.Usage,
+		CompressionRatio: result.compressionRatio(),
+		CloseError:       result.CloseError,
+	}
+	if report.Errors == nil {
+		report.Errors = []entryError{}
+	}
 
-	archive, err = gzip.NewReader(restoreReader)
+	b, err := json.MarshalIndent(report, "", "  ")
 	if err != nil {
-		// might the archive is not compressed
-		log.Debugf("failed to open the archive as .gzip: %s", err)
-		log.Debugf("restoring reader and trying as .tar")
+		return err
+	}
+	return ioutil.WriteFile(pth, b, 0644)
+}
+
+// maxGzipExtraSize is the largest accepted gzip header extra field. Real world extra fields (like BGZF's) are a few bytes,
+// the format allows up to 64 KB.
+const maxGzipExtraSize = 1024
 
-		restoreReader.Restore()
-		archive = restoreReader
+// checkGzipHeader validates the fixed part of a gzip header (the first 12 bytes of the stream, if available).
+// Streams not starting with the gzip magic bytes are not validated.
+func checkGzipHeader(hdr []byte) (bool, error) {
+	if len(hdr) < 2 || hdr[0] != 0x1f || hdr[1] != 0x8b {
+		return false, nil
+	}
+	if len(hdr) < 10 {
+		return true, errors.New("malformed gzip header: truncated")
+	}
+
+	flg := hdr[3]
+	if flg&0xe0 != 0 {
+		return true, fmt.Errorf("malformed gzip header: reserved flags set: %#x", flg)
+	}
+	if flg&0x04 != 0 && len(hdr) >= 12 {
+		if xlen := int(hdr[10]) | int(hdr[11])<<8; xlen > maxGzipExtraSize {
+			return true, fmt.Errorf("malformed gzip header: %d bytes extra field, at most %d bytes are accepted", xlen, maxGzipExtraSize)
+		}
+	}
+	return true, nil
+}
+
+// newArchiveReader returns a tar reader of the archive, which might be gzip compressed.
+// A gzip stream with a malformed header is an error, instead of being read as an uncompressed archive.
+func newArchiveReader(r io.Reader) (*tar.Reader, error) {
+	hdr := make([]byte, 12)
+	n, err := io.ReadFull(r, hdr)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	isGzip, err := checkGzipHeader(hdr[:n])
+	if err != nil {
+		return nil, err
+	}
+	r = io.MultiReader(bytes.NewReader(hdr[:n]), r)
+
+	if !isGzip {
+		return tar.NewReader(r), nil
+	}
+
+	log.Debugf("reading archive as .gzip")
+
+	archive, err := gzip.NewReader(r)
+	if err != nil {
+		// the name and comment fields are limited by the decompressor
+		return nil, fmt.Errorf("malformed gzip header: %s", err)
+	}
+
+	return tar.NewReader(archive), nil
+}
+
+// readFirstEntry reads the first entry from a given archive.
+// A gzip compressed archive is decompressed first, only the prefix holding the first entry is decompressed.
+func readFirstEntry(r io.Reader) (*tar.Reader, *tar.Header, error) {
+	tr, err := newArchiveReader(r)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	tr := tar.NewReader(archive)
 	hdr, err := tr.Next()
 	if err == io.EOF {
 		// no entries in the archive
@@ -0,0 +1,724 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testEntry struct {
+	hdr  tar.Header
+	body string
+}
+
+// createTestArchive creates an uncompressed tar archive from the given entries.
+func createTestArchive(t testing.TB, entries ...testEntry) *bytes.Buffer {
+	var buff bytes.Buffer
+	tw := tar.NewWriter(&buff)
+	for _, entry := range entries {
+		hdr := entry.hdr
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(entry.body))
+		}
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatalf("failed to write header: %s", err)
+		}
+		if _, err := tw.Write([]byte(entry.body)); err != nil {
+			t.Fatalf("failed to write body: %s", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close archive: %s", err)
+	}
+	return &buff
+}
+
+func TestWriteErrorReport(t *testing.T) {
+	dir := t.TempDir()
+	okPth := filepath.Join(dir, "ok.txt")
+	// a path component longer than 255 characters fails to extract, even if running as root
+	failingFilePth := filepath.Join(dir, strings.Repeat("a", 300)+".txt")
+	failingDirPth := filepath.Join(dir, strings.Repeat("b", 300))
+	lastPth := filepath.Join(dir, "last.txt")
+
+	archive := createTestArchive(t,
+		testEntry{hdr: tar.Header{Name: okPth, Typeflag: tar.TypeReg}, body: "ok"},
+		testEntry{hdr: tar.Header{Name: failingFilePth, Typeflag: tar.TypeReg}, body: "fail"},
+		testEntry{hdr: tar.Header{Name: failingDirPth, Typeflag: tar.TypeDir, Mode: 0755}},
+		testEntry{hdr: tar.Header{Name: lastPth, Typeflag: tar.TypeReg}, body: "last"},
+	)
+
+	result, err := extractCacheArchive(archive, extractOptions{})
+	if err == nil {
+		t.Fatalf("extractCacheArchive() error = nil, want error")
+	}
+	if _, err := os.Stat(lastPth); err != nil {
+		t.Errorf("extraction did not continue past the failed entries: %s", err)
+	}
+
+	reportPth := filepath.Join(dir, "report.json")
+	if err := writeErrorReport(reportPth, result); err != nil {
+		t.Fatalf("writeErrorReport() error = %v", err)
+	}
+
+	b, err := ioutil.ReadFile(reportPth)
+	if err != nil {
+		t.Fatalf("failed to read report: %s", err)
+	}
+
+	var report struct {
+		ExtractedEntries int          `json:"extracted_entries"`
+		FailedEntries    int          `json:"failed_entries"`
+		Errors           []entryError `json:"errors"`
+	}
+	if err := json.Unmarshal(b, &report); err != nil {
+		t.Fatalf("failed to parse report: %s", err)
+	}
+
+	if report.ExtractedEntries != 2 {
+		t.Errorf("extracted_entries = %d, want %d", report.ExtractedEntries, 2)
+	}
+	if report.FailedEntries != 2 || len(report.Errors) != 2 {
+		t.Fatalf("failed_entries = %d, errors = %v, want 2 errors", report.FailedEntries, report.Errors)
+	}
+
+	want := []entryError{
+		{Path: failingFilePth, Typeflag: "regular"},
+		{Path: failingDirPth, Typeflag: "directory"},
+	}
+	for i, w := range want {
+		got := report.Errors[i]
+		if got.Path != w.Path {
+			t.Errorf("errors[%d].path = %s, want %s", i, got.Path, w.Path)
+		}
+		if got.Typeflag != w.Typeflag {
+			t.Errorf("errors[%d].typeflag = %s, want %s", i, got.Typeflag, w.Typeflag)
+		}
+		if got.Error == "" {
+			t.Errorf("errors[%d].error is empty", i)
+		}
+	}
+}
+
+func TestParseTarError(t *testing.T) {
+	index := archiveIndex{
+		"/tmp/a: b.txt": {Typeflag: tar.TypeReg},
+		"dir":           {Typeflag: tar.TypeDir},
+	}
+
+	tests := []struct {
+		line   string
+		want   entryError
+		wantOk bool
+	}{
+		{"tar: dir: Cannot mkdir: Permission denied", entryError{Path: "dir", Error: "Cannot mkdir: Permission denied", Typeflag: "directory"}, true},
+		{"tar: /tmp/a: b.txt: Cannot open: File exists", entryError{Path: "/tmp/a: b.txt", Error: "Cannot open: File exists", Typeflag: "regular"}, true},
+		{"tar: tmp/a: b.txt: Cannot open: Not a directory", entryError{Path: "/tmp/a: b.txt", Error: "Cannot open: Not a directory", Typeflag: "regular"}, true},
+		{"tar: Exiting with failure status due to previous errors", entryError{}, false},
+		{"tar: unknown: Cannot open: No such file or directory", entryError{}, false},
+		{"some other output", entryError{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseTarError(tt.line, index)
+		if ok != tt.wantOk || got != tt.want {
+			t.Errorf("parseTarError(%q) = %v, %v, want %v, %v", tt.line, got, ok, tt.want, tt.wantOk)
+		}
+	}
+}
+
+func TestExtractCacheArchive_SkipsMetadata(t *testing.T) {
+	for _, extractMetadata := range []bool{false, true} {
+		dir := t.TempDir()
+		infoPth := filepath.Join(dir, archiveInfoFileName)
+		filePth := filepath.Join(dir, "File.txt")
+
+		archive := createTestArchive(t,
+			testEntry{hdr: tar.Header{Name: infoPth, Typeflag: tar.TypeReg}, body: `{"stack_id":"osx"}`},
+			testEntry{hdr: tar.Header{Name: filePth, Typeflag: tar.TypeReg}, body: "test"},
+		)
+
+		if _, err := extractCacheArchive(archive, extractOptions{ExtractMetadata: extractMetadata}); err != nil {
+			t.Fatalf("extractCacheArchive() error = %v", err)
+		}
+
+		if _, err := os.Stat(filePth); err != nil {
+			t.Errorf("File.txt not extracted: %s", err)
+		}
+		_, err := os.Stat(infoPth)
+		if extractMetadata && err != nil {
+			t.Errorf("extractMetadata = true: %s not extracted: %s", archiveInfoFileName, err)
+		}
+		if !extractMetadata && !os.IsNotExist(err) {
+			t.Errorf("extractMetadata = false: %s extracted to the workspace", archiveInfoFileName)
+		}
+	}
+}
+
+func TestExtractCacheArchive_SkipsOnlyTheMetadataEntry(t *testing.T) {
+	entries := []testEntry{
+		{hdr: tar.Header{Name: archiveInfoFileName, Typeflag: tar.TypeReg}, body: `{"stack_id":"osx"}`},
+		{hdr: tar.Header{Name: "sub/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "sub/" + archiveInfoFileName, Typeflag: tar.TypeReg, Mode: 0644}, body: `{"cached": true}`},
+	}
+
+	for _, opts := range []extractOptions{{}, {ConfineRoot: true}, {DryRun: true}} {
+		opts.Root = t.TempDir()
+		result, err := extractCacheArchive(createTestArchive(t, entries...), opts)
+		if err != nil {
+			t.Fatalf("extractCacheArchive(%+v) error = %v", opts, err)
+		}
+		if result.Skipped != 1 {
+			t.Errorf("%+v: Skipped = %d, want the metadata entry only", opts, result.Skipped)
+		}
+		if opts.DryRun {
+			continue
+		}
+
+		if _, err := os.Stat(filepath.Join(opts.Root, archiveInfoFileName)); !os.IsNotExist(err) {
+			t.Errorf("%+v: the metadata entry is extracted", opts)
+		}
+		b, err := ioutil.ReadFile(filepath.Join(opts.Root, "sub", archiveInfoFileName))
+		if err != nil || string(b) != `{"cached": true}` {
+			t.Errorf("%+v: sub/%s = %q (%v), want the cached file extracted", opts, archiveInfoFileName, b, err)
+		}
+	}
+
+	t.Log("archive file")
+	archivePth := filepath.Join(t.TempDir(), "archive.tar")
+	if err := ioutil.WriteFile(archivePth, createTestArchive(t, entries...).Bytes(), 0644); err != nil {
+		t.Fatalf("failed to write archive: %s", err)
+	}
+	root := t.TempDir()
+	result, err := uncompressArchive(archivePth, extractOptions{Root: root})
+	if err != nil {
+		t.Fatalf("uncompressArchive() error = %v", err)
+	}
+	if result.Skipped != 1 {
+		t.Errorf("uncompressArchive() Skipped = %d, want the metadata entry only", result.Skipped)
+	}
+	if _, err := os.Stat(filepath.Join(root, "sub", archiveInfoFileName)); err != nil {
+		t.Errorf("uncompressArchive() sub/%s not extracted: %s", archiveInfoFileName, err)
+	}
+
+	t.Log("no metadata entry")
+	root = t.TempDir()
+	if _, err := extractCacheArchive(createTestArchive(t, entries[1:]...), extractOptions{Root: root}); err != nil {
+		t.Fatalf("extractCacheArchive() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "sub", archiveInfoFileName)); err != nil {
+		t.Errorf("extractCacheArchive() sub/%s not extracted from an archive without metadata: %s", archiveInfoFileName, err)
+	}
+}
+
+func TestTarExtractArgs_Metadata(t *testing.T) {
+	args := strings.Join(tarExtractArgs("archive", "", extractOptions{metadataName: "/tmp/" + archiveInfoFileName}), " ")
+	want := "--exclude=^/tmp/" + archiveInfoFileName + "$"
+	if isGNUTar() {
+		want = "--anchored --exclude=/tmp/" + archiveInfoFileName
+	}
+	if !strings.Contains(args, want) {
+		t.Errorf("tarExtractArgs() = %s, want %s", args, want)
+	}
+
+	for _, opts := range []extractOptions{{}, {ExtractMetadata: true, metadataName: archiveInfoFileName}} {
+		if args := strings.Join(tarExtractArgs("archive", "", opts), " "); strings.Contains(args, "--exclude") {
+			t.Errorf("tarExtractArgs(%+v) = %s, want nothing excluded", opts, args)
+		}
+	}
+}
+
+func TestUncompressArchive_SkipsMetadata(t *testing.T) {
+	for _, extractMetadata := range []bool{false, true} {
+		dir := t.TempDir()
+		infoPth := filepath.Join(dir, archiveInfoFileName)
+		filePth := filepath.Join(dir, "File.txt")
+
+		archive := createTestArchive(t,
+			testEntry{hdr: tar.Header{Name: infoPth, Typeflag: tar.TypeReg}, body: `{"stack_id":"osx"}`},
+			testEntry{hdr: tar.Header{Name: filePth, Typeflag: tar.TypeReg}, body: "test"},
+		)
+		archivePth := filepath.Join(t.TempDir(), "archive.tar")
+		if err := ioutil.WriteFile(archivePth, archive.Bytes(), 0644); err != nil {
+			t.Fatalf("failed to write archive: %s", err)
+		}
+
+		result, err := uncompressArchive(archivePth, extractOptions{ExtractMetadata: extractMetadata})
+		if err != nil {
+			t.Fatalf("uncompressArchive() error = %v", err)
+		}
+
+		if _, err := os.Stat(filePth); err != nil {
+			t.Errorf("File.txt not extracted: %s", err)
+		}
+		_, err = os.Stat(infoPth)
+		if extractMetadata && err != nil {
+			t.Errorf("extractMetadata = true: %s not extracted: %s", archiveInfoFileName, err)
+		}
+		if !extractMetadata {
+			if !os.IsNotExist(err) {
+				t.Errorf("extractMetadata = false: %s extracted to the workspace", archiveInfoFileName)
+			}
+			if result.Skipped != 1 {
+				t.Errorf("extractMetadata = false: skipped = %d, want %d", result.Skipped, 1)
+			}
+		}
+	}
+}
+
+func TestExtractCacheArchive_Root(t *testing.T) {
+	root := t.TempDir()
+	archive := createTestArchive(t,
+		testEntry{hdr: tar.Header{Name: "/Users/vagrant/.gradle/File.txt", Typeflag: tar.TypeReg}, body: "test"},
+	)
+
+	if _, err := extractCacheArchive(archive, extractOptions{Root: root}); err != nil {
+		t.Fatalf("extractCacheArchive() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "Users/vagrant/.gradle/File.txt")); err != nil {
+		t.Errorf("absolute entry not extracted under the root: %s", err)
+	}
+}
+
+func TestNewArchiveReader_GzipHeader(t *testing.T) {
+	archive := createTestArchive(t, testEntry{hdr: tar.Header{Name: "File.txt", Typeflag: tar.TypeReg}, body: "test"})
+
+	gzipped := func(extra []byte, name string) []byte {
+		var buff bytes.Buffer
+		zw := gzip.NewWriter(&buff)
+		zw.Extra = extra
+		zw.Name = name
+		if _, err := zw.Write(archive.Bytes()); err != nil {
+			t.Fatalf("failed to compress archive: %s", err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("failed to compress archive: %s", err)
+		}
+		return buff.Bytes()
+	}
+
+	tests := []struct {
+		name    string
+		archive []byte
+		wantErr bool
+	}{
+		{name: "tar", archive: archive.Bytes()},
+		{name: "gzip", archive: gzipped(nil, "")},
+		{name: "gzip with extra field and name", archive: gzipped([]byte("BC\x02\x00\x1b\x00"), "cache.tar")},
+		{name: "oversized extra field", archive: gzipped(bytes.Repeat([]byte{'x'}, 60000), ""), wantErr: true},
+		{name: "oversized name", archive: gzipped(nil, strings.Repeat("x", 10000)), wantErr: true},
+		{name: "truncated header", archive: []byte{0x1f, 0x8b, 0x08}, wantErr: true},
+		{name: "reserved flags", archive: append([]byte{0x1f, 0x8b, 0x08, 0xff, 0, 0, 0, 0, 0, 0}, archive.Bytes()...), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr, err := newArchiveReader(bytes.NewReader(tt.archive))
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "malformed gzip header") {
+					t.Fatalf("newArchiveReader() error = %v, want malformed gzip header error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newArchiveReader() error = %v", err)
+			}
+			hdr, err := tr.Next()
+			if err != nil {
+				t.Fatalf("failed to read first entry: %s", err)
+			}
+			if hdr.Name != "File.txt" {
+				t.Errorf("first entry = %s, want File.txt", hdr.Name)
+			}
+		})
+	}
+}
+
+func TestExtractCacheArchive_ExistingSymlink(t *testing.T) {
+	for _, mode := range []string{symlinksReplace, symlinksFollow, symlinksFail} {
+		dir := t.TempDir()
+		external := filepath.Join(dir, "external.txt")
+		if err := ioutil.WriteFile(external, []byte("external"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		filePth := filepath.Join(dir, "cache", "File.txt")
+		if err := os.MkdirAll(filepath.Dir(filePth), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(external, filePth); err != nil {
+			t.Fatal(err)
+		}
+
+		archive := createTestArchive(t,
+			testEntry{hdr: tar.Header{Name: filePth, Typeflag: tar.TypeReg}, body: "cache"},
+		)
+		_, err := extractCacheArchive(archive, extractOptions{ExistingSymlinks: mode})
+
+		externalContent, rerr := ioutil.ReadFile(external)
+		if rerr != nil {
+			t.Fatal(rerr)
+		}
+		info, lerr := os.Lstat(filePth)
+		if lerr != nil {
+			t.Fatal(lerr)
+		}
+		isLink := info.Mode()&os.ModeSymlink != 0
+
+		switch mode {
+		case symlinksReplace:
+			if err != nil {
+				t.Fatalf("%s: extractCacheArchive() error = %v", mode, err)
+			}
+			if isLink || string(externalContent) != "external" {
+				t.Errorf("%s: symlink followed, want it replaced by a regular file", mode)
+			}
+			if b, _ := ioutil.ReadFile(filePth); string(b) != "cache" {
+				t.Errorf("%s: extracted content = %q, want cache", mode, b)
+			}
+		case symlinksFollow:
+			if err != nil {
+				t.Fatalf("%s: extractCacheArchive() error = %v", mode, err)
+			}
+			if !isLink || string(externalContent) != "cache" {
+				t.Errorf("%s: symlink not followed, external content = %q", mode, externalContent)
+			}
+		case symlinksFail:
+			if _, ok := err.(*symlinkError); !ok {
+				t.Fatalf("%s: extractCacheArchive() error = %v, want symlink error", mode, err)
+			}
+			if !isLink || string(externalContent) != "external" {
+				t.Errorf("%s: the symlink or its target was modified", mode)
+			}
+		}
+	}
+}
+
+func TestExtractCacheArchive_DirFileConflict(t *testing.T) {
+	for _, policy := range []string{dirConflictsFail, dirConflictsRemove, dirConflictsSkip} {
+		for _, empty := range []bool{true, false} {
+			root := t.TempDir()
+			dirPth := filepath.Join(root, "cache", "File.txt")
+			if err := os.MkdirAll(dirPth, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if !empty {
+				if err := ioutil.WriteFile(filepath.Join(dirPth, "nested.txt"), []byte("nested"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			archive := createTestArchive(t,
+				testEntry{hdr: tar.Header{Name: "/cache/File.txt", Typeflag: tar.TypeReg}, body: "cache"},
+				testEntry{hdr: tar.Header{Name: "/cache/Other.txt", Typeflag: tar.TypeReg}, body: "other"},
+			)
+			_, err := extractCacheArchive(archive, extractOptions{Root: root, DirFileConflicts: policy})
+
+			info, serr := os.Stat(dirPth)
+			if serr != nil {
+				t.Fatal(serr)
+			}
+			switch {
+			case policy == dirConflictsRemove && empty:
+				if err != nil {
+					t.Fatalf("%s: extractCacheArchive() error = %v", policy, err)
+				}
+				if b, _ := ioutil.ReadFile(dirPth); info.IsDir() || string(b) != "cache" {
+					t.Errorf("%s: the empty directory is not replaced by the file", policy)
+				}
+			case policy == dirConflictsSkip:
+				if err != nil {
+					t.Fatalf("%s: extractCacheArchive() error = %v", policy, err)
+				}
+				if !info.IsDir() {
+					t.Errorf("%s: the directory is replaced, want it skipped", policy)
+				}
+				if b, _ := ioutil.ReadFile(filepath.Join(root, "cache", "Other.txt")); string(b) != "other" {
+					t.Errorf("%s: the entry after the skipped one is not extracted", policy)
+				}
+			default:
+				conflictErr, ok := err.(*dirConflictError)
+				if !ok {
+					t.Fatalf("%s (empty: %t): extractCacheArchive() error = %v, want directory conflict error", policy, empty, err)
+				}
+				if conflictErr.Path != dirPth {
+					t.Errorf("%s: conflicting path = %s, want %s", policy, conflictErr.Path, dirPth)
+				}
+				if !info.IsDir() {
+					t.Errorf("%s: the directory is modified", policy)
+				}
+			}
+		}
+	}
+}
+
+func TestExtractCacheArchive_CompressionRatio(t *testing.T) {
+	dir := t.TempDir()
+	archive := createTestArchive(t,
+		testEntry{hdr: tar.Header{Name: filepath.Join(dir, archiveInfoFileName), Typeflag: tar.TypeReg}, body: `{"stack_id":"osx"}`},
+		testEntry{hdr: tar.Header{Name: filepath.Join(dir, "File.txt"), Typeflag: tar.TypeReg}, body: strings.Repeat("a", 10000)},
+		testEntry{hdr: tar.Header{Name: filepath.Join(dir, "Dir"), Typeflag: tar.TypeDir}},
+	)
+	// an uncompressed archive is bigger than its content, because of the headers and padding
+	compressedSize := int64(archive.Len())
+
+	result, err := extractCacheArchive(archive, extractOptions{})
+	if err != nil {
+		t.Fatalf("extractCacheArchive() error = %v", err)
+	}
+	if result.UncompressedBytes != 10000 {
+		t.Errorf("uncompressed bytes = %d, want 10000", result.UncompressedBytes)
+	}
+	if result.CompressedBytes != compressedSize {
+		t.Errorf("compressed bytes = %d, want %d", result.CompressedBytes, compressedSize)
+	}
+	if got, want := result.compressionRatio(), 10000/float64(compressedSize); got != want {
+		t.Errorf("compressionRatio() = %f, want %f", got, want)
+	}
+	if (extractResult{UncompressedBytes: 10}).compressionRatio() != 0 {
+		t.Errorf("compressionRatio() of an unknown compressed size should be 0")
+	}
+}
+
+// readTree returns the regular files' contents under root, by their paths relative to root.
+func readTree(t *testing.T, root string) map[string]string {
+	tree := map[string]string{}
+	err := filepath.Walk(root, func(pth string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		b, err := ioutil.ReadFile(pth)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, pth)
+		tree[rel] = string(b)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestUncompressArchive_MatchesStream(t *testing.T) {
+	plain := createTestArchive(t,
+		testEntry{hdr: tar.Header{Name: "/" + archiveInfoFileName, Typeflag: tar.TypeReg}, body: `{"stack_id": "osx-xcode-12.0.x"}`},
+		testEntry{hdr: tar.Header{Name: "/cache/dir", Typeflag: tar.TypeDir, Mode: 0755}},
+		testEntry{hdr: tar.Header{Name: "/cache/dir/File.txt", Typeflag: tar.TypeReg}, body: "cache"},
+		testEntry{hdr: tar.Header{Name: "cache/relative.txt", Typeflag: tar.TypeReg}, body: "relative"},
+	).Bytes()
+	rnd := rand.New(rand.NewSource(1))
+	var bodies [][]byte
+	for i := 0; i < 3; i++ {
+		body := make([]byte, 4096)
+		rnd.Read(body)
+		bodies = append(bodies, body)
+	}
+	damaged := createMultistreamArchive(t, []string{"/cache/first", "/cache/second", "/cache/third"}, bodies, 1)
+
+	tests := []struct {
+		name    string
+		archive []byte
+		opts    extractOptions
+	}{
+		{name: "extraction root", archive: plain},
+		{name: "metadata extracted", archive: plain, opts: extractOptions{ExtractMetadata: true}},
+		{name: "existing symlinks followed", archive: plain, opts: extractOptions{ExistingSymlinks: symlinksFollow}},
+		{name: "gzip resync", archive: damaged, opts: extractOptions{GzipResync: true}},
+	}
+	for _, tt := range tests {
+		t.Log(tt.name)
+
+		streamOpts, fileOpts := tt.opts, tt.opts
+		streamOpts.Root, fileOpts.Root = t.TempDir(), t.TempDir()
+		streamed, err := extractCacheArchive(bytes.NewReader(tt.archive), streamOpts)
+		if err != nil {
+			t.Fatalf("extractCacheArchive() error = %v", err)
+		}
+
+		pth := filepath.Join(t.TempDir(), "archive.tar")
+		if err := ioutil.WriteFile(pth, tt.archive, 0644); err != nil {
+			t.Fatal(err)
+		}
+		uncompressed, err := uncompressArchive(pth, fileOpts)
+		if err != nil {
+			t.Fatalf("uncompressArchive() error = %v", err)
+		}
+
+		streamTree, fileTree := readTree(t, streamOpts.Root), readTree(t, fileOpts.Root)
+		if len(streamTree) == 0 || !reflect.DeepEqual(streamTree, fileTree) {
+			t.Errorf("extracted file tree = %v, want the streamed tree %v", fileTree, streamTree)
+		}
+		if uncompressed.Entries != streamed.Entries || uncompressed.Skipped != streamed.Skipped || len(uncompressed.Errors) != len(streamed.Errors) {
+			t.Errorf("uncompressArchive() = %d entries, %d skipped, %d failed, want %d, %d, %d as streamed",
+				uncompressed.Entries, uncompressed.Skipped, len(uncompressed.Errors), streamed.Entries, streamed.Skipped, len(streamed.Errors))
+		}
+	}
+}
+
+func TestExtractCacheArchive_RootTraversal(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// a symlink next to the root, which a guarded extraction would write through
+	victim := filepath.Join(t.TempDir(), "victim.txt")
+	if err := ioutil.WriteFile(victim, []byte("victim"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(victim, filepath.Join(parent, "up.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := []testEntry{
+		{hdr: tar.Header{Name: "/abs/file.txt", Typeflag: tar.TypeReg}, body: "abs"},
+		{hdr: tar.Header{Name: "../up.txt", Typeflag: tar.TypeReg}, body: "escaped"},
+		{hdr: tar.Header{Name: "dir/../../up2.txt", Typeflag: tar.TypeReg}, body: "escaped"},
+		{hdr: tar.Header{Name: "/../up3.txt", Typeflag: tar.TypeReg}, body: "escaped"},
+		{hdr: tar.Header{Name: "ok.txt", Typeflag: tar.TypeReg}, body: "ok"},
+	}
+	for _, opts := range []extractOptions{
+		{Root: root},
+		{Root: root, ExistingSymlinks: symlinksFollow},
+		{Root: root, ConfineRoot: true},
+	} {
+		if _, err := extractCacheArchive(createTestArchive(t, entries...), opts); err == nil {
+			t.Errorf("extractCacheArchive(%+v) error = nil, want the traversing entries refused", opts)
+		}
+
+		if b, err := ioutil.ReadFile(victim); err != nil || string(b) != "victim" {
+			t.Errorf("extractCacheArchive(%+v) wrote outside the root, through a symlink: %q, %v", opts, b, err)
+		}
+		for _, name := range []string{"up2.txt", "up3.txt"} {
+			if _, err := os.Lstat(filepath.Join(parent, name)); !os.IsNotExist(err) {
+				t.Errorf("extractCacheArchive(%+v) wrote %s outside the root: %v", opts, name, err)
+			}
+		}
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(root, "abs/file.txt")); err != nil || string(b) != "abs" {
+		t.Errorf("absolute entry not rebased under the root: %q, %v", b, err)
+	}
+}
+
+func TestEntryTarget(t *testing.T) {
+	tests := []struct {
+		name string
+		root string
+		want string
+	}{
+		{name: "/Users/vagrant/file.txt", root: "", want: "/Users/vagrant/file.txt"},
+		{name: "../file.txt", root: "", want: "../file.txt"},
+		{name: "/Users/vagrant/file.txt", root: "/root", want: "/root/Users/vagrant/file.txt"},
+		{name: "dir/./file.txt", root: "/root", want: "/root/dir/file.txt"},
+		{name: "../file.txt", root: "/root", want: ""},
+		{name: "/dir/../../file.txt", root: "/root", want: ""},
+		{name: "dir/..", root: "/root", want: ""},
+		{name: "dir/..file.txt", root: "/root", want: "/root/dir/..file.txt"},
+	}
+	for _, tt := range tests {
+		if got := entryTarget(tt.name, tt.root); got != tt.want {
+			t.Errorf("entryTarget(%q, %q) = %q, want %q", tt.name, tt.root, got, tt.want)
+		}
+	}
+}
+
+func TestExtractCacheArchive_RoundTrip(t *testing.T) {
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	entries := []testEntry{
+		{hdr: tar.Header{Name: "tools/", Typeflag: tar.TypeDir, Mode: 0750, ModTime: modTime}},
+		{hdr: tar.Header{Name: "tools/run.sh", Typeflag: tar.TypeReg, Mode: 0755, ModTime: modTime}, body: "#!/bin/sh"},
+		{hdr: tar.Header{Name: "tools/run", Typeflag: tar.TypeSymlink, Linkname: "run.sh", Mode: 0777, ModTime: modTime}},
+		{hdr: tar.Header{Name: "tools/run-hard", Typeflag: tar.TypeLink, Linkname: "tools/run.sh", ModTime: modTime}},
+		{hdr: tar.Header{Name: "tools/through.sh", Typeflag: tar.TypeReg, Mode: 0755, ModTime: modTime}, body: "#!/bin/sh"},
+	}
+
+	for _, opts := range []extractOptions{
+		{},
+		{ConfineRoot: true},
+		{ExistingSymlinks: symlinksFollow},
+	} {
+		opts.Root = t.TempDir()
+		// an existing symlink to a non executable file, written through in the follow mode
+		external := filepath.Join(t.TempDir(), "external.sh")
+		if err := ioutil.WriteFile(external, []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Join(opts.Root, "tools"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(external, filepath.Join(opts.Root, "tools/through.sh")); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := extractCacheArchive(createTestArchive(t, entries...), opts); err != nil {
+			t.Fatalf("extractCacheArchive(%+v) error = %v", opts, err)
+		}
+
+		for name, want := range map[string]os.FileMode{"tools": os.ModeDir | 0750, "tools/run.sh": 0755} {
+			info, err := os.Lstat(filepath.Join(opts.Root, name))
+			if err != nil {
+				t.Errorf("%+v: %s not extracted: %s", opts, name, err)
+				continue
+			}
+			if got := info.Mode(); got != want {
+				t.Errorf("%+v: %s mode = %s, want %s", opts, name, got, want)
+			}
+			if !info.ModTime().Equal(modTime) {
+				t.Errorf("%+v: %s modification time = %s, want %s", opts, name, info.ModTime(), modTime)
+			}
+		}
+		if target, err := os.Readlink(filepath.Join(opts.Root, "tools/run")); err != nil || target != "run.sh" {
+			t.Errorf("%+v: tools/run = %q, %v, want a symlink to run.sh", opts, target, err)
+		}
+		original, err := os.Stat(filepath.Join(opts.Root, "tools/run.sh"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hard, err := os.Lstat(filepath.Join(opts.Root, "tools/run-hard")); err != nil || !os.SameFile(original, hard) {
+			t.Errorf("%+v: tools/run-hard is not a hard link of tools/run.sh: %v", opts, err)
+		}
+
+		through := filepath.Join(opts.Root, "tools/through.sh")
+		if opts.ExistingSymlinks == symlinksFollow {
+			through = external
+		}
+		if info, err := os.Lstat(through); err != nil || info.Mode() != 0755 {
+			t.Errorf("%+v: %s = %v, %v, want an executable regular file", opts, through, info, err)
+		}
+	}
+}
+
+func TestExtractCacheArchive_Empty(t *testing.T) {
+	metadataOnly := createTestArchive(t, testEntry{hdr: tar.Header{Name: archiveInfoFileName, Typeflag: tar.TypeReg}, body: `{"stack_id":"osx-xcode-14"}`})
+	for name, archive := range map[string][]byte{
+		"empty stream":  nil,
+		"no entries":    make([]byte, 1024),
+		"only metadata": metadataOnly.Bytes(),
+	} {
+		for _, opts := range []extractOptions{{}, {Root: t.TempDir()}, {Root: t.TempDir(), ConfineRoot: true}} {
+			result, err := extractCacheArchive(bytes.NewReader(archive), opts)
+			if err != nil {
+				t.Fatalf("%s, %+v: extractCacheArchive() error = %v, want an empty archive extracted", name, opts, err)
+			}
+			if !result.Empty || result.Entries != 0 {
+				t.Errorf("%s, %+v: result = %+v, want an empty result", name, opts, result)
+			}
+		}
+	}
+
+	result, err := extractCacheArchive(createTestArchive(t, testEntry{hdr: tar.Header{Name: "File.txt", Typeflag: tar.TypeReg}, body: "test"}), extractOptions{Root: t.TempDir()})
+	if err != nil || result.Empty {
+		t.Errorf("extractCacheArchive() = %+v, %v, want a non-empty archive extracted", result, err)
+	}
+}
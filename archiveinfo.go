@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// archiveInfo is the archive's metadata, stored in the archive_info.json entry by the cache push step.
+type archiveInfo struct {
+	StackID string `json:"stack_id,omitempty"`
+	// EntryCount is the number of entries in the archive, -1 if unknown.
+	EntryCount int64 `json:"entry_count,omitempty"`
+	// Paths are the original cache paths the archive was created from.
+	Paths []string `json:"paths,omitempty"`
+	// CreatedAt is the archive's creation time, as recorded by the push step.
+	CreatedAt string `json:"created_at,omitempty"`
+	// BuildSlug is the slug of the build which created the archive.
+	BuildSlug string `json:"build_slug,omitempty"`
+	// CacheKey is the key the cache was pushed with.
+	CacheKey string `json:"cache_key,omitempty"`
+	// FormatVersion is the version of the archive's format, -1 if unknown.
+	FormatVersion int64 `json:"format_version,omitempty"`
+	// RequiredFeatures are the pull step features the archive depends on, like encryption.
+	RequiredFeatures []string `json:"required_features,omitempty"`
+	// UncompressedSize is the total size of the archive's entries in bytes, 0 if unknown.
+	UncompressedSize int64 `json:"uncompressed_size,omitempty"`
+}
+
+// parseArchiveInfo reads the archive's metadata from the given json bytes.
+func parseArchiveInfo(b []byte) (archiveInfo, error) {
+	info := archiveInfo{EntryCount: -1, FormatVersion: -1}
+	if err := json.Unmarshal(b, &info); err != nil {
+		return archiveInfo{}, err
+	}
+	return info, nil
+}
+
+// createdAt returns the archive's creation time, false if it is not recorded or it is not an RFC 3339 timestamp.
+func (i *archiveInfo) createdAt() (time.Time, bool) {
+	created, err := time.Parse(time.RFC3339, strings.TrimSpace(i.CreatedAt))
+	return created, err == nil
+}
+
+// logCacheAge logs the age of the cache, and warns if it is older than maxAge (0 disables the warning).
+// A stale cache usually means that the cache push step does not run, or it pushes with a different cache key.
+// It reports whether the warning was emitted.
+func logCacheAge(info *archiveInfo, now time.Time, maxAge time.Duration) bool {
+	if info == nil {
+		return false
+	}
+	created, ok := info.createdAt()
+	if !ok {
+		log.Debugf("cache archive creation time is unknown: %q", info.CreatedAt)
+		return false
+	}
+	age := now.Sub(created).Round(time.Minute)
+	log.Printf("cache created at: %s (%s ago)", created.Format(time.RFC3339), age)
+	if maxAge <= 0 || age <= maxAge {
+		return false
+	}
+	log.Warnf("The cache is %s old, older than the %s threshold: it might be stale, check that the cache push step runs and uses the same cache key", age, maxAge)
+	return true
+}
+
+// parseStackID reads the stack id from the given json bytes.
+func parseStackID(b []byte) (string, error) {
+	info, err := parseArchiveInfo(b)
+	if err != nil {
+		return "", err
+	}
+	return info.StackID, nil
+}
+
+// formatVersionError is returned if the archive's format version is below the accepted minimum.
+type formatVersionError struct {
+	Version int64
+	Min     int64
+}
+
+// Error implements the error interface.
+func (e *formatVersionError) Error() string {
+	return fmt.Sprintf("cache archive format version %d is below the minimum %d, the cache needs to be pushed again by an up to date cache push step", e.Version, e.Min)
+}
+
+// checkFormatVersion checks the archive's format version against the minimum (0 accepts any version).
+// An archive without metadata or without a format version is treated as version 1.
+func checkFormatVersion(info *archiveInfo, min int64) error {
+	version := int64(1)
+	if info != nil && info.FormatVersion > 0 {
+		version = info.FormatVersion
+	}
+	if version < min {
+		return &formatVersionError{Version: version, Min: min}
+	}
+	return nil
+}
+
+// checkArchiveInfoPresent returns an error if the archive has no metadata entry as its first entry, for the pulls requiring it.
+func checkArchiveInfoPresent(info *archiveInfo) error {
+	if info == nil {
+		return fmt.Errorf("the archive's first entry is not %s, the archive might be created by an outdated cache push step", archiveInfoFileName)
+	}
+	return nil
+}
+
+// maxArchiveInfoSize is the largest accepted metadata entry, the entry is buffered in memory to be able to restore the archive.
+const maxArchiveInfoSize = 1024 * 1024
+
+// readArchiveInfo reads the archive's metadata from the archive's first entry and restores the reader,
+// so the whole archive can be read again.
+// It returns nil if the first entry is not the metadata entry.
+func readArchiveInfo(r *RestoreReader) (*archiveInfo, error) {
+	// the reader is restored once the metadata entry's body is read, not to replay the buffered bytes as the body
+	defer r.Restore()
+
+	archive, zstd, err := decompressStream(bufio.NewReader(r))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get first archive entry: %s", err)
+	}
+	if zstd != nil {
+		// only the prefix holding the first entry is decompressed, the decompression is stopped before the reader is restored
+		defer func() { _ = zstd.Close() }()
+	}
+
+	tr, hdr, err := readFirstEntry(archive)
+	if r.limitErr != nil {
+		// the stream is not read further, the archive is not buffered in memory
+		return nil, r.limitErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get first archive entry: %s", err)
+	}
+	// the entry is identified by its header, the body of any other first entry is not read (and buffered)
+	if hdr == nil || !isArchiveInfoName(hdr.Name) {
+		return nil, nil
+	}
+	if hdr.Size > maxArchiveInfoSize {
+		return nil, fmt.Errorf("first archive entry is too large for archive info: %d bytes", hdr.Size)
+	}
+
+	b, err := ioutil.ReadAll(tr)
+	if r.limitErr != nil {
+		return nil, r.limitErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read first archive entry: %s", err)
+	}
+
+	info, err := parseArchiveInfo(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse first archive entry: %s", err)
+	}
+	return &info, nil
+}
+
+// readArchiveInfoFile reads the archive info file at the given path, it returns nil if the file does not exist.
+func readArchiveInfoFile(pth string) (*archiveInfo, error) {
+	b, err := ioutil.ReadFile(pth)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := parseArchiveInfo(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse archive info: %s", err)
+	}
+	return &info, nil
+}
+
+// comparePaths compares the cache paths recorded in the archive with the expected cache paths.
+// It returns the expected paths missing from the archive and the archive's paths which are not expected.
+func comparePaths(archivePaths, expectedPaths []string) (missing, unexpected []string) {
+	archived := map[string]bool{}
+	for _, pth := range archivePaths {
+		archived[filepath.Clean(pth)] = true
+	}
+	expected := map[string]bool{}
+	for _, pth := range expectedPaths {
+		expected[filepath.Clean(pth)] = true
+	}
+
+	for _, pth := range expectedPaths {
+		if !archived[filepath.Clean(pth)] {
+			missing = append(missing, pth)
+		}
+	}
+	for _, pth := range archivePaths {
+		if !expected[filepath.Clean(pth)] {
+			unexpected = append(unexpected, pth)
+		}
+	}
+	return missing, unexpected
+}
+
+// splitList splits a newline separated input list, trimming the items and dropping the empty ones.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, "\n") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// stampedExtractDir returns the directory under root to extract the archive into,
+// named after the archive's metadata field selected by stamp (created_at or build_slug).
+// An empty stamp selects the root itself.
+func stampedExtractDir(root, stamp string, info *archiveInfo) (string, error) {
+	if stamp == "" {
+		return root, nil
+	}
+	if info == nil {
+		return "", fmt.Errorf("cache archive does not contain archive info, %s is unknown", stamp)
+	}
+
+	var name string
+	switch stamp {
+	case "created_at":
+		name = info.CreatedAt
+	case "build_slug":
+		name = info.BuildSlug
+	default:
+		return "", fmt.Errorf("unknown extract directory stamp: %s", stamp)
+	}
+
+	// created_at is usually a timestamp like 2020-01-02T03:04:05Z, which also needs to be a valid directory name
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' {
+			return '-'
+		}
+		return r
+	}, strings.TrimSpace(name))
+	if name == "" || name == "." || name == ".." {
+		return "", fmt.Errorf("cache archive info does not contain %s", stamp)
+	}
+	return filepath.Join(root, name), nil
+}
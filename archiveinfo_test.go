@@ -0,0 +1,364 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseArchiveInfo_Paths(t *testing.T) {
+	info, err := parseArchiveInfo([]byte(`{"stack_id": "osx-xcode-12.0.x", "paths": ["/Users/vagrant/.gradle", "/Users/vagrant/git/node_modules"]}`))
+	if err != nil {
+		t.Fatalf("parseArchiveInfo() error = %v", err)
+	}
+	want := []string{"/Users/vagrant/.gradle", "/Users/vagrant/git/node_modules"}
+	if !reflect.DeepEqual(info.Paths, want) {
+		t.Errorf("parseArchiveInfo().Paths = %v, want %v", info.Paths, want)
+	}
+
+	info, err = parseArchiveInfo([]byte(`{"stack_id": "osx-xcode-12.0.x"}`))
+	if err != nil {
+		t.Fatalf("parseArchiveInfo() error = %v", err)
+	}
+	if info.Paths != nil {
+		t.Errorf("parseArchiveInfo().Paths = %v, want nil", info.Paths)
+	}
+}
+
+func TestParseArchiveInfo_UncompressedSize(t *testing.T) {
+	info, err := parseArchiveInfo([]byte(`{"stack_id": "osx-xcode-12.0.x", "uncompressed_size": 5368709120}`))
+	if err != nil {
+		t.Fatalf("parseArchiveInfo() error = %v", err)
+	}
+	if info.UncompressedSize != 5368709120 {
+		t.Errorf("parseArchiveInfo().UncompressedSize = %d, want 5368709120", info.UncompressedSize)
+	}
+}
+
+func TestParseArchiveInfo_Metadata(t *testing.T) {
+	info, err := parseArchiveInfo([]byte(`{"stack_id": "osx-xcode-12.0.x", "created_at": "2021-01-02T03:04:05Z", "cache_key": "gradle", "compression": "zstd", "tool_versions": {"tar": "1.34"}}`))
+	if err != nil {
+		t.Fatalf("parseArchiveInfo() error = %v, want the unknown fields ignored", err)
+	}
+	if info.StackID != "osx-xcode-12.0.x" || info.CacheKey != "gradle" {
+		t.Errorf("parseArchiveInfo() = %+v, want the stack id and the cache key", info)
+	}
+	created, ok := info.createdAt()
+	if !ok || !created.Equal(time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("createdAt() = %s, %t, want 2021-01-02T03:04:05Z", created, ok)
+	}
+	if stackID, err := parseStackID([]byte(`{"stack_id": "osx-xcode-12.0.x", "cache_key": "gradle"}`)); err != nil || stackID != "osx-xcode-12.0.x" {
+		t.Errorf("parseStackID() = %s, %v, want osx-xcode-12.0.x", stackID, err)
+	}
+}
+
+func TestLogCacheAge(t *testing.T) {
+	now := time.Date(2021, 1, 3, 3, 4, 5, 0, time.UTC)
+	info := &archiveInfo{CreatedAt: "2021-01-02T03:04:05Z"}
+	if !logCacheAge(info, now, 12*time.Hour) {
+		t.Errorf("logCacheAge() = false, want a warning about the 24h old cache")
+	}
+	if logCacheAge(info, now, 48*time.Hour) || logCacheAge(info, now, 0) {
+		t.Errorf("logCacheAge() = true, want no warning under the threshold or without one")
+	}
+	if logCacheAge(&archiveInfo{CreatedAt: "yesterday"}, now, time.Hour) || logCacheAge(nil, now, time.Hour) {
+		t.Errorf("logCacheAge() = true, want no warning of an unknown age")
+	}
+}
+
+func TestComparePaths(t *testing.T) {
+	tests := []struct {
+		name           string
+		archivePaths   []string
+		expectedPaths  []string
+		wantMissing    []string
+		wantUnexpected []string
+	}{
+		{
+			name:          "same paths",
+			archivePaths:  []string{"/Users/vagrant/.gradle", "/Users/vagrant/git/node_modules/"},
+			expectedPaths: []string{"/Users/vagrant/git/node_modules", "/Users/vagrant/.gradle"},
+		},
+		{
+			name:           "different home",
+			archivePaths:   []string{"/Users/vagrant/.gradle"},
+			expectedPaths:  []string{"/Users/runner/.gradle"},
+			wantMissing:    []string{"/Users/runner/.gradle"},
+			wantUnexpected: []string{"/Users/vagrant/.gradle"},
+		},
+		{
+			name:          "missing path",
+			archivePaths:  []string{"/Users/vagrant/.gradle"},
+			expectedPaths: []string{"/Users/vagrant/.gradle", "/Users/vagrant/.m2"},
+			wantMissing:   []string{"/Users/vagrant/.m2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			missing, unexpected := comparePaths(tt.archivePaths, tt.expectedPaths)
+			if !reflect.DeepEqual(missing, tt.wantMissing) {
+				t.Errorf("comparePaths() missing = %v, want %v", missing, tt.wantMissing)
+			}
+			if !reflect.DeepEqual(unexpected, tt.wantUnexpected) {
+				t.Errorf("comparePaths() unexpected = %v, want %v", unexpected, tt.wantUnexpected)
+			}
+		})
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	got := splitList("  /Users/vagrant/.gradle\n\n/Users/vagrant/.m2  \n")
+	want := []string{"/Users/vagrant/.gradle", "/Users/vagrant/.m2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("splitList() = %v, want %v", got, want)
+	}
+}
+
+func TestStampedExtractDir(t *testing.T) {
+	info, err := parseArchiveInfo([]byte(`{"stack_id": "osx-xcode-12.0.x", "created_at": "2020-01-02T03:04:05Z", "build_slug": "a1b2c3d4"}`))
+	if err != nil {
+		t.Fatalf("parseArchiveInfo() error = %v", err)
+	}
+
+	tests := []struct {
+		stamp   string
+		info    *archiveInfo
+		want    string
+		wantErr bool
+	}{
+		{stamp: "", info: &info, want: "/tmp/caches"},
+		{stamp: "created_at", info: &info, want: "/tmp/caches/2020-01-02T03-04-05Z"},
+		{stamp: "build_slug", info: &info, want: "/tmp/caches/a1b2c3d4"},
+		{stamp: "build_slug", info: &archiveInfo{BuildSlug: "../a/b"}, want: "/tmp/caches/..-a-b"},
+		{stamp: "build_slug", info: &archiveInfo{StackID: "osx-xcode-12.0.x"}, wantErr: true},
+		{stamp: "build_slug", info: &archiveInfo{BuildSlug: ".."}, wantErr: true},
+		{stamp: "created_at", info: nil, wantErr: true},
+		{stamp: "commit", info: &info, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := stampedExtractDir("/tmp/caches", tt.stamp, tt.info)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("stampedExtractDir(%s) error = %v, wantErr %v", tt.stamp, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("stampedExtractDir(%s) = %s, want %s", tt.stamp, got, tt.want)
+		}
+	}
+}
+
+func TestReadArchiveInfo(t *testing.T) {
+	for _, compressed := range []bool{false, true} {
+		archive := createTestArchive(t,
+			testEntry{hdr: tar.Header{Name: "/tmp/" + archiveInfoFileName, Typeflag: tar.TypeReg}, body: `{"stack_id": "osx-xcode-12.0.x"}`},
+			testEntry{hdr: tar.Header{Name: "File.txt", Typeflag: tar.TypeReg}, body: strings.Repeat("test", 4096)},
+		).Bytes()
+		if compressed {
+			var buff bytes.Buffer
+			zw := gzip.NewWriter(&buff)
+			if _, err := zw.Write(archive); err != nil {
+				t.Fatalf("failed to compress archive: %s", err)
+			}
+			if err := zw.Close(); err != nil {
+				t.Fatalf("failed to compress archive: %s", err)
+			}
+			archive = buff.Bytes()
+		}
+
+		r := NewRestoreReader(bytes.NewReader(archive))
+		info, err := readArchiveInfo(r)
+		if err != nil {
+			t.Fatalf("compressed = %v: readArchiveInfo() error = %v", compressed, err)
+		}
+		if info == nil || info.StackID != "osx-xcode-12.0.x" {
+			t.Fatalf("compressed = %v: readArchiveInfo() = %+v, want stack id osx-xcode-12.0.x", compressed, info)
+		}
+
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("compressed = %v: failed to read the restored archive: %s", compressed, err)
+		}
+		if !bytes.Equal(b, archive) {
+			t.Errorf("compressed = %v: restored archive differs from the original", compressed)
+		}
+	}
+}
+
+// zeroReader reads zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// hugeEntryArchive returns a stream of an archive with a single entry of the given name and size, without holding the entry in memory.
+func hugeEntryArchive(t *testing.T, name string, size int64) io.Reader {
+	var hdr bytes.Buffer
+	tw := tar.NewWriter(&hdr)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: size}); err != nil {
+		t.Fatalf("failed to write header: %s", err)
+	}
+	return io.MultiReader(&hdr, io.LimitReader(zeroReader{}, size))
+}
+
+func TestReadArchiveInfo_BufferLimit(t *testing.T) {
+	const limit = 64 * 1024
+
+	t.Log("tiny archive info - fits in the limit")
+	{
+		archive := createTestArchive(t,
+			testEntry{hdr: tar.Header{Name: archiveInfoFileName, Typeflag: tar.TypeReg}, body: `{"stack_id": "osx-xcode-12.0.x"}`},
+			testEntry{hdr: tar.Header{Name: "File.txt", Typeflag: tar.TypeReg}, body: strings.Repeat("test", 64*1024)},
+		).Bytes()
+		r := NewRestoreReader(bytes.NewReader(archive))
+		r.SetBufferLimit(limit)
+		info, err := readArchiveInfo(r)
+		if err != nil || info == nil || info.StackID != "osx-xcode-12.0.x" {
+			t.Fatalf("readArchiveInfo() = %+v, %v, want stack id osx-xcode-12.0.x", info, err)
+		}
+		if r.Buffered() == 0 || r.Buffered() > limit {
+			t.Errorf("Buffered() = %d, want the head of the stream, at most %d bytes", r.Buffered(), limit)
+		}
+		if restored, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(restored, archive) {
+			t.Errorf("restored %d bytes (%v), want the whole %d bytes archive", len(restored), err, len(archive))
+		}
+	}
+
+	t.Log("oversized archive info - limit exceeded")
+	{
+		archive := createTestArchive(t,
+			testEntry{hdr: tar.Header{Name: archiveInfoFileName, Typeflag: tar.TypeReg}, body: `{"stack_id": "` + strings.Repeat("x", 2*limit) + `"}`},
+		).Bytes()
+		r := NewRestoreReader(bytes.NewReader(archive))
+		r.SetBufferLimit(limit)
+		_, err := readArchiveInfo(r)
+		if _, ok := err.(*bufferLimitError); !ok {
+			t.Fatalf("readArchiveInfo() error = %v, want a bufferLimitError", err)
+		}
+		if r.Buffered() != limit {
+			t.Errorf("Buffered() = %d, want %d", r.Buffered(), limit)
+		}
+		// the buffered head is still restored, the stream is not lost
+		if restored, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(restored, archive) {
+			t.Errorf("restored %d bytes (%v), want the whole %d bytes archive", len(restored), err, len(archive))
+		}
+	}
+}
+
+func TestReadArchiveInfo_HugeFirstEntry(t *testing.T) {
+	const size = 1024 * 1024 * 1024
+
+	t.Log("huge non-metadata first entry - body not buffered")
+	{
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+
+		r := NewRestoreReader(hugeEntryArchive(t, "Huge.bin", size))
+		info, err := readArchiveInfo(r)
+		if err != nil {
+			t.Fatalf("readArchiveInfo() error = %v", err)
+		}
+		if info != nil {
+			t.Errorf("readArchiveInfo() = %+v, want nil", info)
+		}
+
+		runtime.ReadMemStats(&after)
+		if buffered := r.buff.Len(); buffered > 1024 {
+			t.Errorf("%d bytes buffered, want only the first header", buffered)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1024*1024 {
+			t.Errorf("%d bytes allocated while reading the archive info", allocated)
+		}
+
+		// the restored stream still starts with the entry's header
+		tr := tar.NewReader(r)
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("failed to read the restored archive: %s", err)
+		}
+		if hdr.Name != "Huge.bin" || hdr.Size != size {
+			t.Errorf("restored first entry = %s (%d bytes), want Huge.bin (%d bytes)", hdr.Name, hdr.Size, size)
+		}
+	}
+
+	t.Log("huge metadata first entry - rejected")
+	{
+		r := NewRestoreReader(hugeEntryArchive(t, "/tmp/"+archiveInfoFileName, size))
+		if _, err := readArchiveInfo(r); err == nil {
+			t.Errorf("readArchiveInfo() error = nil, want too large error")
+		}
+		if buffered := r.buff.Len(); buffered > 1024 {
+			t.Errorf("%d bytes buffered, want only the first header", buffered)
+		}
+	}
+}
+
+func TestCheckFormatVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		info    *archiveInfo
+		min     int64
+		wantErr bool
+	}{
+		{name: "below minimum", info: &archiveInfo{FormatVersion: 2}, min: 3, wantErr: true},
+		{name: "at minimum", info: &archiveInfo{FormatVersion: 3}, min: 3},
+		{name: "above minimum", info: &archiveInfo{FormatVersion: 4}, min: 3},
+		{name: "missing version", info: &archiveInfo{FormatVersion: -1}, min: 2, wantErr: true},
+		{name: "missing version at v1 minimum", info: &archiveInfo{FormatVersion: -1}, min: 1},
+		{name: "no archive info", info: nil, min: 2, wantErr: true},
+		{name: "no minimum", info: nil, min: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkFormatVersion(tt.info, tt.min)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkFormatVersion() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if versionErr, ok := err.(*formatVersionError); !ok || versionErr.Min != tt.min {
+					t.Errorf("checkFormatVersion() error = %#v, want a formatVersionError", err)
+				}
+			}
+		})
+	}
+
+	info, err := parseArchiveInfo([]byte(`{"stack_id": "osx-xcode-12.0.x"}`))
+	if err != nil {
+		t.Fatalf("parseArchiveInfo() error = %v", err)
+	}
+	if err := checkFormatVersion(&info, 2); err == nil || err.(*formatVersionError).Version != 1 {
+		t.Errorf("checkFormatVersion() error = %v, want version 1 below the minimum", err)
+	}
+}
+
+func TestCheckArchiveInfoPresent(t *testing.T) {
+	tests := []struct {
+		name    string
+		first   testEntry
+		wantErr bool
+	}{
+		{name: "present", first: testEntry{hdr: tar.Header{Name: archiveInfoFileName, Typeflag: tar.TypeReg}, body: `{"stack_id": "osx-xcode-12.0.x"}`}},
+		{name: "absent", first: testEntry{hdr: tar.Header{Name: "File.txt", Typeflag: tar.TypeReg}, body: "test"}, wantErr: true},
+		{name: "malformed", first: testEntry{hdr: tar.Header{Name: archiveInfoFileName, Typeflag: tar.TypeReg}, body: `{"stack_id": `}, wantErr: true},
+	}
+	for _, tt := range tests {
+		archive := createTestArchive(t, tt.first, testEntry{hdr: tar.Header{Name: "Other.txt", Typeflag: tar.TypeReg}, body: "other"})
+		info, err := readArchiveInfo(NewRestoreReader(archive))
+		if err == nil {
+			err = checkArchiveInfoPresent(info)
+		}
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: archive info error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
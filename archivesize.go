@@ -0,0 +1,56 @@
+package main
+
+import "fmt"
+
+// maxArchiveSize is the most bytes of the (compressed) archive read by the pull, 0 is unlimited.
+var maxArchiveSize int64
+
+// archiveSizeError is returned if the archive is larger than maxArchiveSize.
+type archiveSizeError struct {
+	Limit int64
+}
+
+// Error implements the error interface.
+func (e *archiveSizeError) Error() string {
+	return fmt.Sprintf("the cache archive is larger than max_archive_size (%d bytes)", e.Limit)
+}
+
+// checkArchiveSize returns an archiveSizeError if the archive's known size (-1 if unknown) exceeds maxArchiveSize,
+// before reading the archive.
+func checkArchiveSize(size int64) error {
+	if maxArchiveSize > 0 && size > maxArchiveSize {
+		return &archiveSizeError{Limit: maxArchiveSize}
+	}
+	return nil
+}
+
+// sizeLimit counts the archive bytes written to it, and fails the write going beyond maxArchiveSize.
+// It is written next to the archive's reads (io.TeeReader) or writes (io.MultiWriter), which stop at its error.
+type sizeLimit struct {
+	limit int64
+	n     int64
+	err   error
+}
+
+// newSizeLimit creates a sizeLimit of maxArchiveSize.
+func newSizeLimit() *sizeLimit {
+	return &sizeLimit{limit: maxArchiveSize}
+}
+
+// Write implements the io.Writer interface.
+func (l *sizeLimit) Write(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	l.n += int64(len(p))
+	if l.limit > 0 && l.n > l.limit {
+		l.err = &archiveSizeError{Limit: l.limit}
+		return 0, l.err
+	}
+	return len(p), nil
+}
+
+// reset restarts counting, for an archive downloaded again from its start.
+func (l *sizeLimit) reset() {
+	l.n, l.err = 0, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMaxArchiveSize(t *testing.T) {
+	defer func(size int64) { maxArchiveSize = size }(maxArchiveSize)
+	defer func(pth string) { cacheArchivePath = pth }(cacheArchivePath)
+
+	archive := createTestArchive(t, testEntry{hdr: tar.Header{Name: "file.txt", Typeflag: tar.TypeReg}, body: strings.Repeat("content", 1024)}).Bytes()
+	chunked := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// without the Content-Length, the size is not known before the download
+		if !chunked {
+			w.Header().Set("Content-Length", strconv.Itoa(len(archive)))
+		}
+		_, _ = w.Write(archive)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		limit   int64
+		wantErr bool
+	}{
+		{"unlimited", 0, false},
+		{"small archive", int64(len(archive)), false},
+		{"oversized archive", int64(len(archive)) - 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			maxArchiveSize = tt.limit
+			for _, unknownSize := range []bool{false, true} {
+				chunked = unknownSize
+
+				_, err := extractCacheArchive(bytes.NewReader(archive), extractOptions{Root: t.TempDir()})
+				if _, ok := err.(*archiveSizeError); ok != tt.wantErr {
+					t.Errorf("extractCacheArchive() error = %v, wantErr %v", err, tt.wantErr)
+				}
+
+				cacheArchivePath = filepath.Join(t.TempDir(), "cache-archive.tar")
+				_, err = downloadCacheArchive(http.DefaultClient, server.URL, false, expectedChecksum{})
+				if _, ok := err.(*archiveSizeError); ok != tt.wantErr {
+					t.Errorf("downloadCacheArchive() error = %v, wantErr %v (unknown size: %v)", err, tt.wantErr, unknownSize)
+				}
+			}
+		})
+	}
+
+	maxArchiveSize = int64(len(archive)) - 1
+	chunked = false
+	// the reported size is checked before the download
+	if _, _, err := requestArchive(http.DefaultClient, server.URL, false); err == nil || !strings.Contains(err.Error(), "max_archive_size") {
+		t.Errorf("requestArchive() error = %v, want the archive size error", err)
+	}
+	// the size error is not worth a fallback
+	if isFallbackError(&archiveSizeError{Limit: maxArchiveSize}) {
+		t.Errorf("isFallbackError() = true, want false for the archive size error")
+	}
+}
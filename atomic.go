@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// renameDir renames the directory, replaced by the tests simulating a cross-device rename.
+var renameDir = os.Rename
+
+// atomicRestore extracts the archive into a staging directory next to the extraction root,
+// which replaces the root only once the whole archive is extracted: a failed extraction leaves the root as it was.
+type atomicRestore struct {
+	root    string
+	staging string
+}
+
+// stagingPrefix is the name prefix of the root's staging directories, they are hidden siblings of the root.
+func stagingPrefix(root string) string {
+	return "." + filepath.Base(root) + ".restore-"
+}
+
+// newAtomicRestore creates the staging directory of the root, on the root's filesystem so the swap is a rename.
+// The staging directories left behind by the failed restores of the root are removed.
+func newAtomicRestore(root string) (*atomicRestore, error) {
+	root = filepath.Clean(root)
+	parent := filepath.Dir(root)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, err
+	}
+	stale, err := filepath.Glob(filepath.Join(parent, stagingPrefix(root)+"*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, pth := range stale {
+		log.Debugf("removing the staging directory of a failed restore: %s", pth)
+		if err := os.RemoveAll(pth); err != nil {
+			log.Warnf("Failed to remove the staging directory of a failed restore: %s", err)
+		}
+	}
+
+	staging, err := ioutil.TempDir(parent, stagingPrefix(root))
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(staging, 0755); err != nil {
+		_ = os.RemoveAll(staging)
+		return nil, err
+	}
+	return &atomicRestore{root: root, staging: staging}, nil
+}
+
+// commit swaps the staging directory into the root's place, and removes the previous root.
+// If the root can not be renamed (it is a mount point, or on another device), the staging directory's tree is copied
+// into the emptied root instead: that swap is not atomic.
+func (a *atomicRestore) commit() error {
+	previous := a.staging + ".previous"
+	moved := true
+	if err := renameDir(a.root, previous); os.IsNotExist(err) {
+		moved = false
+	} else if isRenameUnsupported(err) {
+		return a.copyIntoRoot()
+	} else if err != nil {
+		return fmt.Errorf("failed to move the previous %s aside: %s", a.root, err)
+	}
+
+	if err := renameDir(a.staging, a.root); err != nil {
+		if moved {
+			if rerr := renameDir(previous, a.root); rerr != nil {
+				return fmt.Errorf("failed to swap the restored %s: %s, and to move back the previous one (%s): %s", a.root, err, previous, rerr)
+			}
+		}
+		if isRenameUnsupported(err) {
+			return a.copyIntoRoot()
+		}
+		return fmt.Errorf("failed to swap the restored %s: %s", a.root, err)
+	}
+	if moved {
+		if err := os.RemoveAll(previous); err != nil {
+			log.Warnf("Failed to remove the previous %s: %s", a.root, err)
+		}
+	}
+	return nil
+}
+
+// copyIntoRoot replaces the root's content with the staging directory's tree by copying it.
+func (a *atomicRestore) copyIntoRoot() error {
+	log.Warnf("%s can not be swapped by a rename, copying the restored tree into it", a.root)
+	if err := os.MkdirAll(a.root, 0755); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(a.root)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(a.root, entry.Name())); err != nil {
+			return err
+		}
+	}
+	if _, err := copyTree(a.staging, a.root); err != nil {
+		return fmt.Errorf("failed to copy the restored tree into %s: %s", a.root, err)
+	}
+	// copyTree skips the archive info at the root, it is kept if extract_metadata restored it
+	infoPth := filepath.Join(a.staging, archiveInfoFileName)
+	if info, err := os.Lstat(infoPth); err == nil && info.Mode().IsRegular() {
+		if _, err := copyFile(infoPth, filepath.Join(a.root, archiveInfoFileName), info.Mode().Perm()); err != nil {
+			return fmt.Errorf("failed to copy the restored archive info into %s: %s", a.root, err)
+		}
+	}
+	a.abort()
+	return nil
+}
+
+// abort removes the staging directory, the root is left as it was.
+func (a *atomicRestore) abort() {
+	if err := os.RemoveAll(a.staging); err != nil {
+		log.Warnf("Failed to remove the staging directory: %s", err)
+	}
+}
+
+// isRenameUnsupported reports whether the rename failed because the directory can not be renamed to its target:
+// it is on another device, or it is a mount point.
+func isRenameUnsupported(err error) bool {
+	if linkErr, ok := err.(*os.LinkError); ok {
+		return linkErr.Err == syscall.EXDEV || linkErr.Err == syscall.EBUSY
+	}
+	return false
+}
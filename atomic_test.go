@@ -0,0 +1,114 @@
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// newTestRoot creates an extraction root holding the previous restore's file.
+func newTestRoot(t *testing.T) string {
+	root := filepath.Join(t.TempDir(), "cache")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "old.txt"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+// restoreArchive extracts the archive of new.txt with the atomic restore of root, and commits it.
+func restoreArchive(t *testing.T, root string) {
+	restore, err := newAtomicRestore(root)
+	if err != nil {
+		t.Fatalf("newAtomicRestore() error = %v", err)
+	}
+	archive := createTestArchive(t, testEntry{hdr: tar.Header{Name: "dir/new.txt", Typeflag: tar.TypeReg, Mode: 0644}, body: "new"})
+	if _, err := extractCacheArchive(archive, extractOptions{Root: restore.staging}); err != nil {
+		t.Fatalf("extractCacheArchive() error = %v", err)
+	}
+	if err := restore.commit(); err != nil {
+		t.Fatalf("commit() error = %v", err)
+	}
+}
+
+// checkRestored checks the root holds the restored tree only, and the staging directories are removed.
+func checkRestored(t *testing.T, root string) {
+	if content, err := ioutil.ReadFile(filepath.Join(root, "dir/new.txt")); err != nil || string(content) != "new" {
+		t.Errorf("dir/new.txt = %q, %v, want the restored file", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "old.txt")); !os.IsNotExist(err) {
+		t.Errorf("old.txt is kept (%v), want the previous content replaced", err)
+	}
+	if left, err := filepath.Glob(filepath.Join(filepath.Dir(root), ".cache.restore-*")); err != nil || len(left) > 0 {
+		t.Errorf("staging directories = %v, %v, want them removed", left, err)
+	}
+}
+
+func TestAtomicRestore(t *testing.T) {
+	t.Log("swapped into place")
+	{
+		root := newTestRoot(t)
+		restoreArchive(t, root)
+		checkRestored(t, root)
+	}
+
+	t.Log("missing root")
+	{
+		root := filepath.Join(t.TempDir(), "cache")
+		restoreArchive(t, root)
+		checkRestored(t, root)
+	}
+
+	t.Log("failed extraction")
+	{
+		root := newTestRoot(t)
+		restore, err := newAtomicRestore(root)
+		if err != nil {
+			t.Fatalf("newAtomicRestore() error = %v", err)
+		}
+		archive := createTestArchive(t,
+			testEntry{hdr: tar.Header{Name: "new.txt", Typeflag: tar.TypeReg, Mode: 0644}, body: "new"},
+			testEntry{hdr: tar.Header{Name: "../escape.txt", Typeflag: tar.TypeReg, Mode: 0644}, body: "escape"},
+		)
+		if _, err := extractCacheArchive(archive, extractOptions{Root: restore.staging, ConfineRoot: true}); err == nil {
+			t.Fatalf("extractCacheArchive() error = nil, want the escaping entry refused")
+		}
+		restore.abort()
+		if content, err := ioutil.ReadFile(filepath.Join(root, "old.txt")); err != nil || string(content) != "old" {
+			t.Errorf("old.txt = %q, %v, want the previous content intact", content, err)
+		}
+		if _, err := os.Stat(filepath.Join(root, "new.txt")); !os.IsNotExist(err) {
+			t.Errorf("new.txt is restored (%v), want the failed extraction discarded", err)
+		}
+		if _, err := os.Stat(restore.staging); !os.IsNotExist(err) {
+			t.Errorf("staging directory is kept (%v), want it removed", err)
+		}
+	}
+
+	t.Log("staging directory of a failed restore")
+	{
+		root := newTestRoot(t)
+		stale := filepath.Join(filepath.Dir(root), stagingPrefix(root)+"123")
+		if err := os.Mkdir(stale, 0755); err != nil {
+			t.Fatal(err)
+		}
+		restoreArchive(t, root)
+		checkRestored(t, root)
+	}
+}
+
+func TestAtomicRestore_CrossDevice(t *testing.T) {
+	defer func(rename func(string, string) error) { renameDir = rename }(renameDir)
+	renameDir = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+
+	root := newTestRoot(t)
+	restoreArchive(t, root)
+	checkRestored(t, root)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// apiHeaders are the headers sent with the Cache API requests, like the Authorization header of a self-hosted cache backend.
+var apiHeaders http.Header
+
+// downloadHeaders are the headers sent with the archive download requests, nil unless download_auth is enabled:
+// the download URL is usually presigned, it does not need the Cache API's credentials.
+var downloadHeaders http.Header
+
+// parseHeaders parses the bearer token and the newline separated `<name>: <value>` header list into the headers to send.
+// A header of the list overrides the token's Authorization header.
+func parseHeaders(token, list string) (http.Header, error) {
+	headers := http.Header{}
+	if token = strings.TrimSpace(token); token != "" {
+		headers.Set("Authorization", "Bearer "+token)
+	}
+	for _, item := range splitList(list) {
+		split := strings.SplitN(item, ":", 2)
+		if len(split) != 2 || strings.TrimSpace(split[0]) == "" || strings.ContainsAny(strings.TrimSpace(split[0]), " \t") {
+			// the item is not printed, it might be a credential
+			return nil, fmt.Errorf("invalid header, expected <name>: <value>")
+		}
+		headers.Set(strings.TrimSpace(split[0]), strings.TrimSpace(split[1]))
+	}
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	return headers, nil
+}
+
+// setHeaders sets the headers on the request.
+func setHeaders(req *http.Request, headers http.Header) {
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+}
+
+// headerNames returns the sorted names of the headers, for the logs: the values are credentials, they are never logged.
+func headerNames(headers http.Header) string {
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
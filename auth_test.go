@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseHeaders(t *testing.T) {
+	headers, err := parseHeaders(" token ", "X-Api-Key: key\n\n x-tenant : ios ")
+	if err != nil {
+		t.Fatalf("parseHeaders() error = %v", err)
+	}
+	if got := headers.Get("Authorization"); got != "Bearer token" {
+		t.Errorf("Authorization = %q, want the bearer token", got)
+	}
+	if headers.Get("X-Api-Key") != "key" || headers.Get("X-Tenant") != "ios" {
+		t.Errorf("parseHeaders() = %v, want the listed headers", headers)
+	}
+	if got := headerNames(headers); got != "Authorization, X-Api-Key, X-Tenant" {
+		t.Errorf("headerNames() = %q, want the sorted names", got)
+	}
+
+	headers, err = parseHeaders("token", "Authorization: Basic dXNlcjpwYXNz")
+	if err != nil || headers.Get("Authorization") != "Basic dXNlcjpwYXNz" {
+		t.Errorf("parseHeaders() = %v, %v, want the listed Authorization header to override the token", headers, err)
+	}
+
+	if headers, err := parseHeaders("", " \n"); err != nil || headers != nil {
+		t.Errorf("parseHeaders() = %v, %v, want no headers", headers, err)
+	}
+	_, err = parseHeaders("", "Authorization Bearer secret-token")
+	if err == nil {
+		t.Fatalf("parseHeaders() error = nil, want an invalid header error")
+	}
+	if strings.Contains(err.Error(), "secret-token") {
+		t.Errorf("parseHeaders() error = %s, want the header value redacted", err)
+	}
+}
+
+func TestRequestHeaders(t *testing.T) {
+	defer func(api, download http.Header) { apiHeaders, downloadHeaders = api, download }(apiHeaders, downloadHeaders)
+
+	var apiAuth, downloadAuth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api" {
+			apiAuth = r.Header.Get("Authorization")
+			_, _ = w.Write([]byte(`{"download_url":"/archive.tar"}`))
+			return
+		}
+		downloadAuth = r.Header.Get("Authorization")
+		_, _ = w.Write([]byte("archive"))
+	}))
+	defer server.Close()
+
+	var err error
+	if apiHeaders, err = parseHeaders("token", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, authenticated := range []bool{false, true} {
+		downloadHeaders = nil
+		if authenticated {
+			downloadHeaders = apiHeaders
+		}
+		if _, err := getCacheDownloadURL(server.URL+"/api", "download_url"); err != nil {
+			t.Fatalf("getCacheDownloadURL() error = %v", err)
+		}
+		body, _, err := performRequest(http.DefaultClient, server.URL+"/archive.tar")
+		if err != nil {
+			t.Fatalf("performRequest() error = %v", err)
+		}
+		_ = body.Close()
+
+		if apiAuth != "Bearer token" {
+			t.Errorf("Cache API request Authorization = %q, want the bearer token", apiAuth)
+		}
+		if want := map[bool]string{true: "Bearer token"}[authenticated]; downloadAuth != want {
+			t.Errorf("download_auth %t: download request Authorization = %q, want %q", authenticated, downloadAuth, want)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The gs:// and s3:// URLs are cloud storage objects (gs://bucket/key, s3://bucket/key), downloaded by the download client
+// like the HTTP URLs: the transport sends the requests to the storage's HTTPS endpoint, authenticated with the credentials
+// of the storage's standard environment variables, so the retries, the resumed downloads and the chunks work the same way.
+const (
+	schemeGCS = "gs"
+	schemeS3  = "s3"
+)
+
+// isBucketURL reports whether the URL is a gs:// or s3:// object URL.
+func isBucketURL(rawURL string) bool {
+	return strings.HasPrefix(rawURL, schemeGCS+"://") || strings.HasPrefix(rawURL, schemeS3+"://")
+}
+
+// registerBucketProtocols makes the transport download the gs:// and s3:// objects.
+func registerBucketProtocols(transport *http.Transport) {
+	transport.RegisterProtocol(schemeGCS, &gcsTransport{base: transport})
+	transport.RegisterProtocol(schemeS3, &s3Transport{base: transport})
+}
+
+// bucketObject returns the bucket and the object key of a gs:// or s3:// URL.
+func bucketObject(u *url.URL) (string, string, error) {
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	if bucket == "" || key == "" {
+		return "", "", fmt.Errorf("invalid %s URL (%s), want %s://bucket/key", u.Scheme, u.Redacted(), u.Scheme)
+	}
+	return bucket, key, nil
+}
+
+// objectRequest returns the request sent to the object's HTTPS URL instead.
+func objectRequest(req *http.Request, u *url.URL) *http.Request {
+	out := req.Clone(req.Context())
+	out.URL = u
+	out.Host = ""
+	return out
+}
+
+func firstEnv(keys ...string) string {
+	for _, key := range keys {
+		if value := os.Getenv(key); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// s3Transport downloads the s3:// objects, the requests are signed with the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+// (and AWS_SESSION_TOKEN) credentials, if they are set. The region is AWS_REGION (or AWS_DEFAULT_REGION), us-east-1 by default.
+// AWS_ENDPOINT_URL_S3 (or AWS_ENDPOINT_URL) replaces the AWS endpoint with an S3 compatible storage's, addressed path style.
+type s3Transport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *s3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	bucket, key, err := bucketObject(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	region := firstEnv("AWS_REGION", "AWS_DEFAULT_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	u := &url.URL{Scheme: "https", Host: bucket + ".s3." + region + ".amazonaws.com", Path: "/" + key}
+	if endpoint := firstEnv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"); endpoint != "" {
+		if u, err = url.Parse(endpoint); err != nil {
+			return nil, fmt.Errorf("invalid S3 endpoint (%s): %s", endpoint, err)
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + bucket + "/" + key
+	}
+	// the path is sent as it is signed
+	u.RawPath = awsURIEncode(u.Path, false)
+
+	out := objectRequest(req, u)
+	if creds, ok := awsCredentialsFromEnv(); ok {
+		signS3Request(out, creds, region, time.Now())
+	}
+	return t.base.RoundTrip(out)
+}
+
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// awsCredentialsFromEnv returns the credentials of the AWS environment variables, the objects are requested anonymously without them.
+func awsCredentialsFromEnv() (awsCredentials, bool) {
+	creds := awsCredentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	return creds, creds.AccessKeyID != "" && creds.SecretAccessKey != ""
+}
+
+// emptyPayloadHash is the SHA256 hash of the empty body of the GET requests.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// signS3Request signs the GET request with AWS Signature Version 4, the Range header is signed too if it is set.
+func signS3Request(req *http.Request, creds awsCredentials, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := amzDate[:8] + "/" + region + "/s3/aws4_request"
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for _, name := range []string{"Range", "X-Amz-Content-Sha256", "X-Amz-Date", "X-Amz-Security-Token"} {
+		if value := req.Header.Get(name); value != "" {
+			headers[strings.ToLower(name)] = strings.TrimSpace(value)
+		}
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsURIEncode(req.URL.Path, false),
+		awsCanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{amzDate[:8], region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsURIEncode percent-encodes everything but the unreserved characters, and the slashes unless encodeSlash is set.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func awsCanonicalQuery(query url.Values) string {
+	var params []string
+	for key, values := range query {
+		for _, value := range values {
+			params = append(params, awsURIEncode(key, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// gcsEndpoint is the Cloud Storage XML API's endpoint, the objects are downloaded from <endpoint>/<bucket>/<key>.
+var gcsEndpoint = "https://storage.googleapis.com"
+
+// gcsReadScope is the OAuth scope of the access tokens requested for a service account.
+const gcsReadScope = "https://www.googleapis.com/auth/devstorage.read_only"
+
+// gcsTransport downloads the gs:// objects, with the access token of GOOGLE_OAUTH_ACCESS_TOKEN, or of the service account
+// or authorized user credentials file of GOOGLE_APPLICATION_CREDENTIALS. The objects are requested anonymously without them.
+// STORAGE_EMULATOR_HOST replaces the endpoint with an emulator's, which is requested anonymously too.
+type gcsTransport struct {
+	base http.RoundTripper
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *gcsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	bucket, key, err := bucketObject(req.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := gcsEndpoint
+	emulator := os.Getenv("STORAGE_EMULATOR_HOST")
+	if emulator != "" {
+		endpoint = emulator
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "http://" + endpoint
+		}
+	}
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/") + "/" + bucket)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Cloud Storage endpoint (%s): %s", endpoint, err)
+	}
+	u.Path += "/" + key
+
+	out := objectRequest(req, u)
+	if emulator == "" {
+		token, err := t.accessToken(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get Cloud Storage access token: %s", err)
+		}
+		if token != "" {
+			out.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	return t.base.RoundTrip(out)
+}
+
+// accessToken returns the access token, requested once and cached until it expires.
+func (t *gcsTransport) accessToken(req *http.Request) (string, error) {
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token, nil
+	}
+	pth := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if pth == "" {
+		return "", nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && time.Now().Before(t.expiry) {
+		return t.token, nil
+	}
+
+	b, err := ioutil.ReadFile(pth)
+	if err != nil {
+		return "", err
+	}
+	var creds gcsCredentials
+	if err := json.Unmarshal(b, &creds); err != nil {
+		return "", fmt.Errorf("invalid credentials file (%s): %s", pth, err)
+	}
+	form, err := creds.tokenRequest(time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	tokenReq, err := http.NewRequestWithContext(req.Context(), "POST", creds.tokenURI(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	tokenReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	client := &http.Client{Timeout: apiTimeout, Transport: t.base}
+	resp, err := client.Do(tokenReq)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = closeBody(resp.Body) }()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request failed, status code: %d", resp.StatusCode)
+	}
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", fmt.Errorf("invalid token response: %s", err)
+	}
+	if tokenResp.AccessToken == "" {
+		return "", errors.New("invalid token response: no access token")
+	}
+
+	// the token is renewed a minute before it expires
+	t.token = tokenResp.AccessToken
+	t.expiry = time.Now().Add(time.Duration(tokenResp.ExpiresIn)*time.Second - time.Minute)
+	return t.token, nil
+}
+
+// gcsCredentials is a service account key or an authorized user's credentials file.
+type gcsCredentials struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func (c gcsCredentials) tokenURI() string {
+	if c.TokenURI != "" {
+		return c.TokenURI
+	}
+	return "https://oauth2.googleapis.com/token"
+}
+
+// tokenRequest returns the form of the access token request: a signed JWT assertion of a service account,
+// or an authorized user's refresh token.
+func (c gcsCredentials) tokenRequest(now time.Time) (url.Values, error) {
+	switch c.Type {
+	case "service_account":
+		assertion, err := c.assertion(now)
+		if err != nil {
+			return nil, err
+		}
+		return url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}, nil
+	case "authorized_user":
+		return url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {c.ClientID},
+			"client_secret": {c.ClientSecret},
+			"refresh_token": {c.RefreshToken},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported credentials type: %s", c.Type)
+	}
+}
+
+// assertion returns the service account's JWT, signed with its private key.
+func (c gcsCredentials) assertion(now time.Time) (string, error) {
+	block, _ := pem.Decode([]byte(c.PrivateKey))
+	if block == nil {
+		return "", errors.New("invalid service account private key")
+	}
+	var key *rsa.PrivateKey
+	if parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		rsaKey, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return "", errors.New("service account private key is not an RSA key")
+		}
+		key = rsaKey
+	} else if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		return "", fmt.Errorf("invalid service account private key: %s", err)
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   c.ClientEmail,
+		"scope": gcsReadScope,
+		"aud":   c.tokenURI(),
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// checksumChunks is the number of read chunks the parallel checksumReader queues for hashing.
+const checksumChunks = 16
+
+// checksumReader computes the digest of the data read through it.
+// In parallel mode the data is hashed on a separate goroutine: read chunks are copied to a buffered channel,
+// so reading the underlying reader is not blocked by hashing. The chunk buffers are recycled through the free channel.
+type checksumReader struct {
+	r io.Reader
+	h hash.Hash
+
+	chunks chan []byte
+	free   chan []byte
+	done   chan struct{}
+}
+
+// newChecksumReader creates a new checksumReader reading from r.
+func newChecksumReader(r io.Reader, h hash.Hash, parallel bool) *checksumReader {
+	c := checksumReader{r: r, h: h}
+	if !parallel {
+		return &c
+	}
+
+	c.chunks = make(chan []byte, checksumChunks)
+	c.free = make(chan []byte, checksumChunks+1)
+	c.done = make(chan struct{})
+
+	go func() {
+		defer close(c.done)
+		for chunk := range c.chunks {
+			// hash.Hash.Write never returns an error
+			_, _ = c.h.Write(chunk)
+			c.free <- chunk
+		}
+	}()
+
+	return &c
+}
+
+// Read implements the io.Reader interface.
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		if c.chunks == nil {
+			_, _ = c.h.Write(p[:n])
+		} else {
+			var chunk []byte
+			select {
+			case chunk = <-c.free:
+			default:
+			}
+			if cap(chunk) < n {
+				chunk = make([]byte, n)
+			}
+			chunk = chunk[:n]
+			copy(chunk, p[:n])
+			c.chunks <- chunk
+		}
+	}
+	return n, err
+}
+
+// stop stops the parallel hashing goroutine once the stream is not read further, like when the extraction falls back
+// from the stream. The reads after it are hashed by the reader, it can be called more than once.
+func (c *checksumReader) stop() {
+	if c.chunks != nil {
+		close(c.chunks)
+		<-c.done
+		c.chunks = nil
+	}
+}
+
+// Sum returns the digest of the data read so far.
+// It should be called once the stream is fully read.
+func (c *checksumReader) Sum() []byte {
+	c.stop()
+	return c.h.Sum(nil)
+}
+
+// expectedChecksum is the archive's checksum reported by the Cache API (the optional `sha256` or `md5` field).
+// The zero value means the checksum is unknown, and the archive is not verified.
+type expectedChecksum struct {
+	Algorithm string
+	// Sum is the hex encoded digest.
+	Sum string
+}
+
+// isSet reports whether the checksum is known.
+func (e expectedChecksum) isSet() bool {
+	return e.Sum != ""
+}
+
+// newHash creates the hash of the checksum's algorithm, sha256 if the checksum is unknown.
+func (e expectedChecksum) newHash() hash.Hash {
+	if e.Algorithm == "md5" {
+		return md5.New()
+	}
+	return sha256.New()
+}
+
+// algorithm returns the name of the checksum's algorithm, sha256 if the checksum is unknown.
+func (e expectedChecksum) algorithm() string {
+	if e.Algorithm == "md5" {
+		return "md5"
+	}
+	return "sha256"
+}
+
+// verify compares the archive's digest with the expected checksum, an unknown checksum matches any digest.
+func (e expectedChecksum) verify(sum []byte) error {
+	if !e.isSet() || strings.EqualFold(hex.EncodeToString(sum), strings.TrimSpace(e.Sum)) {
+		return nil
+	}
+	return &checksumMismatchError{Algorithm: e.algorithm(), Expected: e.Sum, Actual: hex.EncodeToString(sum)}
+}
+
+// checksumMismatchError is returned if the archive's digest does not match the checksum reported by the Cache API.
+type checksumMismatchError struct {
+	Algorithm string
+	Expected  string
+	Actual    string
+}
+
+// Error implements the error interface.
+func (e *checksumMismatchError) Error() string {
+	return fmt.Sprintf("cache archive %s checksum mismatch: expected %s, got %s, the archive is corrupt", e.Algorithm, e.Expected, e.Actual)
+}
+
+// verifyFileChecksum verifies the archive file at pth against the expected checksum.
+func verifyFileChecksum(pth string, expected expectedChecksum) error {
+	if !expected.isSet() {
+		return nil
+	}
+	f, err := os.Open(pth)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	h := expected.newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("failed to read %s: %s", pth, err)
+	}
+	return expected.verify(h.Sum(nil))
+}
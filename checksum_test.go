@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChecksumReader_Sum(t *testing.T) {
+	content := make([]byte, 5*1024*1024+123)
+	rand.New(rand.NewSource(1)).Read(content)
+	want := sha256.Sum256(content)
+
+	for _, parallel := range []bool{false, true} {
+		r := newChecksumReader(bytes.NewReader(content), sha256.New(), parallel)
+
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("parallel = %v: ReadAll() error = %v", parallel, err)
+		}
+		if !bytes.Equal(b, content) {
+			t.Errorf("parallel = %v: read content differs from the original", parallel)
+		}
+		if got := r.Sum(); !bytes.Equal(got, want[:]) {
+			t.Errorf("parallel = %v: Sum() = %x, want %x", parallel, got, want)
+		}
+	}
+}
+
+func TestChecksumReader_Stop(t *testing.T) {
+	content := []byte(strings.Repeat("content", 1024))
+	want := sha256.Sum256(content)
+	r := newChecksumReader(bytes.NewReader(content), sha256.New(), true)
+
+	t.Log("the hashing goroutine finishes once the abandoned stream is stopped")
+	if _, err := io.ReadFull(r, make([]byte, 100)); err != nil {
+		t.Fatalf("ReadFull() error = %v", err)
+	}
+	done := r.done
+	r.stop()
+	r.stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the hashing goroutine is still running after stop()")
+	}
+
+	t.Log("the reads after stop are still hashed")
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if got := r.Sum(); !bytes.Equal(got, want[:]) {
+		t.Errorf("Sum() = %x, want %x", got, want)
+	}
+}
+
+// slowReader simulates a network link with the given throughput.
+type slowReader struct {
+	r              io.Reader
+	bytesPerSecond int
+}
+
+func (s slowReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	time.Sleep(time.Duration(n) * time.Second / time.Duration(s.bytesPerSecond))
+	return n, err
+}
+
+// writerOnly hides the optional interfaces (like io.ReaderFrom) of the writer,
+// so io.CopyBuffer uses the given buffer.
+type writerOnly struct {
+	io.Writer
+}
+
+func benchmarkChecksumReader(b *testing.B, parallel bool) {
+	content := make([]byte, 16*1024*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+	buff := make([]byte, 1024*1024)
+	b.SetBytes(int64(len(content)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		// 200 MB/s, a fast cache CDN link
+		r := newChecksumReader(slowReader{r: bytes.NewReader(content), bytesPerSecond: 200 * 1024 * 1024}, sha256.New(), parallel)
+		if _, err := io.CopyBuffer(writerOnly{ioutil.Discard}, r, buff); err != nil {
+			b.Fatal(err)
+		}
+		r.Sum()
+	}
+}
+
+func BenchmarkChecksumReader_Sequential(b *testing.B) { benchmarkChecksumReader(b, false) }
+
+func BenchmarkChecksumReader_Parallel(b *testing.B) { benchmarkChecksumReader(b, true) }
+
+func TestDownloadCacheArchive_Checksum(t *testing.T) {
+	archive := []byte("cache archive content")
+	sha := sha256.Sum256(archive)
+	md := md5.Sum(archive)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(archive)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		checksum expectedChecksum
+		wantErr  bool
+	}{
+		{name: "no checksum", checksum: expectedChecksum{}},
+		{name: "matching sha256", checksum: expectedChecksum{Algorithm: "sha256", Sum: hex.EncodeToString(sha[:])}},
+		{name: "matching upper case md5", checksum: expectedChecksum{Algorithm: "md5", Sum: strings.ToUpper(hex.EncodeToString(md[:]))}},
+		{name: "mismatching sha256", checksum: expectedChecksum{Algorithm: "sha256", Sum: hex.EncodeToString(md[:])}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Log(tt.name)
+
+		_, err := downloadCacheArchive(http.DefaultClient, server.URL, false, tt.checksum)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("downloadCacheArchive() error = %v, wantErr %v", err, tt.wantErr)
+		}
+		if _, ok := err.(*checksumMismatchError); tt.wantErr && !ok {
+			t.Errorf("downloadCacheArchive() error = %#v, want a checksumMismatchError", err)
+		}
+	}
+}
+
+func TestGetCacheDownloadURL_Checksum(t *testing.T) {
+	tests := []struct {
+		response string
+		want     expectedChecksum
+	}{
+		{response: `{"download_url": "https://storage.com/cache.tar"}`, want: expectedChecksum{}},
+		{response: `{"download_url": "https://storage.com/cache.tar", "md5": "abc"}`, want: expectedChecksum{Algorithm: "md5", Sum: "abc"}},
+		{response: `{"download_url": "https://storage.com/cache.tar", "md5": "abc", "sha256": "def"}`, want: expectedChecksum{Algorithm: "sha256", Sum: "def"}},
+	}
+	for _, tt := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(tt.response))
+		}))
+		resp, err := getCacheDownloadURL(server.URL, "download_url")
+		server.Close()
+
+		if err != nil {
+			t.Fatalf("getCacheDownloadURL() error = %v", err)
+		}
+		if resp.Checksum != tt.want {
+			t.Errorf("getCacheDownloadURL(%s) checksum = %+v, want %+v", tt.response, resp.Checksum, tt.want)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+const (
+	// chunkAttempts is the number of times a chunk download is tried.
+	chunkAttempts = 3
+	// chunkStateFileName is the name of the file recording which archive the part files belong to.
+	chunkStateFileName = "state.json"
+)
+
+// chunkRetryWait is the wait before retrying a failed chunk download, multiplied by the number of failed attempts.
+var chunkRetryWait = 2 * time.Second
+
+// chunkState identifies the archive the part files were downloaded from.
+type chunkState struct {
+	ETag      string `json:"etag"`
+	Size      int64  `json:"size"`
+	ChunkSize int64  `json:"chunk_size"`
+}
+
+// chunkResult is the summary of a chunked download.
+type chunkResult struct {
+	Chunks     int
+	Reused     int
+	Downloaded int
+}
+
+// downloadChunked downloads the archive in chunkSize sized ranges to part files in partsDir, then concatenates them to pth.
+// Completed part files of an interrupted download of the same archive are reused. Each range is retried on failure,
+// and validated against its Content-MD5 header if the server sends one.
+// The archive is downloaded in a single request, if the server does not support range requests.
+func downloadChunked(client *http.Client, url, partsDir, pth string, chunkSize int64) (chunkResult, error) {
+	var result chunkResult
+
+	state, rangesSupported, err := probeArchive(client, url)
+	if err != nil {
+		return result, err
+	}
+	if err := checkArchiveSize(state.Size); err != nil {
+		return result, err
+	}
+	if !rangesSupported {
+		log.Warnf("Download server does not support range requests, downloading the archive in one piece")
+		return result, downloadFile(client, url, pth)
+	}
+	state.ChunkSize = chunkSize
+
+	if err := prepareParts(partsDir, state); err != nil {
+		return result, fmt.Errorf("failed to prepare part files: %s", err)
+	}
+
+	var parts []string
+	for start := int64(0); start < state.Size; start += chunkSize {
+		end := start + chunkSize - 1
+		if end >= state.Size {
+			end = state.Size - 1
+		}
+
+		part := filepath.Join(partsDir, fmt.Sprintf("part-%06d", len(parts)))
+		parts = append(parts, part)
+		result.Chunks++
+
+		if info, err := os.Stat(part); err == nil && info.Size() == end-start+1 {
+			result.Reused++
+			continue
+		}
+
+		if err := retryRange(start, end, func() error { return downloadChunk(client, url, part, start, end) }); err != nil {
+			return result, err
+		}
+		result.Downloaded++
+	}
+
+	if err := concatenateParts(parts, pth); err != nil {
+		return result, fmt.Errorf("failed to concatenate part files: %s", err)
+	}
+	if err := os.RemoveAll(partsDir); err != nil {
+		log.Warnf("Failed to remove part files: %s", err)
+	}
+	return result, nil
+}
+
+// probeArchive requests the first byte of the archive, to get its size and ETag,
+// and reports whether the server supports range requests.
+func probeArchive(client *http.Client, url string) (chunkState, bool, error) {
+	req, err := http.NewRequestWithContext(stepContext, "GET", url, nil)
+	if err != nil {
+		return chunkState{}, false, err
+	}
+	setHeaders(req, downloadHeaders)
+	req.Header.Set("Range", "bytes=0-0")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return chunkState{}, false, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return chunkState{}, false, nil
+	case http.StatusPartialContent:
+	default:
+		return chunkState{}, false, fmt.Errorf("non success response code: %d", resp.StatusCode)
+	}
+
+	_, _, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return chunkState{}, false, err
+	}
+	return chunkState{ETag: resp.Header.Get("ETag"), Size: size}, true, nil
+}
+
+// parseContentRange parses a "bytes <start>-<end>/<size>" Content-Range header.
+func parseContentRange(contentRange string) (start, end, size int64, err error) {
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &start, &end, &size); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range (%s): %s", contentRange, err)
+	}
+	return start, end, size, nil
+}
+
+// prepareParts creates the parts directory, and removes the part files of a different archive or chunk size.
+// Part files are only reused if the archive has an ETag, the size alone does not identify the archive.
+func prepareParts(partsDir string, state chunkState) error {
+	statePth := filepath.Join(partsDir, chunkStateFileName)
+
+	if b, err := ioutil.ReadFile(statePth); err == nil {
+		var previous chunkState
+		if err := json.Unmarshal(b, &previous); err == nil && previous == state && state.ETag != "" {
+			return nil
+		}
+		log.Printf("part files belong to a different archive, removing them")
+	}
+
+	if err := os.RemoveAll(partsDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(partsDir, 0755); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(statePth, b, 0644)
+}
+
+// downloadChunk downloads the archive's bytes from start to end (inclusive) to the part file at pth.
+// The part file only gets its name once it is completely downloaded and validated.
+func downloadChunk(client *http.Client, url, pth string, start, end int64) error {
+	tmpPth := pth + ".tmp"
+	f, err := os.Create(tmpPth)
+	if err != nil {
+		return err
+	}
+	err = downloadRange(client, url, f, start, end)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPth, pth)
+}
+
+// downloadRange downloads the archive's bytes from start to end (inclusive) to w,
+// and validates them against the Content-MD5 header if the server sends one.
+func downloadRange(client *http.Client, url string, w io.Writer, start, end int64) error {
+	req, err := http.NewRequestWithContext(stepContext, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	setHeaders(req, downloadHeaders)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("non partial content response code: %d", resp.StatusCode)
+	}
+	if gotStart, gotEnd, _, err := parseContentRange(resp.Header.Get("Content-Range")); err != nil {
+		return err
+	} else if gotStart != start || gotEnd != end {
+		return fmt.Errorf("unexpected range in response: %d-%d", gotStart, gotEnd)
+	}
+
+	h := md5.New()
+	written, err := io.Copy(io.MultiWriter(w, h), resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if written != end-start+1 {
+		return fmt.Errorf("received %d bytes, expected %d", written, end-start+1)
+	}
+	if contentMD5 := resp.Header.Get("Content-MD5"); contentMD5 != "" {
+		want, err := base64.StdEncoding.DecodeString(strings.TrimSpace(contentMD5))
+		if err != nil {
+			return fmt.Errorf("invalid Content-MD5 (%s): %s", contentMD5, err)
+		}
+		if got := h.Sum(nil); !bytes.Equal(got, want) {
+			return fmt.Errorf("checksum mismatch, Content-MD5: %s, received: %s", contentMD5, base64.StdEncoding.EncodeToString(got))
+		}
+	}
+	return nil
+}
+
+// retryRange runs the download of the range from start to end (inclusive) up to chunkAttempts times, until it succeeds.
+func retryRange(start, end int64, download func() error) error {
+	var err error
+	for attempt := 1; attempt <= chunkAttempts; attempt++ {
+		if err = download(); err == nil {
+			return nil
+		}
+		log.Warnf("Failed to download bytes %d-%d (attempt %d/%d): %s", start, end, attempt, chunkAttempts, err)
+		// the wait is cut short once the step exceeds its max_duration, the further attempts would fail anyway
+		if attempt == chunkAttempts || !sleepContext(stepContext, time.Duration(attempt)*chunkRetryWait) {
+			break
+		}
+	}
+	return fmt.Errorf("failed to download bytes %d-%d: %s", start, end, err)
+}
+
+// concatenateParts writes the part files after each other to pth.
+func concatenateParts(parts []string, pth string) error {
+	out, err := os.Create(pth)
+	if err != nil {
+		return err
+	}
+
+	for _, part := range parts {
+		in, err := os.Open(part)
+		if err != nil {
+			_ = out.Close()
+			return err
+		}
+		_, err = io.Copy(out, in)
+		if cerr := in.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			_ = out.Close()
+			return err
+		}
+	}
+
+	return out.Close()
+}
+
+// downloadFile downloads the whole archive to pth in one request.
+func downloadFile(client *http.Client, url, pth string) error {
+	body, _, err := performRequest(client, url)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	f, err := os.Create(pth)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.MultiWriter(f, newSizeLimit()), body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
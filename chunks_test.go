@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rangeServer serves content with range request support, counting the requested ranges.
+// Ranges listed in failing are answered with an internal server error.
+type rangeServer struct {
+	content []byte
+
+	mu       sync.Mutex
+	requests map[string]int
+	failing  map[string]bool
+	badMD5   bool
+}
+
+func (s *rangeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rng := r.Header.Get("Range")
+
+	s.mu.Lock()
+	s.requests[rng]++
+	fail := s.failing[rng]
+	s.mu.Unlock()
+
+	if fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", `"archive-v1"`)
+	if s.badMD5 {
+		sum := md5.Sum([]byte("other content"))
+		w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+	http.ServeContent(w, r, "cache.tar", time.Time{}, bytes.NewReader(s.content))
+}
+
+func TestDownloadChunked_Resume(t *testing.T) {
+	defer func(wait time.Duration) { chunkRetryWait = wait }(chunkRetryWait)
+	chunkRetryWait = 0
+
+	content := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(content)
+	s := &rangeServer{
+		content:  content,
+		requests: map[string]int{},
+		failing:  map[string]bool{"bytes=600-899": true},
+	}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	dir := t.TempDir()
+	partsDir := filepath.Join(dir, "parts")
+	pth := filepath.Join(dir, "cache.tar")
+
+	t.Log("interrupted download")
+	{
+		result, err := downloadChunked(http.DefaultClient, server.URL, partsDir, pth, 300)
+		if err == nil {
+			t.Fatalf("downloadChunked() error = nil, want error")
+		}
+		if result.Downloaded != 2 {
+			t.Errorf("downloadChunked() = %+v, want 2 chunks downloaded", result)
+		}
+		if got := s.requests["bytes=600-899"]; got != chunkAttempts {
+			t.Errorf("failing chunk requested %d times, want %d", got, chunkAttempts)
+		}
+	}
+
+	t.Log("resumed download")
+	{
+		s.failing = nil
+		result, err := downloadChunked(http.DefaultClient, server.URL, partsDir, pth, 300)
+		if err != nil {
+			t.Fatalf("downloadChunked() error = %v", err)
+		}
+		if result != (chunkResult{Chunks: 4, Reused: 2, Downloaded: 2}) {
+			t.Errorf("downloadChunked() = %+v, want 4 chunks, 2 reused and 2 downloaded", result)
+		}
+		for _, rng := range []string{"bytes=0-299", "bytes=300-599"} {
+			if got := s.requests[rng]; got != 1 {
+				t.Errorf("completed chunk (%s) requested %d times, want 1", rng, got)
+			}
+		}
+
+		b, err := ioutil.ReadFile(pth)
+		if err != nil {
+			t.Fatalf("failed to read archive: %s", err)
+		}
+		if !bytes.Equal(b, content) {
+			t.Errorf("downloaded archive differs from the original")
+		}
+	}
+}
+
+func TestDownloadChunked_ChecksumMismatch(t *testing.T) {
+	defer func(wait time.Duration) { chunkRetryWait = wait }(chunkRetryWait)
+	chunkRetryWait = 0
+
+	s := &rangeServer{content: []byte("archive content"), requests: map[string]int{}, badMD5: true}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	dir := t.TempDir()
+	if _, err := downloadChunked(http.DefaultClient, server.URL, filepath.Join(dir, "parts"), filepath.Join(dir, "cache.tar"), 5); err == nil {
+		t.Errorf("downloadChunked() error = nil, want checksum mismatch error")
+	}
+}
+
+func TestDownloadChunked_RangesNotSupported(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := w.Write([]byte("archive content")); err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	pth := filepath.Join(dir, "cache.tar")
+	if _, err := downloadChunked(http.DefaultClient, server.URL, filepath.Join(dir, "parts"), pth, 5); err != nil {
+		t.Fatalf("downloadChunked() error = %v", err)
+	}
+	b, err := ioutil.ReadFile(pth)
+	if err != nil {
+		t.Fatalf("failed to read archive: %s", err)
+	}
+	if string(b) != "archive content" {
+		t.Errorf("downloaded archive = %s, want archive content", b)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// zstdMagic is the magic number of a zstd frame.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// zstdTool is the zstd tool decompressing the zstd compressed archives.
+var zstdTool = "zstd"
+
+// zstdAvailable reports whether the zstd tool is installed.
+func zstdAvailable() bool {
+	_, err := exec.LookPath(zstdTool)
+	return err == nil
+}
+
+// archiveCompression sniffs the archive file's compression from its magic number: featureGzip, featureZstd, or empty if it is not compressed.
+func archiveCompression(pth string) (string, error) {
+	f, err := os.Open(pth)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = f.Close() }()
+
+	magic := make([]byte, len(zstdMagic))
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	switch {
+	case bytes.HasPrefix(magic[:n], zstdMagic):
+		return featureZstd, nil
+	case bytes.HasPrefix(magic[:n], gzipMagic[:2]):
+		return featureGzip, nil
+	}
+	return "", nil
+}
+
+// compressionError is returned if the compressed archive stream can not be decompressed by the step.
+// The archive file might still be extracted by the tar tool, it is a fallback error.
+type compressionError struct {
+	Format string
+	Err    error
+}
+
+// Error implements the error interface.
+func (e *compressionError) Error() string {
+	return fmt.Sprintf("failed to decompress the %s compressed archive stream: %s", e.Format, e.Err)
+}
+
+// zstdReader decompresses a zstd compressed stream while it is read, with the zstd tool.
+type zstdReader struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+
+	waitOnce sync.Once
+	waitErr  error
+	// err is the decompression's error, set once the decompressed stream is read till its end.
+	err error
+}
+
+// newZstdReader starts decompressing the zstd stream read from r.
+// Windows up to 2 GB are accepted, so archives compressed with zstd's long distance matching are decompressed too.
+func newZstdReader(r io.Reader) (*zstdReader, error) {
+	pth, err := exec.LookPath(zstdTool)
+	if err != nil {
+		return nil, fmt.Errorf("the zstd tool is not available: %s", err)
+	}
+	z := zstdReader{cmd: exec.Command(pth, "-d", "-c", "-q", "--long=31")}
+	z.cmd.Stdin = r
+	z.cmd.Stderr = &z.stderr
+	if z.stdout, err = z.cmd.StdoutPipe(); err != nil {
+		return nil, err
+	}
+	if err := z.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start zstd: %s", err)
+	}
+	return &z, nil
+}
+
+// Read implements the io.Reader interface.
+// The end of the decompressed stream is only returned if the tool exited successfully, a corrupt stream is an error.
+func (z *zstdReader) Read(p []byte) (int, error) {
+	n, err := z.stdout.Read(p)
+	if err == io.EOF {
+		if werr := z.wait(); werr != nil {
+			z.err = werr
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// Close stops the decompression, the stream does not have to be read till its end.
+func (z *zstdReader) Close() error {
+	// the tool has already exited if the stream was read till its end
+	_ = z.cmd.Process.Kill()
+	_ = z.wait()
+	return nil
+}
+
+func (z *zstdReader) wait() error {
+	z.waitOnce.Do(func() {
+		if err := z.cmd.Wait(); err != nil {
+			if out := strings.TrimSpace(z.stderr.String()); out != "" {
+				err = fmt.Errorf("%s: %s", err, out)
+			}
+			z.waitErr = err
+		}
+	})
+	return z.waitErr
+}
+
+// decompressStream returns the archive stream decompressed while it is read, if it starts with the zstd magic number,
+// and the zstd reader to close once the stream is not read any more. Other streams are returned as they are:
+// the tar reader decompresses a gzip stream itself, and an uncompressed stream needs no decompression.
+func decompressStream(br *bufio.Reader) (io.Reader, *zstdReader, error) {
+	if magic, err := br.Peek(len(zstdMagic)); err != nil || !bytes.Equal(magic, zstdMagic) {
+		return br, nil, nil
+	}
+	z, err := newZstdReader(br)
+	if err != nil {
+		return nil, nil, &compressionError{Format: featureZstd, Err: err}
+	}
+	return z, z, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// zstdCompress compresses the data with the zstd tool, the test is skipped if it is not installed.
+func zstdCompress(t *testing.T, data []byte) []byte {
+	if !zstdAvailable() {
+		t.Skip("the zstd tool is not installed")
+	}
+	cmd := exec.Command(zstdTool, "-c", "-q")
+	cmd.Stdin = bytes.NewReader(data)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("failed to compress: %s", err)
+	}
+	return out
+}
+
+func TestExtractCacheArchive_Zstd(t *testing.T) {
+	archive := createTestArchive(t,
+		testEntry{hdr: tar.Header{Name: archiveInfoFileName, Typeflag: tar.TypeReg}, body: `{"stack_id":"osx-xcode-14"}`},
+		testEntry{hdr: tar.Header{Name: "dir/file.txt", Typeflag: tar.TypeReg}, body: "content"},
+	)
+	compressed := zstdCompress(t, archive.Bytes())
+
+	t.Log("archive info")
+	{
+		info, err := readArchiveInfo(NewRestoreReader(bytes.NewReader(compressed)))
+		if err != nil {
+			t.Fatalf("readArchiveInfo() error = %v", err)
+		}
+		if info == nil || info.StackID != "osx-xcode-14" {
+			t.Errorf("readArchiveInfo() = %+v, want the stack osx-xcode-14", info)
+		}
+	}
+
+	for _, opts := range []extractOptions{{}, {ConfineRoot: true}, {ExistingSymlinks: symlinksFollow}} {
+		opts.Root = t.TempDir()
+
+		// the archive info is read from the restored stream first, like the step does
+		r := NewRestoreReader(bytes.NewReader(compressed))
+		if _, err := readArchiveInfo(r); err != nil {
+			t.Fatalf("readArchiveInfo() error = %v", err)
+		}
+		result, err := extractCacheArchive(r, opts)
+		if err != nil {
+			t.Fatalf("extractCacheArchive(%+v) error = %v", opts, err)
+		}
+		if result.Entries != 1 || result.CompressedBytes != int64(len(compressed)) {
+			t.Errorf("%+v: Entries = %d, CompressedBytes = %d, want 1 and %d", opts, result.Entries, result.CompressedBytes, len(compressed))
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(opts.Root, "dir/file.txt")); err != nil || string(b) != "content" {
+			t.Errorf("%+v: dir/file.txt = %q, %v", opts, b, err)
+		}
+	}
+}
+
+func TestExtractCacheArchive_CorruptZstd(t *testing.T) {
+	archive := createTestArchive(t, testEntry{hdr: tar.Header{Name: "file.txt", Typeflag: tar.TypeReg}, body: strings.Repeat("content", 1000)})
+	compressed := zstdCompress(t, archive.Bytes())
+	truncated := compressed[:len(compressed)/2]
+
+	_, err := extractCacheArchive(bytes.NewReader(truncated), extractOptions{Root: t.TempDir()})
+	if _, ok := err.(*compressionError); !ok {
+		t.Fatalf("extractCacheArchive() error = %v, want a compression error", err)
+	}
+	if !isFallbackError(err) {
+		t.Errorf("isFallbackError(%v) = false, want the archive file extracted by tar", err)
+	}
+}
+
+func TestDecompressStream(t *testing.T) {
+	defer func(tool string) { zstdTool = tool }(zstdTool)
+	zstdTool = "zstd-not-installed"
+
+	t.Log("not zstd compressed")
+	{
+		for _, data := range [][]byte{nil, {0x1f, 0x8b, 0x08, 0x00}, []byte("plain tar")} {
+			r, zstd, err := decompressStream(bufio.NewReader(bytes.NewReader(data)))
+			if err != nil || zstd != nil {
+				t.Fatalf("decompressStream(%q) = %v, %v, want the stream as it is", data, zstd, err)
+			}
+			if b, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(b, data) {
+				t.Errorf("decompressStream(%q) read %q, %v", data, b, err)
+			}
+		}
+	}
+
+	t.Log("zstd tool not installed")
+	{
+		_, _, err := decompressStream(bufio.NewReader(bytes.NewReader(append(zstdMagic, 0, 0))))
+		if _, ok := err.(*compressionError); !ok {
+			t.Errorf("decompressStream() error = %v, want a compression error", err)
+		}
+	}
+}
+
+func TestTarExtractArgs_Compression(t *testing.T) {
+	for _, tt := range []struct {
+		compression string
+		root        string
+		want        string
+	}{
+		{"", "", "-xPf archive"},
+		{featureGzip, "", "-xzPf archive"},
+		{"", "/root", "-xf archive -C /root"},
+		{featureGzip, "/root", "-xzf archive -C /root"},
+	} {
+		args := tarExtractArgs("archive", tt.compression, extractOptions{Root: tt.root, ExtractMetadata: true})
+		if got := strings.Join(args, " "); !strings.HasPrefix(got, tt.want) {
+			t.Errorf("tarExtractArgs(%q, %q) = %s, want %s", tt.compression, tt.root, got, tt.want)
+		}
+	}
+}
+
+func TestUncompressArchive_Compression(t *testing.T) {
+	archive := createTestArchive(t, testEntry{hdr: tar.Header{Name: "file.txt", Typeflag: tar.TypeReg, Mode: 0644}, body: "content"})
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	if _, err := gw.Write(archive.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	archives := map[string][]byte{"": archive.Bytes(), featureGzip: gzipped.Bytes()}
+	if zstdAvailable() {
+		archives[featureZstd] = zstdCompress(t, archive.Bytes())
+	}
+	for compression, data := range archives {
+		pth := filepath.Join(dir, "archive-"+compression)
+		if err := ioutil.WriteFile(pth, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := archiveCompression(pth); err != nil || got != compression {
+			t.Errorf("archiveCompression(%s) = %q, %v, want %q", pth, got, err, compression)
+		}
+
+		root := t.TempDir()
+		result, err := uncompressArchive(pth, extractOptions{Root: root})
+		if err != nil {
+			t.Fatalf("uncompressArchive(%q) error = %v", compression, err)
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(root, "file.txt")); err != nil || string(b) != "content" || result.Entries != 1 {
+			t.Errorf("uncompressArchive(%q) extracted %q, %v, %d entries, want the file", compression, b, err, result.Entries)
+		}
+	}
+
+	t.Log("zstd tool not installed")
+	{
+		defer func(tool string) { zstdTool = tool }(zstdTool)
+		zstdTool = "zstd-not-installed"
+
+		pth := filepath.Join(dir, "archive.tar.zst")
+		if err := ioutil.WriteFile(pth, append(zstdMagic, 0, 0), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := uncompressArchive(pth, extractOptions{Root: t.TempDir()}); err == nil || !strings.Contains(err.Error(), "zstd-not-installed tool is not installed") {
+			t.Errorf("uncompressArchive() error = %v, want the missing zstd tool reported", err)
+		}
+	}
+}
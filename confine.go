@@ -0,0 +1,313 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// confinementError is returned if an archive entry would be written outside the extraction root.
+type confinementError struct {
+	Name string
+	Err  error
+}
+
+// Error implements the error interface.
+func (e *confinementError) Error() string {
+	return fmt.Sprintf("refusing to extract %s outside the extraction root: %s", e.Name, e.Err)
+}
+
+// confinedRoot writes the archive's entries beneath the extraction root, the entry names are relative to the root.
+// The existing files, symlinks and empty directories are replaced, like tar's --unlink-first does.
+type confinedRoot interface {
+	mkdirAll(name string, mode os.FileMode) error
+	create(name string, mode os.FileMode) (*os.File, error)
+	symlink(target, name string) error
+	link(oldname, name string) error
+	// openDir opens the existing directory, to set its mode and modification time.
+	openDir(name string) (*os.File, error)
+	close() error
+}
+
+// confinedDir is a directory entry, whose mode and modification time are set after the extraction:
+// extracting its content changes its modification time, and a read-only mode would refuse the content.
+type confinedDir struct {
+	name    string
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// extractConfined extracts the archive read from r beneath opts.Root, without the tar tool.
+// On Linux, the paths are resolved by the kernel (openat2 with RESOLVE_BENEATH), so neither symlinks nor
+// concurrent changes of the tree make a write escape the root. Elsewhere the paths are checked lexically.
+// With opts.Concurrency over 1, the small regular files are written by a pool of workers.
+func extractConfined(r io.Reader, opts extractOptions, failures *entryFailures) error {
+	if opts.Root == "" {
+		return fmt.Errorf("the confined extraction requires an extraction root")
+	}
+	root, err := openConfinedRoot(opts.Root)
+	if err != nil {
+		return fmt.Errorf("failed to open the extraction root: %s", err)
+	}
+	defer func() {
+		if err := root.close(); err != nil {
+			log.Warnf("Failed to close the extraction root: %s", err)
+		}
+	}()
+
+	tr, err := newArchiveReader(r)
+	if err != nil {
+		return err
+	}
+	if opts.Concurrency <= 1 {
+		return extractConfinedEntries(tr, root, nil, opts, failures)
+	}
+	writer := newParallelWriter(root, opts.Concurrency, failures)
+	err = extractConfinedEntries(tr, root, writer, opts, failures)
+	if werr := writer.close(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+func extractConfinedEntries(tr *tar.Reader, root confinedRoot, writer *parallelWriter, opts extractOptions, failures *entryFailures) error {
+	var dirs []confinedDir
+	for {
+		// the entries already buffered are not extracted past the deadline either
+		if err := stepContext.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			if writer != nil {
+				if err := writer.wait(); err != nil {
+					return err
+				}
+			}
+			return restoreConfinedDirs(root, dirs)
+		}
+		if err != nil {
+			return err
+		}
+
+		name := strings.TrimLeft(hdr.Name, "/")
+		if name == "" || (!opts.ExtractMetadata && isMetadataEntry(name, opts.metadataName)) {
+			continue
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, confinedDir{name: name, mode: fileMode(uint32(hdr.Mode)), modTime: hdr.ModTime})
+		}
+
+		if writer != nil {
+			// the sparse files are written with holes, not from memory
+			if hdr.Typeflag == tar.TypeReg && hdr.Size <= maxParallelFileSize && !isSparseEntry(hdr) {
+				body, err := ioutil.ReadAll(tr)
+				if err != nil {
+					return err
+				}
+				if err := writer.write(name, hdr, body); err != nil {
+					return err
+				}
+				continue
+			}
+			// a directory only depends on a queued file of its name, the links and the large files might depend
+			// on any of them: the hard link's target, or the file replaced by a symlink
+			if hdr.Typeflag != tar.TypeDir || writer.isQueued(name) {
+				if err := writer.wait(); err != nil {
+					return err
+				}
+			}
+		}
+		if err := extractConfinedEntry(root, name, hdr, tr); err != nil && !failures.skip(hdr, err) {
+			return confinedEntryError(hdr.Name, err)
+		}
+	}
+}
+
+// confinedEntryError returns the error of extracting the entry of the given name, the refused writes are confinementErrors.
+func confinedEntryError(name string, err error) error {
+	if errno, ok := err.(syscall.Errno); ok && errno == syscall.EXDEV {
+		return &confinementError{Name: name, Err: err}
+	}
+	if _, ok := err.(*confinementError); ok {
+		return err
+	}
+	return fmt.Errorf("failed to extract %s: %s", name, err)
+}
+
+// restoreConfinedDirs sets the extracted directories' modes and modification times, the deepest directories first.
+// A directory replaced by a later entry is not restored.
+func restoreConfinedDirs(root confinedRoot, dirs []confinedDir) error {
+	for i := len(dirs) - 1; i >= 0; i-- {
+		f, err := root.openDir(dirs[i].name)
+		if err != nil {
+			log.Warnf("Failed to restore the mode of %s: %s", dirs[i].name, err)
+			continue
+		}
+		err = setFileMeta(f, dirs[i].mode, dirs[i].modTime)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to restore the mode of %s: %s", dirs[i].name, err)
+		}
+	}
+	return nil
+}
+
+// setFileMeta sets the mode (the umask applies on creation) and the modification time, if known, on the descriptor.
+func setFileMeta(f *os.File, mode os.FileMode, modTime time.Time) error {
+	if err := f.Chmod(mode); err != nil {
+		return err
+	}
+	if modTime.IsZero() {
+		return nil
+	}
+	mtime := syscall.NsecToTimeval(modTime.UnixNano())
+	return syscall.Futimes(int(f.Fd()), []syscall.Timeval{mtime, mtime})
+}
+
+func extractConfinedEntry(root confinedRoot, name string, hdr *tar.Header, r io.Reader) error {
+	// the setuid, setgid and sticky bits are kept too, like tar does when run by root
+	mode := fileMode(uint32(hdr.Mode))
+	if dir := filepath.Dir(name); dir != "." {
+		if err := root.mkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		// the directory's own mode is set after its content is extracted
+		return root.mkdirAll(name, 0755)
+	case tar.TypeReg, tar.TypeGNUSparse:
+		f, err := root.create(name, mode.Perm())
+		if err != nil {
+			return err
+		}
+		if isSparseEntry(hdr) {
+			_, err = writeSparse(f, r)
+		} else {
+			_, err = io.Copy(f, r)
+		}
+		if err == nil {
+			err = setFileMeta(f, mode, hdr.ModTime)
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	case tar.TypeSymlink:
+		return root.symlink(hdr.Linkname, name)
+	case tar.TypeLink:
+		return root.link(strings.TrimLeft(hdr.Linkname, "/"), name)
+	default:
+		log.Warnf("Skipping %s, %s entries are not extracted beneath the extraction root", hdr.Name, typeflagName(hdr.Typeflag))
+		return nil
+	}
+}
+
+// lexicalRoot confines the entries beneath the root by checking their paths: names escaping the root
+// and existing symlinks among the parent directories are refused. Concurrent changes of the tree are not guarded against.
+type lexicalRoot struct {
+	root string
+}
+
+// path returns the checked path of the entry.
+func (l lexicalRoot) path(name string) (string, error) {
+	rel := filepath.Clean(name)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", &confinementError{Name: name, Err: fmt.Errorf("the path escapes the root")}
+	}
+
+	pth := l.root
+	parts := strings.Split(rel, "/")
+	for _, part := range parts[:len(parts)-1] {
+		pth = filepath.Join(pth, part)
+		if info, err := os.Lstat(pth); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return "", &confinementError{Name: name, Err: fmt.Errorf("%s is a symlink", pth)}
+		}
+	}
+	return filepath.Join(l.root, rel), nil
+}
+
+// replace removes the existing file, symlink or empty directory at pth.
+func (l lexicalRoot) replace(pth string) error {
+	if err := os.Remove(pth); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (l lexicalRoot) mkdirAll(name string, mode os.FileMode) error {
+	pth, err := l.path(name)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Lstat(pth); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return &confinementError{Name: name, Err: fmt.Errorf("%s is a symlink", pth)}
+	}
+	return os.MkdirAll(pth, mode)
+}
+
+func (l lexicalRoot) create(name string, mode os.FileMode) (*os.File, error) {
+	pth, err := l.path(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.replace(pth); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(pth, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+}
+
+func (l lexicalRoot) symlink(target, name string) error {
+	pth, err := l.path(name)
+	if err != nil {
+		return err
+	}
+	if err := l.replace(pth); err != nil {
+		return err
+	}
+	return os.Symlink(target, pth)
+}
+
+func (l lexicalRoot) openDir(name string) (*os.File, error) {
+	pth, err := l.path(name)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Lstat(pth); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, &confinementError{Name: name, Err: fmt.Errorf("%s is not a directory", pth)}
+	}
+	return os.Open(pth)
+}
+
+func (l lexicalRoot) link(oldname, name string) error {
+	oldPth, err := l.path(oldname)
+	if err != nil {
+		return err
+	}
+	pth, err := l.path(name)
+	if err != nil {
+		return err
+	}
+	if err := l.replace(pth); err != nil {
+		return err
+	}
+	return os.Link(oldPth, pth)
+}
+
+func (l lexicalRoot) close() error {
+	return nil
+}
@@ -0,0 +1,229 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// sysOpenat2 is the openat2 system call's number, the same on every architecture (Linux 5.6+).
+const sysOpenat2 = 437
+
+// openat2 resolve flags.
+const (
+	resolveNoMagiclinks = 0x02
+	resolveBeneath      = 0x08
+)
+
+// atRemoveDir is the unlinkat flag removing a directory.
+const atRemoveDir = 0x200
+
+// openHow is the openat2 system call's struct open_how.
+type openHow struct {
+	Flags   uint64
+	Mode    uint64
+	Resolve uint64
+}
+
+// openat2 opens pth relative to dirfd, the whole path resolution stays beneath dirfd.
+func openat2(dirfd int, pth string, flags int) (int, error) {
+	p, err := syscall.BytePtrFromString(pth)
+	if err != nil {
+		return -1, err
+	}
+	how := openHow{Flags: uint64(flags | syscall.O_CLOEXEC), Resolve: resolveBeneath | resolveNoMagiclinks}
+	fd, _, errno := syscall.Syscall6(sysOpenat2, uintptr(dirfd), uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&how)), unsafe.Sizeof(how), 0, 0)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+// openConfinedRoot opens the root for the confined extraction, the lexically checked root is returned
+// on kernels without openat2.
+func openConfinedRoot(root string) (confinedRoot, error) {
+	fd, err := syscall.Open(root, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	dirfd, err := openat2(fd, ".", syscall.O_RDONLY|syscall.O_DIRECTORY)
+	if err == syscall.ENOSYS || err == syscall.EPERM {
+		// EPERM is returned by seccomp filters not knowing the system call
+		log.Warnf("openat2 is not supported (%s), checking the extracted paths lexically", err)
+		_ = syscall.Close(fd)
+		return lexicalRoot{root: root}, nil
+	}
+	if err != nil {
+		_ = syscall.Close(fd)
+		return nil, err
+	}
+	_ = syscall.Close(dirfd)
+	return &beneathRoot{fd: fd}, nil
+}
+
+// beneathRoot confines the entries beneath the root by resolving their parent directories with openat2 and RESOLVE_BENEATH:
+// a path escaping the root, through ".." or a symlink, fails with EXDEV.
+// The entry itself is created relative to its parent's descriptor, without following a symlink in its place.
+type beneathRoot struct {
+	fd int
+}
+
+// openDirFd opens the directory at name beneath the root.
+func (b *beneathRoot) openDirFd(name string) (int, error) {
+	if name == "" {
+		name = "."
+	}
+	return openat2(b.fd, name, syscall.O_RDONLY|syscall.O_DIRECTORY)
+}
+
+// parent opens the entry's parent directory, and returns its descriptor and the entry's base name.
+func (b *beneathRoot) parent(name string) (int, string, error) {
+	name = strings.TrimRight(name, "/")
+	dir, base := filepath.Split(name)
+	fd, err := b.openDirFd(dir)
+	if err != nil {
+		return -1, "", err
+	}
+	return fd, base, nil
+}
+
+// replaceAt removes the existing file, symlink or empty directory at name in the directory.
+func replaceAt(dirfd int, name string) error {
+	err := syscall.Unlinkat(dirfd, name)
+	if err == syscall.EISDIR || err == syscall.EPERM {
+		// directories are removed with AT_REMOVEDIR, which fails for a non-empty one
+		err = unlinkat(dirfd, name, atRemoveDir)
+	}
+	if err != nil && err != syscall.ENOENT {
+		return err
+	}
+	return nil
+}
+
+func unlinkat(dirfd int, name string, flags int) error {
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_UNLINKAT, uintptr(dirfd), uintptr(unsafe.Pointer(p)), uintptr(flags)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (b *beneathRoot) mkdirAll(name string, mode os.FileMode) error {
+	name = strings.TrimRight(filepath.Clean(name), "/")
+	if name == "." {
+		return nil
+	}
+	if fd, err := b.openDirFd(name); err == nil {
+		return syscall.Close(fd)
+	} else if err != syscall.ENOENT {
+		return err
+	}
+
+	if dir := filepath.Dir(name); dir != "." {
+		if err := b.mkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	fd, base, err := b.parent(name)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = syscall.Close(fd) }()
+	if err := syscall.Mkdirat(fd, base, uint32(mode)); err != nil && err != syscall.EEXIST {
+		return err
+	}
+	return nil
+}
+
+func (b *beneathRoot) create(name string, mode os.FileMode) (*os.File, error) {
+	dirfd, base, err := b.parent(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = syscall.Close(dirfd) }()
+	if err := replaceAt(dirfd, base); err != nil {
+		return nil, err
+	}
+	// O_EXCL fails, instead of following a symlink created in the file's place meanwhile
+	fd, err := syscall.Openat(dirfd, base, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, uint32(mode))
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+func (b *beneathRoot) symlink(target, name string) error {
+	dirfd, base, err := b.parent(name)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = syscall.Close(dirfd) }()
+	if err := replaceAt(dirfd, base); err != nil {
+		return err
+	}
+
+	t, err := syscall.BytePtrFromString(target)
+	if err != nil {
+		return err
+	}
+	p, err := syscall.BytePtrFromString(base)
+	if err != nil {
+		return err
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_SYMLINKAT, uintptr(unsafe.Pointer(t)), uintptr(dirfd), uintptr(unsafe.Pointer(p))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (b *beneathRoot) link(oldname, name string) error {
+	olddirfd, oldbase, err := b.parent(oldname)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = syscall.Close(olddirfd) }()
+	dirfd, base, err := b.parent(name)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = syscall.Close(dirfd) }()
+	if err := replaceAt(dirfd, base); err != nil {
+		return err
+	}
+
+	o, err := syscall.BytePtrFromString(oldbase)
+	if err != nil {
+		return err
+	}
+	p, err := syscall.BytePtrFromString(base)
+	if err != nil {
+		return err
+	}
+	// without AT_SYMLINK_FOLLOW, a symlink in the target's place is linked itself, not followed
+	if _, _, errno := syscall.Syscall6(syscall.SYS_LINKAT, uintptr(olddirfd), uintptr(unsafe.Pointer(o)), uintptr(dirfd), uintptr(unsafe.Pointer(p)), 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (b *beneathRoot) openDir(name string) (*os.File, error) {
+	// a symlink in the directory's place is not followed
+	fd, err := openat2(b.fd, filepath.Clean(name), syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+func (b *beneathRoot) close() error {
+	return syscall.Close(b.fd)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// openBeneathRoot opens the root for the confined extraction, skipping the test on kernels without openat2.
+func openBeneathRoot(t *testing.T, root string) *beneathRoot {
+	r, err := openConfinedRoot(root)
+	if err != nil {
+		t.Fatalf("openConfinedRoot() error = %v", err)
+	}
+	b, ok := r.(*beneathRoot)
+	if !ok {
+		t.Skipf("openat2 is not supported by the kernel")
+	}
+	return b
+}
+
+func TestExtractConfined_Escapes(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	b := openBeneathRoot(t, root)
+
+	// the kernel refuses resolving the escaping paths
+	for _, name := range []string{"escape/pwned.txt", "../pwned.txt", "dir/../../pwned.txt"} {
+		if _, err := b.create(name, 0644); err != syscall.EXDEV {
+			t.Errorf("create(%s) error = %v, want %v", name, err, syscall.EXDEV)
+		}
+	}
+	if err := b.mkdirAll("escape/dir", 0755); err != syscall.EXDEV {
+		t.Errorf("mkdirAll(escape/dir) error = %v, want %v", err, syscall.EXDEV)
+	}
+	if err := b.symlink("/etc", "escape/link"); err != syscall.EXDEV {
+		t.Errorf("symlink(escape/link) error = %v, want %v", err, syscall.EXDEV)
+	}
+	if err := b.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"/escape/pwned.txt", "/../pwned.txt"} {
+		archive := createTestArchive(t,
+			testEntry{hdr: tar.Header{Name: name, Typeflag: tar.TypeReg}, body: "pwned"},
+		)
+		_, err := extractCacheArchive(archive, extractOptions{Root: root, ConfineRoot: true})
+		if _, ok := err.(*confinementError); !ok {
+			t.Errorf("%s: extractCacheArchive() error = %v, want confinement error", name, err)
+		}
+	}
+	if entries, err := ioutil.ReadDir(outside); err != nil || len(entries) > 0 {
+		t.Errorf("files written outside the root: %v, %v", entries, err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(root), "pwned.txt")); !os.IsNotExist(err) {
+		t.Errorf("file written to the root's parent: %v", err)
+	}
+}
+
+func TestExtractConfined(t *testing.T) {
+	root := t.TempDir()
+	outside := filepath.Join(t.TempDir(), "outside.txt")
+	if err := ioutil.WriteFile(outside, []byte("outside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "cache"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// an existing symlink at a file entry's path is replaced, not written through
+	if err := os.Symlink(outside, filepath.Join(root, "cache", "File.txt")); err != nil {
+		t.Fatal(err)
+	}
+	openBeneathRoot(t, root).close()
+
+	archive := createTestArchive(t,
+		testEntry{hdr: tar.Header{Name: "/cache/deep/dir", Typeflag: tar.TypeDir, Mode: 0700}},
+		testEntry{hdr: tar.Header{Name: "/cache/File.txt", Typeflag: tar.TypeReg, Mode: 0600}, body: "cache"},
+		testEntry{hdr: tar.Header{Name: "/cache/link", Typeflag: tar.TypeSymlink, Linkname: "deep"}},
+		testEntry{hdr: tar.Header{Name: "/cache/link/nested.txt", Typeflag: tar.TypeReg}, body: "nested"},
+		testEntry{hdr: tar.Header{Name: "/cache/hardlink.txt", Typeflag: tar.TypeLink, Linkname: "/cache/File.txt"}},
+	)
+	if _, err := extractCacheArchive(archive, extractOptions{Root: root, ConfineRoot: true}); err != nil {
+		t.Fatalf("extractCacheArchive() error = %v", err)
+	}
+
+	if b, err := ioutil.ReadFile(outside); err != nil || string(b) != "outside" {
+		t.Errorf("the symlink's target is modified: %q, %v", b, err)
+	}
+	info, err := os.Lstat(filepath.Join(root, "cache", "File.txt"))
+	if err != nil || !info.Mode().IsRegular() || info.Mode().Perm() != 0600 {
+		t.Errorf("File.txt = %v, %v, want a regular file with 0600 permissions", info, err)
+	}
+	if info, err := os.Stat(filepath.Join(root, "cache", "deep", "dir")); err != nil || !info.IsDir() {
+		t.Errorf("nested directory not created: %v", err)
+	}
+	// symlinks staying beneath the root are followed
+	if b, err := ioutil.ReadFile(filepath.Join(root, "cache", "deep", "nested.txt")); err != nil || string(b) != "nested" {
+		t.Errorf("file through the in-root symlink = %q, %v, want nested", b, err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(root, "cache", "hardlink.txt")); err != nil || string(b) != "cache" {
+		t.Errorf("hardlink = %q, %v, want cache", b, err)
+	}
+}
+
+func TestLexicalRoot_Escapes(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	l := lexicalRoot{root: root}
+
+	for _, name := range []string{"escape/pwned.txt", "../pwned.txt", "dir/../../pwned.txt"} {
+		if _, err := l.create(name, 0644); err == nil {
+			t.Errorf("create(%s) error = nil, want confinement error", name)
+		} else if _, ok := err.(*confinementError); !ok {
+			t.Errorf("create(%s) error = %v, want confinement error", name, err)
+		}
+	}
+	if entries, err := ioutil.ReadDir(outside); err != nil || len(entries) > 0 {
+		t.Errorf("files written outside the root: %v, %v", entries, err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// Handling of the archive's regular file entries, whose target path is an existing directory.
+const (
+	// dirConflictsFail fails the extraction.
+	dirConflictsFail = "fail"
+	// dirConflictsRemove removes the directory if it is empty, and extracts the file in its place.
+	dirConflictsRemove = "remove"
+	// dirConflictsSkip leaves the directory in place, and does not extract the file.
+	dirConflictsSkip = "skip"
+)
+
+// dirConflictError is returned if a regular file entry's target is a directory, which can not be replaced.
+type dirConflictError struct {
+	Path     string
+	NotEmpty bool
+}
+
+// Error implements the error interface.
+func (e *dirConflictError) Error() string {
+	if e.NotEmpty {
+		return fmt.Sprintf("%s is a non-empty directory, refusing to remove it to extract a regular file in its place", e.Path)
+	}
+	return fmt.Sprintf("%s is a directory, refusing to extract a regular file in its place", e.Path)
+}
+
+// resolveDirConflict handles the existing directory at a regular file entry's target path, with the given policy.
+// It reports whether the entry should be skipped.
+func resolveDirConflict(pth, policy string) (bool, error) {
+	switch policy {
+	case dirConflictsSkip:
+		log.Warnf("Skipping %s, it is an existing directory", pth)
+		return true, nil
+	case dirConflictsRemove:
+		entries, err := ioutil.ReadDir(pth)
+		if err != nil {
+			return false, err
+		}
+		if len(entries) > 0 {
+			return false, &dirConflictError{Path: pth, NotEmpty: true}
+		}
+		log.Debugf("removing the empty directory %s, to extract a file in its place", pth)
+		return false, os.Remove(pth)
+	default:
+		return false, &dirConflictError{Path: pth}
+	}
+}
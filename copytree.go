@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// copyResult is the summary of a directory tree copy.
+type copyResult struct {
+	Files     int // regular files and symlinks
+	Reflinked int
+	Skipped   int
+}
+
+// copyTree copies the directory tree under src into dst, preserving the file modes and modification times.
+// Directories already existing in dst are kept as they are.
+// Regular files are reflink-copied where the filesystem supports it, and copied otherwise.
+// The archive info file at the root of src is not copied.
+func copyTree(src, dst string) (copyResult, error) {
+	var result copyResult
+	var dirs []string
+
+	err := filepath.Walk(src, func(pth string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, pth)
+		if err != nil {
+			return err
+		}
+		if rel == archiveInfoFileName {
+			result.Skipped++
+			return nil
+		}
+		target := filepath.Join(dst, rel)
+
+		switch mode := info.Mode(); {
+		case mode.IsDir():
+			if fi, err := os.Stat(target); err == nil && fi.IsDir() {
+				// existing directories (like the filesystem root) keep their mode
+				return nil
+			}
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			// the mode and modification time are set after the directory's content is copied
+			dirs = append(dirs, rel)
+			return nil
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(pth)
+			if err != nil {
+				return err
+			}
+			if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			reflinked, err := copyFile(pth, target, mode.Perm())
+			if err != nil {
+				return err
+			}
+			if reflinked {
+				result.Reflinked++
+			}
+			if err := os.Chtimes(target, info.ModTime(), info.ModTime()); err != nil {
+				return err
+			}
+		default:
+			log.Warnf("Skipping %s, unsupported file type: %s", rel, mode.Type())
+			result.Skipped++
+			return nil
+		}
+
+		result.Files++
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		info, err := os.Stat(filepath.Join(src, dirs[i]))
+		if err != nil {
+			return result, err
+		}
+		target := filepath.Join(dst, dirs[i])
+		if err := os.Chmod(target, info.Mode().Perm()); err != nil {
+			return result, err
+		}
+		if err := os.Chtimes(target, info.ModTime(), info.ModTime()); err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// copyFile copies the regular file at src to dst, and reports whether the content was reflink-copied.
+func copyFile(src, dst string, perm os.FileMode) (bool, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err := in.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", src, err)
+		}
+	}()
+
+	// a read-only target can not be opened for writing, the mode is set once the content is copied
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return false, err
+	}
+
+	reflinked := true
+	if err := cloneFile(out, in); err != nil {
+		log.Debugf("reflink %s: %s, copying", src, err)
+		reflinked = false
+		if _, err := io.Copy(out, in); err != nil {
+			_ = out.Close()
+			return false, fmt.Errorf("failed to copy %s: %s", src, err)
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		return false, err
+	}
+	return reflinked, os.Chmod(dst, perm)
+}
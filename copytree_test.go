@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCopyTree(t *testing.T) {
+	src := t.TempDir()
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	if err := os.MkdirAll(filepath.Join(src, "Users/vagrant/.gradle"), 0755); err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+	if err := os.Mkdir(filepath.Join(src, "Users/vagrant/.m2"), 0700); err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+	files := map[string]string{
+		"Users/vagrant/.gradle/caches.bin": "caches",
+		"Users/vagrant/.gradle/gradlew":    "#!/bin/sh",
+		archiveInfoFileName:                `{"stack_id": "s1"}`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write file: %s", err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(src, "Users/vagrant/.gradle/gradlew"), 0755); err != nil {
+		t.Fatalf("failed to chmod: %s", err)
+	}
+	if err := os.Chtimes(filepath.Join(src, "Users/vagrant/.gradle/caches.bin"), modTime, modTime); err != nil {
+		t.Fatalf("failed to set modification time: %s", err)
+	}
+	if err := os.Symlink("caches.bin", filepath.Join(src, "Users/vagrant/.gradle/link")); err != nil {
+		t.Fatalf("failed to create symlink: %s", err)
+	}
+	// read-only source directory, like a shared cache volume
+	if err := os.Chmod(filepath.Join(src, "Users/vagrant"), 0555); err != nil {
+		t.Fatalf("failed to chmod: %s", err)
+	}
+
+	dst := t.TempDir()
+	// an existing read-only file is replaced
+	if err := os.MkdirAll(filepath.Join(dst, "Users/vagrant/.gradle"), 0755); err != nil {
+		t.Fatalf("failed to create dir: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dst, "Users/vagrant/.gradle/caches.bin"), []byte("old"), 0444); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+
+	result, err := copyTree(src, dst)
+	if err != nil {
+		t.Fatalf("copyTree() error = %v", err)
+	}
+	if result.Files != 3 || result.Skipped != 1 {
+		t.Errorf("copyTree() = %+v, want 3 files and 1 skipped", result)
+	}
+
+	for name, content := range files {
+		b, err := ioutil.ReadFile(filepath.Join(dst, name))
+		if name == archiveInfoFileName {
+			if !os.IsNotExist(err) {
+				t.Errorf("archive info file copied")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("failed to read copied file: %s", err)
+		}
+		if string(b) != content {
+			t.Errorf("%s content = %s, want %s", name, b, content)
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(dst, "Users/vagrant/.gradle/gradlew"))
+	if err != nil {
+		t.Fatalf("failed to stat: %s", err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("gradlew mode = %s, want %s", info.Mode().Perm(), os.FileMode(0755))
+	}
+
+	info, err = os.Stat(filepath.Join(dst, "Users/vagrant/.gradle/caches.bin"))
+	if err != nil {
+		t.Fatalf("failed to stat: %s", err)
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Errorf("caches.bin modification time = %s, want %s", info.ModTime(), modTime)
+	}
+
+	info, err = os.Stat(filepath.Join(dst, "Users/vagrant"))
+	if err != nil {
+		t.Fatalf("failed to stat: %s", err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("existing directory mode = %s, want %s", info.Mode().Perm(), os.FileMode(0755))
+	}
+
+	info, err = os.Stat(filepath.Join(dst, "Users/vagrant/.m2"))
+	if err != nil {
+		t.Fatalf("failed to stat: %s", err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("directory mode = %s, want %s", info.Mode().Perm(), os.FileMode(0700))
+	}
+
+	link, err := os.Readlink(filepath.Join(dst, "Users/vagrant/.gradle/link"))
+	if err != nil {
+		t.Fatalf("failed to read symlink: %s", err)
+	}
+	if link != "caches.bin" {
+		t.Errorf("symlink target = %s, want caches.bin", link)
+	}
+}
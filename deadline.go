@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// deadlineExitCode is the exit code of a step aborted for exceeding its max_duration, the same as timeout(1)'s.
+const deadlineExitCode = 124
+
+// stepContext bounds the step's HTTP requests and extraction, it is canceled once the step exceeds its max_duration,
+// or it is interrupted.
+var stepContext = context.Background()
+
+// maxDuration is the step's time budget, 0 if it is not limited.
+var maxDuration time.Duration
+
+// deadlineGrace is how long the operations get to fail on the canceled stepContext, before the step is aborted anyway.
+// It covers the ones not watching the context, like a blocked tar process.
+var deadlineGrace = 5 * time.Second
+
+var (
+	deadlineMu       sync.Mutex
+	deadlineCleanups []func()
+)
+
+// startDeadline bounds the step by the duration: once it passes, the running operations are canceled,
+// and the step is aborted deadlineGrace later if it did not exit on its own by then.
+func startDeadline(d time.Duration) context.CancelFunc {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	stepContext = ctx
+	maxDuration = d
+	go func() {
+		<-ctx.Done()
+		if ctx.Err() != context.DeadlineExceeded {
+			return
+		}
+		time.Sleep(deadlineGrace)
+		exit(deadlineExitCode)
+	}()
+	return cancel
+}
+
+// deadlineExceeded reports whether the step exceeded its max_duration.
+func deadlineExceeded() bool {
+	return stepContext.Err() == context.DeadlineExceeded
+}
+
+// onDeadline registers a cleanup, run if the step is aborted for exceeding its max_duration, or by an interrupt.
+func onDeadline(cleanup func()) {
+	deadlineMu.Lock()
+	defer deadlineMu.Unlock()
+	deadlineCleanups = append(deadlineCleanups, cleanup)
+}
+
+// runDeadlineCleanups runs the registered cleanups, the last registered first.
+func runDeadlineCleanups() {
+	deadlineMu.Lock()
+	cleanups := deadlineCleanups
+	deadlineCleanups = nil
+	deadlineMu.Unlock()
+
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		cleanups[i]()
+	}
+}
+
+// contextReader fails the reads once the context is done, so a canceled extraction stops at its next read.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// Read implements the io.Reader interface.
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// sleepContext waits for the duration, or until the context is done. It reports whether the whole duration passed.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// withStepDeadline bounds stepContext by the timeout for the test.
+func withStepDeadline(t *testing.T, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	original := stepContext
+	stepContext = ctx
+	t.Cleanup(func() {
+		cancel()
+		stepContext = original
+	})
+}
+
+func TestExtractCacheArchive_Deadline(t *testing.T) {
+	// a huge entry, its content trickles in far slower than the deadline
+	archive := slowReader{r: hugeEntryArchive(t, "huge.bin", 1<<30), bytesPerSecond: 1024 * 1024}
+	withStepDeadline(t, 300*time.Millisecond)
+
+	start := time.Now()
+	_, err := extractCacheArchive(archive, extractOptions{Root: t.TempDir()})
+	if err == nil {
+		t.Fatalf("extractCacheArchive() error = nil, want the extraction aborted at the deadline")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("extractCacheArchive() returned after %s, want it aborted at the deadline", elapsed)
+	}
+	if !deadlineExceeded() {
+		t.Errorf("deadlineExceeded() = false, want true")
+	}
+}
+
+func TestDownloadCacheArchive_Deadline(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Length", "1048576")
+		for i := 0; i < 1024; i++ {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+			_, _ = w.Write(make([]byte, 1024))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer server.Close()
+	withStepDeadline(t, 300*time.Millisecond)
+
+	start := time.Now()
+	if _, err := downloadCacheArchive(newDownloadClient(false), server.URL, false, expectedChecksum{}); err == nil {
+		t.Fatalf("downloadCacheArchive() error = nil, want the download aborted at the deadline")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("downloadCacheArchive() returned after %s, want it aborted at the deadline", elapsed)
+	}
+	if requests != 1 {
+		t.Errorf("requests = %d, want 1: a request canceled at the deadline is not resumed or retried", requests)
+	}
+}
+
+func TestRunDeadlineCleanups(t *testing.T) {
+	var order []int
+	onDeadline(func() { order = append(order, 1) })
+	onDeadline(func() { order = append(order, 2) })
+	runDeadlineCleanups()
+	runDeadlineCleanups()
+
+	if len(order) != 2 || order[0] != 2 || order[1] != 1 {
+		t.Errorf("cleanups ran in order %v, want [2 1], once each", order)
+	}
+}
+
+func TestExtractConfined_Deadline(t *testing.T) {
+	withStepDeadline(t, 0)
+	archive := createTestArchive(t, testEntry{hdr: tar.Header{Name: "a.txt", Typeflag: tar.TypeReg}, body: "a"})
+
+	root := t.TempDir()
+	if err := extractConfined(archive, extractOptions{Root: root}, nil); err != context.DeadlineExceeded {
+		t.Errorf("extractConfined() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := os.Lstat(filepath.Join(root, "a.txt")); err == nil {
+		t.Errorf("a.txt extracted past the deadline")
+	}
+}
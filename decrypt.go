@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// Encrypted archive format:
+//
+//	magic "BCPE", version (1 byte)
+//	key id length (1 byte), key id
+//	nonce prefix (8 bytes)
+//	chunks: sealed length (4 bytes, big endian, the top bit marks the final chunk), AES-256-GCM sealed chunk
+//
+// Chunk i is sealed with the nonce prefix followed by i (4 bytes, big endian) as nonce,
+// and the final flag (1 byte) as additional data, so reordered or truncated chunks fail to open.
+const (
+	encryptedMagic   = "BCPE"
+	encryptedVersion = 1
+	noncePrefixSize  = 8
+	finalChunkFlag   = 1 << 31
+	// maxSealedChunkSize bounds the chunk allocation of a corrupt archive.
+	maxSealedChunkSize = 16*1024*1024 + 16
+)
+
+// decryptionKey is an AES-256 key and its id.
+type decryptionKey struct {
+	ID  string
+	Key []byte
+}
+
+// parseDecryptionKeys parses the newline separated list of `<key id>=<key>` keys, the 32 bytes keys are base64 or hex encoded.
+func parseDecryptionKeys(list string) ([]decryptionKey, error) {
+	var keys []decryptionKey
+	for _, item := range splitList(list) {
+		i := strings.Index(item, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid decryption key, <key id>=<base64 or hex key> expected")
+		}
+		id := strings.TrimSpace(item[:i])
+		key, err := decodeKey(strings.TrimSpace(item[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid decryption key (%s): %s", id, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("invalid decryption key (%s): %d bytes, 32 bytes expected", id, len(key))
+		}
+		keys = append(keys, decryptionKey{ID: id, Key: key})
+	}
+	return keys, nil
+}
+
+// decodeKey decodes the hex or base64 encoded key: a 32 bytes key is 64 characters hex encoded, and 44 base64 encoded.
+func decodeKey(encoded string) ([]byte, error) {
+	if len(encoded) == 64 {
+		if key, err := hex.DecodeString(encoded); err == nil {
+			return key, nil
+		}
+	}
+	return base64.StdEncoding.DecodeString(encoded)
+}
+
+// encryptedHeader is the header of an encrypted archive.
+type encryptedHeader struct {
+	KeyID       string
+	NoncePrefix []byte
+}
+
+// readEncryptedHeader reads the encrypted archive header following the magic and version bytes.
+func readEncryptedHeader(r io.Reader) (encryptedHeader, error) {
+	var idLen [1]byte
+	if _, err := io.ReadFull(r, idLen[:]); err != nil {
+		return encryptedHeader{}, err
+	}
+	id := make([]byte, idLen[0])
+	if _, err := io.ReadFull(r, id); err != nil {
+		return encryptedHeader{}, err
+	}
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return encryptedHeader{}, err
+	}
+	return encryptedHeader{KeyID: string(id), NoncePrefix: prefix}, nil
+}
+
+// decryptReader decrypts the chunks of an encrypted archive.
+type decryptReader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	prefix []byte
+
+	counter uint32
+	buff    []byte
+	final   bool
+	err     error
+}
+
+// newDecryptReader returns a reader of the decrypted archive, and the id of the key which decrypts it.
+// The key with the archive's key id is tried first, then the rest of the keys, so a key rotated under a different id still works.
+// Not encrypted archives are returned as they are, with an empty key id.
+func newDecryptReader(r io.Reader, keys []decryptionKey) (io.Reader, string, error) {
+	magic := make([]byte, len(encryptedMagic)+1)
+	n, err := io.ReadFull(r, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, "", err
+	}
+	if n < len(magic) || string(magic[:len(encryptedMagic)]) != encryptedMagic {
+		return io.MultiReader(bytes.NewReader(magic[:n]), r), "", nil
+	}
+	if magic[len(encryptedMagic)] != encryptedVersion {
+		return nil, "", fmt.Errorf("unsupported encrypted archive version: %d", magic[len(encryptedMagic)])
+	}
+	if len(keys) == 0 {
+		return nil, "", errors.New("cache archive is encrypted, but no decryption key is provided")
+	}
+
+	hdr, err := readEncryptedHeader(r)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read encrypted archive header: %s", err)
+	}
+
+	sorted := make([]decryptionKey, 0, len(keys))
+	for _, key := range keys {
+		if key.ID == hdr.KeyID {
+			sorted = append([]decryptionKey{key}, sorted...)
+		} else {
+			sorted = append(sorted, key)
+		}
+	}
+
+	// the first chunk is read once, and opened with each key until one works
+	length, sealed, err := readSealedChunk(r)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read encrypted archive: %s", err)
+	}
+	for _, key := range sorted {
+		block, err := aes.NewCipher(key.Key)
+		if err != nil {
+			return nil, "", err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, "", err
+		}
+
+		d := &decryptReader{r: r, aead: aead, prefix: hdr.NoncePrefix}
+		// a failed open clears its output, each key gets its own copy of the chunk
+		if err := d.open(length, append([]byte(nil), sealed...)); err != nil {
+			continue
+		}
+		return d, key.ID, nil
+	}
+	return nil, "", fmt.Errorf("none of the %d decryption keys decrypts the cache archive (key id: %s)", len(keys), hdr.KeyID)
+}
+
+// readSealedChunk reads the next chunk's length field and sealed data.
+func readSealedChunk(r io.Reader) (uint32, []byte, error) {
+	var lengthField [4]byte
+	if _, err := io.ReadFull(r, lengthField[:]); err != nil {
+		if err == io.EOF {
+			return 0, nil, errors.New("encrypted archive is truncated")
+		}
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(lengthField[:])
+	size := length &^ finalChunkFlag
+	if size > maxSealedChunkSize {
+		return 0, nil, fmt.Errorf("invalid encrypted chunk size: %d", size)
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(r, sealed); err != nil {
+		return 0, nil, err
+	}
+	return length, sealed, nil
+}
+
+// open decrypts a sealed chunk into the reader's buffer.
+func (d *decryptReader) open(length uint32, sealed []byte) error {
+	nonce := make([]byte, d.aead.NonceSize())
+	copy(nonce, d.prefix)
+	binary.BigEndian.PutUint32(nonce[len(nonce)-4:], d.counter)
+
+	final := length&finalChunkFlag != 0
+	ad := []byte{0}
+	if final {
+		ad[0] = 1
+	}
+
+	plain, err := d.aead.Open(sealed[:0], nonce, sealed, ad)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt chunk %d: %s", d.counter, err)
+	}
+	d.buff = plain
+	d.final = final
+	d.counter++
+	return nil
+}
+
+// Read implements the io.Reader interface.
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buff) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.final {
+			return 0, io.EOF
+		}
+		length, sealed, err := readSealedChunk(d.r)
+		if err == nil {
+			err = d.open(length, sealed)
+		}
+		if err != nil {
+			d.err = err
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.buff)
+	d.buff = d.buff[n:]
+	return n, nil
+}
+
+// decryptArchiveFile decrypts the encrypted archive file at pth to a new file, and returns the decrypted file's path.
+// Not encrypted archive files are not copied, their path is returned.
+func decryptArchiveFile(pth string, keys []decryptionKey) (string, error) {
+	in, err := os.Open(pth)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := in.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", pth, err)
+		}
+	}()
+
+	r, keyID, err := newDecryptReader(in, keys)
+	if err != nil {
+		return "", err
+	}
+	if keyID == "" {
+		return pth, nil
+	}
+
+	decryptedPth := strings.TrimSuffix(pth, filepath.Ext(pth)) + ".decrypted.tar"
+	out, err := os.Create(decryptedPth)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(out, r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt cache archive: %s", err)
+	}
+	return decryptedPth, nil
+}
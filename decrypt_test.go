@@ -0,0 +1,191 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// encryptArchive encrypts the archive in the encrypted archive format, in chunks of the given size.
+func encryptArchive(t *testing.T, archive []byte, keyID string, key []byte, chunkSize int) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("failed to create cipher: %s", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatalf("failed to create AEAD: %s", err)
+	}
+
+	var buff bytes.Buffer
+	buff.WriteString(encryptedMagic)
+	buff.WriteByte(encryptedVersion)
+	buff.WriteByte(byte(len(keyID)))
+	buff.WriteString(keyID)
+	prefix := []byte("noncepfx")
+	buff.Write(prefix)
+
+	for i := 0; ; i++ {
+		chunk := archive
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		archive = archive[len(chunk):]
+		final := len(archive) == 0
+
+		nonce := make([]byte, aead.NonceSize())
+		copy(nonce, prefix)
+		binary.BigEndian.PutUint32(nonce[len(nonce)-4:], uint32(i))
+		ad := []byte{0}
+		if final {
+			ad[0] = 1
+		}
+		sealed := aead.Seal(nil, nonce, chunk, ad)
+
+		length := uint32(len(sealed))
+		if final {
+			length |= finalChunkFlag
+		}
+		var lengthField [4]byte
+		binary.BigEndian.PutUint32(lengthField[:], length)
+		buff.Write(lengthField[:])
+		buff.Write(sealed)
+
+		if final {
+			return buff.Bytes()
+		}
+	}
+}
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestParseDecryptionKeys(t *testing.T) {
+	keys, err := parseDecryptionKeys("old=" + base64.StdEncoding.EncodeToString(testKey(1)) + "\n\n new = " + base64.StdEncoding.EncodeToString(testKey(2)) + "\n")
+	if err != nil {
+		t.Fatalf("parseDecryptionKeys() error = %v", err)
+	}
+	if len(keys) != 2 || keys[0].ID != "old" || keys[1].ID != "new" || !bytes.Equal(keys[1].Key, testKey(2)) {
+		t.Errorf("parseDecryptionKeys() = %+v", keys)
+	}
+
+	keys, err = parseDecryptionKeys("hex=" + hex.EncodeToString(testKey(3)))
+	if err != nil || len(keys) != 1 || !bytes.Equal(keys[0].Key, testKey(3)) {
+		t.Errorf("parseDecryptionKeys() hex key = %+v, %v", keys, err)
+	}
+
+	for _, invalid := range []string{"nokey", "shorthex=" + hex.EncodeToString([]byte("key")), "=" + base64.StdEncoding.EncodeToString(testKey(1)), "short=" + base64.StdEncoding.EncodeToString([]byte("key")), "bad=%%%"} {
+		if _, err := parseDecryptionKeys(invalid); err == nil {
+			t.Errorf("parseDecryptionKeys(%s) error = nil, want error", invalid)
+		}
+	}
+}
+
+func TestNewDecryptReader(t *testing.T) {
+	archive := createTestArchive(t, testEntry{hdr: tar.Header{Name: "File.txt", Typeflag: tar.TypeReg}, body: strings.Repeat("test", 1000)}).Bytes()
+	keys := []decryptionKey{{ID: "key-1", Key: testKey(1)}, {ID: "key-2", Key: testKey(2)}}
+
+	t.Log("encrypted under the second key")
+	{
+		encrypted := encryptArchive(t, archive, "key-2", testKey(2), 1000)
+		r, keyID, err := newDecryptReader(bytes.NewReader(encrypted), keys)
+		if err != nil {
+			t.Fatalf("newDecryptReader() error = %v", err)
+		}
+		if keyID != "key-2" {
+			t.Errorf("newDecryptReader() key id = %s, want key-2", keyID)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("failed to read decrypted archive: %s", err)
+		}
+		if !bytes.Equal(b, archive) {
+			t.Errorf("decrypted archive differs from the original")
+		}
+	}
+
+	t.Log("key rotated under a different id")
+	{
+		encrypted := encryptArchive(t, archive, "key-0", testKey(2), 1000)
+		r, keyID, err := newDecryptReader(bytes.NewReader(encrypted), keys)
+		if err != nil {
+			t.Fatalf("newDecryptReader() error = %v", err)
+		}
+		if keyID != "key-2" {
+			t.Errorf("newDecryptReader() key id = %s, want key-2", keyID)
+		}
+		if b, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(b, archive) {
+			t.Errorf("failed to decrypt archive: %v", err)
+		}
+	}
+
+	t.Log("none of the keys")
+	{
+		encrypted := encryptArchive(t, archive, "key-3", testKey(3), 1000)
+		if _, _, err := newDecryptReader(bytes.NewReader(encrypted), keys); err == nil {
+			t.Errorf("newDecryptReader() error = nil, want error")
+		}
+		if _, _, err := newDecryptReader(bytes.NewReader(encrypted), nil); err == nil {
+			t.Errorf("newDecryptReader() without keys error = nil, want error")
+		}
+	}
+
+	t.Log("truncated archive")
+	{
+		encrypted := encryptArchive(t, archive, "key-1", testKey(1), 1000)
+		// drop the final chunk
+		truncated := encrypted[:len(encrypted)-(len(archive)%1000+16+4)]
+		r, _, err := newDecryptReader(bytes.NewReader(truncated), keys)
+		if err != nil {
+			t.Fatalf("newDecryptReader() error = %v", err)
+		}
+		if _, err := ioutil.ReadAll(r); err == nil {
+			t.Errorf("reading a truncated archive error = nil, want error")
+		}
+	}
+
+	t.Log("not encrypted archive")
+	{
+		r, keyID, err := newDecryptReader(bytes.NewReader(archive), keys)
+		if err != nil {
+			t.Fatalf("newDecryptReader() error = %v", err)
+		}
+		if keyID != "" {
+			t.Errorf("newDecryptReader() key id = %s, want empty", keyID)
+		}
+		if b, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(b, archive) {
+			t.Errorf("not encrypted archive changed: %v", err)
+		}
+	}
+}
+
+func TestDecryptArchiveFile(t *testing.T) {
+	archive := createTestArchive(t, testEntry{hdr: tar.Header{Name: "File.txt", Typeflag: tar.TypeReg}, body: "test"}).Bytes()
+	keys := []decryptionKey{{ID: "key-1", Key: testKey(1)}, {ID: "key-2", Key: testKey(2)}}
+
+	pth := filepath.Join(t.TempDir(), "cache-archive.tar")
+	if err := ioutil.WriteFile(pth, encryptArchive(t, archive, "key-2", testKey(2), 1000), 0644); err != nil {
+		t.Fatalf("failed to write archive: %s", err)
+	}
+
+	decryptedPth, err := decryptArchiveFile(pth, keys)
+	if err != nil {
+		t.Fatalf("decryptArchiveFile() error = %v", err)
+	}
+	b, err := ioutil.ReadFile(decryptedPth)
+	if err != nil {
+		t.Fatalf("failed to read decrypted archive: %s", err)
+	}
+	if !bytes.Equal(b, archive) {
+		t.Errorf("decrypted archive differs from the original")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// maxLoggedDiffEntries is the number of entries logged per diff category, the rest is only counted.
+const maxLoggedDiffEntries = 20
+
+// indexDiff is the difference between the indexes of two restored archives.
+type indexDiff struct {
+	Added   []string
+	Removed []string
+	Changed []string
+}
+
+// diffIndexes compares the index of the previously restored archive with the current one, by entry name, type and size.
+// The archive's metadata entry is ignored.
+func diffIndexes(previous, current archiveIndex) indexDiff {
+	var diff indexDiff
+	for name, entry := range current {
+		if entry.Metadata {
+			continue
+		}
+		prev, ok := previous[name]
+		if !ok {
+			diff.Added = append(diff.Added, name)
+		} else if prev.Typeflag != entry.Typeflag || prev.Size != entry.Size {
+			diff.Changed = append(diff.Changed, name)
+		}
+	}
+	for name, entry := range previous {
+		if entry.Metadata {
+			continue
+		}
+		if _, ok := current[name]; !ok {
+			diff.Removed = append(diff.Removed, name)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+	return diff
+}
+
+// logIndexDiff logs the diff's entries.
+func logIndexDiff(diff indexDiff) {
+	log.Printf("%d entries added, %d removed, %d changed since the previous restore", len(diff.Added), len(diff.Removed), len(diff.Changed))
+
+	logEntries := func(prefix string, names []string) {
+		for i, name := range names {
+			if i == maxLoggedDiffEntries {
+				log.Printf("%s ... and %d more", prefix, len(names)-i)
+				return
+			}
+			log.Printf("%s %s", prefix, name)
+		}
+	}
+	logEntries("+", diff.Added)
+	logEntries("-", diff.Removed)
+	logEntries("~", diff.Changed)
+}
+
+// cacheIndexPath returns the path where the index of the restored archive is kept between builds.
+func cacheIndexPath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "steps-cache-pull", "index.json"), nil
+}
+
+// readIndexFile reads the index written by a previous restore, it returns nil if there is none.
+func readIndexFile(pth string) (archiveIndex, error) {
+	b, err := ioutil.ReadFile(pth)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var index archiveIndex
+	if err := json.Unmarshal(b, &index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// indexArchiveFile indexes the downloaded archive file before it is extracted, decrypted by the keys, for the diff against the previous restore.
+func indexArchiveFile(pth string, keys []decryptionKey) (archiveIndex, error) {
+	if isZip, err := isZipFile(pth); err != nil {
+		return nil, err
+	} else if isZip {
+		return nil, fmt.Errorf("a zip archive is not indexed")
+	}
+
+	f, err := os.Open(pth)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	r, _, err := newDecryptReader(f, keys)
+	if err != nil {
+		return nil, err
+	}
+	archive, zstd, err := decompressStream(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+	if zstd != nil {
+		defer func() { _ = zstd.Close() }()
+	}
+	return indexArchive(archive, false, nil)
+}
+
+// writeIndexFile writes the index of the restored archive to the given path.
+func writeIndexFile(pth string, index archiveIndex) error {
+	b, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(pth), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(pth, b, 0644)
+}
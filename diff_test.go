@@ -0,0 +1,98 @@
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiffIndexes(t *testing.T) {
+	previous := archiveIndex{
+		"/Users/vagrant/.gradle/caches/a.jar": {Typeflag: tar.TypeReg, Size: 10},
+		"/Users/vagrant/.gradle/caches/b.jar": {Typeflag: tar.TypeReg, Size: 20},
+		"/Users/vagrant/.gradle/caches/c.jar": {Typeflag: tar.TypeReg, Size: 30},
+		"/Users/vagrant/.gradle/caches/d":     {Typeflag: tar.TypeReg, Size: 0},
+		"/tmp/" + archiveInfoFileName:         {Typeflag: tar.TypeReg, Size: 20, Metadata: true},
+	}
+	current := archiveIndex{
+		"/Users/vagrant/.gradle/caches/a.jar": {Typeflag: tar.TypeReg, Size: 10},
+		"/Users/vagrant/.gradle/caches/b.jar": {Typeflag: tar.TypeReg, Size: 25},
+		"/Users/vagrant/.gradle/caches/d":     {Typeflag: tar.TypeDir, Size: 0},
+		"/Users/vagrant/.gradle/caches/e.jar": {Typeflag: tar.TypeReg, Size: 50},
+		"/tmp/" + archiveInfoFileName:         {Typeflag: tar.TypeReg, Size: 40, Metadata: true},
+	}
+
+	want := indexDiff{
+		Added:   []string{"/Users/vagrant/.gradle/caches/e.jar"},
+		Removed: []string{"/Users/vagrant/.gradle/caches/c.jar"},
+		Changed: []string{"/Users/vagrant/.gradle/caches/b.jar", "/Users/vagrant/.gradle/caches/d"},
+	}
+	if got := diffIndexes(previous, current); !reflect.DeepEqual(got, want) {
+		t.Errorf("diffIndexes() = %+v, want %+v", got, want)
+	}
+
+	if got := diffIndexes(current, current); !reflect.DeepEqual(got, indexDiff{}) {
+		t.Errorf("diffIndexes() of the same index = %+v, want empty diff", got)
+	}
+}
+
+func TestIndexFile(t *testing.T) {
+	pth := filepath.Join(t.TempDir(), "steps-cache-pull", "index.json")
+
+	index, err := readIndexFile(pth)
+	if err != nil {
+		t.Fatalf("readIndexFile() error = %v", err)
+	}
+	if index != nil {
+		t.Errorf("readIndexFile() = %v, want nil for a missing index", index)
+	}
+
+	want := archiveIndex{"/Users/vagrant/.gradle": {Typeflag: tar.TypeDir}, "/Users/vagrant/.gradle/a.jar": {Typeflag: tar.TypeReg, Size: 10}}
+	if err := writeIndexFile(pth, want); err != nil {
+		t.Fatalf("writeIndexFile() error = %v", err)
+	}
+	index, err = readIndexFile(pth)
+	if err != nil {
+		t.Fatalf("readIndexFile() error = %v", err)
+	}
+	if !reflect.DeepEqual(index, want) {
+		t.Errorf("readIndexFile() = %v, want %v", index, want)
+	}
+}
+
+func TestIndexArchiveFile(t *testing.T) {
+	archive := createTestArchive(t,
+		testEntry{hdr: tar.Header{Name: "/tmp/" + archiveInfoFileName, Typeflag: tar.TypeReg}, body: `{"stack_id":"osx"}`},
+		testEntry{hdr: tar.Header{Name: "/Users/vagrant/.gradle/", Typeflag: tar.TypeDir}},
+		testEntry{hdr: tar.Header{Name: "/Users/vagrant/.gradle/a.jar", Typeflag: tar.TypeReg}, body: "0123456789"},
+	)
+	pth := filepath.Join(t.TempDir(), "archive.tar")
+	if err := ioutil.WriteFile(pth, archive.Bytes(), 0644); err != nil {
+		t.Fatalf("failed to write archive: %s", err)
+	}
+
+	index, err := indexArchiveFile(pth, nil)
+	if err != nil {
+		t.Fatalf("indexArchiveFile() error = %v", err)
+	}
+	want := archiveIndex{
+		"/tmp/" + archiveInfoFileName:  {Typeflag: tar.TypeReg, Size: 18, Metadata: true},
+		"/Users/vagrant/.gradle/":      {Typeflag: tar.TypeDir},
+		"/Users/vagrant/.gradle/a.jar": {Typeflag: tar.TypeReg, Size: 10},
+	}
+	for name, entry := range index {
+		// the index is read from a file, not while tar extracts it
+		entry.Duration = 0
+		index[name] = entry
+	}
+	if !reflect.DeepEqual(index, want) {
+		t.Errorf("indexArchiveFile() = %v, want %v", index, want)
+	}
+
+	previous := archiveIndex{"/Users/vagrant/.gradle/": {Typeflag: tar.TypeDir}}
+	if got := diffIndexes(previous, index); !reflect.DeepEqual(got.Added, []string{"/Users/vagrant/.gradle/a.jar"}) {
+		t.Errorf("diffIndexes() added = %v, want the archive's new file", got.Added)
+	}
+}
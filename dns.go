@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// dnsRetries is the number of times a dial failing on a temporary DNS resolution error is retried.
+var dnsRetries = 3
+
+// dnsRetryWait is the wait before retrying a failed DNS resolution, multiplied by the number of failed attempts.
+// DNS usually recovers quickly, so it is shorter than the other retries' waits.
+var dnsRetryWait = 500 * time.Millisecond
+
+// isTemporaryDNSError reports whether the error is a temporary (or timed out) DNS resolution error.
+func isTemporaryDNSError(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && (dnsErr.IsTemporary || dnsErr.IsTimeout)
+}
+
+// dnsRetryDialer retries the dials failing on a temporary DNS resolution error,
+// other connection errors are returned as they are.
+type dnsRetryDialer struct {
+	dial    func(ctx context.Context, network, addr string) (net.Conn, error)
+	retries int
+	wait    time.Duration
+}
+
+// newDNSRetryDialer creates a dialer with the default net.Dialer settings, and the configured DNS retries.
+func newDNSRetryDialer() dnsRetryDialer {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return dnsRetryDialer{dial: dialer.DialContext, retries: dnsRetries, wait: dnsRetryWait}
+}
+
+// DialContext dials the address, retrying temporary DNS resolution errors.
+func (d dnsRetryDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	for attempt := 1; ; attempt++ {
+		conn, err := d.dial(ctx, network, addr)
+		if err == nil || !isTemporaryDNSError(err) || attempt > d.retries {
+			return conn, err
+		}
+
+		log.Warnf("Failed to resolve %s (attempt %d/%d): %s", addr, attempt, d.retries+1, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(attempt) * d.wait):
+		}
+	}
+}
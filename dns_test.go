@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDNSRetryDialer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	var dialer net.Dialer
+	tests := []struct {
+		name      string
+		failures  int
+		err       error
+		wantErr   bool
+		wantDials int
+	}{
+		{name: "temporary DNS errors", failures: 2, err: &net.DNSError{Err: "server misbehaving", Name: "cache", IsTemporary: true}, wantDials: 3},
+		{name: "DNS timeout", failures: 1, err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "i/o timeout", Name: "cache", IsTimeout: true}}, wantDials: 2},
+		{name: "too many DNS errors", failures: 5, err: &net.DNSError{Err: "server misbehaving", Name: "cache", IsTemporary: true}, wantErr: true, wantDials: 4},
+		{name: "not found is not retried", failures: 1, err: &net.DNSError{Err: "no such host", Name: "cache", IsNotFound: true}, wantErr: true, wantDials: 1},
+		{name: "connection error is not retried", failures: 1, err: errors.New("connection refused"), wantErr: true, wantDials: 1},
+	}
+	for _, tt := range tests {
+		dials := 0
+		d := dnsRetryDialer{
+			dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dials++
+				if dials <= tt.failures {
+					return nil, tt.err
+				}
+				return dialer.DialContext(ctx, network, addr)
+			},
+			retries: 3,
+			wait:    time.Millisecond,
+		}
+		client := &http.Client{Transport: &http.Transport{DialContext: d.DialContext}}
+
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: Get() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if dials != tt.wantDials {
+			t.Errorf("%s: %d dials, want %d", tt.name, dials, tt.wantDials)
+		}
+	}
+}
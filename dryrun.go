@@ -0,0 +1,41 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// listArchive logs the archive's entries read from r (their names, types and sizes), then the total file count
+// and uncompressed size, instead of extracting them. Nothing is written to the disk.
+// The metadata entry is not listed, unless it would be extracted.
+func listArchive(r io.Reader, opts extractOptions) error {
+	tr, err := newArchiveReader(r)
+	if err != nil {
+		return err
+	}
+
+	var files int
+	var size int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !opts.ExtractMetadata && isMetadataEntry(hdr.Name, opts.metadataName) {
+			continue
+		}
+
+		log.Printf("- %s: %s, %d bytes", hdr.Name, typeflagName(hdr.Typeflag), hdr.Size)
+		if hdr.Typeflag == tar.TypeReg {
+			files++
+			size += hdr.Size
+		}
+	}
+	log.Printf("dry run: %d files, %d bytes uncompressed, nothing extracted", files, size)
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtractCacheArchive_DryRun(t *testing.T) {
+	dir := t.TempDir()
+	entries := []testEntry{
+		{hdr: tar.Header{Name: archiveInfoFileName, Typeflag: tar.TypeReg}, body: `{"stack_id":"osx-xcode-14"}`},
+		{hdr: tar.Header{Name: filepath.Join(dir, "cache") + "/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: filepath.Join(dir, "cache/file.txt"), Typeflag: tar.TypeReg}, body: "content"},
+		{hdr: tar.Header{Name: filepath.Join(dir, "cache/link"), Typeflag: tar.TypeSymlink, Linkname: "file.txt"}},
+		{hdr: tar.Header{Name: filepath.Join(dir, "existing.txt"), Typeflag: tar.TypeReg}, body: "new"},
+	}
+	// an existing regular file target is a symlink, the follow mode would write through it
+	target := filepath.Join(t.TempDir(), "target.txt")
+	if err := ioutil.WriteFile(target, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, filepath.Join(dir, "existing.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []extractOptions{
+		{DryRun: true},
+		{DryRun: true, ExistingSymlinks: symlinksFollow, DirFileConflicts: dirConflictsRemove},
+		{DryRun: true, Root: t.TempDir(), ConfineRoot: true},
+		{DryRun: true, ExtractMetadata: true, MinFreeSpace: 1 << 62, FreeSpacePath: dir},
+	} {
+		result, err := extractCacheArchive(createTestArchive(t, entries...), opts)
+		if err != nil {
+			t.Fatalf("extractCacheArchive(%+v) error = %v", opts, err)
+		}
+		wantBytes := int64(len("content") + len("new"))
+		if opts.ExtractMetadata {
+			wantBytes += int64(len(entries[0].body))
+		}
+		if len(result.Index) != len(entries) || result.UncompressedBytes != wantBytes {
+			t.Errorf("%+v: %d entries indexed, %d bytes uncompressed, want %d and %d", opts, len(result.Index), result.UncompressedBytes, len(entries), wantBytes)
+		}
+
+		for _, pth := range []string{filepath.Join(dir, "cache"), filepath.Join(opts.Root, "cache"), filepath.Join(opts.Root, archiveInfoFileName)} {
+			if _, err := os.Lstat(pth); !os.IsNotExist(err) {
+				t.Errorf("%+v: %s written in a dry run", opts, pth)
+			}
+		}
+		if b, err := ioutil.ReadFile(target); err != nil || string(b) != "old" {
+			t.Errorf("%+v: symlink target = %q, %v, want it untouched", opts, b, err)
+		}
+	}
+}
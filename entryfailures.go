@@ -0,0 +1,106 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// Handling of the entries failed to extract and skipped with continue_on_error.
+const (
+	failedEntriesFail = "fail"
+	failedEntriesWarn = "warn"
+)
+
+// checkFailedEntries reports the entries skipped with continue_on_error, by the returned error with the fail policy,
+// by a warning with the warn policy.
+func checkFailedEntries(failed int, policy string) error {
+	if failed == 0 {
+		return nil
+	}
+	if policy == failedEntriesWarn {
+		log.Warnf("%d entries failed to extract, the cache was partially restored", failed)
+		return nil
+	}
+	return fmt.Errorf("%d entries failed to extract, the rest of the cache was restored", failed)
+}
+
+// entryFailures collects the entries the confined extraction failed to write and continued past, with continue_on_error.
+type entryFailures struct {
+	// metadata is the name of the archive's metadata entry, its failure is never skipped.
+	metadata string
+
+	mu     sync.Mutex
+	errors []entryError
+}
+
+// skip records the entry's failure, and reports whether the extraction continues past it.
+// The refused writes and the archive info entry's failure are not skipped, they fail the extraction.
+func (f *entryFailures) skip(hdr *tar.Header, err error) bool {
+	if f == nil || isMetadataEntry(hdr.Name, f.metadata) {
+		return false
+	}
+	if _, ok := confinedEntryError(hdr.Name, err).(*confinementError); ok {
+		return false
+	}
+	log.Warnf("Skipping %s: %s", hdr.Name, err)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errors = append(f.errors, entryError{Path: hdr.Name, Error: err.Error(), Typeflag: typeflagName(hdr.Typeflag)})
+	return true
+}
+
+// failed returns the skipped entries' failures.
+func (f *entryFailures) failed() []entryError {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.errors
+}
+
+// tarFailureSummaries are the tar tool's output lines closing an extraction which continued past failed entries,
+// and the ones only noting how the entries are extracted.
+var tarFailureSummaries = []string{
+	"tar: Exiting with failure status due to previous errors",
+	"tar: Error exit delayed from previous errors",
+	"tar: Removing leading",
+}
+
+// continuesPastFailures reports whether the tar tool's failure is only the failed entries it reported and extracted the rest past,
+// so the extraction succeeds with continue_on_error. The archive info entry's failure is not skipped.
+func continuesPastFailures(out string, result extractResult, opts extractOptions) bool {
+	if !opts.ContinueOnError || len(result.Errors) == 0 {
+		return false
+	}
+	for _, entryErr := range result.Errors {
+		if isMetadataEntry(entryErr.Path, opts.metadataName) {
+			return false
+		}
+	}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "tar: ") {
+			continue
+		}
+		if _, ok := parseTarError(line, result.Index); ok || isTarFailureSummary(line) {
+			continue
+		}
+		// like a truncated archive, the rest of it is not extracted
+		return false
+	}
+	return true
+}
+
+func isTarFailureSummary(line string) bool {
+	for _, summary := range tarFailureSummaries {
+		if strings.HasPrefix(line, summary) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// newBlockedRoot creates an extraction root with a regular file in place of the blocker directory,
+// so no entry can be written under it (the permissions would not stop root).
+func newBlockedRoot(t *testing.T) string {
+	root := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(root, "blocker"), []byte("file"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestExtractCacheArchive_ContinueOnError(t *testing.T) {
+	entries := []testEntry{
+		{hdr: tar.Header{Name: "blocker/unwritable.txt", Typeflag: tar.TypeReg, Mode: 0644}, body: "unwritable"},
+		{hdr: tar.Header{Name: "ok.txt", Typeflag: tar.TypeReg, Mode: 0644}, body: "ok"},
+	}
+	modes := []struct {
+		name string
+		opts extractOptions
+	}{
+		{name: "tar"},
+		{name: "confined", opts: extractOptions{ConfineRoot: true}},
+		{name: "confined parallel", opts: extractOptions{ConfineRoot: true, Concurrency: 4}},
+	}
+	for _, mode := range modes {
+		t.Log(mode.name)
+
+		root := newBlockedRoot(t)
+		opts := mode.opts
+		opts.Root = root
+		if _, err := extractCacheArchive(createTestArchive(t, entries...), opts); err == nil {
+			t.Errorf("extractCacheArchive() error = nil, want the unwritable entry failing the extraction")
+		}
+
+		root = newBlockedRoot(t)
+		opts.Root = root
+		opts.ContinueOnError = true
+		result, err := extractCacheArchive(createTestArchive(t, entries...), opts)
+		if err != nil {
+			t.Fatalf("extractCacheArchive() error = %v, want the unwritable entry skipped", err)
+		}
+		if len(result.Errors) != 1 || result.Errors[0].Path != "blocker/unwritable.txt" || result.Entries != 1 {
+			t.Errorf("extractCacheArchive() = %d entries, errors %+v, want 1 entry and the unwritable entry failed", result.Entries, result.Errors)
+		}
+		if content, err := ioutil.ReadFile(filepath.Join(root, "ok.txt")); err != nil || string(content) != "ok" {
+			t.Errorf("ok.txt = %q, %v, want the rest of the archive extracted", content, err)
+		}
+	}
+}
+
+func TestExtractCacheArchive_ContinueOnErrorArchiveInfo(t *testing.T) {
+	entries := []testEntry{
+		{hdr: tar.Header{Name: "blocker/" + archiveInfoFileName, Typeflag: tar.TypeReg, Mode: 0644}, body: `{"stack_id": "s1"}`},
+		{hdr: tar.Header{Name: "ok.txt", Typeflag: tar.TypeReg, Mode: 0644}, body: "ok"},
+	}
+	for _, confine := range []bool{false, true} {
+		opts := extractOptions{Root: newBlockedRoot(t), ExtractMetadata: true, ConfineRoot: confine, ContinueOnError: true}
+		if _, err := extractCacheArchive(createTestArchive(t, entries...), opts); err == nil {
+			t.Errorf("confined %t: extractCacheArchive() error = nil, want the archive info entry's failure fatal", confine)
+		}
+	}
+}
+
+func TestCheckFailedEntries(t *testing.T) {
+	if err := checkFailedEntries(0, failedEntriesFail); err != nil {
+		t.Errorf("checkFailedEntries(0) error = %v, want nil", err)
+	}
+	if err := checkFailedEntries(2, failedEntriesFail); err == nil {
+		t.Errorf("checkFailedEntries(2, fail) error = nil, want the failed entries reported")
+	}
+	if err := checkFailedEntries(2, failedEntriesWarn); err != nil {
+		t.Errorf("checkFailedEntries(2, warn) error = %v, want a warning only", err)
+	}
+}
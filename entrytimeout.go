@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// entryStallError is returned if the extraction did not read the archive for the entry timeout,
+// stuck writing an entry, like on a stalled network filesystem.
+type entryStallError struct {
+	Name    string
+	Timeout time.Duration
+}
+
+// Error implements the error interface.
+func (e *entryStallError) Error() string {
+	return fmt.Sprintf("the extraction stalled for %s writing %s (or an entry right before it), aborting", e.Timeout, e.Name)
+}
+
+// entryWatchdog passes the archive to the extraction, and reports a stall if the extraction did not come back for more of it
+// for the timeout: it is stuck writing an entry. The time spent waiting for the archive (the download) is not a stall,
+// and a large file written at any pace keeps reading the archive.
+type entryWatchdog struct {
+	r       io.Reader
+	timeout time.Duration
+
+	mu      sync.Mutex
+	reading bool
+	last    time.Time
+	entry   string
+}
+
+// newEntryWatchdog creates an entryWatchdog of the timeout.
+func newEntryWatchdog(r io.Reader, timeout time.Duration) *entryWatchdog {
+	return &entryWatchdog{r: r, timeout: timeout, last: time.Now()}
+}
+
+// Read implements the io.Reader interface.
+func (w *entryWatchdog) Read(p []byte) (int, error) {
+	w.mu.Lock()
+	w.reading = true
+	w.mu.Unlock()
+
+	n, err := w.r.Read(p)
+
+	w.mu.Lock()
+	w.reading = false
+	w.last = time.Now()
+	w.mu.Unlock()
+	return n, err
+}
+
+// setEntry records the entry the archive is read at, the one named by the stall.
+func (w *entryWatchdog) setEntry(name string) {
+	w.mu.Lock()
+	w.entry = name
+	w.mu.Unlock()
+}
+
+// stalled returns the stall's error, nil if the extraction is not stalled.
+func (w *entryWatchdog) stalled() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.reading || time.Since(w.last) < w.timeout {
+		return nil
+	}
+	return &entryStallError{Name: w.entry, Timeout: w.timeout}
+}
+
+// run runs the extraction, and returns its error, or the stall's error as soon as it stalls.
+// The stalled extraction is left behind, blocked on the filesystem: the step fails on the error.
+func (w *entryWatchdog) run(extract func() error) error {
+	done := make(chan error, 1)
+	go func() { done <- extract() }()
+
+	ticker := time.NewTicker(w.timeout / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-ticker.C:
+			if err := w.stalled(); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEntryWatchdog(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	content := bytes.Repeat([]byte("x"), 64)
+
+	t.Log("stuck writing an entry")
+	{
+		w := newEntryWatchdog(bytes.NewReader(content), timeout)
+		w.setEntry("dir/stuck.bin")
+		blocked := make(chan struct{})
+		defer close(blocked)
+		err := w.run(func() error {
+			_, _ = w.Read(make([]byte, 8))
+			<-blocked
+			return nil
+		})
+		stall, ok := err.(*entryStallError)
+		if !ok || stall.Name != "dir/stuck.bin" || !strings.Contains(err.Error(), "dir/stuck.bin") {
+			t.Fatalf("run() error = %v, want the stall of dir/stuck.bin", err)
+		}
+		if isFallbackError(err) {
+			t.Errorf("isFallbackError() = true, want false")
+		}
+	}
+
+	t.Log("slow but progressing write")
+	{
+		w := newEntryWatchdog(bytes.NewReader(content), timeout)
+		err := w.run(func() error {
+			buf := make([]byte, 8)
+			for {
+				if _, err := w.Read(buf); err == io.EOF {
+					return nil
+				}
+				time.Sleep(timeout / 3)
+			}
+		})
+		if err != nil {
+			t.Errorf("run() error = %v, want the slow write not stopped", err)
+		}
+	}
+
+	t.Log("slow download")
+	{
+		w := newEntryWatchdog(slowReader{r: bytes.NewReader(content), bytesPerSecond: 100}, timeout)
+		err := w.run(func() error {
+			_, err := io.Copy(ioutil.Discard, w)
+			return err
+		})
+		if err != nil {
+			t.Errorf("run() error = %v, want waiting for the archive not counted", err)
+		}
+	}
+}
+
+func TestExtractCacheArchive_EntryTimeout(t *testing.T) {
+	archive := createTestArchive(t, testEntry{hdr: tar.Header{Name: "file.txt", Typeflag: tar.TypeReg}, body: "content"})
+	result, err := extractCacheArchive(archive, extractOptions{Root: t.TempDir(), EntryTimeout: time.Second})
+	if err != nil || result.Entries != 1 {
+		t.Errorf("extractCacheArchive() = %d entries, %v, want the archive extracted", result.Entries, err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// transientExitCode is the exit code of the failures which might not happen again (network errors, timeouts, overloaded servers),
+// so an orchestrator can re-run the step. It defaults to EX_TEMPFAIL.
+var transientExitCode = 75
+
+// permanentExitCode is the exit code of the other failures (a corrupt archive, a refused authentication, an invalid input).
+var permanentExitCode = 1
+
+// statusError is returned if an HTTP request gets a non success response.
+type statusError struct {
+	StatusCode int
+	Body       string
+}
+
+// Error implements the error interface.
+func (e *statusError) Error() string {
+	return fmt.Sprintf("non success response code: %d, body: %s", e.StatusCode, e.Body)
+}
+
+// transientError marks a failure caused by a transient error, its message is the failure's.
+// The errors are wrapped with their context as strings, so the cause's type only survives in this marker.
+type transientError struct {
+	err error
+}
+
+// Error implements the error interface.
+func (e *transientError) Error() string {
+	return e.err.Error()
+}
+
+// withCause returns the failure err, marked as transient if its cause is transient.
+func withCause(err, cause error) error {
+	if isTransientError(cause) {
+		return &transientError{err: err}
+	}
+	return err
+}
+
+// isTransientError reports whether the step may succeed if it is re-run: the connection errors and timeouts,
+// and the 5xx and 429 responses are transient.
+func isTransientError(err error) bool {
+	var marked *transientError
+	if errors.As(err, &marked) {
+		return true
+	}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return isRetryableStatus(statusErr.StatusCode)
+	}
+	return errors.Is(err, context.DeadlineExceeded) || isConnectionError(err)
+}
+
+// exitCode returns the step's exit code for the failure.
+func exitCode(err error) int {
+	if isTransientError(err) {
+		return transientExitCode
+	}
+	return permanentExitCode
+}
+
+// failWithf prints an error and terminates the step, with the exit code of the failure's cause.
+func failWithf(cause error, format string, args ...interface{}) {
+	log.Errorf(format, args...)
+	stepTracer.rootSpan().setAttribute("error", fmt.Sprintf(format, args...))
+	stepSummary.setError(fmt.Sprintf(format, args...))
+	if isTransientError(cause) && !deadlineExceeded() {
+		log.Warnf("The failure is transient, re-running the step might succeed")
+	}
+	exit(exitCode(cause))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	defer func(retries int) { requestRetries = retries }(requestRetries)
+	requestRetries = 0
+	defer func(transient, permanent int) { transientExitCode, permanentExitCode = transient, permanent }(transientExitCode, permanentExitCode)
+	transientExitCode, permanentExitCode = 42, 3
+
+	var status int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	defer server.Close()
+	corrupt := filepath.Join(t.TempDir(), "corrupt.tar")
+	if err := ioutil.WriteFile(corrupt, []byte("not an archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	download := func(url string) func() error {
+		return func() error {
+			_, err := uncompressFallback(archiveSource{Client: http.DefaultClient, URI: url}, extractOptions{Root: t.TempDir()})
+			return err
+		}
+	}
+	api := func(url string) func() error {
+		return func() error {
+			_, err := getCacheDownloadURL(url, "download_url")
+			return err
+		}
+	}
+
+	tests := []struct {
+		name   string
+		status int
+		do     func() error
+		want   int
+	}{
+		{name: "api connection refused", do: api(closed.URL), want: 42},
+		{name: "api overloaded", status: http.StatusServiceUnavailable, do: api(server.URL), want: 42},
+		{name: "api unauthorized", status: http.StatusUnauthorized, do: api(server.URL), want: 3},
+		{name: "download connection refused", do: download(closed.URL), want: 42},
+		{name: "download rate limited", status: http.StatusTooManyRequests, do: download(server.URL), want: 42},
+		{name: "download forbidden", status: http.StatusForbidden, do: download(server.URL), want: 3},
+		{name: "corrupt archive", do: download("file://" + corrupt), want: 3},
+	}
+	for _, tt := range tests {
+		status = tt.status
+		err := tt.do()
+		if err == nil {
+			t.Fatalf("%s: error = nil, want a failure", tt.name)
+		}
+		if got := exitCode(err); got != tt.want {
+			t.Errorf("%s: exitCode(%v) = %d, want %d", tt.name, err, got, tt.want)
+		}
+	}
+
+	if got := exitCode(withCause(errors.New("extraction failed"), &statusError{StatusCode: http.StatusBadGateway})); got != 42 {
+		t.Errorf("exitCode() = %d, want the transient code of the marked failure", got)
+	}
+	if got := exitCode(&timeoutError{}); got != 42 {
+		t.Errorf("exitCode() = %d, want the transient code of a timeout", got)
+	}
+}
+
+// timeoutError is a net.Error timing out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The pull step features an archive can depend on, listed in the archive info's required_features by the push step.
+const (
+	featureGzip       = "gzip"
+	featureParts      = "parts"
+	featureEncryption = "encryption"
+	featureZip        = "zip"
+	featureZstd       = "zstd"
+)
+
+// Handling of the archive's required features, which are not available in the current step invocation.
+const (
+	featuresFail   = "fail"
+	featuresWarn   = "warn"
+	featuresIgnore = "ignore"
+)
+
+// missingFeature is a required feature of the archive, which is not available.
+type missingFeature struct {
+	Feature string
+	// Hint tells how to make the feature available.
+	Hint string
+}
+
+// missingFeaturesError is returned if the archive depends on features which are not available.
+type missingFeaturesError struct {
+	Missing []missingFeature
+}
+
+// Error implements the error interface.
+func (e *missingFeaturesError) Error() string {
+	var features []string
+	for _, missing := range e.Missing {
+		features = append(features, fmt.Sprintf("%s (%s)", missing.Feature, missing.Hint))
+	}
+	return fmt.Sprintf("cache archive requires features which are not available: %s", strings.Join(features, ", "))
+}
+
+// unavailableFeatures returns the hints of the known features, which are not available with the config.
+// The features missing from it are available.
+func unavailableFeatures(conf Config) map[string]string {
+	unavailable := map[string]string{}
+	if !zstdAvailable() {
+		unavailable[featureZstd] = "install the zstd tool"
+	}
+	if strings.TrimSpace(string(conf.DecryptionKeys)) == "" {
+		unavailable[featureEncryption] = "set decryption_keys to the archive's key"
+	}
+	if !conf.AcceptZip {
+		unavailable[featureZip] = "enable accept_zip"
+	}
+	return unavailable
+}
+
+// checkRequiredFeatures checks the archive's required features against the unavailable ones.
+// Unknown features are not available either, they were added by a newer push step.
+// An archive without metadata does not require any features.
+func checkRequiredFeatures(info *archiveInfo, unavailable map[string]string) error {
+	if info == nil {
+		return nil
+	}
+	known := map[string]bool{featureGzip: true, featureParts: true, featureEncryption: true, featureZip: true, featureZstd: true}
+
+	var missing []missingFeature
+	for _, feature := range info.RequiredFeatures {
+		if !known[feature] {
+			missing = append(missing, missingFeature{Feature: feature, Hint: "unknown feature, update the step to a newer version"})
+		} else if hint, ok := unavailable[feature]; ok {
+			missing = append(missing, missingFeature{Feature: feature, Hint: hint})
+		}
+	}
+	if len(missing) > 0 {
+		return &missingFeaturesError{Missing: missing}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckRequiredFeatures(t *testing.T) {
+	info, err := parseArchiveInfo([]byte(`{"stack_id": "osx", "required_features": ["gzip", "encryption", "zip"]}`))
+	if err != nil {
+		t.Fatalf("parseArchiveInfo() error = %v", err)
+	}
+
+	// satisfied
+	if err := checkRequiredFeatures(&info, unavailableFeatures(Config{DecryptionKeys: "key1=secret", AcceptZip: true})); err != nil {
+		t.Errorf("checkRequiredFeatures() error = %v, want the features available", err)
+	}
+	if err := checkRequiredFeatures(nil, unavailableFeatures(Config{})); err != nil {
+		t.Errorf("checkRequiredFeatures() error = %v, want no features required without archive info", err)
+	}
+
+	// missing
+	err = checkRequiredFeatures(&info, unavailableFeatures(Config{AcceptZip: true}))
+	featuresErr, ok := err.(*missingFeaturesError)
+	if !ok {
+		t.Fatalf("checkRequiredFeatures() error = %v, want a missing features error", err)
+	}
+	if want := []missingFeature{{Feature: featureEncryption, Hint: "set decryption_keys to the archive's key"}}; !reflect.DeepEqual(featuresErr.Missing, want) {
+		t.Errorf("Missing = %+v, want %+v", featuresErr.Missing, want)
+	}
+
+	// unsupported and unknown
+	defer func(tool string) { zstdTool = tool }(zstdTool)
+	zstdTool = "zstd-not-installed"
+	info.RequiredFeatures = []string{featureZstd, "teleportation"}
+	err = checkRequiredFeatures(&info, unavailableFeatures(Config{}))
+	if want := "cache archive requires features which are not available: zstd (install the zstd tool), teleportation (unknown feature, update the step to a newer version)"; err == nil || err.Error() != want {
+		t.Errorf("checkRequiredFeatures() error = %v, want %s", err, want)
+	}
+}
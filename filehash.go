@@ -0,0 +1,102 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// fileHashRecord is the PAX record the push step stores a regular file's hex encoded SHA-256 content hash in.
+const fileHashRecord = "BITRISE.sha256"
+
+// Handling of the regular files not matching their recorded content hash.
+const (
+	// verifyPerFileNone does not verify the files.
+	verifyPerFileNone = "none"
+	// verifyPerFileWarn removes the mismatching files, and reports them as failed entries.
+	verifyPerFileWarn = "warn"
+	// verifyPerFileFail removes the mismatching files, and fails the extraction.
+	verifyPerFileFail = "fail"
+)
+
+// fileHashError is returned if extracted files do not match their recorded content hash, and the extraction is configured to fail.
+type fileHashError struct {
+	Mismatches []entryError
+}
+
+// Error implements the error interface.
+func (e *fileHashError) Error() string {
+	return fmt.Sprintf("%d extracted files do not match their content hash, like %s", len(e.Mismatches), e.Mismatches[0].Path)
+}
+
+// verifyEntryHash hashes the entry's content read from r, and compares it to the entry's recorded hash.
+// It returns the mismatch's description, empty if the entry has no recorded hash or matches it.
+func verifyEntryHash(hdr *tar.Header, r io.Reader) (string, error) {
+	want := hdr.PAXRecords[fileHashRecord]
+	if hdr.Typeflag != tar.TypeReg || want == "" {
+		return "", nil
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != strings.ToLower(want) {
+		return fmt.Sprintf("content hash mismatch: sha256 %s, recorded %s", got, want), nil
+	}
+	return "", nil
+}
+
+// hashMismatches returns the indexed entries not matching their recorded content hash, sorted by name.
+func hashMismatches(index archiveIndex) []entryError {
+	var mismatches []entryError
+	for name, entry := range index {
+		if entry.HashMismatch != "" {
+			mismatches = append(mismatches, entryError{Path: name, Error: entry.HashMismatch, Typeflag: typeflagName(entry.Typeflag)})
+		}
+	}
+	sort.Slice(mismatches, func(i, j int) bool { return mismatches[i].Path < mismatches[j].Path })
+	return mismatches
+}
+
+// handleHashMismatches removes the extracted files not matching their recorded content hash, and reports them as failed entries.
+// A fileHashError is returned for the mismatches, if the extraction is configured to fail on them.
+func handleHashMismatches(result *extractResult, opts extractOptions) error {
+	if !opts.verifiesFiles() {
+		return nil
+	}
+	mismatches := hashMismatches(result.Index)
+	if len(mismatches) == 0 {
+		return nil
+	}
+
+	if opts.DryRun {
+		log.Warnf("%d archived files do not match their content hash", len(mismatches))
+	} else {
+		log.Warnf("%d extracted files do not match their content hash, removing them", len(mismatches))
+	}
+	for _, mismatch := range mismatches {
+		log.Warnf("- %s: %s", mismatch.Path, mismatch.Error)
+		if opts.DryRun {
+			continue
+		}
+		if err := os.Remove(entryTarget(mismatch.Path, opts.Root)); err != nil && !os.IsNotExist(err) {
+			log.Warnf("Failed to remove mismatching file: %s", err)
+		}
+	}
+	result.Errors = append(result.Errors, mismatches...)
+	if result.Entries -= len(mismatches); result.Entries < 0 {
+		result.Entries = 0
+	}
+
+	if opts.VerifyPerFile == verifyPerFileFail {
+		return &fileHashError{Mismatches: mismatches}
+	}
+	return nil
+}
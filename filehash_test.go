@@ -0,0 +1,62 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtractCacheArchive_VerifyPerFile(t *testing.T) {
+	hash := func(body string) map[string]string {
+		sum := sha256.Sum256([]byte(body))
+		return map[string]string{fileHashRecord: hex.EncodeToString(sum[:])}
+	}
+	entries := []testEntry{
+		{hdr: tar.Header{Name: "intact.txt", Typeflag: tar.TypeReg, PAXRecords: hash("intact")}, body: "intact"},
+		{hdr: tar.Header{Name: "tampered.txt", Typeflag: tar.TypeReg, PAXRecords: hash("original")}, body: "tampered"},
+		{hdr: tar.Header{Name: "unhashed.txt", Typeflag: tar.TypeReg}, body: "unhashed"},
+	}
+
+	for _, policy := range []string{verifyPerFileNone, verifyPerFileWarn, verifyPerFileFail} {
+		t.Run(policy, func(t *testing.T) {
+			root := t.TempDir()
+			result, err := extractCacheArchive(createTestArchive(t, entries...), extractOptions{Root: root, VerifyPerFile: policy})
+
+			if policy == verifyPerFileFail {
+				hashErr, ok := err.(*fileHashError)
+				if !ok {
+					t.Fatalf("extractCacheArchive() error = %v, want a content hash error", err)
+				}
+				if len(hashErr.Mismatches) != 1 || hashErr.Mismatches[0].Path != "tampered.txt" {
+					t.Errorf("Mismatches = %v, want tampered.txt", hashErr.Mismatches)
+				}
+			} else if err != nil {
+				t.Fatalf("extractCacheArchive() error = %v", err)
+			}
+
+			_, statErr := os.Stat(filepath.Join(root, "tampered.txt"))
+			if policy == verifyPerFileNone {
+				if statErr != nil || result.Entries != 3 || len(result.Errors) != 0 {
+					t.Errorf("tampered file not kept without verification: %v, %d entries, errors: %v", statErr, result.Entries, result.Errors)
+				}
+			} else {
+				if !os.IsNotExist(statErr) {
+					t.Errorf("tampered file not removed: %v", statErr)
+				}
+				if result.Entries != 2 || len(result.Errors) != 1 || result.Errors[0].Path != "tampered.txt" {
+					t.Errorf("result = %d entries, errors: %v, want 2 entries and the tampered file failed", result.Entries, result.Errors)
+				}
+			}
+
+			for _, name := range []string{"intact.txt", "unhashed.txt"} {
+				if _, err := ioutil.ReadFile(filepath.Join(root, name)); err != nil {
+					t.Errorf("%s not extracted: %s", name, err)
+				}
+			}
+		})
+	}
+}
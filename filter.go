@@ -0,0 +1,269 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// pathFilter selects the archive's entries to extract, by glob patterns matched against the entries' paths.
+// An entry is extracted if it matches an include pattern (or there are none), and it does not match any exclude pattern.
+// The archive's metadata entry is never filtered, so the archive info is read the same way with or without the filter.
+type pathFilter struct {
+	include [][]string
+	exclude [][]string
+}
+
+// parsePathFilter parses the comma or newline separated include and exclude glob patterns, a nil filter is returned without patterns.
+func parsePathFilter(include, exclude string) (*pathFilter, error) {
+	var f pathFilter
+	var err error
+	if f.include, err = parsePatterns(include); err != nil {
+		return nil, fmt.Errorf("include_paths: %s", err)
+	}
+	if f.exclude, err = parsePatterns(exclude); err != nil {
+		return nil, fmt.Errorf("exclude_paths: %s", err)
+	}
+	if len(f.include) == 0 && len(f.exclude) == 0 {
+		return nil, nil
+	}
+	return &f, nil
+}
+
+func parsePatterns(list string) ([][]string, error) {
+	var patterns [][]string
+	for _, item := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == '\n' }) {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		components := splitEntryPath(item)
+		for _, component := range components {
+			if _, err := path.Match(component, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %s: %s", item, err)
+			}
+		}
+		patterns = append(patterns, components)
+	}
+	return patterns, nil
+}
+
+// splitEntryPath splits the cleaned path into its components, the leading / and ./ are dropped:
+// /Users/vagrant/.gradle, ./Users/vagrant/.gradle and Users/vagrant/.gradle are the same path.
+func splitEntryPath(pth string) []string {
+	pth = strings.Trim(path.Clean("/"+pth), "/")
+	if pth == "" {
+		return nil
+	}
+	return strings.Split(pth, "/")
+}
+
+// matches reports whether the entry of the given name is extracted.
+func (f *pathFilter) matches(name string) bool {
+	components := splitEntryPath(name)
+	if len(f.include) > 0 && !matchesAnyGlob(f.include, components) {
+		return false
+	}
+	return !matchesAnyGlob(f.exclude, components)
+}
+
+func matchesAnyGlob(patterns [][]string, name []string) bool {
+	for _, pattern := range patterns {
+		if matchGlob(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob reports whether the pattern matches the path, or one of its parent directories: a matching directory's content matches too.
+// A ** component matches any number of path components (zero too), the other components are matched by path.Match.
+func matchGlob(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return true
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchGlob(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], name[0])
+	return ok && matchGlob(pattern[1:], name[1:])
+}
+
+// stripComponents drops the first n components of the entry's path, like tar's --strip-components, the leading / is not a component.
+// It reports false for the entries of at most n components, they are skipped.
+func stripComponents(name string, n int) (string, bool) {
+	var components []string
+	for _, component := range strings.Split(name, "/") {
+		if component != "" && component != "." {
+			components = append(components, component)
+		}
+	}
+	if len(components) <= n {
+		return "", false
+	}
+	stripped := strings.Join(components[n:], "/")
+	if strings.HasSuffix(name, "/") {
+		stripped += "/"
+	}
+	return stripped, true
+}
+
+// filteredArchive streams the archive's entries selected by the filter, re-encoded as an uncompressed tar stream.
+// The regular files already existing identical to their entry (by the skip_existing_identical policy) are left out too.
+// The entries' paths are stripped of their leading components first, the filter matches the stripped paths.
+type filteredArchive struct {
+	filter    *pathFilter
+	identical string
+	root      string
+	strip     int
+	// metadata is the name of the archive's metadata entry, it is never filtered out or stripped.
+	metadata string
+	// writeSparse makes the sparse files written by the step, if tar extracts the stream.
+	writeSparse bool
+	// Written indexes the sparse files written by the step instead of tar, it is final once the stream is closed.
+	Written archiveIndex
+	// Skipped is the number of entries left out by the filter, it is final once the stream is closed.
+	Skipped int
+	// Identical indexes the entries left out because their files already exist identical, it is final once the stream is closed.
+	Identical archiveIndex
+
+	pr   *io.PipeReader
+	err  error
+	done chan struct{}
+}
+
+// newFilteredArchive starts streaming the entries of the archive read from r, which are selected by the options' filter (nil selects every entry),
+// and which are not identical to their existing file by the options' SkipIdentical policy.
+func newFilteredArchive(r io.Reader, opts extractOptions) *filteredArchive {
+	pr, pw := io.Pipe()
+	a := filteredArchive{
+		filter:   opts.Filter,
+		root:     opts.Root,
+		strip:    opts.StripComponents,
+		metadata: opts.metadataName,
+		// tar extracts the filtered stream, unless it is guarded too
+		writeSparse: !opts.guarded() && !opts.ConfineRoot && !opts.DryRun,
+		Identical:   archiveIndex{},
+		Written:     archiveIndex{},
+		pr:          pr,
+		done:        make(chan struct{}),
+	}
+	if opts.skipsIdentical() {
+		a.identical = opts.SkipIdentical
+	}
+	go func() {
+		defer close(a.done)
+		a.err = a.copyArchive(r, tar.NewWriter(pw))
+		_ = pw.CloseWithError(a.err)
+	}()
+	return &a
+}
+
+// Read implements the io.Reader interface.
+func (a *filteredArchive) Read(p []byte) (int, error) {
+	return a.pr.Read(p)
+}
+
+// close stops the streaming, and returns its error. A stream stopped before its end, because the extraction stopped, is not an error.
+func (a *filteredArchive) close() error {
+	_ = a.pr.Close()
+	<-a.done
+	if a.err == io.ErrClosedPipe {
+		return nil
+	}
+	return a.err
+}
+
+func (a *filteredArchive) copyArchive(r io.Reader, tw *tar.Writer) error {
+	counter := &countingReader{r: r}
+	tr, err := newArchiveReader(counter)
+	if err != nil {
+		return err
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF && counter.n == 0 {
+			return errEmptyArchive
+		}
+		if err == io.EOF {
+			return tw.Close()
+		}
+		if err != nil {
+			return err
+		}
+
+		normalizeSparseHeader(hdr)
+		if !a.stripHeader(hdr) {
+			a.Skipped++
+			continue
+		}
+		if a.filter != nil && !isMetadataEntry(hdr.Name, a.metadata) && !a.filter.matches(hdr.Name) {
+			a.Skipped++
+			continue
+		}
+		if a.filter != nil && hdr.Typeflag == tar.TypeLink && !a.filter.matches(hdr.Linkname) {
+			// the link's target is not extracted, there is nothing to link to
+			log.Debugf("skipping the hard link %s, its target %s is filtered out", hdr.Name, hdr.Linkname)
+			a.Skipped++
+			continue
+		}
+		// the hard links to an identical file are still written, they link to the existing file
+		if existingIdentical(hdr, a.root, a.identical) {
+			a.Identical[hdr.Name] = indexEntry{Typeflag: hdr.Typeflag, Size: hdr.Size}
+			continue
+		}
+
+		if a.writeSparse && hdr.Typeflag == tar.TypeReg && isSparseEntry(hdr) {
+			target := entryTarget(hdr.Name, a.root)
+			log.Debugf("writing the sparse file %s with its holes", target)
+			if err := writeSparseEntry(target, hdr, tr); err != nil {
+				return fmt.Errorf("failed to write %s: %s", target, err)
+			}
+			a.Written[hdr.Name] = indexEntry{Typeflag: hdr.Typeflag, Size: hdr.Size}
+			continue
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// stripHeader strips the entry's path, and a hard link's target, of the leading components.
+// It reports false for the entries left without a path, the archive's metadata entry is never stripped.
+func (a *filteredArchive) stripHeader(hdr *tar.Header) bool {
+	if a.strip <= 0 || isMetadataEntry(hdr.Name, a.metadata) {
+		return true
+	}
+	name, ok := stripComponents(hdr.Name, a.strip)
+	if !ok {
+		return false
+	}
+	if hdr.Typeflag == tar.TypeLink {
+		// the symlinks' targets are kept, like tar does
+		linkname, ok := stripComponents(hdr.Linkname, a.strip)
+		if !ok {
+			log.Debugf("skipping the hard link %s, its target %s is stripped", hdr.Name, hdr.Linkname)
+			return false
+		}
+		hdr.Linkname = linkname
+	}
+	hdr.Name = name
+	return true
+}
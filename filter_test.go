@@ -0,0 +1,269 @@
+package main
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParsePathFilter(t *testing.T) {
+	if filter, err := parsePathFilter("", " ,\n"); err != nil || filter != nil {
+		t.Errorf("parsePathFilter() = %v, %v, want a nil filter without patterns", filter, err)
+	}
+	if _, err := parsePathFilter("/a/[b", ""); err == nil {
+		t.Errorf("parsePathFilter() error = nil, want an invalid pattern error")
+	}
+
+	filter, err := parsePathFilter("/Users/vagrant/.gradle,\n ./Users/vagrant/.m2/ ", "**/*.lock")
+	if err != nil {
+		t.Fatalf("parsePathFilter() error = %v", err)
+	}
+	if len(filter.include) != 2 || len(filter.exclude) != 1 {
+		t.Errorf("parsePathFilter() = %d include, %d exclude patterns, want 2 and 1", len(filter.include), len(filter.exclude))
+	}
+}
+
+func TestPathFilter_Matches(t *testing.T) {
+	tests := []struct {
+		name    string
+		include string
+		exclude string
+		entries map[string]bool
+	}{
+		{
+			name:    "include directory",
+			include: "/Users/vagrant/.gradle",
+			entries: map[string]bool{
+				"/Users/vagrant/.gradle":                    true,
+				"/Users/vagrant/.gradle/caches/modules.bin": true,
+				"Users/vagrant/.gradle/wrapper/":            true,
+				"/Users/vagrant/.gradlew":                   false,
+				"/Users/vagrant/.m2/settings.xml":           false,
+			},
+		},
+		{
+			name:    "double star",
+			include: "**/build",
+			entries: map[string]bool{
+				"build/out.o":            true,
+				"/a/b/build/c/d.o":       true,
+				"/a/b/builder/c.o":       false,
+				"/a/b/build.gradle.kts":  false,
+				"/src/main/build-output": false,
+			},
+		},
+		{
+			name:    "double star in the middle",
+			include: "/ws/**/*.jar",
+			entries: map[string]bool{
+				"/ws/app.jar":        true,
+				"/ws/libs/a/lib.jar": true,
+				"/ws/libs/a/lib.aar": false,
+				"/other/lib.jar":     false,
+			},
+		},
+		{
+			name:    "exclude wins over an overlapping include",
+			include: "/Users/vagrant/.gradle",
+			exclude: "/Users/vagrant/.gradle/caches/**/*.lock, /Users/vagrant/.gradle/daemon",
+			entries: map[string]bool{
+				"/Users/vagrant/.gradle/caches/modules.bin":         true,
+				"/Users/vagrant/.gradle/caches/modules-2/a.lock":    false,
+				"/Users/vagrant/.gradle/caches/jars.lock":           false,
+				"/Users/vagrant/.gradle/daemon/8.0/daemon.log":      false,
+				"/Users/vagrant/.gradle/daemon-registry/registry.x": true,
+			},
+		},
+		{
+			name:    "include inside an excluded directory",
+			include: "/cache/keep/**",
+			exclude: "/cache",
+			entries: map[string]bool{
+				"/cache/keep/a.txt": false,
+				"/cache/drop/b.txt": false,
+			},
+		},
+		{
+			name:    "overlapping includes",
+			include: "/cache/*,\n/cache/nested/deep",
+			entries: map[string]bool{
+				"/cache/a.txt":             true,
+				"/cache/nested/deep/b.txt": true,
+				"/cache/nested/other.txt":  true,
+				"/other/a.txt":             false,
+			},
+		},
+		{
+			name:    "exclude only",
+			exclude: "*.tmp",
+			entries: map[string]bool{
+				"a.tmp":     false,
+				"/a/b.tmp":  true,
+				"/b.tmp":    false,
+				"/a/b.txt":  true,
+				"/keep.tmp": false,
+			},
+		},
+		{
+			name:    "a cached archive info file is filtered like the other files",
+			include: "/cache",
+			exclude: "**/*.json",
+			entries: map[string]bool{
+				archiveInfoFileName:                 false,
+				"/cache/sub/" + archiveInfoFileName: false,
+				"/cache/other.json":                 false,
+				"/other/readme.txt":                 false,
+				"/cache/nested/readme.txt":          true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := parsePathFilter(tt.include, tt.exclude)
+			if err != nil {
+				t.Fatalf("parsePathFilter() error = %v", err)
+			}
+			for name, want := range tt.entries {
+				if got := filter.matches(name); got != want {
+					t.Errorf("matches(%s) = %t, want %t", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractCacheArchive_Filter(t *testing.T) {
+	entries := []testEntry{
+		{hdr: tar.Header{Name: archiveInfoFileName, Typeflag: tar.TypeReg}, body: `{"stack_id":"osx-xcode-14"}`},
+		{hdr: tar.Header{Name: "gradle/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "gradle/caches/modules.bin", Typeflag: tar.TypeReg}, body: "modules"},
+		{hdr: tar.Header{Name: "gradle/caches/modules.lock", Typeflag: tar.TypeReg}, body: "lock"},
+		{hdr: tar.Header{Name: "gradle/modules-hard", Typeflag: tar.TypeLink, Linkname: "gradle/caches/modules.bin"}},
+		{hdr: tar.Header{Name: "gradle/lock-hard", Typeflag: tar.TypeLink, Linkname: "gradle/caches/modules.lock"}},
+		{hdr: tar.Header{Name: "m2/settings.xml", Typeflag: tar.TypeReg}, body: "settings"},
+		{hdr: tar.Header{Name: "m2/" + archiveInfoFileName, Typeflag: tar.TypeReg}, body: `{"cached": true}`},
+	}
+	filter, err := parsePathFilter("/gradle", "**/*.lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []extractOptions{
+		{Filter: filter},
+		{Filter: filter, ConfineRoot: true},
+		{Filter: filter, ExtractMetadata: true},
+	} {
+		opts.Root = t.TempDir()
+		result, err := extractCacheArchive(createTestArchive(t, entries...), opts)
+		if err != nil {
+			t.Fatalf("extractCacheArchive(%+v) error = %v", opts, err)
+		}
+		// the lock file, the hard link to it and the m2 files are filtered, the metadata entry is only skipped if not extracted
+		wantEntries, wantSkipped := 3, 5
+		if opts.ExtractMetadata {
+			wantEntries, wantSkipped = 4, 4
+		}
+		if result.Entries != wantEntries || result.Skipped != wantSkipped {
+			t.Errorf("%+v: Entries = %d, Skipped = %d, want %d and %d", opts, result.Entries, result.Skipped, wantEntries, wantSkipped)
+		}
+		if _, ok := result.Index[archiveInfoFileName]; !ok {
+			t.Errorf("%+v: %s not read from the filtered archive", opts, archiveInfoFileName)
+		}
+
+		for name, want := range map[string]bool{
+			"gradle/caches/modules.bin":  true,
+			"gradle/modules-hard":        true,
+			"gradle/caches/modules.lock": false,
+			"gradle/lock-hard":           false,
+			"m2":                         false,
+			archiveInfoFileName:          opts.ExtractMetadata,
+		} {
+			_, err := os.Lstat(filepath.Join(opts.Root, name))
+			if got := err == nil; got != want {
+				t.Errorf("%+v: %s extracted = %t, want %t", opts, name, got, want)
+			}
+		}
+	}
+}
+
+func TestStripComponents(t *testing.T) {
+	tests := []struct {
+		name   string
+		n      int
+		want   string
+		wantOK bool
+	}{
+		{"cache/gradle/file.bin", 0, "cache/gradle/file.bin", true},
+		{"cache/gradle/file.bin", 1, "gradle/file.bin", true},
+		{"/cache/gradle/", 1, "gradle/", true},
+		{"./cache//gradle/file.bin", 2, "file.bin", true},
+		{"cache/../../etc/passwd", 1, "../../etc/passwd", true},
+		{"cache/", 1, "", false},
+		{"cache/file.bin", 2, "", false},
+	}
+	for _, tt := range tests {
+		if got, ok := stripComponents(tt.name, tt.n); got != tt.want || ok != tt.wantOK {
+			t.Errorf("stripComponents(%s, %d) = %s, %t, want %s, %t", tt.name, tt.n, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestExtractCacheArchive_StripComponents(t *testing.T) {
+	entries := []testEntry{
+		{hdr: tar.Header{Name: archiveInfoFileName, Typeflag: tar.TypeReg}, body: `{"stack_id":"osx-xcode-14"}`},
+		{hdr: tar.Header{Name: "cache/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "cache/gradle/modules.bin", Typeflag: tar.TypeReg}, body: "modules"},
+		{hdr: tar.Header{Name: "cache/gradle/modules-hard", Typeflag: tar.TypeLink, Linkname: "cache/gradle/modules.bin"}},
+		{hdr: tar.Header{Name: "cache/gradle/modules-link", Typeflag: tar.TypeSymlink, Linkname: "modules.bin"}},
+		{hdr: tar.Header{Name: "top.txt", Typeflag: tar.TypeReg}, body: "top"},
+	}
+
+	tests := []struct {
+		name      string
+		n         int
+		extracted []string
+		missing   []string
+	}{
+		{name: "unchanged", n: 0, extracted: []string{"cache/gradle/modules.bin", "cache/gradle/modules-hard", "top.txt"}},
+		{name: "one component", n: 1, extracted: []string{"gradle/modules.bin", "gradle/modules-hard", "gradle/modules-link"}, missing: []string{"cache", "top.txt"}},
+		// every entry is shorter but the metadata entry
+		{name: "longer than the entries", n: 3, missing: []string{"cache", "gradle", "modules.bin", "top.txt"}},
+	}
+	for _, tt := range tests {
+		for _, confine := range []bool{false, true} {
+			root := t.TempDir()
+			opts := extractOptions{Root: root, StripComponents: tt.n, ConfineRoot: confine}
+			result, err := extractCacheArchive(createTestArchive(t, entries...), opts)
+			if err != nil {
+				t.Fatalf("%s (confined: %t): extractCacheArchive() error = %v", tt.name, confine, err)
+			}
+			if _, ok := result.Index[archiveInfoFileName]; !ok {
+				t.Errorf("%s (confined: %t): %s not read from the stripped archive", tt.name, confine, archiveInfoFileName)
+			}
+			for _, name := range tt.extracted {
+				if _, err := os.Lstat(filepath.Join(root, name)); err != nil {
+					t.Errorf("%s (confined: %t): %s not extracted: %s", tt.name, confine, name, err)
+				}
+				if _, ok := result.Index[name]; !ok {
+					t.Errorf("%s (confined: %t): %s not indexed by its stripped path", tt.name, confine, name)
+				}
+			}
+			for _, name := range tt.missing {
+				if _, err := os.Lstat(filepath.Join(root, name)); err == nil {
+					t.Errorf("%s (confined: %t): %s extracted, want it stripped", tt.name, confine, name)
+				}
+			}
+		}
+	}
+
+	// the stripped path traversing out of the root is still refused
+	for _, confine := range []bool{false, true} {
+		dir := t.TempDir()
+		traversal := testEntry{hdr: tar.Header{Name: "cache/gradle/../../../outside.txt", Typeflag: tar.TypeReg}, body: "outside"}
+		_, err := extractCacheArchive(createTestArchive(t, traversal), extractOptions{Root: filepath.Join(dir, "root"), StripComponents: 1, ConfineRoot: confine})
+		if _, serr := os.Lstat(filepath.Join(dir, "outside.txt")); err == nil || serr == nil {
+			t.Errorf("confined: %t: extractCacheArchive() error = %v, want the traversal refused", confine, err)
+		}
+	}
+}
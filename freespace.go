@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"syscall"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// freeSpaceCheckInterval is the number of archive bytes passed to tar between two free space checks.
+var freeSpaceCheckInterval int64 = 64 * 1024 * 1024
+
+// freeSpace returns the space available for unprivileged users on the filesystem of the given path.
+var freeSpace = func(pth string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(pth, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
+
+// diskSize returns the total size of the filesystem of the given path.
+var diskSize = func(pth string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(pth, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Blocks) * uint64(stat.Bsize), nil
+}
+
+// checkCacheSize warns if the extracted cache's size is over the given percent of the total size of the disk it is extracted to:
+// such a cache routinely fails the free space checks on the runner. It reports whether the warning was emitted.
+func checkCacheSize(size int64, pth string, percent int) bool {
+	total, err := diskSize(pth)
+	if err != nil {
+		log.Debugf("failed to get the disk size: %s", err)
+		return false
+	}
+	if total == 0 || size <= 0 || uint64(size)*100 <= total*uint64(percent) {
+		return false
+	}
+	log.Warnf("The cache is %d MB, %d%% of the %d MB disk it is extracted to, it is probably too large for the runner.", size/1024/1024, uint64(size)*100/total, total/1024/1024)
+	log.Warnf("Consider caching fewer paths, the extraction is likely to run out of space on this runner.")
+	return true
+}
+
+// requiredSpaceError is returned if the free space is not enough for the cache before the extraction starts.
+type requiredSpaceError struct {
+	Path   string
+	Free   uint64
+	Size   uint64
+	Margin uint64
+}
+
+func (e *requiredSpaceError) Error() string {
+	return fmt.Sprintf("not enough free space on %s to extract the cache: %d MB free, %d MB required (the %d MB cache and the %d MB margin)",
+		e.Path, e.Free/1024/1024, (e.Size+e.Margin)/1024/1024, e.Size/1024/1024, e.Margin/1024/1024)
+}
+
+// checkRequiredSpace checks whether the free space on the filesystem of the given path holds the cache of the given size and the margin.
+// A cache of unknown size (not positive) is not checked, neither is a filesystem whose free space can not be queried.
+func checkRequiredSpace(pth string, size int64, margin uint64) error {
+	if size <= 0 {
+		return nil
+	}
+	free, err := freeSpace(pth)
+	if err != nil {
+		log.Debugf("failed to get the free space, skipping the free space check: %s", err)
+		return nil
+	}
+	log.Debugf("free space on %s: %d MB, the cache is %d MB", pth, free/1024/1024, size/1024/1024)
+	if free < uint64(size)+margin {
+		return &requiredSpaceError{Path: pth, Free: free, Size: uint64(size), Margin: margin}
+	}
+	return nil
+}
+
+// insufficientSpaceError is returned if the free space drops below the threshold during the extraction.
+type insufficientSpaceError struct {
+	Path      string
+	Free      uint64
+	Threshold uint64
+}
+
+func (e *insufficientSpaceError) Error() string {
+	return fmt.Sprintf("free space on %s dropped to %d MB, below the %d MB threshold", e.Path, e.Free/1024/1024, e.Threshold/1024/1024)
+}
+
+// freeSpaceMonitor checks the free space of the extraction target's filesystem, periodically while the archive is read.
+// Reading fails with an insufficientSpaceError once the free space drops below the threshold, which aborts the extraction.
+type freeSpaceMonitor struct {
+	r         io.Reader
+	pth       string
+	threshold uint64
+
+	unchecked int64
+	err       error
+}
+
+// Read implements the io.Reader interface.
+func (m *freeSpaceMonitor) Read(p []byte) (int, error) {
+	if m.err != nil {
+		return 0, m.err
+	}
+
+	n, err := m.r.Read(p)
+	m.unchecked += int64(n)
+	if m.unchecked < freeSpaceCheckInterval {
+		return n, err
+	}
+	m.unchecked = 0
+
+	free, ferr := freeSpace(m.pth)
+	if ferr != nil {
+		log.Debugf("failed to check free space: %s", ferr)
+		return n, err
+	}
+	log.Debugf("free space on %s: %d MB", m.pth, free/1024/1024)
+	if free < m.threshold {
+		m.err = &insufficientSpaceError{Path: m.pth, Free: free, Threshold: m.threshold}
+		return n, m.err
+	}
+	return n, err
+}
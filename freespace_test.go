@@ -0,0 +1,141 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExtractCacheArchive_FreeSpaceMonitor(t *testing.T) {
+	defer func(interval int64, fn func(string) (uint64, error)) {
+		freeSpaceCheckInterval, freeSpace = interval, fn
+	}(freeSpaceCheckInterval, freeSpace)
+	freeSpaceCheckInterval = 8 * 1024
+
+	createArchive := func(dir string) ([]testEntry, []string) {
+		var entries []testEntry
+		var pths []string
+		for i := 0; i < 32; i++ {
+			pth := filepath.Join(dir, fmt.Sprintf("file-%02d", i))
+			entries = append(entries, testEntry{hdr: tar.Header{Name: pth, Typeflag: tar.TypeReg}, body: strings.Repeat("x", 4*1024)})
+			pths = append(pths, pth)
+		}
+		return entries, pths
+	}
+
+	t.Log("shrinking free space - abort")
+	{
+		// other processes fill the disk: 100 MB, 50 MB, 10 MB, 1 MB...
+		free := []uint64{100, 50, 10, 1}
+		var checks int
+		freeSpace = func(string) (uint64, error) {
+			mb := free[len(free)-1]
+			if checks < len(free) {
+				mb = free[checks]
+			}
+			checks++
+			return mb * 1024 * 1024, nil
+		}
+
+		dir := t.TempDir()
+		entries, pths := createArchive(dir)
+		archive := createTestArchive(t, entries...)
+
+		_, err := extractCacheArchive(archive, extractOptions{MinFreeSpace: 20 * 1024 * 1024, FreeSpacePath: dir})
+		spaceErr, ok := err.(*insufficientSpaceError)
+		if !ok {
+			t.Fatalf("extractCacheArchive() error = %v, want insufficientSpaceError", err)
+		}
+		if spaceErr.Free != 10*1024*1024 {
+			t.Errorf("insufficientSpaceError.Free = %d, want %d", spaceErr.Free, 10*1024*1024)
+		}
+		if checks != 3 {
+			t.Errorf("free space checked %d times, want 3", checks)
+		}
+		if _, err := os.Stat(pths[len(pths)-1]); !os.IsNotExist(err) {
+			t.Errorf("extraction continued after the free space dropped below the threshold")
+		}
+	}
+
+	t.Log("enough free space")
+	{
+		freeSpace = func(string) (uint64, error) { return 100 * 1024 * 1024, nil }
+
+		dir := t.TempDir()
+		entries, pths := createArchive(dir)
+		archive := createTestArchive(t, entries...)
+
+		if _, err := extractCacheArchive(archive, extractOptions{MinFreeSpace: 20 * 1024 * 1024, FreeSpacePath: dir}); err != nil {
+			t.Fatalf("extractCacheArchive() error = %v", err)
+		}
+		for _, pth := range pths {
+			if _, err := os.Stat(pth); err != nil {
+				t.Errorf("%s not extracted: %s", pth, err)
+			}
+		}
+	}
+}
+
+func TestFreeSpace(t *testing.T) {
+	free, err := freeSpace(t.TempDir())
+	if err != nil {
+		t.Fatalf("freeSpace() error = %v", err)
+	}
+	if free == 0 {
+		t.Errorf("freeSpace() = 0, want the available space")
+	}
+}
+
+func TestCheckCacheSize(t *testing.T) {
+	defer func(fn func(string) (uint64, error)) { diskSize = fn }(diskSize)
+	// a mocked 100 KB disk
+	diskSize = func(string) (uint64, error) { return 100 * 1024, nil }
+
+	root := t.TempDir()
+	archive := createTestArchive(t,
+		testEntry{hdr: tar.Header{Name: "/large.bin", Typeflag: tar.TypeReg}, body: strings.Repeat("x", 90*1024)},
+		testEntry{hdr: tar.Header{Name: "/small.bin", Typeflag: tar.TypeReg}, body: "x"},
+	)
+	result, err := extractCacheArchive(archive, extractOptions{Root: root})
+	if err != nil {
+		t.Fatalf("extractCacheArchive() error = %v", err)
+	}
+
+	if !checkCacheSize(result.UncompressedBytes, root, 80) {
+		t.Errorf("checkCacheSize(%d, 80%%) = false, want a warning on the 100 KB disk", result.UncompressedBytes)
+	}
+	if checkCacheSize(result.UncompressedBytes, root, 95) {
+		t.Errorf("checkCacheSize(%d, 95%%) = true, want no warning", result.UncompressedBytes)
+	}
+	if checkCacheSize(1024, root, 80) {
+		t.Errorf("checkCacheSize(1024, 80%%) = true, want no warning for a small cache")
+	}
+}
+
+func TestCheckRequiredSpace(t *testing.T) {
+	defer func(fn func(string) (uint64, error)) { freeSpace = fn }(freeSpace)
+	freeSpace = func(string) (uint64, error) { return 1024 * 1024 * 1024, nil }
+
+	const mb = 1024 * 1024
+	if err := checkRequiredSpace(".", 900*mb, 100*mb); err != nil {
+		t.Errorf("checkRequiredSpace() error = %v, want the cache to fit", err)
+	}
+	err := checkRequiredSpace(".", 1000*mb, 100*mb)
+	if _, ok := err.(*requiredSpaceError); !ok {
+		t.Fatalf("checkRequiredSpace() error = %v, want a requiredSpaceError", err)
+	}
+	if !strings.Contains(err.Error(), "1024 MB free, 1100 MB required") {
+		t.Errorf("checkRequiredSpace() error = %s, want the free and the required space", err)
+	}
+	if err := checkRequiredSpace(".", -1, 100*mb); err != nil {
+		t.Errorf("checkRequiredSpace() error = %v, want no check of an unknown size", err)
+	}
+
+	freeSpace = func(string) (uint64, error) { return 0, fmt.Errorf("statfs not supported") }
+	if err := checkRequiredSpace(".", 1000*mb, 100*mb); err != nil {
+		t.Errorf("checkRequiredSpace() error = %v, want the check skipped if the free space is unknown", err)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// tarBlockSize is the size of the tar format's blocks, headers and entry bodies are aligned to it.
+const tarBlockSize = 512
+
+// gzipMagic are the first bytes of a gzip member (ID1, ID2 and the deflate compression method).
+var gzipMagic = []byte{0x1f, 0x8b, 0x08}
+
+// gzipResyncReader decompresses a multistream gzip archive, recovering from damaged members in best-effort mode:
+// the rest of a damaged member is skipped up to the next member's magic bytes, and the decompression continues from there.
+// The decompressed tar stream is kept well-formed for the tar tool: the body of the entry a damaged member ends in
+// is zero-filled to its size (the entry is reported as damaged), and the blocks of the next member are dropped
+// till the next valid tar header.
+// This recovers the entries after the damage, if the members start at tar block boundaries (as the parallel compressors' do).
+type gzipResyncReader struct {
+	br *bufio.Reader
+	zr *gzip.Reader
+
+	block   []byte
+	pending []byte
+	// zeros is the number of zero bytes to pass on, filling a damaged entry's body
+	zeros int64
+	ended bool
+
+	// remaining is the number of body blocks left of the current entry, -1 while a valid header is looked for.
+	remaining int64
+	entry     entryError
+	// memberEntries are the entries with body bytes in the current member.
+	memberEntries []entryError
+
+	// SkippedMembers is the number of damaged members.
+	SkippedMembers int
+	// Damaged are the entries zero-filled because of a damaged member, they should not be kept on the disk.
+	Damaged []entryError
+}
+
+// newGzipResyncReader creates a new gzipResyncReader reading the compressed archive from r.
+func newGzipResyncReader(r io.Reader) *gzipResyncReader {
+	return &gzipResyncReader{br: bufio.NewReader(r), block: make([]byte, tarBlockSize)}
+}
+
+// Read implements the io.Reader interface.
+func (g *gzipResyncReader) Read(p []byte) (int, error) {
+	for len(g.pending) == 0 && g.zeros == 0 {
+		if err := g.nextBlock(); err != nil {
+			return 0, err
+		}
+	}
+	if g.zeros > 0 {
+		if int64(len(p)) > g.zeros {
+			p = p[:g.zeros]
+		}
+		for i := range p {
+			p[i] = 0
+		}
+		g.zeros -= int64(len(p))
+		return len(p), nil
+	}
+	n := copy(p, g.pending)
+	g.pending = g.pending[n:]
+	return n, nil
+}
+
+// nextBlock decompresses the next tar block, and queues the blocks to pass on to the tar tool.
+func (g *gzipResyncReader) nextBlock() error {
+	n, err := g.readBlock()
+	if err == io.EOF && n == 0 {
+		if g.remaining < 0 && !g.ended {
+			// the end of archive marker might have been dropped while looking for a header
+			g.ended = true
+			g.zeros = 2 * tarBlockSize
+			return nil
+		}
+		return io.EOF
+	}
+	if err != nil && err != io.EOF {
+		g.SkippedMembers++
+		log.Warnf("Skipping a damaged gzip member: %s", err)
+
+		// the checksum of a member is only checked at its end, each entry with body bytes in the member is damaged
+		for _, entry := range g.memberEntries {
+			log.Warnf("%s is damaged by the gzip member", entry.Path)
+			entry.Error = "damaged gzip member"
+			g.Damaged = append(g.Damaged, entry)
+		}
+		g.memberEntries = nil
+		if g.remaining > 0 {
+			// the body of the entry is zero-filled, so the tar tool finds the next header where it is expected
+			g.zeros = g.remaining * tarBlockSize
+		}
+		g.remaining = -1
+		return g.resync()
+	}
+	if n < tarBlockSize {
+		// a truncated last block is passed on as it is, the tar tool reports it
+		g.pending = append([]byte(nil), g.block[:n]...)
+		return nil
+	}
+
+	if g.remaining > 0 {
+		g.remaining--
+		g.pending = append([]byte(nil), g.block...)
+		return nil
+	}
+
+	zero := bytes.Count(g.block, []byte{0}) == len(g.block)
+	size, name, typeflag, ok := parseTarBlockHeader(g.block)
+	if g.remaining < 0 && (!ok || zero) {
+		// looking for the next header after a damaged member, zero blocks of a file's body are not the end of the archive
+		return nil
+	}
+	if zero {
+		// end of archive
+		g.pending = append([]byte(nil), g.block...)
+		return nil
+	}
+	if !ok {
+		// not a damaged member's data, the tar tool reports the invalid header
+		g.pending = append([]byte(nil), g.block...)
+		return nil
+	}
+	g.remaining = (size + tarBlockSize - 1) / tarBlockSize
+	g.entry = entryError{Path: name, Typeflag: string(typeflag)}
+	if g.remaining > 0 {
+		g.memberEntries = append(g.memberEntries, g.entry)
+	}
+	g.pending = append([]byte(nil), g.block...)
+	return nil
+}
+
+// readBlock fills the block buffer from the gzip members, it returns the number of bytes read.
+func (g *gzipResyncReader) readBlock() (int, error) {
+	n := 0
+	for n < tarBlockSize {
+		if g.zr == nil {
+			if _, err := g.br.Peek(1); err != nil {
+				// no more members
+				return n, io.EOF
+			}
+			if err := g.startMember(); err != nil {
+				return n, err
+			}
+			g.memberEntries = nil
+			if g.remaining > 0 {
+				// the current entry's body continues in the member
+				g.memberEntries = append(g.memberEntries, g.entry)
+			}
+		}
+
+		m, err := g.zr.Read(g.block[n:])
+		n += m
+		if err == io.EOF {
+			// the member ended
+			g.zr = nil
+			continue
+		}
+		if err != nil {
+			g.zr = nil
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// startMember starts decompressing the next gzip member.
+func (g *gzipResyncReader) startMember() error {
+	zr, err := gzip.NewReader(g.br)
+	if err != nil {
+		return err
+	}
+	zr.Multistream(false)
+	g.zr = zr
+	return nil
+}
+
+// resync skips the compressed stream to the next gzip member's magic bytes.
+func (g *gzipResyncReader) resync() error {
+	for {
+		b, err := g.br.Peek(len(gzipMagic))
+		if err != nil {
+			// no more members, the rest is dropped
+			if _, err := io.Copy(ioutil.Discard, g.br); err != nil {
+				return err
+			}
+			return nil
+		}
+		if bytes.Equal(b, gzipMagic) {
+			return nil
+		}
+		if _, err := g.br.Discard(1); err != nil {
+			return err
+		}
+	}
+}
+
+// parseTarBlockHeader parses the body size, name and type of a tar header block,
+// it reports false if the block is not a valid header (its checksum does not match).
+func parseTarBlockHeader(block []byte) (int64, string, byte, bool) {
+	var sum int64
+	for i, b := range block {
+		if i >= 148 && i < 156 {
+			// the checksum field is summed as spaces
+			b = ' '
+		}
+		sum += int64(b)
+	}
+	chksum, err := parseTarOctal(block[148:156])
+	if err != nil || chksum != sum {
+		return 0, "", 0, false
+	}
+
+	typeflag := block[156]
+	var size int64
+	if block[124]&0x80 != 0 {
+		// base-256 encoding of large sizes
+		for _, b := range block[125:136] {
+			size = size<<8 | int64(b)
+		}
+	} else if size, err = parseTarOctal(block[124:136]); err != nil {
+		return 0, "", 0, false
+	}
+	if strings.IndexByte("123456", typeflag) >= 0 {
+		// links, devices, directories and fifos have no body
+		size = 0
+	}
+
+	name := cString(block[0:100])
+	if prefix := cString(block[345:500]); prefix != "" && string(block[257:262]) == "ustar" {
+		name = prefix + "/" + name
+	}
+	return size, name, typeflag, true
+}
+
+// parseTarOctal parses a NUL or space terminated octal tar header field.
+func parseTarOctal(field []byte) (int64, error) {
+	s := strings.Trim(cString(field), " ")
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 8, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid octal field: %q", s)
+	}
+	return n, nil
+}
+
+// cString returns the NUL terminated string of the field.
+func cString(field []byte) string {
+	if i := bytes.IndexByte(field, 0); i >= 0 {
+		field = field[:i]
+	}
+	return string(field)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// createMultistreamArchive creates a tar archive of the given files, compressing each entry into its own gzip member.
+// The member of the damaged entry is corrupted in its middle.
+func createMultistreamArchive(t *testing.T, names []string, bodies [][]byte, damaged int) []byte {
+	var archive bytes.Buffer
+	for i, name := range names {
+		var entry bytes.Buffer
+		tw := tar.NewWriter(&entry)
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(bodies[i]))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(bodies[i]); err != nil {
+			t.Fatal(err)
+		}
+		if i == len(names)-1 {
+			if err := tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+		} else if err := tw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		var member bytes.Buffer
+		gw := gzip.NewWriter(&member)
+		if _, err := gw.Write(entry.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if err := gw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		b := member.Bytes()
+		if i == damaged {
+			for j := len(b) / 2; j < len(b)/2+16; j++ {
+				b[j] ^= 0xff
+			}
+		}
+		archive.Write(b)
+	}
+	return archive.Bytes()
+}
+
+func TestExtractCacheArchive_GzipResync(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	var bodies [][]byte
+	for i := 0; i < 3; i++ {
+		body := make([]byte, 4096)
+		rnd.Read(body)
+		bodies = append(bodies, body)
+	}
+
+	dir := t.TempDir()
+	names := []string{filepath.Join(dir, "first"), filepath.Join(dir, "second"), filepath.Join(dir, "third")}
+	archive := createMultistreamArchive(t, names, bodies, 1)
+
+	result, err := extractCacheArchive(bytes.NewReader(archive), extractOptions{GzipResync: true})
+	if err != nil {
+		t.Fatalf("extractCacheArchive() error = %v", err)
+	}
+
+	for _, i := range []int{0, 2} {
+		if b, err := ioutil.ReadFile(names[i]); err != nil || !bytes.Equal(b, bodies[i]) {
+			t.Errorf("%s not recovered (%v)", names[i], err)
+		}
+	}
+	if _, err := os.Stat(names[1]); !os.IsNotExist(err) {
+		t.Errorf("the damaged entry is kept on the disk")
+	}
+	if len(result.Errors) != 1 || result.Errors[0].Path != names[1] {
+		t.Errorf("errors = %v, want the damaged entry", result.Errors)
+	}
+	if result.Entries != 2 {
+		t.Errorf("entries = %d, want 2", result.Entries)
+	}
+}
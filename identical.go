@@ -0,0 +1,58 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Handling of the regular file entries whose target already exists, like on a warm runner.
+const (
+	// skipIdenticalNone writes every entry.
+	skipIdenticalNone = "none"
+	// skipIdenticalMetadata skips the entries whose existing file has the entry's size, modification time and permissions.
+	skipIdenticalMetadata = "metadata"
+	// skipIdenticalContent also requires the existing file to match the entry's recorded content hash.
+	skipIdenticalContent = "content"
+)
+
+// existingIdentical reports whether the regular file entry's target already exists and is identical to the entry,
+// by the policy: the entry is not written then.
+// The modification times are compared to the second, like the tar header stores them.
+// The content policy only skips the entries with a recorded content hash.
+func existingIdentical(hdr *tar.Header, root, policy string) bool {
+	if policy == "" || policy == skipIdenticalNone || hdr.Typeflag != tar.TypeReg || hasParentComponent(hdr.Name) {
+		return false
+	}
+	pth := entryTarget(hdr.Name, root)
+	info, err := os.Lstat(pth)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	if info.Size() != hdr.Size || info.Mode().Perm() != os.FileMode(hdr.Mode).Perm() ||
+		!info.ModTime().Truncate(time.Second).Equal(hdr.ModTime.Truncate(time.Second)) {
+		return false
+	}
+	if policy != skipIdenticalContent {
+		return true
+	}
+
+	want := hdr.PAXRecords[fileHashRecord]
+	if want == "" {
+		return false
+	}
+	f, err := os.Open(pth)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = f.Close() }()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false
+	}
+	return hex.EncodeToString(h.Sum(nil)) == strings.ToLower(want)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExtractCacheArchive_SkipIdentical(t *testing.T) {
+	modTime := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	sum := sha256.Sum256([]byte("cached"))
+	entries := []testEntry{
+		{hdr: tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: modTime}},
+		{hdr: tar.Header{Name: "dir/kept.txt", Typeflag: tar.TypeReg, ModTime: modTime}, body: "cached"},
+		{hdr: tar.Header{Name: "dir/changed.txt", Typeflag: tar.TypeReg, ModTime: modTime}, body: "cached"},
+		{hdr: tar.Header{Name: "dir/hashed.txt", Typeflag: tar.TypeReg, ModTime: modTime, PAXRecords: map[string]string{fileHashRecord: hex.EncodeToString(sum[:])}}, body: "cached"},
+		{hdr: tar.Header{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "kept.txt", ModTime: modTime}},
+		{hdr: tar.Header{Name: "new/file.txt", Typeflag: tar.TypeReg, ModTime: modTime}, body: "new"},
+	}
+
+	// a warm runner: the previous pull's files are on the disk, one of them was modified since, keeping its size
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"kept.txt", "changed.txt", "hashed.txt"} {
+		pth := filepath.Join(root, "dir", name)
+		if err := ioutil.WriteFile(pth, []byte("cached"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := modTime
+		if name == "changed.txt" {
+			if err := ioutil.WriteFile(pth, []byte("edited"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			mtime = modTime.Add(time.Hour)
+		}
+		if err := os.Chtimes(pth, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Log("metadata")
+	{
+		result, err := extractCacheArchive(createTestArchive(t, entries...), extractOptions{Root: root, SkipIdentical: skipIdenticalMetadata})
+		if err != nil {
+			t.Fatalf("extractCacheArchive() error = %v", err)
+		}
+		if result.Identical != 2 {
+			t.Errorf("Identical = %d, want the kept and the hashed files", result.Identical)
+		}
+		if _, ok := result.Index["dir/kept.txt"]; !ok || len(result.Index) != len(entries) {
+			t.Errorf("Index = %v, want every entry indexed", result.Index)
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(root, "dir/changed.txt")); err != nil || string(b) != "cached" {
+			t.Errorf("dir/changed.txt = %q, %v, want the modified file overwritten", b, err)
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(root, "new/file.txt")); err != nil || string(b) != "new" {
+			t.Errorf("new/file.txt = %q, %v, want the missing file and its parent created", b, err)
+		}
+		if target, err := os.Readlink(filepath.Join(root, "dir/link")); err != nil || target != "kept.txt" {
+			t.Errorf("dir/link = %s, %v, want the symlink extracted", target, err)
+		}
+	}
+
+	t.Log("content")
+	{
+		// the kept file has no recorded hash
+		result, err := extractCacheArchive(createTestArchive(t, entries...), extractOptions{Root: root, SkipIdentical: skipIdenticalContent})
+		if err != nil {
+			t.Fatalf("extractCacheArchive() error = %v", err)
+		}
+		if result.Identical != 1 {
+			t.Errorf("Identical = %d, want the hashed file only", result.Identical)
+		}
+	}
+
+	t.Log("none")
+	{
+		result, err := extractCacheArchive(createTestArchive(t, entries...), extractOptions{Root: root, SkipIdentical: skipIdenticalNone})
+		if err != nil {
+			t.Fatalf("extractCacheArchive() error = %v", err)
+		}
+		if result.Identical != 0 || result.Entries != len(entries) {
+			t.Errorf("Identical = %d, Entries = %d, want every entry written", result.Identical, result.Entries)
+		}
+	}
+}
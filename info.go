@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// readCacheInfo reads the cache's metadata and the archive's size (-1 if unknown), without downloading the whole archive.
+// The metadata is read from the sidecar or the pre-extracted cache directory if available, otherwise the archive is read
+// only till its first entry. It returns a nil info if the archive has no metadata.
+func readCacheInfo(src archiveSource) (*archiveInfo, int64, error) {
+	if src.InfoURL != "" {
+		body, _, err := performRequest(src.Client, src.InfoURL)
+		if err != nil {
+			return nil, -1, fmt.Errorf("failed to download archive info: %s", err)
+		}
+		defer func() {
+			if err := body.Close(); err != nil {
+				log.Warnf("Failed to close response body: %s", err)
+			}
+		}()
+
+		b, err := ioutil.ReadAll(io.LimitReader(body, maxArchiveInfoSize))
+		if err != nil {
+			return nil, -1, fmt.Errorf("failed to download archive info: %s", err)
+		}
+		info, err := parseArchiveInfo(b)
+		if err != nil {
+			return nil, -1, fmt.Errorf("failed to parse archive info: %s", err)
+		}
+		return &info, -1, nil
+	}
+
+	if strings.HasPrefix(src.URI, "dir://") {
+		info, err := readArchiveInfoFile(filepath.Join(strings.TrimPrefix(src.URI, "dir://"), archiveInfoFileName))
+		return info, -1, err
+	}
+
+	var archive io.ReadCloser
+	size := int64(-1)
+	if strings.HasPrefix(src.URI, "file://") {
+		f, err := os.Open(strings.TrimPrefix(src.URI, "file://"))
+		if err != nil {
+			return nil, -1, err
+		}
+		if stat, err := f.Stat(); err == nil {
+			size = stat.Size()
+		}
+		archive = f
+	} else {
+		var err error
+		archive, size, err = requestArchive(src.Client, src.URI, src.IgnoreZeroLength)
+		if err != nil {
+			return nil, -1, err
+		}
+	}
+	// closing the archive before its end stops the download
+	defer func() {
+		if err := archive.Close(); err != nil {
+			log.Warnf("Failed to close cache archive: %s", err)
+		}
+	}()
+
+	r, _, err := newDecryptReader(archive, src.DecryptionKeys)
+	if err != nil {
+		return nil, size, fmt.Errorf("failed to decrypt cache archive: %s", err)
+	}
+	info, err := readArchiveInfo(NewRestoreReader(r))
+	return info, size, err
+}
+
+// printCacheInfo prints the cache's metadata, the unknown values as "unknown".
+func printCacheInfo(w io.Writer, info *archiveInfo, size int64) {
+	value := func(v string) string {
+		if v == "" {
+			return "unknown"
+		}
+		return v
+	}
+	number := func(n int64) string {
+		if n < 0 {
+			return "unknown"
+		}
+		return fmt.Sprintf("%d", n)
+	}
+
+	if info == nil {
+		info = &archiveInfo{EntryCount: -1, FormatVersion: -1}
+	}
+
+	fmt.Fprintf(w, "stack id: %s\n", value(info.StackID))
+	fmt.Fprintf(w, "created at: %s\n", value(info.CreatedAt))
+	fmt.Fprintf(w, "build slug: %s\n", value(info.BuildSlug))
+	fmt.Fprintf(w, "cache key: %s\n", value(info.CacheKey))
+	fmt.Fprintf(w, "format version: %s\n", number(info.FormatVersion))
+	fmt.Fprintf(w, "size: %s\n", number(size))
+	uncompressedSize := int64(-1)
+	if info.UncompressedSize > 0 {
+		uncompressedSize = info.UncompressedSize
+	}
+	fmt.Fprintf(w, "uncompressed size: %s\n", number(uncompressedSize))
+	fmt.Fprintf(w, "entry count: %s\n", number(info.EntryCount))
+	if len(info.Paths) > 0 {
+		fmt.Fprintf(w, "paths:\n")
+		for _, pth := range info.Paths {
+			fmt.Fprintf(w, "- %s\n", pth)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadCacheInfo_Archive(t *testing.T) {
+	archive := createTestArchive(t,
+		testEntry{hdr: tar.Header{Name: archiveInfoFileName, Typeflag: tar.TypeReg}, body: `{"stack_id":"osx","entry_count":2,"format_version":2}`},
+		testEntry{hdr: tar.Header{Name: "/Users/vagrant/.gradle/File.txt", Typeflag: tar.TypeReg}, body: "test"},
+	)
+	pth := filepath.Join(t.TempDir(), "archive.tar")
+	if err := ioutil.WriteFile(pth, archive.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	info, size, err := readCacheInfo(archiveSource{URI: "file://" + pth})
+	if err != nil {
+		t.Fatalf("readCacheInfo() error = %v", err)
+	}
+	if info == nil || info.StackID != "osx" || info.EntryCount != 2 || info.FormatVersion != 2 {
+		t.Errorf("readCacheInfo() info = %+v", info)
+	}
+	if size != int64(archive.Len()) {
+		t.Errorf("readCacheInfo() size = %d, want %d", size, archive.Len())
+	}
+}
+
+func TestReadCacheInfo_GzipArchive(t *testing.T) {
+	archive := createTestArchive(t,
+		testEntry{hdr: tar.Header{Name: archiveInfoFileName, Typeflag: tar.TypeReg}, body: `{"stack_id":"osx"}`},
+		testEntry{hdr: tar.Header{Name: "/Users/vagrant/.gradle/File.txt", Typeflag: tar.TypeReg}, body: strings.Repeat("test", 4096)},
+	)
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(archive.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	pth := filepath.Join(t.TempDir(), "archive.tar.gz")
+	if err := ioutil.WriteFile(pth, compressed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the stack check reads the metadata from the decompressed stream
+	info, _, err := readCacheInfo(archiveSource{URI: "file://" + pth})
+	if err != nil {
+		t.Fatalf("readCacheInfo() error = %v", err)
+	}
+	if info == nil || info.StackID != "osx" {
+		t.Fatalf("readCacheInfo() info = %+v, want stack id osx", info)
+	}
+	if !shouldSkipForStack(info, "linux", false) {
+		t.Errorf("shouldSkipForStack() = false, want the compressed archive skipped on a different stack")
+	}
+}
+
+func TestReadCacheInfo_Sidecar(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/archive_info.json" {
+			t.Errorf("unexpected request: %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`{"stack_id":"linux","build_slug":"abc"}`))
+	}))
+	defer server.Close()
+
+	info, size, err := readCacheInfo(archiveSource{Client: server.Client(), URI: server.URL + "/cache.tar", InfoURL: server.URL + "/archive_info.json"})
+	if err != nil {
+		t.Fatalf("readCacheInfo() error = %v", err)
+	}
+	if info == nil || info.StackID != "linux" || info.BuildSlug != "abc" {
+		t.Errorf("readCacheInfo() info = %+v", info)
+	}
+	if size != -1 {
+		t.Errorf("readCacheInfo() size = %d, want unknown", size)
+	}
+}
+
+func TestPrintCacheInfo(t *testing.T) {
+	info := archiveInfo{
+		StackID:       "osx-xcode-12.0.x",
+		EntryCount:    42,
+		Paths:         []string{"/Users/vagrant/.gradle"},
+		CreatedAt:     "2021-01-02T03:04:05Z",
+		CacheKey:      "gradle-cache",
+		FormatVersion: -1,
+
+		UncompressedSize: 4096,
+	}
+
+	var buff bytes.Buffer
+	printCacheInfo(&buff, &info, 1024)
+
+	want := `stack id: osx-xcode-12.0.x
+created at: 2021-01-02T03:04:05Z
+build slug: unknown
+cache key: gradle-cache
+format version: unknown
+size: 1024
+uncompressed size: 4096
+entry count: 42
+paths:
+- /Users/vagrant/.gradle
+`
+	if got := buff.String(); got != want {
+		t.Errorf("printCacheInfo() =\n%s\nwant\n%s", got, want)
+	}
+
+	buff.Reset()
+	printCacheInfo(&buff, nil, -1)
+	want = `stack id: unknown
+created at: unknown
+build slug: unknown
+cache key: unknown
+format version: unknown
+size: unknown
+uncompressed size: unknown
+entry count: unknown
+`
+	if got := buff.String(); got != want {
+		t.Errorf("printCacheInfo(nil) =\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+var (
+	interruptMu sync.Mutex
+	interrupted os.Signal
+)
+
+// interruptExitCode is the exit code of a step aborted by the signal, 128 + the signal's number like the shells'.
+func interruptExitCode(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return 128 + int(s)
+	}
+	return 1
+}
+
+// handleInterrupts cancels the step's operations on SIGINT or SIGTERM, like max_duration does: they get deadlineGrace
+// to fail, then the step is aborted. A second signal aborts it right away. The returned func stops the handling,
+// an interrupted step still exits with the interrupt's exit code if it returned on its own.
+func handleInterrupts() func() {
+	ctx, cancel := context.WithCancel(stepContext)
+	stepContext = ctx
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+			return
+		case sig := <-sigs:
+			interruptMu.Lock()
+			interrupted = sig
+			interruptMu.Unlock()
+			log.Warnf("Received %s, canceling the pull", sig)
+			cancel()
+		}
+		select {
+		case <-sigs:
+		case <-time.After(deadlineGrace):
+		}
+		exit(1)
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+		cancel()
+		if interruptSignal() != nil {
+			exit(1)
+		}
+	}
+}
+
+// interruptSignal returns the signal which interrupted the step, nil if it was not interrupted.
+func interruptSignal() os.Signal {
+	interruptMu.Lock()
+	defer interruptMu.Unlock()
+	return interrupted
+}
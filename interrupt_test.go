@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// interruptTestDirEnv runs TestHandleInterrupts as the interrupted process, cleaning up the directory.
+const interruptTestDirEnv = "CACHE_PULL_INTERRUPT_TEST_DIR"
+
+func TestHandleInterrupts(t *testing.T) {
+	if dir := os.Getenv(interruptTestDirEnv); dir != "" {
+		// the interrupted step: it is blocked on its canceled operation, past the grace period
+		deadlineGrace = 100 * time.Millisecond
+		onDeadline(func() { _ = os.RemoveAll(dir) })
+		defer handleInterrupts()()
+		if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+			t.Fatal(err)
+		}
+		<-stepContext.Done()
+		select {}
+	}
+
+	dir := filepath.Join(t.TempDir(), "tmp")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHandleInterrupts$")
+	cmd.Env = append(os.Environ(), interruptTestDirEnv+"="+dir)
+	out, err := cmd.CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 128+int(syscall.SIGTERM) {
+		t.Fatalf("interrupted step: %v, want the SIGTERM exit code: %s", err, out)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("the temporary directory is kept (%v), want it cleaned up", err)
+	}
+}
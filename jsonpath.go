@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// lookupJSONString returns the string value at the given path of the JSON document.
+// The path is a dot separated list of object keys and array indexes, like `data.caches[0].url`,
+// optionally prefixed with the `$.` JSONPath root.
+func lookupJSONString(b []byte, path string) (string, error) {
+	var value interface{}
+	if err := json.Unmarshal(b, &value); err != nil {
+		return "", err
+	}
+
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	for _, key := range strings.Split(path, ".") {
+		var indexes []int
+		if i := strings.Index(key, "["); i >= 0 {
+			for _, idx := range strings.Split(strings.TrimSuffix(key[i+1:], "]"), "][") {
+				n, err := strconv.Atoi(idx)
+				if err != nil {
+					return "", fmt.Errorf("invalid array index in %s: %s", key, idx)
+				}
+				indexes = append(indexes, n)
+			}
+			key = key[:i]
+		}
+
+		if key != "" {
+			obj, ok := value.(map[string]interface{})
+			if !ok {
+				return "", fmt.Errorf("%s: not an object", key)
+			}
+			if value, ok = obj[key]; !ok {
+				return "", fmt.Errorf("%s: not found", key)
+			}
+		}
+		for _, n := range indexes {
+			arr, ok := value.([]interface{})
+			if !ok {
+				return "", fmt.Errorf("%s[%d]: not an array", key, n)
+			}
+			if n < 0 || n >= len(arr) {
+				return "", fmt.Errorf("%s[%d]: index out of range", key, n)
+			}
+			value = arr[n]
+		}
+	}
+
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%s: not a string", path)
+	}
+	return s, nil
+}
+
+// utf8BOM is the byte order mark some backends prefix their UTF-8 responses with.
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+// trimJSONBody removes a leading UTF-8 byte order mark and the surrounding whitespace of a JSON response body.
+func trimJSONBody(b []byte) []byte {
+	return bytes.TrimSpace(bytes.TrimPrefix(bytes.TrimSpace(b), utf8BOM))
+}
+
+// maxBodySnippetSize is the most bytes of a response body quoted in an error message.
+const maxBodySnippetSize = 200
+
+// bodySnippet returns the beginning of a response body to quote in an error message.
+func bodySnippet(b []byte) string {
+	if len(b) > maxBodySnippetSize {
+		return fmt.Sprintf("%q...", b[:maxBodySnippetSize])
+	}
+	return fmt.Sprintf("%q", b)
+}
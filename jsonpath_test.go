@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLookupJSONString(t *testing.T) {
+	body := []byte(`{"download_url": "https://a.com/cache.tar", "data": {"cache": {"url": "https://b.com/cache.tar", "size": 1}, "caches": [{"url": "https://c.com/0.tar"}, {"url": "https://c.com/1.tar"}]}, "urls": [["https://d.com/cache.tar"]]}`)
+
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{path: "download_url", want: "https://a.com/cache.tar"},
+		{path: "$.download_url", want: "https://a.com/cache.tar"},
+		{path: "data.cache.url", want: "https://b.com/cache.tar"},
+		{path: "$.data.caches[1].url", want: "https://c.com/1.tar"},
+		{path: "urls[0][0]", want: "https://d.com/cache.tar"},
+		{path: "data.cache.missing", wantErr: true},
+		{path: "data.cache.size", wantErr: true},
+		{path: "data.cache", wantErr: true},
+		{path: "data.caches[2].url", wantErr: true},
+		{path: "download_url.url", wantErr: true},
+		{path: "data.caches[x].url", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := lookupJSONString(body, tt.path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("lookupJSONString(%s) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("lookupJSONString(%s) = %s, want %s", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestGetCacheDownloadURL_CustomPath(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := w.Write([]byte(`{"result": {"archive": {"presigned_url": "https://storage.com/cache.tar"}}}`)); err != nil {
+			t.Errorf("failed to write response: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	resp, err := getCacheDownloadURL(server.URL, "result.archive.presigned_url")
+	if err != nil {
+		t.Fatalf("getCacheDownloadURL() error = %v", err)
+	}
+	if got := resp.DownloadURL; got != "https://storage.com/cache.tar" {
+		t.Errorf("getCacheDownloadURL() = %s, want https://storage.com/cache.tar", got)
+	}
+
+	if _, err := getCacheDownloadURL(server.URL, "download_url"); err == nil {
+		t.Errorf("getCacheDownloadURL() error = nil, want error for the default path")
+	}
+}
+
+func TestGetCacheDownloadURL_BOM(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("\xef\xbb\xbf \n{\"download_url\": \"https://storage.com/cache.tar\"}\r\n"))
+	}))
+	defer server.Close()
+
+	resp, err := getCacheDownloadURL(server.URL, "download_url")
+	if err != nil {
+		t.Fatalf("getCacheDownloadURL() error = %v", err)
+	}
+	if got := resp.DownloadURL; got != "https://storage.com/cache.tar" {
+		t.Errorf("getCacheDownloadURL() = %s, want https://storage.com/cache.tar", got)
+	}
+}
+
+func TestGetCacheDownloadURL_JunkPrefix(t *testing.T) {
+	junk := ")]}'\n" + strings.Repeat("x", 300)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(junk + `{"download_url": "https://storage.com/cache.tar"}`))
+	}))
+	defer server.Close()
+
+	_, err := getCacheDownloadURL(server.URL, "download_url")
+	if err == nil {
+		t.Fatalf("getCacheDownloadURL() error = nil, want a parse error")
+	}
+	if !strings.Contains(err.Error(), `")]}'\nxxx`) {
+		t.Errorf("getCacheDownloadURL() error = %v, want the beginning of the body quoted", err)
+	}
+	if strings.Contains(err.Error(), "storage.com") {
+		t.Errorf("getCacheDownloadURL() error = %v, want the body truncated to %d bytes", err, maxBodySnippetSize)
+	}
+}
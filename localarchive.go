@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// localArchiveURL returns the file:// URL of the pre-staged archive at pth, pulled instead of the Cache API URL:
+// the Cache API is not requested. The archive has to exist, a missing archive is not a cache miss.
+func localArchiveURL(pth, apiURL string) (string, error) {
+	abs, err := filepath.Abs(pth)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("%s is a directory, not an archive", abs)
+	}
+	if apiURL != "" {
+		log.Warnf("local_archive_path is set, overriding the Cache API URL: %s", redactURLs(apiURL))
+	}
+	return "file://" + abs, nil
+}
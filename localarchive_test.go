@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLocalArchiveURL(t *testing.T) {
+	dir := t.TempDir()
+	pth := filepath.Join(dir, "cache.tar")
+	if err := ioutil.WriteFile(pth, createTestArchive(t).Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = w.Write([]byte(`{"download_url": "http://example.com/cache.tar"}`))
+	}))
+	defer server.Close()
+
+	t.Log("overrides the Cache API URL")
+	{
+		localURL, err := localArchiveURL(pth, server.URL)
+		if err != nil || localURL != "file://"+pth {
+			t.Fatalf("localArchiveURL() = %s, %v, want file://%s", localURL, err, pth)
+		}
+		// the pull resolves and downloads the archive the way it does, without a request
+		apiURL, _, err := findCache([]string{localURL}, "download_url")
+		if err != nil || apiURL != localURL {
+			t.Errorf("findCache() = %s, %v, want the local archive", apiURL, err)
+		}
+		archivePth, err := downloadCacheArchive(http.DefaultClient, apiURL, false, expectedChecksum{})
+		if err != nil || archivePth != pth {
+			t.Errorf("downloadCacheArchive() = %s, %v, want the local archive used as it is", archivePth, err)
+		}
+		if n := atomic.LoadInt32(&requests); n != 0 {
+			t.Errorf("the Cache API got %d requests, want none", n)
+		}
+	}
+
+	t.Log("relative path")
+	{
+		wd, err := os.Getwd()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rel, err := filepath.Rel(wd, pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if localURL, err := localArchiveURL(rel, ""); err != nil || localURL != "file://"+pth {
+			t.Errorf("localArchiveURL() = %s, %v, want file://%s", localURL, err, pth)
+		}
+	}
+
+	t.Log("missing archive")
+	if _, err := localArchiveURL(filepath.Join(dir, "missing.tar"), server.URL); err == nil {
+		t.Errorf("localArchiveURL() error = nil, want the missing archive reported")
+	}
+
+	t.Log("directory")
+	if _, err := localArchiveURL(dir, ""); err == nil {
+		t.Errorf("localArchiveURL() error = nil, want the directory refused")
+	}
+}
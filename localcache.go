@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// archiveStore keeps the downloaded archives on a persistent runner, with their ETag and Last-Modified validators:
+// the next download of the same URL is a conditional request, and an unchanged archive (304) is not downloaded again.
+// Each URL keeps its last archive only.
+type archiveStore struct {
+	dir string
+}
+
+// localArchives is the store of the downloaded archives, nil if they are not kept.
+var localArchives *archiveStore
+
+// storedArchive is the metadata of a stored archive.
+type storedArchive struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Size         int64  `json:"size"`
+}
+
+// newArchiveStore creates the store in dir.
+func newArchiveStore(dir string) (*archiveStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &archiveStore{dir: dir}, nil
+}
+
+// archiveKey returns the store's key of the archive URL. The query and the user info are not part of it:
+// the presigned download URLs of the same archive differ in their signature only.
+func archiveKey(rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil {
+		u.User = nil
+		u.RawQuery = ""
+		u.Fragment = ""
+		rawURL = u.String()
+	}
+	sum := sha256.Sum256([]byte(rawURL))
+	return fmt.Sprintf("%x", sum[:16])
+}
+
+func (s *archiveStore) archivePath(key string) string {
+	return filepath.Join(s.dir, key+".tar")
+}
+
+func (s *archiveStore) metadataPath(key string) string {
+	return filepath.Join(s.dir, key+".json")
+}
+
+// lock acquires the URL's lock, held while its archive is requested, downloaded and stored:
+// the parallel pulls of the same URL wait for the first one's download, then their conditional request reuses its stored archive.
+func (s *archiveStore) lock(rawURL string) (*fileLock, error) {
+	return lockFile(filepath.Join(s.dir, archiveKey(rawURL)+".lock"), "waiting for another pull downloading the same archive")
+}
+
+// lookup returns the stored archive of the URL, nil if there is none or its file is missing.
+func (s *archiveStore) lookup(rawURL string) *storedArchive {
+	key := archiveKey(rawURL)
+	b, err := ioutil.ReadFile(s.metadataPath(key))
+	if err != nil {
+		return nil
+	}
+	var stored storedArchive
+	if err := json.Unmarshal(b, &stored); err != nil {
+		log.Warnf("Invalid stored archive metadata: %s", err)
+		return nil
+	}
+	if info, err := os.Stat(s.archivePath(key)); err != nil || info.Size() != stored.Size {
+		return nil
+	}
+	return &stored
+}
+
+// request requests the archive, conditionally if the URL has a stored archive.
+// It returns the stored archive's path if the server reports the archive unchanged,
+// otherwise the response of the archive (status 200).
+func (s *archiveStore) request(client *http.Client, rawURL string) (string, *http.Response, error) {
+	req, err := http.NewRequestWithContext(stepContext, "GET", rawURL, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	setHeaders(req, downloadHeaders)
+	stored := s.lookup(rawURL)
+	if stored != nil {
+		if stored.ETag != "" {
+			req.Header.Set("If-None-Match", stored.ETag)
+		}
+		if stored.LastModified != "" {
+			req.Header.Set("If-Modified-Since", stored.LastModified)
+		}
+	}
+	resp, err := doWithRetry(client, req)
+	if err != nil {
+		return "", nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && stored != nil:
+		_ = closeBody(resp.Body)
+		return s.archivePath(archiveKey(rawURL)), nil, nil
+	case resp.StatusCode != 200:
+		defer func() { _ = closeBody(resp.Body) }()
+		responseBytes, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return "", nil, err
+		}
+		return "", nil, &statusError{StatusCode: resp.StatusCode, Body: string(responseBytes)}
+	}
+	return "", resp, nil
+}
+
+// save stores the downloaded archive at pth with the response's validators, an archive without any of them is not stored.
+func (s *archiveStore) save(rawURL, pth string, header http.Header) error {
+	stored := storedArchive{URL: redactURL(rawURL), ETag: header.Get("ETag"), LastModified: header.Get("Last-Modified")}
+	if stored.ETag == "" && stored.LastModified == "" {
+		log.Debugf("the archive response has no ETag or Last-Modified header, the archive is not stored")
+		return nil
+	}
+	info, err := os.Stat(pth)
+	if err != nil {
+		return err
+	}
+	stored.Size = info.Size()
+
+	key := archiveKey(rawURL)
+	// the metadata is removed first, a half written archive is never reused
+	if err := os.Remove(s.metadataPath(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	tmpPth := s.archivePath(key) + ".tmp"
+	if err := linkOrCopy(pth, tmpPth); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPth, s.archivePath(key)); err != nil {
+		_ = os.Remove(tmpPth)
+		return err
+	}
+
+	b, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.metadataPath(key)+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(s.metadataPath(key)+".tmp", s.metadataPath(key))
+}
+
+// remove removes the stored archive of the URL.
+func (s *archiveStore) remove(rawURL string) {
+	key := archiveKey(rawURL)
+	for _, pth := range []string{s.metadataPath(key), s.archivePath(key)} {
+		if err := os.Remove(pth); err != nil && !os.IsNotExist(err) {
+			log.Warnf("Failed to remove the stored archive: %s", err)
+		}
+	}
+}
+
+// linkOrCopy hard links the file at src to dst, or copies it if src's file system does not support it (or dst is on another one).
+// An existing dst is replaced.
+func linkOrCopy(src, dst string) error {
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		_ = os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
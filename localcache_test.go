@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDownloadCacheArchive_LocalCache(t *testing.T) {
+	defer func(pth string) { cacheArchivePath = pth }(cacheArchivePath)
+	defer func(store *archiveStore) { localArchives = store }(localArchives)
+
+	archive := bytes.Repeat([]byte("archive"), 1024)
+	etag := `"v1"`
+	var requests, archiveRequests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		archiveRequests++
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write(archive)
+	}))
+	defer server.Close()
+
+	var err error
+	if localArchives, err = newArchiveStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	download := func(query string) []byte {
+		cacheArchivePath = filepath.Join(t.TempDir(), "cache-archive.tar")
+		pth, err := downloadCacheArchive(http.DefaultClient, server.URL+"/archive.tar"+query, false, expectedChecksum{})
+		if err != nil {
+			t.Fatalf("downloadCacheArchive() error = %v", err)
+		}
+		b, err := ioutil.ReadFile(pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	t.Log("the archive is downloaded and stored")
+	if b := download("?signature=1"); !bytes.Equal(b, archive) {
+		t.Fatalf("downloaded %d bytes, want the archive", len(b))
+	}
+
+	t.Log("the unchanged archive is reused, the presigned URL's signature differs")
+	if b := download("?signature=2"); !bytes.Equal(b, archive) || requests != 2 || archiveRequests != 1 {
+		t.Fatalf("got %d bytes in %d requests (%d archive downloads), want the stored archive reused", len(b), requests, archiveRequests)
+	}
+
+	t.Log("the changed archive is downloaded again")
+	etag = `"v2"`
+	archive = bytes.Repeat([]byte("changed"), 1024)
+	if b := download("?signature=3"); !bytes.Equal(b, archive) || archiveRequests != 2 {
+		t.Fatalf("got %d bytes in %d archive downloads, want the changed archive downloaded", len(b), archiveRequests)
+	}
+	if b := download(""); !bytes.Equal(b, archive) || archiveRequests != 2 {
+		t.Errorf("got %d bytes in %d archive downloads, want the changed archive stored", len(b), archiveRequests)
+	}
+}
+
+func TestDownloadCacheArchive_LocalCacheChecksum(t *testing.T) {
+	defer func(pth string) { cacheArchivePath = pth }(cacheArchivePath)
+	defer func(store *archiveStore) { localArchives = store }(localArchives)
+
+	archive := []byte("archive")
+	archiveRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		archiveRequests++
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write(archive)
+	}))
+	defer server.Close()
+
+	var err error
+	if localArchives, err = newArchiveStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	cacheArchivePath = filepath.Join(t.TempDir(), "cache-archive.tar")
+	if _, err := downloadCacheArchive(http.DefaultClient, server.URL, false, expectedChecksum{}); err != nil {
+		t.Fatal(err)
+	}
+	// the stored archive is corrupted
+	key := archiveKey(server.URL)
+	if err := ioutil.WriteFile(localArchives.archivePath(key), []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cacheArchivePath = filepath.Join(t.TempDir(), "cache-archive.tar")
+	sum := sha256.Sum256(archive)
+	checksum := expectedChecksum{Algorithm: "sha256", Sum: hex.EncodeToString(sum[:])}
+	pth, err := downloadCacheArchive(http.DefaultClient, server.URL, false, checksum)
+	if err != nil {
+		t.Fatalf("downloadCacheArchive() error = %v, want the archive downloaded again", err)
+	}
+	if b, _ := ioutil.ReadFile(pth); !bytes.Equal(b, archive) || archiveRequests != 2 {
+		t.Errorf("got %q in %d archive downloads, want the archive downloaded again", b, archiveRequests)
+	}
+}
+
+func TestDownloadCacheArchive_LocalCacheConcurrent(t *testing.T) {
+	defer func(pth string) { cacheArchivePath = pth }(cacheArchivePath)
+	defer func(store *archiveStore) { localArchives = store }(localArchives)
+
+	archive := bytes.Repeat([]byte("archive"), 1024)
+	var mu sync.Mutex
+	archiveRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		mu.Lock()
+		archiveRequests++
+		mu.Unlock()
+		// the download takes a while, the other pulls request the archive meanwhile
+		time.Sleep(200 * time.Millisecond)
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write(archive)
+	}))
+	defer server.Close()
+
+	var err error
+	if localArchives, err = newArchiveStore(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	cacheArchivePath = filepath.Join(t.TempDir(), "cache-archive.tar")
+
+	// the pulls of separate processes share the store, each of them locks its own lock file descriptor
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := downloadCacheArchive(http.DefaultClient, server.URL+"/archive.tar?signature="+strconv.Itoa(i), false, expectedChecksum{})
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("downloadCacheArchive() error = %v", err)
+		}
+	}
+	if archiveRequests != 1 {
+		t.Errorf("the archive is downloaded %d times, want once", archiveRequests)
+	}
+	if b, err := ioutil.ReadFile(cacheArchivePath); err != nil || !bytes.Equal(b, archive) {
+		t.Errorf("downloaded %d bytes, %v, want the archive", len(b), err)
+	}
+}
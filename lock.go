@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// extractionLockPath returns the path of the lock file of the extraction root, the pulls into the same root share it.
+func extractionLockPath(root string) string {
+	sum := sha256.Sum256([]byte(filepath.Clean(root)))
+	return filepath.Join(os.TempDir(), fmt.Sprintf("steps-cache-pull-%x.lock", sum[:8]))
+}
+
+// fileLock is an advisory (flock) lock of a lock file, held by a single pull at a time.
+type fileLock struct {
+	f *os.File
+}
+
+// lockExtraction acquires the extraction root's lock, it waits while another pull holds it.
+// The lock is released by the system if the process exits without unlocking it.
+func lockExtraction(root string) (*fileLock, error) {
+	return lockFile(extractionLockPath(root), fmt.Sprintf("waiting for another pull into %s to finish", root))
+}
+
+// lockFile acquires the lock of the lock file at pth, it logs the waiting message and waits while another pull holds it.
+func lockFile(pth, waiting string) (*fileLock, error) {
+	f, err := os.OpenFile(pth, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err == syscall.EWOULDBLOCK {
+		log.Printf("%s", waiting)
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	} else if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return &fileLock{f: f}, nil
+}
+
+// unlock releases the lock.
+func (l *fileLock) unlock() {
+	if err := syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN); err != nil {
+		log.Warnf("Failed to release the lock %s: %s", l.f.Name(), err)
+	}
+	if err := l.f.Close(); err != nil {
+		log.Warnf("Failed to close the lock %s: %s", l.f.Name(), err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLockExtraction_ConcurrentPulls(t *testing.T) {
+	root := t.TempDir()
+	marker := filepath.Join(t.TempDir(), "marker")
+	archive := createTestArchive(t,
+		testEntry{hdr: tar.Header{Name: "/cache/File.txt", Typeflag: tar.TypeReg}, body: strings.Repeat("cache", 64*1024)},
+	).Bytes()
+
+	var holders, extractions int32
+	pull := func() error {
+		lock, err := lockExtraction(root)
+		if err != nil {
+			return err
+		}
+		defer lock.unlock()
+		if atomic.AddInt32(&holders, 1) > 1 {
+			t.Errorf("the extraction lock is held by two pulls")
+		}
+		defer atomic.AddInt32(&holders, -1)
+
+		if match, err := markerMatches(marker, "archive-id"); err != nil || match {
+			return err
+		}
+		atomic.AddInt32(&extractions, 1)
+		// a slow extraction, the other pull waits for it
+		time.Sleep(100 * time.Millisecond)
+		if _, err := extractCacheArchive(bytes.NewReader(archive), extractOptions{Root: root}); err != nil {
+			return err
+		}
+		return writeMarker(marker, "archive-id")
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = pull()
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("pull %d error = %v", i, err)
+		}
+	}
+	if extractions != 1 {
+		t.Errorf("extractions = %d, want 1, the second pull skipped by the marker", extractions)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(root, "cache", "File.txt")); err != nil || string(b) != strings.Repeat("cache", 64*1024) {
+		t.Errorf("extracted file is corrupt: %d bytes, %v", len(b), err)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// The log_format values.
+const (
+	logFormatConsole = "console"
+	logFormatJSON    = "json"
+)
+
+// logWriter receives the lines of the log package: the URLs in them are redacted,
+// and in the JSON format each line is written as a single line JSON object, its level told by the line's color.
+type logWriter struct {
+	out  io.Writer
+	json bool
+	now  func() time.Time
+
+	mu sync.Mutex
+}
+
+// stepLog is the JSON log writer emitting the events, nil in the console format.
+var stepLog *logWriter
+
+// setupLog makes the log package write through a logWriter of the format.
+func setupLog(format string, out io.Writer) {
+	w := &logWriter{out: out, json: format == logFormatJSON, now: time.Now}
+	log.SetOutWriter(w)
+	stepLog = nil
+	if w.json {
+		stepLog = w
+	}
+}
+
+// logLevels maps the log package's line colors to the levels, the uncolored lines are info.
+var logLevels = map[string]string{
+	"\x1b[31;1m": "error",
+	"\x1b[33;1m": "warn",
+	"\x1b[34;1m": "info",
+	"\x1b[32;1m": "info",
+}
+
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// Write implements the io.Writer interface, p is a log line.
+func (w *logWriter) Write(p []byte) (int, error) {
+	line := redactURLs(string(p))
+	if !w.json {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if _, err := io.WriteString(w.out, line); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	level := "info"
+	for color, l := range logLevels {
+		if strings.HasPrefix(line, color) {
+			level = l
+		}
+	}
+	message := strings.TrimSpace(ansiEscape.ReplaceAllString(line, ""))
+	if message == "" {
+		return len(p), nil
+	}
+	if err := w.writeJSON(map[string]interface{}{"level": level, "message": message}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeJSON writes the entry as a JSON line, with the current time.
+func (w *logWriter) writeJSON(entry map[string]interface{}) error {
+	entry["time"] = w.now().UTC().Format(time.RFC3339Nano)
+	var b bytes.Buffer
+	// the messages are not HTML, < and > are kept as they are
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(entry); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := w.out.Write(b.Bytes())
+	return err
+}
+
+// logEvent logs a significant event of the pull with its fields, in the JSON format only:
+// the console format has the event's human readable lines.
+func logEvent(event string, fields map[string]interface{}) {
+	if stepLog == nil {
+		return
+	}
+	entry := map[string]interface{}{"level": "info", "event": event}
+	for key, value := range fields {
+		if s, ok := value.(string); ok {
+			value = redactURLs(s)
+		}
+		entry[key] = value
+	}
+	if err := stepLog.writeJSON(entry); err != nil {
+		fmt.Printf("failed to log the %s event: %s\n", event, err)
+	}
+}
+
+// redactedValue replaces the credentials of the logged URLs.
+const redactedValue = "REDACTED"
+
+var urlPattern = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s"'<>]+`)
+
+// redactURLs redacts the URLs in the text.
+func redactURLs(s string) string {
+	if !strings.Contains(s, "://") {
+		return s
+	}
+	return urlPattern.ReplaceAllStringFunc(s, redactURL)
+}
+
+// redactURL redacts the URL's user info and query values: a presigned URL's signature, or a token passed in the URL is not logged.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.User == nil && u.RawQuery == "") {
+		return rawURL
+	}
+	if u.User != nil {
+		u.User = url.User(redactedValue)
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		for key := range query {
+			query[key] = []string{redactedValue}
+		}
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+// printConfig logs the config's fields, like stepconf.Print does, through the log package: the URLs are redacted,
+// and in the JSON format the config is logged line by line.
+func printConfig(config interface{}) {
+	v := reflect.ValueOf(config)
+	t := v.Type()
+	log.Infof("%s:", strings.Title(t.Name()))
+	for i := 0; i < t.NumField(); i++ {
+		// the stepconf.Secret fields are masked by their String method
+		log.Printf("- %s: %v", t.Field(i).Name, v.Field(i).Interface())
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// Handling of the archive's entries, whose full path (joined with the extraction root) exceeds the filesystem's limit.
+const (
+	// longPathsSkip leaves the entry out of the extraction.
+	longPathsSkip = "skip"
+	// longPathsFail fails the extraction.
+	longPathsFail = "fail"
+	// longPathsTruncate shortens the entry's name to fit, keeping its extension and making it unique with a hash of the original name.
+	longPathsTruncate = "truncate"
+)
+
+// longPathError is returned if an entry's path is too long for the filesystem, and it can not be truncated or the extraction is configured to fail.
+type longPathError struct {
+	Path string
+	Max  int
+}
+
+// Error implements the error interface.
+func (e *longPathError) Error() string {
+	return fmt.Sprintf("%s is %d bytes long, the filesystem's limit is %d bytes", e.Path, len(e.Path), e.Max)
+}
+
+// resolveLongPath handles the entry, if its target path is longer than max, with the given policy.
+// It reports whether the entry should be skipped, a truncated entry's header is renamed.
+func resolveLongPath(hdr *tar.Header, root, policy string, max int) (bool, error) {
+	target := entryTarget(hdr.Name, root)
+	if len(target) <= max {
+		return false, nil
+	}
+
+	switch policy {
+	case longPathsSkip:
+		log.Warnf("Skipping %s, its path is longer than the filesystem's %d bytes limit", hdr.Name, max)
+		return true, nil
+	case longPathsTruncate:
+		name, ok := truncateEntryName(strings.TrimRight(hdr.Name, "/"), len(target)-max)
+		if !ok {
+			return false, &longPathError{Path: target, Max: max}
+		}
+		log.Warnf("Extracting %s as %s, its path is longer than the filesystem's %d bytes limit", hdr.Name, name, max)
+		hdr.Name = name
+		return false, nil
+	default:
+		return false, &longPathError{Path: target, Max: max}
+	}
+}
+
+// truncateEntryName shortens the entry name's last component by at least excess bytes.
+// It reports false if the last component is too short to be truncated that much.
+func truncateEntryName(name string, excess int) (string, bool) {
+	dir, base := path.Split(name)
+	ext := path.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+
+	sum := sha256.Sum256([]byte(name))
+	suffix := fmt.Sprintf("~%x", sum[:4])
+	keep := len(stem) - excess - len(suffix)
+	// a multi-byte character is not cut
+	for keep > 0 && !utf8.RuneStart(stem[keep]) {
+		keep--
+	}
+	if keep < 1 {
+		return "", false
+	}
+	return dir + stem[:keep] + suffix + ext, true
+}
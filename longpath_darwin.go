@@ -0,0 +1,18 @@
+//go:build darwin
+
+package main
+
+import "syscall"
+
+// pcPathMax is pathconf's _PC_PATH_MAX name on Darwin.
+const pcPathMax = 5
+
+// pathMax returns the longest path the filesystem of pth accepts, as reported by pathconf.
+var pathMax = func(pth string) int {
+	max, err := syscall.Pathconf(pth, pcPathMax)
+	if err != nil || max <= 0 {
+		// MAXPATHLEN
+		return 1024
+	}
+	return max
+}
@@ -0,0 +1,9 @@
+//go:build !darwin
+
+package main
+
+// pathMax returns the longest path the filesystem of pth accepts.
+// Linux has no pathconf system call, the C library reports the kernel's PATH_MAX for each filesystem.
+var pathMax = func(pth string) int {
+	return 4096
+}
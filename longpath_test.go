@@ -0,0 +1,67 @@
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExtractCacheArchive_LongPaths(t *testing.T) {
+	deep := "/" + strings.Repeat("deep/", 900) + "file.txt"
+
+	for _, policy := range []string{longPathsSkip, longPathsFail, longPathsTruncate} {
+		root := t.TempDir()
+		archive := createTestArchive(t,
+			testEntry{hdr: tar.Header{Name: deep, Typeflag: tar.TypeReg}, body: "deep"},
+			testEntry{hdr: tar.Header{Name: "/cache/File.txt", Typeflag: tar.TypeReg}, body: "cache"},
+		)
+		_, err := extractCacheArchive(archive, extractOptions{Root: root, LongPaths: policy})
+
+		switch policy {
+		case longPathsSkip:
+			if err != nil {
+				t.Fatalf("%s: extractCacheArchive() error = %v", policy, err)
+			}
+			if b, err := ioutil.ReadFile(filepath.Join(root, "cache", "File.txt")); err != nil || string(b) != "cache" {
+				t.Errorf("%s: the entry after the skipped one is not extracted: %v", policy, err)
+			}
+		default:
+			// the deep entry's directories alone are too long to truncate its name
+			pathErr, ok := err.(*longPathError)
+			if !ok {
+				t.Fatalf("%s: extractCacheArchive() error = %v, want long path error", policy, err)
+			}
+			if pathErr.Path != filepath.Join(root, deep) || pathErr.Max != pathMax(root) {
+				t.Errorf("%s: long path error = %s", policy, pathErr)
+			}
+		}
+	}
+}
+
+func TestExtractCacheArchive_TruncateLongPath(t *testing.T) {
+	root := t.TempDir()
+	defer func(fn func(string) int) { pathMax = fn }(pathMax)
+	max := len(root) + 64
+	pathMax = func(string) int { return max }
+
+	long := "/cache/" + strings.Repeat("long", 50) + ".txt"
+	archive := createTestArchive(t,
+		testEntry{hdr: tar.Header{Name: long, Typeflag: tar.TypeReg}, body: "long"},
+	)
+	if _, err := extractCacheArchive(archive, extractOptions{Root: root, LongPaths: longPathsTruncate}); err != nil {
+		t.Fatalf("extractCacheArchive() error = %v", err)
+	}
+
+	matches, err := filepath.Glob(filepath.Join(root, "cache", "longlong*~*.txt"))
+	if err != nil || len(matches) != 1 {
+		t.Fatalf("truncated entry not found: %v, %v", matches, err)
+	}
+	if len(matches[0]) > max {
+		t.Errorf("truncated path is %d bytes, want at most %d", len(matches[0]), max)
+	}
+	if b, err := ioutil.ReadFile(matches[0]); err != nil || string(b) != "long" {
+		t.Errorf("truncated entry = %q, %v", b, err)
+	}
+}
@@ -1,16 +1,20 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/bitrise-io/go-steputils/stepconf"
 	"github.com/bitrise-io/go-utils/log"
@@ -18,240 +22,1829 @@ import (
 
 // Config stores the step inputs.
 type Config struct {
-	CacheAPIURL string `env:"cache_api_url"`
-	DebugMode   bool   `env:"is_debug_mode,opt[true,false]"`
-	StackID     string `env:"BITRISEIO_STACK_ID"`
+	CacheAPIURL         string          `env:"cache_api_url"`
+	DownloadKeepAlive   bool            `env:"download_keep_alive,opt[true,false]"`
+	ErrorReportPath     string          `env:"error_report_path"`
+	ExtractMetadata     bool            `env:"extract_metadata,opt[true,false]"`
+	MarkerPath          string          `env:"marker_path"`
+	AcceptRelativeURL   bool            `env:"accept_relative_download_url,opt[true,false]"`
+	ParallelChecksum    bool            `env:"parallel_checksum,opt[true,false]"`
+	PrefetchTarget      bool            `env:"prefetch_target,opt[true,false]"`
+	ExportArchiveStats  bool            `env:"export_archive_stats,opt[true,false]"`
+	ExpectedCachePaths  string          `env:"expected_cache_paths"`
+	OTLPEndpoint        string          `env:"otlp_traces_endpoint"`
+	IgnoreZeroLength    bool            `env:"ignore_zero_content_length,opt[true,false]"`
+	DownloadChunkSize   int             `env:"download_chunk_size"`
+	RequireArchiveStack bool            `env:"require_archive_stack,opt[true,false]"`
+	StackMismatch       string          `env:"stack_mismatch_behavior,opt[skip,restore,fail]"`
+	CheckFreeSpace      bool            `env:"check_free_space,opt[true,false]"`
+	FreeSpaceMargin     int             `env:"free_space_margin"`
+	AuthToken           stepconf.Secret `env:"auth_token"`
+	AuthHeader          stepconf.Secret `env:"auth_header"`
+	DownloadAuth        bool            `env:"download_auth,opt[true,false]"`
+	CacheAgeWarning     int             `env:"cache_age_warning"`
+	PeekBufferLimit     int             `env:"peek_buffer_limit"`
+	ExtractConcurrency  int             `env:"extract_concurrency"`
+	AllowedSchemes      string          `env:"allowed_url_schemes"`
+	AllowedHosts        string          `env:"allowed_url_hosts"`
+	FailOnMiss          bool            `env:"fail_on_cache_miss,opt[true,false]"`
+	SpoolStream         bool            `env:"spool_stream,opt[true,false]"`
+	LogFormat           string          `env:"log_format,opt[console,json]"`
+	AcceptedStacks      string          `env:"accepted_stack_ids"`
+	LocalCache          bool            `env:"local_cache,opt[true,false]"`
+	LocalCacheDir       string          `env:"local_cache_dir"`
+	StreamBuffer        int             `env:"stream_buffer_size"`
+	SkipIdentical       string          `env:"skip_existing_identical,opt[none,metadata,content]"`
+	RequiredPolicy      string          `env:"required_files_policy,opt[fail,warn]"`
+	CopyLocal           bool            `env:"copy_local_archive,opt[true,false]"`
+	MaxArchiveSize      int             `env:"max_archive_size"`
+	EntryTimeout        int             `env:"entry_timeout"`
+	StripComponents     int             `env:"strip_components"`
+	RequireArchiveInfo  bool            `env:"require_archive_info,opt[true,false]"`
+	ExportDownloadURL   string          `env:"export_download_url_to"`
+	DownloadParts       int             `env:"download_parts"`
+	AtomicRestore       bool            `env:"atomic_restore,opt[true,false]"`
+	ContinueOnError     bool            `env:"continue_on_error,opt[true,false]"`
+	FailedPolicy        string          `env:"failed_entries_policy,opt[fail,warn]"`
+	LocalArchivePath    string          `env:"local_archive_path"`
+	LogCacheDiff        bool            `env:"log_cache_diff,opt[true,false]"`
+	MonitorFreeSpace    bool            `env:"monitor_free_space,opt[true,false]"`
+	MinFreeSpace        int             `env:"min_free_space"`
+	DownloadURLJSONPath string          `env:"download_url_json_path,required"`
+	ExtractRoot         string          `env:"extract_root"`
+	ExtractDirStamp     string          `env:"extract_dir_stamp,opt[none,created_at,build_slug]"`
+	DecryptionKeys      stepconf.Secret `env:"decryption_keys"`
+	ReportResourceUsage bool            `env:"report_resource_usage,opt[true,false]"`
+	ExistingSymlinks    string          `env:"existing_symlinks,opt[replace,follow,fail]"`
+	DirFileConflicts    string          `env:"dir_file_conflict_policy,opt[fail,remove,skip]"`
+	LongPaths           string          `env:"long_path_policy,opt[skip,fail,truncate]"`
+	Mode                string          `env:"mode,opt[pull,info]"`
+	OverlapExtract      bool            `env:"overlap_download_extract,opt[true,false]"`
+	FallbackMode        string          `env:"fallback_mode,opt[file,pipe]"`
+	PermissionsManifest string          `env:"permissions_manifest"`
+	GzipResync          bool            `env:"gzip_resync,opt[true,false]"`
+	SignaturePublicKey  string          `env:"signature_public_key"`
+	AllowBadSignature   bool            `env:"allow_invalid_signature,opt[true,false]"`
+	DNSRetries          int             `env:"dns_retries"`
+	DNSRetryWait        int             `env:"dns_retry_wait"`
+	ExportBreadcrumb    bool            `env:"export_breadcrumb,opt[true,false]"`
+	PrefetchNext        bool            `env:"prefetch_next,opt[true,false]"`
+	MissStatusCodes     string          `env:"miss_status_codes"`
+	APITimeout          int             `env:"api_timeout"`
+	DownloadURLCacheTTL int             `env:"download_url_cache_ttl"`
+	DiskWarningPercent  int             `env:"disk_size_warning_percent"`
+	ConfineRoot         bool            `env:"confine_to_root,opt[true,false]"`
+	PullLock            bool            `env:"pull_lock,opt[true,false]"`
+	ReportTopEntries    bool            `env:"report_top_entries,opt[true,false]"`
+	TopEntriesCount     int             `env:"top_entries_count"`
+	SizeReport          bool            `env:"size_report,opt[true,false]"`
+	MinFormatVersion    int             `env:"min_archive_format_version"`
+	RetryCount          int             `env:"retry_count"`
+	RetryBaseDelay      int             `env:"retry_base_delay"`
+	RetryAfterMax       int             `env:"retry_after_max"`
+	RequiredFiles       string          `env:"required_files"`
+	TmpDir              string          `env:"tmp_dir"`
+	CacheURLs           string          `env:"cache_urls"`
+	TransientExitCode   int             `env:"transient_exit_code"`
+	PermanentExitCode   int             `env:"permanent_exit_code"`
+	ProxyURL            string          `env:"proxy_url"`
+	DownloadTimeout     int             `env:"download_timeout"`
+	AcceptZip           bool            `env:"accept_zip,opt[true,false]"`
+	VerifyPerFile       string          `env:"verify_per_file,opt[none,warn,fail]"`
+	ProgressAnnotations bool            `env:"progress_annotations,opt[true,false]"`
+	FeaturesPolicy      string          `env:"required_features_policy,opt[fail,warn,ignore]"`
+	MaxDuration         int             `env:"max_duration"`
+	IncludePaths        string          `env:"include_paths"`
+	ExcludePaths        string          `env:"exclude_paths"`
+	DryRun              bool            `env:"dry_run,opt[true,false]"`
+	SummaryPath         string          `env:"summary_path"`
+	DebugMode           bool            `env:"is_debug_mode,opt[true,false]"`
+	StackID             string          `env:"BITRISEIO_STACK_ID"`
 }
 
-// downloadCacheArchive downloads the cache archive and returns the downloaded file's path.
-// If the URI points to a local file it returns the local paths.
-func downloadCacheArchive(url string) (string, error) {
-	if strings.HasPrefix(url, "file://") {
-		return strings.TrimPrefix(url, "file://"), nil
+// proxyFunc selects the proxy of the Cache API and the archive download requests. The HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+// environment variables are honored by default, the proxy_url input overrides them.
+var proxyFunc = http.ProxyFromEnvironment
+
+// parseProxyURL parses the explicitly configured proxy's URL, a bare host:port is an HTTP proxy.
+func parseProxyURL(rawURL string) (*url.URL, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("no proxy host in %s", rawURL)
+	}
+	return u, nil
+}
+
+// newDownloadClient creates the http client used for the archive download.
+// The download gets its own transport, so that disabling keep-alive (forcing a fresh connection)
+// does not affect the cache API call.
+func newDownloadClient(keepAlive bool) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableKeepAlives = !keepAlive
+	transport.DialContext = stallDialContext(newDNSRetryDialer().DialContext, downloadStallTimeout)
+	transport.Proxy = proxyFunc
+	if downloadStallTimeout > 0 {
+		transport.ResponseHeaderTimeout = responseHeaderTimeout
+	}
+	registerBucketProtocols(transport)
+	return &http.Client{Transport: transport}
+}
+
+// maxBodyDrainSize is the most bytes read from a response body before closing it.
+const maxBodyDrainSize = 256 * 1024
+
+// closeBody drains the rest of a response body (up to maxBodyDrainSize) and closes it, so the connection can be reused.
+// A failing close does not invalidate the completely read body: the error is warned about, and returned to be recorded.
+func closeBody(body io.ReadCloser) error {
+	if _, err := io.Copy(ioutil.Discard, io.LimitReader(body, maxBodyDrainSize)); err != nil {
+		log.Debugf("failed to drain response body: %s", err)
 	}
+	err := body.Close()
+	if err != nil {
+		log.Warnf("Failed to close response body: %s", err)
+	}
+	return err
+}
+
+// fallbackModePipe downloads the archive again into the tar tool's input in the fallback, instead of into cacheArchivePath.
+const fallbackModePipe = "pipe"
 
-	resp, err := http.Get(url)
+// cacheArchivePath is the path the cache archive is downloaded to, if it is not extracted from the download stream.
+// Each run downloads into its own temporary directory, see newArchiveTempDir.
+var cacheArchivePath = filepath.Join(os.TempDir(), "cache-archive.tar")
+
+// newArchiveTempDir creates the run's temporary directory under dir (the OS temp dir if empty),
+// and points cacheArchivePath into it, so concurrent pulls on the same machine do not collide.
+func newArchiveTempDir(dir string) (string, error) {
+	tmpDir, err := ioutil.TempDir(dir, "cache-pull-")
 	if err != nil {
 		return "", err
 	}
+	cacheArchivePath = filepath.Join(tmpDir, "cache-archive.tar")
+	return tmpDir, nil
+}
 
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			log.Warnf("Failed to close response body: %s", err)
-		}
-	}()
+// downloadCacheArchive downloads the cache archive and returns the downloaded file's path.
+// If the checksum is known, the archive is hashed while it is written, and a mismatching download fails.
+// If the URI points to a local file it returns the local paths.
+func downloadCacheArchive(client *http.Client, url string, ignoreZeroLength bool, checksum expectedChecksum) (string, error) {
+	if strings.HasPrefix(url, "file://") {
+		return strings.TrimPrefix(url, "file://"), nil
+	}
 
-	if resp.StatusCode != 200 {
-		responseBytes, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
+	var body io.ReadCloser
+	var size int64
+	var header http.Header
+	if localArchives != nil {
+		if lock, err := localArchives.lock(url); err != nil {
+			log.Warnf("Failed to lock the stored archive: %s", err)
+		} else {
+			defer lock.unlock()
+		}
+		storedPth, resp, err := localArchives.request(client, url)
+		switch {
+		case err != nil:
+			log.Warnf("Conditional archive request failed: %s, downloading the archive", err)
+		case storedPth != "":
+			pth, err := reuseStoredArchive(url, storedPth, checksum)
+			if err == nil {
+				return pth, nil
+			}
+			log.Warnf("Failed to reuse the stored archive: %s, downloading the archive", err)
+		case resp.ContentLength == 0:
+			// the zero Content-Length is handled by requestArchive
+			_ = closeBody(resp.Body)
+		default:
+			if body, err = sniffArchive(resp.Body); err != nil {
+				return "", err
+			}
+			size, header = resp.ContentLength, resp.Header
+		}
+	}
+	if body == nil {
+		var err error
+		if body, size, err = requestArchive(client, url, ignoreZeroLength); err != nil {
 			return "", err
 		}
+	}
 
-		return "", fmt.Errorf("non success response code: %d, body: %s", resp.StatusCode, string(responseBytes))
+	defer func() { _ = closeBody(body) }()
+	if err := checkArchiveSize(size); err != nil {
+		return "", err
 	}
 
-	const cacheArchivePath = "/tmp/cache-archive.tar"
+	// the file might be a hard link of the stored archive, it is replaced instead of being truncated
+	if err := os.Remove(cacheArchivePath); err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to remove the previous local cache file: %s", err)
+	}
 	f, err := os.Create(cacheArchivePath)
 	if err != nil {
 		return "", fmt.Errorf("failed to open the local cache file for write: %s", err)
 	}
 
-	_, err = io.Copy(f, resp.Body)
+	h := checksum.newHash()
+	progress := newProgressWriter(size)
+	// the download stops at the max_archive_size, before filling the disk
+	limit := newSizeLimit()
+	written, err := io.Copy(io.MultiWriter(f, h, progress, limit), body)
+	err = checkReceived(written, size, err)
+	for attempt := 1; err != nil && isConnectionError(err) && attempt <= requestRetries; attempt++ {
+		// an interrupted download is resumed from the received bytes, instead of starting over
+		_ = body.Close()
+		delay := retryDelay(requestRetryBaseDelay, attempt)
+		log.Warnf("Download interrupted after %d bytes (attempt %d/%d): %s, resuming in %s", written, attempt, requestRetries+1, err, delay)
+		if !sleepContext(stepContext, delay) {
+			err = stepContext.Err()
+			break
+		}
+
+		var partial bool
+		body, partial, err = resumeArchive(client, url, written)
+		if err != nil {
+			body = ioutil.NopCloser(strings.NewReader(""))
+			continue
+		}
+		if !partial {
+			log.Warnf("Download server does not support range requests, downloading the archive again")
+			if _, err = f.Seek(0, io.SeekStart); err == nil {
+				err = f.Truncate(0)
+			}
+			if err != nil {
+				return "", err
+			}
+			h.Reset()
+			progress.reset()
+			limit.reset()
+			written = 0
+		}
+
+		var n int64
+		n, err = io.Copy(io.MultiWriter(f, h, progress, limit), body)
+		written += n
+		err = checkReceived(written, size, err)
+	}
 	if err != nil {
 		return "", err
 	}
+	if written == 0 {
+		return "", errors.New("downloaded cache archive is empty")
+	}
+	progress.finish()
+	if err := checksum.verify(h.Sum(nil)); err != nil {
+		return "", err
+	}
+	if header != nil {
+		if err := localArchives.save(url, cacheArchivePath, header); err != nil {
+			log.Warnf("Failed to store the archive for the next download: %s", err)
+		}
+	}
 
 	return cacheArchivePath, nil
 }
 
-// performRequest performs an http request and returns the response's body, if the status code is 200.
-func performRequest(url string) (io.ReadCloser, error) {
-	resp, err := http.Get(url)
+// reuseStoredArchive links the stored archive unchanged on the server to cacheArchivePath, and verifies its checksum.
+// A mismatching stored archive is removed.
+func reuseStoredArchive(url, storedPth string, checksum expectedChecksum) (string, error) {
+	if err := linkOrCopy(storedPth, cacheArchivePath); err != nil {
+		return "", err
+	}
+	if err := verifyFileChecksum(cacheArchivePath, checksum); err != nil {
+		localArchives.remove(url)
+		return "", err
+	}
+	log.Donef("The cache archive is unchanged since the last download, reusing the stored archive")
+	logEvent("stored_archive_reused", map[string]interface{}{"url": url})
+	return cacheArchivePath, nil
+}
+
+// copyLocalArchive copies the local archive file at src to dst, so the extraction and its fallback read a stable copy:
+// not the original file, which might change between the reads, or be slow to read twice.
+func copyLocalArchive(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("local cache archive copied: %d bytes", n)
+	return nil
+}
+
+// requestArchive requests the cache archive and returns the response's body and content length (-1 if unknown).
+// Some misconfigured servers send a zero Content-Length, yet stream the archive. A close-delimited response's zero Content-Length
+// is not trusted: the archive is requested again and read until the server closes the connection, like a response without a length.
+// A keep-alive response's zero Content-Length is only ignored this way if ignoreZeroLength is set.
+// A chunked response has no length, net/http drops its Content-Length header.
+func requestArchive(client *http.Client, url string, ignoreZeroLength bool) (io.ReadCloser, int64, error) {
+	resp, err := requestOK(client, url)
+	if err != nil {
+		return nil, 0, err
+	}
+	body, size := resp.Body, resp.ContentLength
+	// a too large archive is not downloaded
+	if err := checkArchiveSize(size); err != nil {
+		_ = closeBody(body)
+		return nil, 0, err
+	}
+	if body, err = sniffArchive(body); err != nil {
+		return nil, 0, err
+	}
+	if size != 0 {
+		return body, size, nil
+	}
+
+	// the object storages are not read until the connection is closed, they are not misconfigured servers
+	if isBucketURL(url) || (!resp.Close && !ignoreZeroLength) {
+		log.Warnf("Cache archive response has a zero Content-Length, the archive might be empty")
+		return body, -1, nil
+	}
+
+	if err := body.Close(); err != nil {
+		log.Warnf("Failed to close response body: %s", err)
+	}
+	log.Warnf("Cache archive response has a zero Content-Length, reading the archive until the connection is closed")
+
+	if body, err = requestUntilClose(client, url); err != nil {
+		return nil, 0, err
+	}
+	body, err = sniffArchive(body)
+	return body, -1, err
+}
+
+// performRequest performs an http request and returns the response's body and content length (-1 if unknown),
+// if the status code is 200. Connection errors and 5xx and 429 responses are retried.
+func performRequest(client *http.Client, url string) (io.ReadCloser, int64, error) {
+	resp, err := requestOK(client, url)
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+// requestOK performs a GET request of the archive download and returns the response, if the status code is 200.
+// Connection errors and 5xx and 429 responses are retried.
+func requestOK(client *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(stepContext, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	setHeaders(req, downloadHeaders)
+	resp, err := doWithRetry(client, req)
 	if err != nil {
 		return nil, err
 	}
 
 	if resp.StatusCode != 200 {
-		defer func() {
-			if err := resp.Body.Close(); err != nil {
-				log.Warnf("Failed to close response body: %s", err)
-			}
-		}()
+		defer func() { _ = closeBody(resp.Body) }()
 
 		responseBytes, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
 			return nil, err
 		}
 
-		return nil, fmt.Errorf("non success response code: %d, body: %s", resp.StatusCode, string(responseBytes))
+		return nil, &statusError{StatusCode: resp.StatusCode, Body: string(responseBytes)}
+	}
+
+	return resp, nil
+}
+
+// errCacheMiss is returned by getCacheDownloadURL if the Cache API reports that there is no cache (one of missStatusCodes).
+var errCacheMiss = errors.New("no cache found")
+
+// apiTimeout is the timeout of the Cache API request, the archive download is not limited by it.
+var apiTimeout = 20 * time.Second
+
+// missStatusCodes are the Cache API response status codes meaning there is no cache, a clean miss.
+var missStatusCodes = []int{http.StatusNoContent}
+
+// parseStatusCodes parses the comma or newline separated list of HTTP status codes.
+func parseStatusCodes(list string) ([]int, error) {
+	var codes []int
+	for _, item := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		code, err := strconv.Atoi(item)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid HTTP status code: %s", item)
+		}
+		codes = append(codes, code)
 	}
+	return codes, nil
+}
 
-	return resp.Body, nil
+// cacheAPIResponse is the Cache API's response model.
+type cacheAPIResponse struct {
+	DownloadURL string
+	// DirURL is the cache's pre-extracted directory (the optional `dir_url` field), used as the last fallback.
+	DirURL string
+	// InfoURL is the archive info sidecar (the optional `info_url` field), read in info mode.
+	InfoURL string
+	// SignatureURL is the archive's detached signature (the optional `signature_url` field).
+	SignatureURL string
+	// PartURLs are the download URLs of a split archive's further parts (the optional `part_urls` field).
+	PartURLs []string
+	// Checksum is the archive's checksum (the optional `sha256` or `md5` field).
+	Checksum expectedChecksum
+}
+
+// findCache gets the cache download URL from the first of the Cache API URLs having a cache, the others are the fallbacks tried in order.
+// A local file:// or dir:// URL, or a gs:// or s3:// object URL is used as it is, the URLs after it are not tried. errCacheMiss is returned if none of them has a cache.
+func findCache(apiURLs []string, jsonPath string) (string, cacheAPIResponse, error) {
+	for i, apiURL := range apiURLs {
+		var apiResp cacheAPIResponse
+		if !strings.HasPrefix(apiURL, "file://") && !strings.HasPrefix(apiURL, "dir://") && !isBucketURL(apiURL) {
+			var err error
+			apiResp, err = lookupCacheDownloadURL(apiURL, jsonPath)
+			if err == errCacheMiss {
+				if i < len(apiURLs)-1 {
+					log.Warnf("No cache found at %s, trying the next Cache API URL", apiURL)
+				}
+				continue
+			}
+			if err != nil {
+				return apiURL, cacheAPIResponse{}, err
+			}
+		}
+		if len(apiURLs) > 1 {
+			log.Infof("Cache found at %s (%d. of the %d Cache API URLs)", apiURL, i+1, len(apiURLs))
+		}
+		return apiURL, apiResp, nil
+	}
+	return "", cacheAPIResponse{}, errCacheMiss
 }
 
-// getCacheDownloadURL gets the given build's cache download URL.
-func getCacheDownloadURL(cacheAPIURL string) (string, error) {
-	req, err := http.NewRequest("GET", cacheAPIURL, nil)
+// getCacheDownloadURL gets the given build's cache download URL, from the given path of the JSON response.
+func getCacheDownloadURL(cacheAPIURL, jsonPath string) (cacheAPIResponse, error) {
+	defer stepTimings.measure(&stepTimings.urlResolution)()
+	req, err := http.NewRequestWithContext(stepContext, "GET", cacheAPIURL, nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %s", err)
+		return cacheAPIResponse{}, fmt.Errorf("failed to create request: %s", err)
 	}
+	setHeaders(req, apiHeaders)
 
-	client := &http.Client{Timeout: 20 * time.Second}
-	resp, err := client.Do(req)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = newDNSRetryDialer().DialContext
+	transport.Proxy = proxyFunc
+	client := &http.Client{Timeout: apiTimeout, Transport: transport}
+	resp, err := doWithRetry(client, req)
 	if err != nil {
-		return "", fmt.Errorf("failed to send request: %s", err)
+		return cacheAPIResponse{}, withCause(fmt.Errorf("failed to send request: %s", err), err)
 	}
-	defer func() {
-		if err := resp.Body.Close(); err != nil {
-			log.Warnf("Failed to close response body: %s", err)
-		}
-	}()
+	defer func() { _ = closeBody(resp.Body) }()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("request sent, but failed to read response body (http-code: %d): %s", resp.StatusCode, body)
+		return cacheAPIResponse{}, fmt.Errorf("request sent, but failed to read response body (http-code: %d): %s", resp.StatusCode, body)
+	}
+
+	for _, code := range missStatusCodes {
+		if resp.StatusCode == code {
+			return cacheAPIResponse{}, errCacheMiss
+		}
 	}
 
 	if resp.StatusCode < 200 || resp.StatusCode > 202 {
-		return "", fmt.Errorf("build cache not found: probably cache not initialised yet (first cache push initialises the cache), nothing to worry about ;)")
+		err := fmt.Errorf("build cache not found: probably cache not initialised yet (first cache push initialises the cache), nothing to worry about ;)")
+		return cacheAPIResponse{}, withCause(err, &statusError{StatusCode: resp.StatusCode, Body: string(body)})
 	}
 
-	var respModel struct {
-		DownloadURL string `json:"download_url"`
+	body = trimJSONBody(body)
+	downloadURL, err := lookupJSONString(body, jsonPath)
+	if err != nil {
+		return cacheAPIResponse{}, fmt.Errorf("failed to get download URL (%s) from the JSON response (%s): %s", jsonPath, bodySnippet(body), err)
+	}
+
+	if downloadURL == "" {
+		return cacheAPIResponse{}, errors.New("download URL not included in the response")
 	}
-	if err := json.Unmarshal(body, &respModel); err != nil {
-		return "", fmt.Errorf("failed to parse JSON response (%s): %s", body, err)
+
+	// dir_url is optional
+	dirURL, _ := lookupJSONString(body, "dir_url")
+	infoURL, _ := lookupJSONString(body, "info_url")
+	signatureURL, _ := lookupJSONString(body, "signature_url")
+
+	var partURLs []string
+	for i := 0; ; i++ {
+		partURL, err := lookupJSONString(body, fmt.Sprintf("part_urls[%d]", i))
+		if err != nil {
+			break
+		}
+		partURLs = append(partURLs, partURL)
 	}
 
-	if respModel.DownloadURL == "" {
-		return "", errors.New("download URL not included in the response")
+	var checksum expectedChecksum
+	if sum, _ := lookupJSONString(body, "sha256"); sum != "" {
+		checksum = expectedChecksum{Algorithm: "sha256", Sum: sum}
+	} else if sum, _ := lookupJSONString(body, "md5"); sum != "" {
+		checksum = expectedChecksum{Algorithm: "md5", Sum: sum}
 	}
 
-	return respModel.DownloadURL, nil
+	return cacheAPIResponse{DownloadURL: downloadURL, DirURL: dirURL, InfoURL: infoURL, SignatureURL: signatureURL, PartURLs: partURLs, Checksum: checksum}, nil
 }
 
-// parseStackID reads the stack id from the given json bytes.
-func parseStackID(b []byte) (string, error) {
-	type ArchiveInfo struct {
-		StackID string `json:"stack_id,omitempty"`
+// resolveDownloadURL resolves a relative download URL against the cache API URL.
+// Relative download URLs are rejected, unless acceptRelative is set, and so are the URLs downloadURLPolicy does not allow.
+func resolveDownloadURL(cacheAPIURL, downloadURL string, acceptRelative bool) (string, error) {
+	u, err := url.Parse(downloadURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid download URL (%s): %s", downloadURL, err)
 	}
-	var archiveInfo ArchiveInfo
-	if err := json.Unmarshal(b, &archiveInfo); err != nil {
-		return "", err
+	if !u.IsAbs() {
+		if !acceptRelative {
+			return "", fmt.Errorf("download URL is relative (%s), relative download URLs are not accepted", downloadURL)
+		}
+
+		base, err := url.Parse(cacheAPIURL)
+		if err != nil {
+			return "", fmt.Errorf("invalid cache API URL: %s", err)
+		}
+		u = base.ResolveReference(u)
+		downloadURL = u.String()
 	}
-	return archiveInfo.StackID, nil
-}
 
-// failf prints an error and terminates the step.
-func failf(format string, args ...interface{}) {
-	log.Errorf(format, args...)
-	os.Exit(1)
+	if err := downloadURLPolicy.check(cacheAPIURL, u); err != nil {
+		return "", err
+	}
+	return downloadURL, nil
 }
 
-func main() {
-	var conf Config
-	if err := stepconf.Parse(&conf); err != nil {
-		failf(err.Error())
+// reportExtraction logs the extraction summary and writes the error report, if a report path is set.
+func reportExtraction(reportPth string, result extractResult) {
+	if result.DryRun {
+		// nothing was extracted, there is no ratio and no error report of a dry run
+		log.Printf("%d entries would be extracted, %d skipped, %d failed", result.Entries, result.Skipped, len(result.Errors))
+		return
+	}
+	log.Printf("%d entries extracted, %d skipped, %d failed", result.Entries, result.Skipped, len(result.Errors))
+	if result.Identical > 0 {
+		log.Printf("%d files already existed identical, not written again", result.Identical)
+	}
+	logEvent("extraction_finished", map[string]interface{}{
+		"entries":            result.Entries,
+		"skipped":            result.Skipped,
+		"identical":          result.Identical,
+		"failed":             len(result.Errors),
+		"source":             result.Source,
+		"compressed_bytes":   result.CompressedBytes,
+		"uncompressed_bytes": result.UncompressedBytes,
+	})
+	if counts := countEntries(result.Index); counts != (entryCounts{}) {
+		log.Printf("%d files (%d bytes), %d directories, %d symlinks, %d hard links, %d other entries",
+			counts.Files, counts.Bytes, counts.Dirs, counts.Symlinks, counts.HardLinks, counts.Other)
+	}
+	if ratio := result.compressionRatio(); ratio > 0 {
+		log.Printf("compression ratio: %.2f (%d bytes extracted from %d bytes)", ratio, result.UncompressedBytes, result.CompressedBytes)
 	}
-	stepconf.Print(conf)
-	log.SetEnableDebugLog(conf.DebugMode)
 
-	if conf.CacheAPIURL == "" {
-		log.Warnf("No Cache API URL specified, there's no cache to use, exiting.")
+	if reportPth == "" {
 		return
 	}
+	if err := writeErrorReport(reportPth, result); err != nil {
+		log.Warnf("Failed to write extraction error report: %s", err)
+	}
+}
 
-	startTime := time.Now()
+// acceptedStackIDs are the glob patterns of the archive stacks accepted instead of the current stack, nil accepts the current stack only.
+var acceptedStackIDs []string
 
-	var cacheReader io.Reader
-	var cacheURI string
+// parseStackPatterns parses the newline separated stack id glob patterns.
+func parseStackPatterns(list string) ([]string, error) {
+	patterns := splitList(list)
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %s", pattern, err)
+		}
+	}
+	return patterns, nil
+}
 
-	if strings.HasPrefix(conf.CacheAPIURL, "file://") {
-		cacheURI = conf.CacheAPIURL
+// shouldSkipForStack reports whether the cache pull should be skipped, because the archive was created on a different stack.
+// The archive's stack has to be the current one, or match one of the acceptedStackIDs patterns if there are any.
+// An archive without a stack id (no archive info, or an empty stack_id) was created on an unknown stack,
+// which matches any stack, unless requireStack is set.
+func shouldSkipForStack(info *archiveInfo, currentStackID string, requireStack bool) bool {
+	if info == nil || strings.TrimSpace(info.StackID) == "" {
+		return requireStack
+	}
+	archiveStackID := strings.TrimSpace(info.StackID)
+	if len(acceptedStackIDs) == 0 {
+		return archiveStackID != currentStackID
+	}
+	for _, pattern := range acceptedStackIDs {
+		if ok, _ := path.Match(pattern, archiveStackID); ok {
+			return false
+		}
+	}
+	return true
+}
 
-		fmt.Println()
-		log.Infof("Using local cache archive")
+// The stack_mismatch_behavior values, the behaviors if the archive was created on a different stack.
+const (
+	stackMismatchSkip    = "skip"
+	stackMismatchRestore = "restore"
+	stackMismatchFail    = "fail"
+)
 
-		pth := strings.TrimPrefix(conf.CacheAPIURL, "file://")
+// checkStack compares the archive's stack with the current one, and applies the mismatch behavior if the cache was created on a different stack:
+// the step terminates successfully (skip), it fails (fail), or the pull goes on (restore).
+// An unknown stack, with requireStack set, is skipped with the restore behavior too.
+func checkStack(info *archiveInfo, currentStackID string, requireStack bool, mismatch string) {
+	fmt.Println()
+	log.Infof("Checking archive and current stacks")
+	log.Printf("current stack id: %s", currentStackID)
+	if len(acceptedStackIDs) > 0 {
+		log.Printf("accepted stack ids: %s", strings.Join(acceptedStackIDs, ", "))
+	}
 
-		var err error
-		cacheReader, err = os.Open(pth)
-		if err != nil {
-			failf("Failed to open cache archive file: %s", err)
-		}
+	stackSpan := stepTracer.start("stack check")
+	stackSpan.setAttribute("stack.current", currentStackID)
+
+	var archiveStackID string
+	if info != nil && strings.TrimSpace(info.StackID) != "" {
+		archiveStackID = strings.TrimSpace(info.StackID)
+		log.Printf("archive stack id: %s", archiveStackID)
+		stackSpan.setAttribute("stack.archive", archiveStackID)
+	} else if info != nil {
+		log.Warnf("cache archive has an empty stack id, the archive's stack is unknown")
 	} else {
-		fmt.Println()
-		log.Infof("Downloading remote cache archive")
+		log.Warnf("cache archive does not contain stack information")
+	}
 
-		downloadURL, err := getCacheDownloadURL(conf.CacheAPIURL)
-		if err != nil {
-			failf("Failed to get cache download url: %s", err)
+	matched := !shouldSkipForStack(info, currentStackID, requireStack)
+	logEvent("stack_checked", map[string]interface{}{"current_stack": currentStackID, "archive_stack": archiveStackID, "matched": matched})
+	if !matched {
+		stackSpan.setAttribute("stack.match", false)
+		stepSummary.setStackMatched(false)
+		if archiveStackID != "" {
+			log.Warnf("Cache was created on stack: %s, current stack: %s", archiveStackID, currentStackID)
 		}
-		cacheURI = downloadURL
+		switch {
+		case mismatch == stackMismatchFail && archiveStackID != "":
+			failf("The cache archive was created on a different stack than the current one")
+		case mismatch == stackMismatchFail:
+			failf("The cache archive's stack is unknown")
+		case mismatch == stackMismatchRestore && archiveStackID != "":
+			log.Warnf("Restoring the cache anyway, stack_mismatch_behavior is %s", mismatch)
+			stackSpan.finish()
+			return
+		case archiveStackID != "":
+			log.Warnf("Skipping cache pull, because of the stack has changed")
+		default:
+			log.Warnf("Skipping cache pull, because the archive's stack is unknown")
+		}
+		stepTracer.rootSpan().setAttribute("cache.hit", false)
+		exit(0)
+	}
 
-		log.Infof("%s", downloadURL)
+	if archiveStackID == "" {
+		log.Warnf("skipping stack check")
+	}
+	stackSpan.setAttribute("stack.match", true)
+	stackSpan.finish()
+	stepSummary.setStackMatched(true)
+}
+
+// restoreDirectory restores a pre-extracted cache directory by copying its tree to the filesystem root.
+func restoreDirectory(dir, currentStackID string, requireStack bool, mismatch string) {
+	fmt.Println()
+	log.Infof("Using pre-extracted cache directory")
+	log.Printf("%s", dir)
 
-		cacheReader, err = performRequest(downloadURL)
+	if len(currentStackID) > 0 {
+		info, err := readArchiveInfoFile(filepath.Join(dir, archiveInfoFileName))
 		if err != nil {
-			failf("Failed to perform cache download request: %s", err)
+			failf("Failed to read archive info: %s", err)
 		}
+		checkStack(info, currentStackID, requireStack, mismatch)
 	}
 
-	cacheRecorderReader := NewRestoreReader(cacheReader)
+	fmt.Println()
+	log.Infof("Copying cache directory")
 
-	currentStackID := strings.TrimSpace(conf.StackID)
-	if len(currentStackID) > 0 {
-		fmt.Println()
-		log.Infof("Checking archive and current stacks")
-		log.Printf("current stack id: %s", currentStackID)
+	copySpan := stepTracer.start("extraction")
+	result, err := copyTree(dir, "/")
+	copySpan.setAttribute("extraction.entries", result.Files)
+	copySpan.setAttribute("extraction.reflinked", result.Reflinked)
+	copySpan.setAttribute("extraction.skipped", result.Skipped)
+	copySpan.finish()
+	if err != nil {
+		failf("Failed to copy cache directory: %s", err)
+	}
+	log.Printf("%d files copied (%d reflinked), %d skipped", result.Files, result.Reflinked, result.Skipped)
+	stepTracer.rootSpan().setAttribute("cache.hit", true)
+	stepSummary.setExtraction(extractResult{Entries: result.Files, Skipped: result.Skipped, Source: extractSourceDirectory})
+}
 
-		r, hdr, err := readFirstEntry(cacheRecorderReader)
-		if err != nil {
-			failf("Failed to get first archive entry: %s", err)
-		}
+// logCacheDiff logs the difference between the previously restored archive's index and the archive's index, before it is extracted.
+func logCacheDiff(index archiveIndex) {
+	fmt.Println()
+	log.Infof("Comparing with the previous restore")
+
+	pth, err := cacheIndexPath()
+	if err != nil {
+		log.Warnf("Failed to get cache index path: %s", err)
+		return
+	}
 
-		cacheRecorderReader.Restore()
+	previous, err := readIndexFile(pth)
+	if err != nil {
+		log.Warnf("Failed to read the previous restore's index: %s", err)
+	} else if previous == nil {
+		log.Printf("no previous restore found")
+	} else {
+		logIndexDiff(diffIndexes(previous, index))
+	}
+}
 
-		if filepath.Base(hdr.Name) == "archive_info.json" {
-			b, err := ioutil.ReadAll(r)
-			if err != nil {
-				failf("Failed to read first archive entry: %s", err)
-			}
+// recordCacheIndex records the restored archive's index for the next build's diff.
+func recordCacheIndex(index archiveIndex) {
+	pth, err := cacheIndexPath()
+	if err != nil {
+		log.Warnf("Failed to get cache index path: %s", err)
+		return
+	}
+	if err := writeIndexFile(pth, index); err != nil {
+		log.Warnf("Failed to write cache index: %s", err)
+	}
+}
 
-			archiveStackID, err := parseStackID(b)
-			if err != nil {
-				failf("Failed to parse first archive entry: %s", err)
-			}
-			log.Printf("archive stack id: %s", archiveStackID)
+const (
+	extractSourceStream    = "stream"
+	extractSourceFile      = "file"
+	extractSourceDirectory = "directory"
+)
 
-			if archiveStackID != currentStackID {
-				log.Warnf("Cache was created on stack: %s, current stack: %s", archiveStackID, currentStackID)
-				log.Warnf("Skipping cache pull, because of the stack has changed")
-				os.Exit(0)
-			}
+// archiveSource describes where the cache archive is downloaded from for the fallbacks.
+type archiveSource struct {
+	Client *http.Client
+	URI    string
+	// DirURL is the pre-extracted cache directory (`dir://<path>`), if available.
+	DirURL           string
+	IgnoreZeroLength bool
+	DecryptionKeys   []decryptionKey
+	// InfoURL is the archive info sidecar's URL, if available. Only the info mode reads it.
+	InfoURL string
+	// OverlapExtract enables extracting the archive file of the fallback while it is downloaded.
+	OverlapExtract bool
+	// PipeFallback makes the fallback download the archive again into tar's input, without an archive file.
+	PipeFallback bool
+	// Checksum is the archive's checksum reported by the Cache API, the fallback's download is verified against it.
+	Checksum expectedChecksum
+	// StreamErr is the error the archive stream can not be extracted with, if it is known before the extraction:
+	// the archive file is extracted instead.
+	StreamErr error
+	// Spool is the spooled archive stream, the fallback extracts its file instead of downloading the archive again. Nil if not spooled.
+	Spool      *streamSpool // StopStream stops the archive stream's readers, it is called once the stream is not read further. Nil if there is nothing to stop.
+	StopStream func()
+}
+
+// extractWithFallbacks extracts the archive stream. If it fails, the archive file is downloaded and uncompressed,
+// and if that fails too, the pre-extracted cache directory is copied, if available.
+// The result's Source tells which of them restored the cache.
+func extractWithFallbacks(r io.Reader, src archiveSource, opts extractOptions) (extractResult, error) {
+	var result extractResult
+	err := src.StreamErr
+	if err == nil {
+		if result, err = extractCacheArchive(r, opts); err == nil {
+			result.Source = extractSourceStream
+			return result, nil
+		}
+	}
+	if src.StopStream != nil {
+		src.StopStream()
+	}
+	if zipErr, ok := err.(*zipArchiveError); ok && zipErr.Accepted {
+		// the zip archive is extracted from the file, not streamed again
+		if useSpool(&src) {
+			log.Printf("the cache archive is a zip archive, extracting the spooled archive file")
 		} else {
-			log.Warnf("cache archive does not contain stack information, skipping stack check")
+			log.Printf("the cache archive is a zip archive, downloading the archive file to extract it")
+		}
+		src.PipeFallback, src.OverlapExtract = false, false
+		result, err = uncompressFallback(src, opts)
+		if err == nil {
+			result.Source = extractSourceFile
 		}
+		return result, err
+	}
+	if !isFallbackError(err) {
+		return result, err
 	}
 
-	fmt.Println()
-	log.Infof("Extracting cache archive")
-
-	if err := extractCacheArchive(cacheRecorderReader); err != nil {
-		log.Warnf("Failed to uncompress cache archive stream: %s", err)
+	log.Warnf("Failed to uncompress cache archive stream: %s", err)
+	if useSpool(&src) {
+		log.Warnf("Trying to uncompress the spooled archive file using tar tool, the archive is not downloaded again")
+	} else {
 		log.Warnf("Downloading the archive file and trying to uncompress using tar tool")
+	}
 
-		pth, err := downloadCacheArchive(cacheURI)
-		if err != nil {
-			failf("Fallback failed, unable to download cache archive: %s", err)
+	result, err = uncompressFallback(src, opts)
+	if err == nil {
+		result.Source = extractSourceFile
+		return result, nil
+	}
+	if !isFallbackError(err) || src.DirURL == "" || opts.ConfineRoot {
+		// the directory copy is not confined beneath the extraction root
+		return result, err
+	}
+
+	log.Warnf("Failed to uncompress cache archive file: %s", err)
+	log.Warnf("Copying the pre-extracted cache directory: %s", src.DirURL)
+
+	dst := opts.Root
+	if dst == "" {
+		dst = "/"
+	}
+	copied, err := copyTree(strings.TrimPrefix(src.DirURL, "dir://"), dst)
+	result = extractResult{Entries: copied.Files, Skipped: copied.Skipped, Source: extractSourceDirectory}
+	if err != nil {
+		return result, fmt.Errorf("unable to copy cache directory: %s", err)
+	}
+	return result, nil
+}
+
+// useSpool completes the source's spooled archive stream, and makes the fallback extract its file.
+// It reports whether the spool is used, an incomplete spool or a checksum mismatch is only warned about: the archive is downloaded again.
+func useSpool(src *archiveSource) bool {
+	if src.Spool == nil {
+		return false
+	}
+	pth, err := src.Spool.complete(src.Client, src.URI)
+	src.Spool.close()
+	if err == nil {
+		err = verifyFileChecksum(pth, src.Checksum)
+	}
+	if err != nil {
+		log.Warnf("Failed to spool the archive stream: %s", err)
+		return false
+	}
+	src.URI = "file://" + pth
+	src.PipeFallback, src.OverlapExtract = false, false
+	return true
+}
+
+// isFallbackError reports whether the extraction error is worth a fallback.
+// Running out of space, refusing an existing symlink or directory, a too long path, refusing to write outside
+// the extraction root, and a not accepted zip archive fail the same way with each of them.
+func isFallbackError(err error) bool {
+	switch err.(type) {
+	case *insufficientSpaceError, *symlinkError, *dirConflictError, *confinementError, *traversalError, *longPathError, *zipArchiveError, *archiveSizeError, *notArchiveError, *entryStallError:
+		return false
+	}
+	return true
+}
+
+// uncompressFallback downloads the archive file and uncompresses it using tar tool.
+func uncompressFallback(src archiveSource, opts extractOptions) (extractResult, error) {
+	if src.PipeFallback && !strings.HasPrefix(src.URI, "file://") {
+		log.Printf("downloading the archive again into the tar tool's input")
+		return pipedFallback(src, opts)
+	}
+	if src.OverlapExtract && !strings.HasPrefix(src.URI, "file://") {
+		log.Printf("extracting the archive file while it is downloaded")
+		return overlappedFallback(src, cacheArchivePath, opts)
+	}
+
+	pth, err := downloadCacheArchive(src.Client, src.URI, src.IgnoreZeroLength, src.Checksum)
+	if err != nil {
+		return extractResult{}, withCause(fmt.Errorf("unable to download cache archive: %s", err), err)
+	}
+
+	pth, err = decryptArchiveFile(pth, src.DecryptionKeys)
+	if err != nil {
+		return extractResult{}, fmt.Errorf("unable to decrypt cache archive file: %s", err)
+	}
+
+	if opts.MinFreeSpace > 0 {
+		// tar reads the archive file directly, the free space is only checked before the extraction
+		if free, err := freeSpace(opts.FreeSpacePath); err != nil {
+			log.Warnf("Failed to check free space: %s", err)
+		} else if free < opts.MinFreeSpace {
+			return extractResult{}, &insufficientSpaceError{Path: opts.FreeSpacePath, Free: free, Threshold: opts.MinFreeSpace}
 		}
+	}
+
+	result, err := uncompressArchive(pth, opts)
+	if err != nil {
+		return result, fmt.Errorf("unable to uncompress cache archive file: %s", err)
+	}
+	return result, nil
+}
+
+// pipedFallback downloads the archive again, and pipes it into the tar tool, without staging it in a file.
+// If tar exits mid-download, the download is stopped and tar's error is returned.
+func pipedFallback(src archiveSource, opts extractOptions) (extractResult, error) {
+	body, _, err := requestArchive(src.Client, src.URI, src.IgnoreZeroLength)
+	if err != nil {
+		return extractResult{}, withCause(fmt.Errorf("unable to download cache archive: %s", err), err)
+	}
+	defer func() { _ = body.Close() }()
+
+	checksum := newChecksumReader(body, src.Checksum.newHash(), false)
+	r, _, err := newDecryptReader(checksum, src.DecryptionKeys)
+	if err != nil {
+		return extractResult{}, fmt.Errorf("unable to decrypt cache archive: %s", err)
+	}
+	// the body is closed here, not drained by the extraction
+	result, err := extractCacheArchive(struct{ io.Reader }{r}, opts)
+	if err != nil {
+		return result, fmt.Errorf("unable to uncompress cache archive stream: %s", err)
+	}
+	if src.Checksum.isSet() {
+		// the rest of the archive (after the end-of-archive marker) still belongs to the checksum
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			return result, fmt.Errorf("unable to verify cache archive checksum: %s", err)
+		}
+		if err := src.Checksum.verify(checksum.Sum()); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// verifySignature downloads the detached signature of the archive file at pth, and verifies it.
+func verifySignature(client *http.Client, pth, signatureURL, publicKey string) error {
+	key, err := parseSignaturePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	if signatureURL == "" {
+		return errors.New("the cache archive is not signed, no signature_url in the Cache API response")
+	}
+	sig, err := downloadSignature(client, signatureURL)
+	if err != nil {
+		return fmt.Errorf("failed to download archive signature: %s", err)
+	}
+	return verifyArchiveSignature(pth, sig, key)
+}
+
+// modeInfo is the mode printing the cache's metadata, instead of pulling the cache.
+const modeInfo = "info"
+
+// showCacheInfo prints the cache's metadata.
+func showCacheInfo(src archiveSource) {
+	fmt.Println()
+	log.Infof("Reading cache info")
+
+	info, size, err := readCacheInfo(src)
+	if err != nil {
+		failf("Failed to read cache info: %s", err)
+	}
+	if info == nil {
+		log.Warnf("The cache archive does not contain archive info")
+	}
+	printCacheInfo(os.Stdout, info, size)
+}
+
+// stepTracer records the spans of the step run, nil if tracing is not configured.
+// It is a package variable, so that the trace is exported on the os.Exit paths too.
+var stepTracer *tracer
+
+// exitMu is held by the exiting step, so a concurrent exit waits for the process to terminate.
+var exitMu sync.Mutex
+
+// exit exports the trace and terminates the step with the given code.
+// A failing step which exceeded its max_duration exits with deadlineExitCode.
+func exit(code int) {
+	// the deadline's abort may race the step's own exit, the first one exits
+	exitMu.Lock()
+	if code != 0 && deadlineExceeded() {
+		log.Errorf("The step exceeded its max_duration of %s, aborting", maxDuration)
+		stepTracer.rootSpan().setAttribute("error", "max_duration exceeded")
+		runDeadlineCleanups()
+		code = deadlineExitCode
+	} else if sig := interruptSignal(); code != 0 && sig != nil {
+		log.Errorf("The step was interrupted by %s, aborting", sig)
+		stepTracer.rootSpan().setAttribute("error", "interrupted by "+sig.String())
+		runDeadlineCleanups()
+		code = interruptExitCode(sig)
+	}
+	stepSummary.write(code == 0)
+	stepTracer.flush()
+	os.Exit(code)
+}
+
+// failf prints an error and terminates the step.
+func failf(format string, args ...interface{}) {
+	log.Errorf(format, args...)
+	stepTracer.rootSpan().setAttribute("error", fmt.Sprintf(format, args...))
+	stepSummary.setError(fmt.Sprintf(format, args...))
+	exit(permanentExitCode)
+}
+
+func main() {
+	if printVersionRequested(os.Args[1:], os.Getenv) {
+		fmt.Println(versionInfo())
+		os.Exit(0)
+	}
+
+	var conf Config
+	if err := stepconf.Parse(&conf); err != nil {
+		failf("%s", err)
+	}
+	setupLog(conf.LogFormat, os.Stdout)
+	log.Infof("%s", versionInfo())
+	printConfig(conf)
+	log.SetEnableDebugLog(conf.DebugMode)
+
+	if conf.SummaryPath != "" {
+		stepSummary = newRestoreSummary(conf.SummaryPath)
+		// the failures write it on exit
+		defer stepSummary.write(true)
+	}
+
+	if conf.DryRun {
+		// a dry run writes nothing but the downloaded archive: no error report, and no lock file in the extraction root
+		conf.ErrorReportPath = ""
+		conf.PullLock = false
+	}
+	if conf.TransientExitCode > 0 {
+		transientExitCode = conf.TransientExitCode
+	}
+	if conf.PermanentExitCode > 0 {
+		permanentExitCode = conf.PermanentExitCode
+	}
+
+	if conf.LocalArchivePath != "" {
+		localURL, err := localArchiveURL(conf.LocalArchivePath, conf.CacheAPIURL)
+		if err != nil {
+			failf("Invalid local_archive_path: %s", err)
+		}
+		conf.CacheAPIURL = localURL
+		if conf.CacheURLs != "" {
+			log.Warnf("local_archive_path is set, cache_urls is not pulled")
+			conf.CacheURLs = ""
+		}
+	}
+	caches, err := parseCacheURLs(os.ExpandEnv(conf.CacheURLs))
+	if err != nil {
+		failf("Invalid cache_urls: %s", err)
+	}
+	if conf.CacheAPIURL == "" && len(caches) == 0 {
+		if conf.FailOnMiss {
+			failf("No Cache API URL specified, there's no cache to use (fail_on_cache_miss is set)")
+		}
+		log.Warnf("No Cache API URL specified, there's no cache to use, exiting.")
+		return
+	}
+
+	startTime := time.Now()
+
+	if conf.MaxDuration > 0 {
+		cancel := startDeadline(time.Duration(conf.MaxDuration) * time.Second)
+		defer cancel()
+	}
+	defer handleInterrupts()()
+	if conf.DNSRetries >= 0 {
+		dnsRetries = conf.DNSRetries
+	}
+	if conf.DNSRetryWait > 0 {
+		dnsRetryWait = time.Duration(conf.DNSRetryWait) * time.Millisecond
+	}
+	if conf.RetryCount >= 0 {
+		requestRetries = conf.RetryCount
+	}
+	if conf.RetryBaseDelay > 0 {
+		requestRetryBaseDelay = time.Duration(conf.RetryBaseDelay) * time.Millisecond
+	}
+	if conf.RetryAfterMax >= 0 {
+		retryAfterMax = time.Duration(conf.RetryAfterMax) * time.Second
+	}
+	if conf.APITimeout > 0 {
+		apiTimeout = time.Duration(conf.APITimeout) * time.Second
+	}
+	if conf.DownloadURLCacheTTL > 0 {
+		downloadURLs = newDownloadURLCache(downloadURLCacheSize, time.Duration(conf.DownloadURLCacheTTL)*time.Second)
+	}
+	if conf.DownloadTimeout >= 0 {
+		downloadStallTimeout = time.Duration(conf.DownloadTimeout) * time.Second
+	}
+	if conf.ProgressAnnotations {
+		if progressAnnotations = isOnBitrise(); !progressAnnotations {
+			log.Debugf("not running on Bitrise, the progress is not annotated")
+		}
+	}
+	if conf.ProxyURL != "" {
+		proxyURL, err := parseProxyURL(conf.ProxyURL)
+		if err != nil {
+			failf("Invalid proxy_url: %s", err)
+		}
+		proxyFunc = http.ProxyURL(proxyURL)
+	}
+	if conf.MissStatusCodes != "" {
+		codes, err := parseStatusCodes(conf.MissStatusCodes)
+		if err != nil {
+			failf("Invalid miss_status_codes: %s", err)
+		}
+		missStatusCodes = codes
+	}
+	downloadURLPolicy = parseURLPolicy(conf.AllowedSchemes, conf.AllowedHosts)
+	if conf.MaxArchiveSize > 0 {
+		maxArchiveSize = int64(conf.MaxArchiveSize) * 1024 * 1024
+	}
+	if acceptedStackIDs, err = parseStackPatterns(conf.AcceptedStacks); err != nil {
+		failf("Invalid accepted_stack_ids: %s", err)
+	}
+	if conf.LocalCache {
+		dir := conf.LocalCacheDir
+		if dir == "" {
+			dir = filepath.Join(os.TempDir(), "cache-pull-archives")
+		}
+		if localArchives, err = newArchiveStore(dir); err != nil {
+			log.Warnf("Failed to create the local cache dir, the archive is not stored: %s", err)
+		}
+	}
+	if apiHeaders, err = parseHeaders(string(conf.AuthToken), string(conf.AuthHeader)); err != nil {
+		failf("Invalid auth_header: %s", err)
+	}
+	if apiHeaders != nil {
+		log.Debugf("sending the %s headers with the Cache API requests (values redacted)", headerNames(apiHeaders))
+		if conf.DownloadAuth {
+			downloadHeaders = apiHeaders
+			log.Debugf("sending the %s headers with the download requests (values redacted)", headerNames(downloadHeaders))
+		}
+	}
+	filter, err := parsePathFilter(conf.IncludePaths, conf.ExcludePaths)
+	if err != nil {
+		failf("Invalid path filter: %s", err)
+	}
+	if conf.StripComponents < 0 {
+		failf("Invalid strip_components: %d, it can not be negative", conf.StripComponents)
+	}
+
+	var sampler *resourceSampler
+	if conf.ReportResourceUsage {
+		sampler = startResourceSampler(resourceSampleInterval)
+	}
+
+	if conf.OTLPEndpoint != "" {
+		stepTracer = newTracer(otlpExporter{client: &http.Client{Timeout: 10 * time.Second}, endpoint: conf.OTLPEndpoint})
+		defer stepTracer.flush()
+	}
+
+	downloadClient := newDownloadClient(conf.DownloadKeepAlive)
+
+	if conf.PrefetchTarget {
+		// runs in the background, overlapping the metadata warm-up with the download
+		go func() {
+			wd, err := os.Getwd()
+			if err != nil {
+				log.Debugf("prefetch: failed to get working directory: %s", err)
+				return
+			}
+			prefetchStart := time.Now()
+			visited := prefetchTree(wd)
+			log.Debugf("prefetch: %d entries visited under %s in %s", visited, wd, time.Since(prefetchStart))
+		}()
+	}
+
+	if len(caches) > 0 {
+		if conf.CacheAPIURL != "" {
+			log.Warnf("cache_urls is set, cache_api_url is not pulled")
+		}
+		pullIndependentCaches(conf, caches, downloadClient, filter)
+
+		fmt.Println()
+		log.Donef("Done")
+		log.Printf("Took: " + time.Since(startTime).String())
+		return
+	}
+
+	apiURL, apiResp, err := findCache(splitList(conf.CacheAPIURL), conf.DownloadURLJSONPath)
+	if err == errCacheMiss {
+		stepTracer.rootSpan().setAttribute("cache.hit", false)
+		if conf.FailOnMiss {
+			failf("No cache found for this build (fail_on_cache_miss is set)")
+		}
+		log.Warnf("No cache found for this build, nothing to pull")
+		return
+	}
+	if err != nil {
+		failWithf(err, "Failed to get cache download url: %s", err)
+	}
+	// the rest of the pull uses the URL providing the cache
+	conf.CacheAPIURL = apiURL
+
+	if strings.HasPrefix(conf.CacheAPIURL, "dir://") {
+		if conf.Mode == modeInfo {
+			showCacheInfo(archiveSource{URI: conf.CacheAPIURL})
+			return
+		}
+		restoreDirectory(strings.TrimPrefix(conf.CacheAPIURL, "dir://"), strings.TrimSpace(conf.StackID), conf.RequireArchiveStack, conf.StackMismatch)
+
+		fmt.Println()
+		log.Donef("Done")
+		log.Printf("Took: " + time.Since(startTime).String())
+		return
+	}
+
+	var cacheURI, dirURL, infoURL, signatureURL string
+	var partURIs []string
+	var checksum expectedChecksum
+
+	downloadSpan := stepTracer.start("download")
+	stopDownloadTiming := stepTimings.measure(&stepTimings.download)
+
+	if strings.HasPrefix(conf.CacheAPIURL, "file://") {
+		cacheURI = conf.CacheAPIURL
+
+		fmt.Println()
+		log.Infof("Using local cache archive")
+	} else if isBucketURL(conf.CacheAPIURL) {
+		cacheURI = conf.CacheAPIURL
+
+		fmt.Println()
+		log.Infof("Downloading cache archive from cloud storage")
+	} else {
+		fmt.Println()
+		log.Infof("Downloading remote cache archive")
+
+		dirURL = apiResp.DirURL
+		infoURL = apiResp.InfoURL
+		signatureURL = apiResp.SignatureURL
+		checksum = apiResp.Checksum
+
+		downloadURL, err := resolveDownloadURL(conf.CacheAPIURL, apiResp.DownloadURL, conf.AcceptRelativeURL)
+		if err != nil {
+			failf("Failed to resolve cache download url: %s", err)
+		}
+		cacheURI = downloadURL
+
+		for _, partURL := range apiResp.PartURLs {
+			partURI, err := resolveDownloadURL(conf.CacheAPIURL, partURL, conf.AcceptRelativeURL)
+			if err != nil {
+				failf("Failed to resolve archive part download url: %s", err)
+			}
+			partURIs = append(partURIs, partURI)
+		}
+
+		log.Infof("%s", downloadURL)
+		logEvent("download_url_resolved", map[string]interface{}{"url": downloadURL, "parts": len(partURIs)})
+	}
+	stepSummary.setDownloadURL(cacheURI)
+	// the archive file's URL replaces the download URL, once the archive is downloaded
+	resolvedURL := cacheURI
+
+	if conf.Mode == modeInfo {
+		decryptionKeys, err := parseDecryptionKeys(string(conf.DecryptionKeys))
+		if err != nil {
+			failf("Failed to parse decryption keys: %s", err)
+		}
+		showCacheInfo(archiveSource{
+			Client:           downloadClient,
+			URI:              cacheURI,
+			IgnoreZeroLength: conf.IgnoreZeroLength,
+			DecryptionKeys:   decryptionKeys,
+			InfoURL:          infoURL,
+		})
+		return
+	}
+
+	if conf.PullLock {
+		// the second pull into the same root waits for the first one, then skips the pull if the marker matches
+		root := conf.ExtractRoot
+		if root == "" {
+			root = "/"
+		}
+		lock, err := lockExtraction(root)
+		if err != nil {
+			failf("Failed to lock the extraction root: %s", err)
+		}
+		defer lock.unlock()
+	}
+
+	var archiveID string
+	if conf.MarkerPath != "" {
+		var err error
+		archiveID, err = archiveIdentity(downloadClient, cacheURI)
+		if err != nil {
+			log.Warnf("Failed to identify cache archive, skipping marker check: %s", err)
+		}
+
+		match, err := markerMatches(conf.MarkerPath, archiveID)
+		if err != nil {
+			log.Warnf("Failed to read marker, skipping marker check: %s", err)
+		}
+		if match {
+			log.Donef("Cache archive (%s) was already restored by a previous build, skipping cache pull", archiveID)
+			stepTracer.rootSpan().setAttribute("cache.hit", true)
+			stepTracer.rootSpan().setAttribute("cache.marker_match", true)
+			return
+		}
+	}
+
+	tmpDir, err := newArchiveTempDir(conf.TmpDir)
+	if err != nil {
+		failf("Failed to create temporary directory: %s", err)
+	}
+	// a failed run exits without the cleanup, keeping the downloaded archive for inspection
+	removeTmpDir := func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			log.Warnf("Failed to remove temporary directory: %s", err)
+		}
+	}
+	// an aborted run removes it too, its partial download is not worth keeping
+	onDeadline(removeTmpDir)
+	defer removeTmpDir()
+
+	if conf.CopyLocal && strings.HasPrefix(cacheURI, "file://") {
+		// the stream and the fallback read the run's copy
+		if err := copyLocalArchive(strings.TrimPrefix(cacheURI, "file://"), cacheArchivePath); err != nil {
+			failf("Failed to copy the local cache archive: %s", err)
+		}
+		cacheURI = "file://" + cacheArchivePath
+	}
+
+	var cacheReader io.Reader
+	var archiveSize int64
+	// progress is only reported for the archive stream downloaded while it is extracted
+	var progress *progressWriter
+	var spool *streamSpool
+
+	if strings.HasPrefix(cacheURI, "file://") {
+		pth := strings.TrimPrefix(cacheURI, "file://")
+
+		f, err := os.Open(pth)
+		if err != nil {
+			failf("Failed to open cache archive file: %s", err)
+		}
+		cacheReader = f
+
+		archiveSize = -1
+		if info, err := f.Stat(); err == nil {
+			archiveSize = info.Size()
+		}
+		if err := checkArchiveSize(archiveSize); err != nil {
+			failf("Failed to open cache archive file: %s", err)
+		}
+	} else if conf.DownloadChunkSize > 0 || conf.DownloadParts > 1 || conf.SignaturePublicKey != "" || localArchives != nil || conf.LogCacheDiff {
+		// the signature is verified and the diff is logged before the extraction, the stored archive is reused as a file,
+		// and the chunks and parts are assembled in a file, so the archive is downloaded to a file
+		if conf.DownloadChunkSize > 0 {
+			// the part files outlive the run, an interrupted download is resumed by the next one
+			partsDir := conf.TmpDir
+			if partsDir == "" {
+				partsDir = os.TempDir()
+			}
+			result, err := downloadChunked(downloadClient, cacheURI, filepath.Join(partsDir, "cache-archive.parts"), cacheArchivePath, int64(conf.DownloadChunkSize)*1024*1024)
+			if err != nil {
+				failWithf(err, "Failed to download cache archive in chunks: %s", err)
+			}
+			log.Printf("%d chunks, %d downloaded, %d reused", result.Chunks, result.Downloaded, result.Reused)
+			if err := verifyFileChecksum(cacheArchivePath, checksum); err != nil {
+				failf("Failed to verify cache archive: %s", err)
+			}
+		} else if conf.DownloadParts > 1 {
+			if err := downloadParts(downloadClient, cacheURI, cacheArchivePath, conf.DownloadParts); err != nil {
+				failWithf(err, "Failed to download cache archive in parts: %s", err)
+			}
+			if err := verifyFileChecksum(cacheArchivePath, checksum); err != nil {
+				failf("Failed to verify cache archive: %s", err)
+			}
+		} else if _, err := downloadCacheArchive(downloadClient, cacheURI, conf.IgnoreZeroLength, checksum); err != nil {
+			failWithf(err, "Failed to download cache archive: %s", err)
+		}
+
+		f, err := os.Open(cacheArchivePath)
+		if err != nil {
+			failf("Failed to open cache archive file: %s", err)
+		}
+		cacheReader = f
+
+		archiveSize = -1
+		if info, err := f.Stat(); err == nil {
+			archiveSize = info.Size()
+		}
+		// the fallback uncompresses the downloaded file
+		cacheURI = "file://" + cacheArchivePath
+	} else {
+		var err error
+		cacheReader, archiveSize, err = requestArchive(downloadClient, cacheURI, conf.IgnoreZeroLength)
+		if err != nil {
+			failWithf(err, "Failed to perform cache download request: %s", err)
+		}
+		progress = newProgressWriter(archiveSize)
+		if conf.SpoolStream {
+			if spool, err = newStreamSpool(cacheReader, cacheArchivePath); err != nil {
+				log.Warnf("Failed to create the archive stream's spool file: %s", err)
+			}
+		}
+	}
+
+	downloadSpan.setAttribute("archive.size", archiveSize)
+	downloadSpan.finish()
+	stopDownloadTiming()
+	logEvent("download_started", map[string]interface{}{"url": cacheURI, "archive_bytes": archiveSize})
+
+	if conf.SignaturePublicKey != "" {
+		if err := verifySignature(downloadClient, strings.TrimPrefix(cacheURI, "file://"), signatureURL, conf.SignaturePublicKey); err != nil {
+			if !conf.AllowBadSignature {
+				failf("%s", err)
+			}
+			log.Warnf("%s, extracting the archive anyway", err)
+		} else {
+			log.Donef("Cache archive signature verified")
+		}
+	}
+
+	decryptionKeys, err := parseDecryptionKeys(string(conf.DecryptionKeys))
+	if err != nil {
+		failf("Failed to parse decryption keys: %s", err)
+	}
+
+	stream := cacheReader
+	if spool != nil {
+		defer spool.close()
+		stream = spool
+	}
+	if progress != nil {
+		stream = io.TeeReader(stream, progress)
+		if conf.StreamBuffer > 0 {
+			// the download is read ahead, while the stream is decompressed and extracted
+			readAhead := newReadAheadReader(stream, conf.StreamBuffer*1024*1024)
+			defer readAhead.close()
+			stream = readAhead
+		}
+	}
+	archiveChecksum := newChecksumReader(stream, checksum.newHash(), conf.ParallelChecksum)
+	archiveReader, keyID, err := newDecryptReader(archiveChecksum, decryptionKeys)
+	if err != nil {
+		failf("Failed to decrypt cache archive: %s", err)
+	}
+	if keyID != "" {
+		log.Printf("cache archive decrypted with key: %s", keyID)
+	}
+	cacheRecorderReader := NewRestoreReader(archiveReader)
+	cacheRecorderReader.SetBufferLimit(conf.PeekBufferLimit * 1024 * 1024)
+
+	currentStackID := strings.TrimSpace(conf.StackID)
+
+	expectedPaths := splitList(os.ExpandEnv(conf.ExpectedCachePaths))
+
+	stamp := conf.ExtractDirStamp
+	if stamp == "none" {
+		stamp = ""
+	}
+
+	stopStackTiming := stepTimings.measure(&stepTimings.stackCheck)
+	var info *archiveInfo
+	var streamErr error
+	checkFeatures := conf.FeaturesPolicy != featuresIgnore
+	// the archive info's uncompressed size is only read for an enabled free space check
+	checkFreeSpace := conf.CheckFreeSpace && conf.FreeSpaceMargin >= 0 && !conf.DryRun
+	if len(currentStackID) > 0 || conf.ExportArchiveStats || len(expectedPaths) > 0 || stamp != "" || conf.ExportBreadcrumb || conf.MinFormatVersion > 0 || checkFeatures || checkFreeSpace || conf.CacheAgeWarning > 0 || conf.RequireArchiveInfo || conf.ExportDownloadURL != "" {
+		var err error
+		info, err = readArchiveInfo(cacheRecorderReader)
+		log.Debugf("%d bytes of the archive stream buffered to read the archive info", cacheRecorderReader.Buffered())
+		stepTracer.rootSpan().setAttribute("archive.info.buffered", cacheRecorderReader.Buffered())
+		if limitErr, ok := err.(*bufferLimitError); ok {
+			if conf.RequireArchiveInfo {
+				failf("Failed to read archive info: %s", limitErr)
+			}
+			log.Warnf("Failed to read archive info: %s", limitErr)
+			log.Warnf("The archive's first entry is too large to read ahead, its metadata is unknown, the archive file is extracted with the tar tool")
+			streamErr, err = limitErr, nil
+		}
+		if err != nil {
+			if len(currentStackID) > 0 || conf.MinFormatVersion > 0 || conf.RequireArchiveInfo {
+				failf("Failed to read archive info: %s", err)
+			}
+			log.Warnf("Failed to read archive info: %s", err)
+		} else if conf.RequireArchiveInfo {
+			if err := checkArchiveInfoPresent(info); err != nil {
+				failf("Failed to read archive info: %s", err)
+			}
+		}
+		logCacheAge(info, time.Now(), time.Duration(conf.CacheAgeWarning)*time.Hour)
+	}
+
+	if conf.ExportArchiveStats {
+		if err := exportArchiveStats(exportEnvironmentWithEnvman, archiveSize, info); err != nil {
+			log.Warnf("Failed to export archive stats: %s", err)
+		}
+	}
+	if conf.ExportDownloadURL != "" {
+		if err := exportDownloadRecord(exportEnvironmentWithEnvman, conf.ExportDownloadURL, newDownloadRecord(resolvedURL, info, archiveSize)); err != nil {
+			log.Warnf("Failed to export the download URL: %s", err)
+		}
+	}
+
+	if len(expectedPaths) > 0 {
+		fmt.Println()
+		log.Infof("Checking archive and expected cache paths")
+
+		if info != nil && len(info.Paths) > 0 {
+			missing, unexpected := comparePaths(info.Paths, expectedPaths)
+			for _, pth := range missing {
+				log.Warnf("Expected cache path is not in the archive: %s", pth)
+			}
+			for _, pth := range unexpected {
+				log.Warnf("Archive contains a not expected cache path: %s", pth)
+			}
+			if len(missing) > 0 || len(unexpected) > 0 {
+				log.Warnf("The cache archive was created from different cache paths, the cache key might be misconfigured")
+			} else {
+				log.Printf("archive cache paths match the expected ones")
+			}
+		} else {
+			log.Warnf("cache archive does not contain the cache paths, skipping cache paths check")
+		}
+	}
+
+	if len(currentStackID) > 0 {
+		checkStack(info, currentStackID, conf.RequireArchiveStack, conf.StackMismatch)
+	}
+
+	if err := checkFormatVersion(info, int64(conf.MinFormatVersion)); err != nil {
+		failf("%s", err)
+	}
+	if checkFeatures {
+		if err := checkRequiredFeatures(info, unavailableFeatures(conf)); err != nil {
+			if conf.FeaturesPolicy == featuresFail {
+				failf("%s", err)
+			}
+			log.Warnf("%s, extracting the archive anyway", err)
+		}
+	}
+	stopStackTiming()
+
+	fmt.Println()
+	if conf.DryRun {
+		log.Infof("Listing cache archive (dry run)")
+	} else {
+		log.Infof("Extracting cache archive")
+	}
+
+	extractionSpan := stepTracer.start("extraction")
+	stopExtractionTiming := stepTimings.measure(&stepTimings.extraction)
+
+	opts := extractOptions{ExtractMetadata: conf.ExtractMetadata, ExistingSymlinks: conf.ExistingSymlinks, DirFileConflicts: conf.DirFileConflicts, LongPaths: conf.LongPaths, GzipResync: conf.GzipResync, ConfineRoot: conf.ConfineRoot, AcceptZip: conf.AcceptZip, VerifyPerFile: conf.VerifyPerFile, Filter: filter, DryRun: conf.DryRun, Concurrency: extractConcurrency(conf.ExtractConcurrency), SkipIdentical: conf.SkipIdentical, EntryTimeout: time.Duration(conf.EntryTimeout) * time.Second, StripComponents: conf.StripComponents, ContinueOnError: conf.ContinueOnError}
+	if conf.ExtractRoot != "" {
+		root, err := stampedExtractDir(conf.ExtractRoot, stamp, info)
+		if err != nil {
+			failf("Failed to get extraction directory: %s", err)
+		}
+		opts.Root = root
+
+		if conf.DryRun {
+			log.Printf("would extract to: %s", root)
+		} else {
+			if err := os.MkdirAll(root, 0755); err != nil {
+				failf("Failed to create extraction directory: %s", err)
+			}
+			log.Printf("extracting to: %s", root)
+
+			if err := exportEnvironmentWithEnvman(extractPathEnvKey, root); err != nil {
+				log.Warnf("Failed to export extraction directory: %s", err)
+			}
+		}
+	} else if stamp != "" {
+		log.Warnf("extract_dir_stamp requires extract_root, extracting the archive to its own paths")
+	}
+	var restore *atomicRestore
+	if conf.AtomicRestore && !conf.DryRun {
+		if opts.Root == "" {
+			failf("atomic_restore requires extract_root, refusing to extract the archive to its own paths")
+		}
+		var err error
+		restore, err = newAtomicRestore(opts.Root)
+		if err != nil {
+			failf("Failed to create the staging directory of the atomic restore: %s", err)
+		}
+		// an aborted pull leaves the extraction root as it was, a failed one keeps the staging directory for inspection
+		onDeadline(restore.abort)
+		log.Printf("staging the restore in: %s", restore.staging)
+		opts.Root = restore.staging
+	}
+	if conf.ConfineRoot && opts.Root == "" {
+		failf("confine_to_root requires extract_root, refusing to extract the archive to its own paths")
+	}
+	// absolute archive paths are usually under the home directory, relative ones under the working directory
+	spacePth := "."
+	if opts.Root != "" {
+		spacePth = opts.Root
+	}
+	if conf.MonitorFreeSpace {
+		opts.MinFreeSpace = uint64(conf.MinFreeSpace) * 1024 * 1024
+		opts.FreeSpacePath = spacePth
+	}
+	if checkFreeSpace {
+		// the archive's size is the estimate of the cache's size, if the archive info does not record it
+		size := archiveSize
+		if info != nil && info.UncompressedSize > 0 {
+			size = info.UncompressedSize
+		}
+		if err := checkRequiredSpace(spacePth, size, uint64(conf.FreeSpaceMargin)*1024*1024); err != nil {
+			failf("%s", err)
+		}
+	}
+	src := archiveSource{
+		Client:           downloadClient,
+		URI:              cacheURI,
+		DirURL:           dirURL,
+		IgnoreZeroLength: conf.IgnoreZeroLength,
+		DecryptionKeys:   decryptionKeys,
+		OverlapExtract:   conf.OverlapExtract,
+		PipeFallback:     conf.FallbackMode == fallbackModePipe,
+		Checksum:         checksum,
+		StreamErr:        streamErr,
+		Spool:            spool,
+		StopStream:       archiveChecksum.stop,
+	}
+	if conf.DryRun {
+		// the pre-extracted cache directory would be copied, not listed
+		src.DirURL = ""
+	}
+	parts := make([]archiveSource, 0, len(partURIs))
+	for _, partURI := range partURIs {
+		part := src
+		part.URI = partURI
+		part.DirURL = ""
+		part.Spool = nil
+		parts = append(parts, part)
+	}
+	var prefetcher *partPrefetcher
+	if conf.PrefetchNext && len(parts) > 0 {
+		prefetcher = newPartPrefetcher(parts)
+	}
+
+	// the archive is downloaded to a file for the diff, it is indexed before it is extracted
+	var diffIndex archiveIndex
+	if conf.LogCacheDiff && strings.HasPrefix(cacheURI, "file://") {
+		if diffIndex, err = indexArchiveFile(strings.TrimPrefix(cacheURI, "file://"), decryptionKeys); err != nil {
+			log.Warnf("Failed to index the archive for the diff: %s", err)
+			diffIndex = nil
+		} else {
+			logCacheDiff(diffIndex)
+		}
+	}
+
+	result, err := extractWithFallbacks(cacheRecorderReader, src, opts)
+	extractionSpan.setAttribute("extraction.source", result.Source)
+	stepSummary.setExtraction(result)
+	if err != nil {
+		reportExtraction(conf.ErrorReportPath, result)
+		if spaceErr, ok := err.(*insufficientSpaceError); ok {
+			failf("Aborted the extraction, not enough free space: %s", spaceErr)
+		}
+		if linkErr, ok := err.(*symlinkError); ok {
+			failf("Aborted the extraction: %s", linkErr)
+		}
+		if dirErr, ok := err.(*dirConflictError); ok {
+			failf("Aborted the extraction: %s", dirErr)
+		}
+		if confErr, ok := err.(*confinementError); ok {
+			failf("Aborted the extraction: %s", confErr)
+		}
+		if pathErr, ok := err.(*longPathError); ok {
+			failf("Aborted the extraction: %s", pathErr)
+		}
+		failWithf(err, "Fallback failed, %s", err)
+	}
+	if result.Source == extractSourceStream {
+		// tar stops reading at the end-of-archive marker, the rest (padding) still belongs to the checksum
+		rest, err := io.Copy(ioutil.Discard, cacheRecorderReader)
+		result.CompressedBytes += rest
+		if err != nil {
+			if checksum.isSet() {
+				failf("Failed to verify cache archive checksum, the rest of the stream could not be read: %s", err)
+			}
+			log.Warnf("Failed to read the rest of the cache archive stream: %s", err)
+		} else {
+			if progress != nil {
+				progress.finish()
+			}
+			sum := archiveChecksum.Sum()
+			log.Printf("cache archive %s: %x", checksum.algorithm(), sum)
+			if err := checksum.verify(sum); err != nil {
+				failf("%s", err)
+			}
+		}
+	}
+	if body, ok := cacheReader.(io.ReadCloser); ok {
+		// the extraction succeeded, a failing close is only recorded in the summary
+		if err := closeBody(body); err != nil {
+			result.CloseError = err.Error()
+		}
+	}
+	if len(parts) > 0 {
+		partsResult, err := extractArchiveParts(parts, opts, prefetcher)
+		result.add(partsResult)
+		if err != nil {
+			reportExtraction(conf.ErrorReportPath, result)
+			failf("%s", err)
+		}
+	}
+	if restore != nil {
+		if result.Empty {
+			// nothing was restored, the previous content is kept
+			restore.abort()
+		} else if err := restore.commit(); err != nil {
+			failf("Failed to swap the restored cache into %s: %s", restore.root, err)
+		}
+		opts.Root = restore.root
+	}
+	// the archive's rest and the parts are counted too
+	stepSummary.setExtraction(result)
+	if result.Empty {
+		fmt.Println()
+		log.Infof("The cache archive was empty, nothing restored")
+		extractionSpan.finish()
+		stopExtractionTiming()
+
+		fmt.Println()
+		log.Donef("Done")
+		stepTimings.log()
+		log.Printf("Took: " + time.Since(startTime).String())
+		return
+	}
+	if requiredFiles := splitList(os.ExpandEnv(conf.RequiredFiles)); len(requiredFiles) > 0 && !conf.DryRun {
+		if err := checkRequiredFiles(requiredFiles, opts.Root, conf.RequiredPolicy); err != nil {
+			reportExtraction(conf.ErrorReportPath, result)
+			failf("Failed to verify the restored files: %s", err)
+		}
+	}
+	if conf.PermissionsManifest != "" && !conf.DryRun {
+		manifest, err := readPermissionsManifest(conf.PermissionsManifest)
+		if err != nil {
+			failf("Failed to read permissions manifest: %s", err)
+		}
+		applied, err := applyPermissions(manifest, opts.Root)
+		if err != nil {
+			failf("Failed to restore file permissions: %s", err)
+		}
+		log.Printf("file permissions restored from the manifest: %d", applied)
+	}
+	if sampler != nil {
+		usage := sampler.stop()
+		result.Usage = &usage
+		log.Printf("peak memory: %d MB (tar: %d MB), %d MB read, %d MB written", usage.PeakRSS/1024/1024, usage.PeakChildRSS/1024/1024, usage.BytesRead/1024/1024, usage.BytesWritten/1024/1024)
+		if err := exportResourceUsage(exportEnvironmentWithEnvman, usage); err != nil {
+			log.Warnf("Failed to export resource usage: %s", err)
+		}
+	}
+	reportExtraction(conf.ErrorReportPath, result)
+	if conf.SizeReport {
+		report := newSizeReport(result.Index)
+		logSizeReport(report)
+		if err := exportSizeReport(exportEnvironmentWithEnvman, report); err != nil {
+			log.Warnf("Failed to export size report: %s", err)
+		}
+	}
+	// the top entries help diagnosing a slow restore, they are always logged in debug mode
+	if (conf.ReportTopEntries || conf.DebugMode) && conf.TopEntriesCount > 0 {
+		logTopEntries(result.Index, conf.TopEntriesCount)
+	}
+	if conf.DiskWarningPercent > 0 {
+		checkCacheSize(result.UncompressedBytes, spacePth, conf.DiskWarningPercent)
+	}
+	if diffIndex != nil && !conf.DryRun {
+		recordCacheIndex(diffIndex)
+	}
+	extractionSpan.setAttribute("extraction.entries", result.Entries)
+	extractionSpan.setAttribute("extraction.skipped", result.Skipped)
+	extractionSpan.setAttribute("extraction.failed", len(result.Errors))
+	extractionSpan.finish()
+	stopExtractionTiming()
+	stepTracer.rootSpan().setAttribute("cache.hit", true)
+
+	if conf.ExportBreadcrumb && !conf.DryRun {
+		if err := exportBreadcrumb(exportEnvironmentWithEnvman, newBreadcrumb(info, result.Index)); err != nil {
+			log.Warnf("Failed to export cache breadcrumb: %s", err)
+		}
+	}
+
+	if conf.ContinueOnError && !conf.DryRun {
+		// the marker is not written, the next pull restores the cache again
+		if err := checkFailedEntries(len(result.Errors), conf.FailedPolicy); err != nil {
+			failf("%s", err)
+		}
+	}
 
-		if err := uncompressArchive(pth); err != nil {
-			failf("Fallback failed, unable to uncompress cache archive file: %s", err)
+	if conf.MarkerPath != "" && !conf.DryRun {
+		if err := writeMarker(conf.MarkerPath, archiveID); err != nil {
+			log.Warnf("Failed to write marker: %s", err)
 		}
 	}
 
 	fmt.Println()
 	log.Donef("Done")
+	stepTimings.log()
 	log.Printf("Took: " + time.Since(startTime).String())
+	logEvent("done", map[string]interface{}{"duration_ms": time.Since(startTime).Milliseconds()})
 }
@@ -0,0 +1,730 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewDownloadClient_KeepAlive(t *testing.T) {
+	for _, keepAlive := range []bool{true, false} {
+		var newConns int32
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := w.Write([]byte("archive")); err != nil {
+				t.Errorf("failed to write response: %s", err)
+			}
+		}))
+		server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				atomic.AddInt32(&newConns, 1)
+			}
+		}
+		server.Start()
+
+		client := newDownloadClient(keepAlive)
+		for i := 0; i < 2; i++ {
+			body, _, err := performRequest(client, server.URL)
+			if err != nil {
+				t.Fatalf("performRequest() error = %v", err)
+			}
+			if _, err := io.Copy(ioutil.Discard, body); err != nil {
+				t.Fatalf("failed to read body: %s", err)
+			}
+			if err := body.Close(); err != nil {
+				t.Fatalf("failed to close body: %s", err)
+			}
+		}
+		server.Close()
+
+		want := int32(2)
+		if keepAlive {
+			want = 1
+		}
+		if got := atomic.LoadInt32(&newConns); got != want {
+			t.Errorf("keepAlive = %v: opened connections = %d, want %d", keepAlive, got, want)
+		}
+	}
+}
+
+func TestResolveDownloadURL(t *testing.T) {
+	const cacheAPIURL = "https://cache.example.com/api/v1/cache/app-slug"
+
+	tests := []struct {
+		name           string
+		downloadURL    string
+		acceptRelative bool
+		want           string
+		wantErr        bool
+	}{
+		{"absolute URL", "https://storage.example.com/archive.tar", false, "https://storage.example.com/archive.tar", false},
+		{"relative URL rejected by default", "/downloads/archive.tar", false, "", true},
+		{"host relative URL", "/downloads/archive.tar", true, "https://cache.example.com/downloads/archive.tar", false},
+		{"path relative URL", "archive.tar?token=abc", true, "https://cache.example.com/api/v1/cache/archive.tar?token=abc", false},
+		{"parent relative URL", "../archive.tar", true, "https://cache.example.com/api/v1/archive.tar", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveDownloadURL(cacheAPIURL, tt.downloadURL, tt.acceptRelative)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveDownloadURL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("resolveDownloadURL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// zeroLengthServer serves the given body with a zero Content-Length header, closing the connection after the body.
+// A close-delimited response tells it with a Connection: close header. Each request's URI is sent on requests.
+func zeroLengthServer(t *testing.T, body []byte, closeDelimited bool) (string, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	header := "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+	if closeDelimited {
+		header = "HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"
+	}
+	requests := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { _ = conn.Close() }()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				requests <- req.RequestURI
+				_, _ = conn.Write([]byte(header))
+				_, _ = conn.Write(body)
+			}()
+		}
+	}()
+
+	return "http://" + listener.Addr().String() + "/cache.tar", requests
+}
+
+func TestRequestArchive_ZeroContentLength(t *testing.T) {
+	archive := createTestArchive(t, testEntry{hdr: tar.Header{Name: "File.txt", Typeflag: tar.TypeReg}, body: "content"}).Bytes()
+
+	readUntilClose := func(url string, ignoreZeroLength bool) {
+		t.Helper()
+		body, size, err := requestArchive(http.DefaultClient, url, ignoreZeroLength)
+		if err != nil {
+			t.Fatalf("requestArchive() error = %v", err)
+		}
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Fatalf("failed to read body: %s", err)
+		}
+		if err := body.Close(); err != nil {
+			t.Errorf("failed to close body: %s", err)
+		}
+		if size != -1 {
+			t.Errorf("requestArchive() size = %d, want -1", size)
+		}
+		if !bytes.Equal(b, archive) {
+			t.Errorf("requestArchive() read %d bytes, want the %d bytes archive", len(b), len(archive))
+		}
+
+		pth, err := downloadCacheArchive(http.DefaultClient, url, ignoreZeroLength, expectedChecksum{})
+		if err != nil {
+			t.Fatalf("downloadCacheArchive() error = %v", err)
+		}
+		b, err = ioutil.ReadFile(pth)
+		if err != nil {
+			t.Fatalf("failed to read downloaded archive: %s", err)
+		}
+		if !bytes.Equal(b, archive) {
+			t.Errorf("downloadCacheArchive() wrote %d bytes, want the %d bytes archive", len(b), len(archive))
+		}
+	}
+
+	t.Log("close-delimited zero Content-Length - archive read until close")
+	{
+		url, _ := zeroLengthServer(t, archive, true)
+		readUntilClose(url, false)
+	}
+
+	t.Log("keep-alive zero Content-Length ignored - archive read until close")
+	{
+		url, _ := zeroLengthServer(t, archive, false)
+		readUntilClose(url, true)
+	}
+
+	t.Log("keep-alive zero Content-Length trusted - empty archive")
+	{
+		url, _ := zeroLengthServer(t, archive, false)
+		body, size, err := requestArchive(http.DefaultClient, url, false)
+		if err != nil {
+			t.Fatalf("requestArchive() error = %v", err)
+		}
+		if err := body.Close(); err != nil {
+			t.Errorf("failed to close body: %s", err)
+		}
+		if size != -1 {
+			t.Errorf("requestArchive() size = %d, want -1", size)
+		}
+
+		if _, err := downloadCacheArchive(http.DefaultClient, url, false, expectedChecksum{}); err == nil {
+			t.Errorf("downloadCacheArchive() error = nil, want empty archive error")
+		}
+	}
+}
+
+func TestRequestUntilClose_Proxy(t *testing.T) {
+	archive := createTestArchive(t, testEntry{hdr: tar.Header{Name: "File.txt", Typeflag: tar.TypeReg}, body: "content"}).Bytes()
+	// the proxy answers the proxied request itself, the archive's host does not exist
+	proxy, requests := zeroLengthServer(t, archive, true)
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxyURL)
+	client := &http.Client{Transport: transport}
+
+	body, err := requestUntilClose(client, "http://cache.invalid/cache.tar")
+	if err != nil {
+		t.Fatalf("requestUntilClose() error = %v", err)
+	}
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatalf("failed to read body: %s", err)
+	}
+	_ = body.Close()
+	if !bytes.Equal(b, archive) {
+		t.Errorf("requestUntilClose() read %d bytes, want the %d bytes archive", len(b), len(archive))
+	}
+	if uri := <-requests; uri != "http://cache.invalid/cache.tar" {
+		t.Errorf("proxy got request of %s, want the archive's absolute URL", uri)
+	}
+}
+
+func TestShouldSkipForStack(t *testing.T) {
+	tests := []struct {
+		name         string
+		info         *archiveInfo
+		requireStack bool
+		want         bool
+	}{
+		{name: "same stack", info: &archiveInfo{StackID: "osx-xcode-12.0.x"}, want: false},
+		{name: "different stack", info: &archiveInfo{StackID: "osx-xcode-11.7.x"}, want: true},
+		{name: "empty archive stack id", info: &archiveInfo{StackID: ""}, want: false},
+		{name: "blank archive stack id", info: &archiveInfo{StackID: "  "}, want: false},
+		{name: "no archive info", info: nil, want: false},
+		{name: "empty archive stack id, stack required", info: &archiveInfo{StackID: ""}, requireStack: true, want: true},
+		{name: "no archive info, stack required", info: nil, requireStack: true, want: true},
+		{name: "same stack, stack required", info: &archiveInfo{StackID: "osx-xcode-12.0.x"}, requireStack: true, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shouldSkipForStack(tt.info, "osx-xcode-12.0.x", tt.requireStack); got != tt.want {
+				t.Errorf("shouldSkipForStack() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShouldSkipForStack_AcceptedStacks(t *testing.T) {
+	defer func(patterns []string) { acceptedStackIDs = patterns }(acceptedStackIDs)
+	var err error
+	if acceptedStackIDs, err = parseStackPatterns("osx-xcode-14.*\n linux-docker-android-22.04 \n"); err != nil {
+		t.Fatal(err)
+	}
+
+	for stackID, want := range map[string]bool{
+		"osx-xcode-14.2.x":           false,
+		"osx-xcode-14.3.x":           false,
+		"linux-docker-android-22.04": false,
+		"osx-xcode-15.0.x":           true,
+		// the current stack is not accepted implicitly
+		"osx-xcode-13.4.x": true,
+	} {
+		if got := shouldSkipForStack(&archiveInfo{StackID: stackID}, "osx-xcode-13.4.x", false); got != want {
+			t.Errorf("shouldSkipForStack(%s) = %v, want %v", stackID, got, want)
+		}
+	}
+	if !shouldSkipForStack(nil, "osx-xcode-13.4.x", true) {
+		t.Errorf("shouldSkipForStack(nil) = false, want the unknown stack skipped with require_archive_stack")
+	}
+
+	if _, err := parseStackPatterns("osx-[xcode"); err == nil {
+		t.Errorf("parseStackPatterns() error = nil, want an invalid pattern error")
+	}
+}
+
+func TestShouldSkipForStack_EmptyArchiveInfo(t *testing.T) {
+	info, err := parseArchiveInfo([]byte(`{"stack_id": ""}`))
+	if err != nil {
+		t.Fatalf("parseArchiveInfo() error = %v", err)
+	}
+	if shouldSkipForStack(&info, "osx-xcode-12.0.x", false) {
+		t.Errorf("shouldSkipForStack() = true, want false for an empty archive stack id")
+	}
+}
+
+func TestCheckStack_Restore(t *testing.T) {
+	// returns instead of terminating the step, the other behaviors exit
+	checkStack(&archiveInfo{StackID: "osx-xcode-11.7.x"}, "osx-xcode-12.0.x", false, stackMismatchRestore)
+	checkStack(&archiveInfo{StackID: "osx-xcode-12.0.x"}, "osx-xcode-12.0.x", true, stackMismatchFail)
+}
+
+func TestGetCacheDownloadURL_NoContent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	resp, err := getCacheDownloadURL(server.URL, "download_url")
+	if err != errCacheMiss {
+		t.Fatalf("getCacheDownloadURL() error = %v, want %v", err, errCacheMiss)
+	}
+	if resp.DownloadURL != "" {
+		t.Errorf("getCacheDownloadURL() = %s, want empty download URL", resp.DownloadURL)
+	}
+}
+
+func TestGetCacheDownloadURL_MissStatusCodes(t *testing.T) {
+	defer func(codes []int) { missStatusCodes = codes }(missStatusCodes)
+	defer func(delay time.Duration) { requestRetryBaseDelay = delay }(requestRetryBaseDelay)
+	requestRetryBaseDelay = time.Millisecond
+
+	tests := []struct {
+		codes    string
+		status   int
+		wantMiss bool
+	}{
+		{codes: "204", status: http.StatusNoContent, wantMiss: true},
+		{codes: "204", status: http.StatusNotFound, wantMiss: false},
+		{codes: "204,404,410", status: http.StatusNotFound, wantMiss: true},
+		{codes: "204, 404, 410", status: http.StatusGone, wantMiss: true},
+		{codes: "404\n410", status: http.StatusNoContent, wantMiss: false},
+		{codes: "404\n410", status: http.StatusInternalServerError, wantMiss: false},
+	}
+	for _, tt := range tests {
+		codes, err := parseStatusCodes(tt.codes)
+		if err != nil {
+			t.Fatalf("parseStatusCodes(%q) error = %v", tt.codes, err)
+		}
+		missStatusCodes = codes
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+		}))
+		_, err = getCacheDownloadURL(server.URL, "download_url")
+		server.Close()
+
+		if tt.wantMiss && err != errCacheMiss {
+			t.Errorf("%q, %d: getCacheDownloadURL() error = %v, want %v", tt.codes, tt.status, err, errCacheMiss)
+		}
+		if !tt.wantMiss && (err == nil || err == errCacheMiss) {
+			t.Errorf("%q, %d: getCacheDownloadURL() error = %v, want a non-miss error", tt.codes, tt.status, err)
+		}
+	}
+
+	if _, err := parseStatusCodes("204,not-found"); err == nil {
+		t.Errorf("parseStatusCodes() error = nil, want an invalid status code error")
+	}
+}
+
+func TestGetCacheDownloadURL_Timeout(t *testing.T) {
+	defer func(timeout time.Duration) { apiTimeout = timeout }(apiTimeout)
+	defer func(retries int) { requestRetries = retries }(requestRetries)
+	requestRetries = 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a slow API
+		time.Sleep(300 * time.Millisecond)
+		_, _ = w.Write([]byte(`{"download_url": "https://storage.com/cache.tar"}`))
+	}))
+	defer server.Close()
+
+	apiTimeout = 100 * time.Millisecond
+	if _, err := getCacheDownloadURL(server.URL, "download_url"); err == nil {
+		t.Errorf("getCacheDownloadURL() error = nil, want a timeout error")
+	}
+
+	apiTimeout = 5 * time.Second
+	resp, err := getCacheDownloadURL(server.URL, "download_url")
+	if err != nil {
+		t.Fatalf("getCacheDownloadURL() error = %v, want the longer timeout honored", err)
+	}
+	if resp.DownloadURL != "https://storage.com/cache.tar" {
+		t.Errorf("getCacheDownloadURL() = %s", resp.DownloadURL)
+	}
+}
+
+func TestGetCacheDownloadURL_DirURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"download_url": "https://storage.com/cache.tar", "dir_url": "dir:///cache/dir"}`))
+	}))
+	defer server.Close()
+
+	resp, err := getCacheDownloadURL(server.URL, "download_url")
+	if err != nil {
+		t.Fatalf("getCacheDownloadURL() error = %v", err)
+	}
+	if resp.DirURL != "dir:///cache/dir" {
+		t.Errorf("getCacheDownloadURL() dir url = %s, want dir:///cache/dir", resp.DirURL)
+	}
+}
+
+func TestExtractWithFallbacks_Directory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	cacheDir := filepath.Join(dir, "cache")
+	if err := os.MkdirAll(filepath.Join(cacheDir, "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(cacheDir, "a", "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	garbage := filepath.Join(dir, "garbage.tar")
+	if err := ioutil.WriteFile(garbage, []byte("not an archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "root")
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	src := archiveSource{URI: "file://" + garbage, DirURL: "dir://" + cacheDir}
+	result, err := extractWithFallbacks(bytes.NewReader([]byte("not an archive")), src, extractOptions{Root: root})
+	if err != nil {
+		t.Fatalf("extractWithFallbacks() error = %v", err)
+	}
+	if result.Source != extractSourceDirectory {
+		t.Errorf("extractWithFallbacks() source = %s, want %s", result.Source, extractSourceDirectory)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(root, "a", "file")); err != nil || string(b) != "content" {
+		t.Errorf("copied file = %q (%v), want content", b, err)
+	}
+}
+
+func TestExtractWithFallbacks_Pipe(t *testing.T) {
+	root := t.TempDir()
+	archive := createTestArchive(t,
+		testEntry{hdr: tar.Header{Name: "/cache/File.txt", Typeflag: tar.TypeReg}, body: "cache"},
+	).Bytes()
+	body := archive
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(body)
+	}))
+	defer server.Close()
+	if err := os.Remove(cacheArchivePath); err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	stream := newChecksumReader(bytes.NewReader([]byte("not an archive")), sha256.New(), true)
+	src := archiveSource{Client: server.Client(), URI: server.URL, PipeFallback: true, StopStream: stream.stop}
+	result, err := extractWithFallbacks(stream, src, extractOptions{Root: root})
+	if err != nil {
+		t.Fatalf("extractWithFallbacks() error = %v", err)
+	}
+	if result.Source != extractSourceFile || result.Entries != 1 {
+		t.Errorf("extractWithFallbacks() source = %s, entries = %d, want %s, 1", result.Source, result.Entries, extractSourceFile)
+	}
+	if stream.chunks != nil {
+		t.Errorf("extractWithFallbacks() left the abandoned stream's hashing goroutine running")
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(root, "cache", "File.txt")); err != nil || string(b) != "cache" {
+		t.Errorf("extracted file = %q (%v), want cache", b, err)
+	}
+	if _, err := os.Stat(cacheArchivePath); !os.IsNotExist(err) {
+		t.Errorf("%s is created in pipe mode: %v", cacheArchivePath, err)
+	}
+
+	// the piped archive is verified against the Cache API's checksum
+	src.Checksum = expectedChecksum{Algorithm: "sha256", Sum: strings.Repeat("0", 64)}
+	if _, err := extractWithFallbacks(bytes.NewReader([]byte("not an archive")), src, extractOptions{Root: root}); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("extractWithFallbacks() error = %v, want a checksum mismatch", err)
+	}
+	src.Checksum = expectedChecksum{}
+
+	// tar exits mid-download on the corrupt archive
+	body = append(archive[:1024:1024], bytes.Repeat([]byte("corrupt!"), 64*1024)...)
+	if _, err := extractWithFallbacks(bytes.NewReader([]byte("not an archive")), src, extractOptions{Root: root}); err == nil {
+		t.Errorf("extractWithFallbacks() error = nil, want the tar error of the corrupt archive")
+	}
+	if _, err := os.Stat(cacheArchivePath); !os.IsNotExist(err) {
+		t.Errorf("%s is created in pipe mode: %v", cacheArchivePath, err)
+	}
+}
+
+// failingCloseBody is a response body whose Close fails.
+type failingCloseBody struct {
+	io.Reader
+	closed bool
+}
+
+func (b *failingCloseBody) Close() error {
+	b.closed = true
+	return errors.New("connection reset by peer")
+}
+
+// bodyTransport responds to every request with the given body.
+type bodyTransport struct {
+	body io.ReadCloser
+}
+
+func (t bodyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusOK, Body: t.body, ContentLength: -1, Request: req}, nil
+}
+
+func TestCloseBody_FailingClose(t *testing.T) {
+	archive := createTestArchive(t,
+		testEntry{hdr: tar.Header{Name: "/cache/File.txt", Typeflag: tar.TypeReg}, body: "cache"},
+	)
+
+	t.Log("downloaded archive file")
+	{
+		body := &failingCloseBody{Reader: bytes.NewReader(archive.Bytes())}
+		client := &http.Client{Transport: bodyTransport{body: body}}
+		pth, err := downloadCacheArchive(client, "https://storage.com/cache.tar", false, expectedChecksum{})
+		if err != nil {
+			t.Fatalf("downloadCacheArchive() error = %v, want the close error ignored", err)
+		}
+		if b, err := ioutil.ReadFile(pth); err != nil || !bytes.Equal(b, archive.Bytes()) {
+			t.Errorf("downloaded archive differs from the original: %v", err)
+		}
+		if !body.closed {
+			t.Errorf("body not closed")
+		}
+	}
+
+	t.Log("extracted archive stream")
+	{
+		root := t.TempDir()
+		body := &failingCloseBody{Reader: bytes.NewReader(archive.Bytes())}
+		result, err := extractCacheArchive(body, extractOptions{Root: root})
+		if err != nil {
+			t.Fatalf("extractCacheArchive() error = %v, want the close error recorded", err)
+		}
+		if result.CloseError != "connection reset by peer" {
+			t.Errorf("close error = %q, want it recorded in the summary", result.CloseError)
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(root, "cache", "File.txt")); err != nil || string(b) != "cache" {
+			t.Errorf("extracted file = %q, %v", b, err)
+		}
+	}
+}
+
+func TestNewArchiveTempDir(t *testing.T) {
+	defer func(pth string) { cacheArchivePath = pth }(cacheArchivePath)
+	base := t.TempDir()
+
+	first, err := newArchiveTempDir(base)
+	if err != nil {
+		t.Fatalf("newArchiveTempDir() error = %v", err)
+	}
+	firstPth := cacheArchivePath
+	if filepath.Dir(firstPth) != first || !strings.HasPrefix(first, base) {
+		t.Errorf("cacheArchivePath = %s, want under %s", firstPth, base)
+	}
+
+	second, err := newArchiveTempDir(base)
+	if err != nil {
+		t.Fatalf("newArchiveTempDir() error = %v", err)
+	}
+	if second == first || cacheArchivePath == firstPth {
+		t.Errorf("newArchiveTempDir() = %s twice, want a directory per run", second)
+	}
+
+	// the file:// archive is used in place
+	if pth, err := downloadCacheArchive(http.DefaultClient, "file:///cache/archive.tar", false, expectedChecksum{}); err != nil || pth != "/cache/archive.tar" {
+		t.Errorf("downloadCacheArchive() = %s, %v, want the local path", pth, err)
+	}
+}
+
+func TestCopyLocalArchive(t *testing.T) {
+	archive := createTestArchive(t, testEntry{hdr: tar.Header{Name: "file.txt", Typeflag: tar.TypeReg}, body: "cached"}).Bytes()
+	src := filepath.Join(t.TempDir(), "archive.tar")
+	if err := ioutil.WriteFile(src, archive, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), "cache-archive.tar")
+	if err := copyLocalArchive(src, dst); err != nil {
+		t.Fatalf("copyLocalArchive() error = %v", err)
+	}
+
+	// the original changes after the copy, the pull extracts the copy
+	if err := ioutil.WriteFile(src, []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pth, err := downloadCacheArchive(http.DefaultClient, "file://"+dst, false, expectedChecksum{})
+	if err != nil || pth != dst {
+		t.Fatalf("downloadCacheArchive() = %s, %v, want the copy", pth, err)
+	}
+	root := t.TempDir()
+	if _, err := uncompressArchive(pth, extractOptions{Root: root}); err != nil {
+		t.Fatalf("uncompressArchive() error = %v", err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(root, "file.txt")); err != nil || string(b) != "cached" {
+		t.Errorf("file.txt = %q, %v, want the copied archive extracted", b, err)
+	}
+	if b, err := ioutil.ReadFile(src); err != nil || string(b) != "changed" {
+		t.Errorf("original archive = %q, %v, want it untouched", b, err)
+	}
+}
+
+func TestProxyURL(t *testing.T) {
+	defer func(proxy func(*http.Request) (*url.URL, error)) { proxyFunc = proxy }(proxyFunc)
+
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a proxy gets the absolute URL of the request
+		proxied = append(proxied, r.URL.String())
+		if r.URL.Path == "/api" {
+			_, _ = w.Write([]byte(`{"download_url": "http://storage.invalid/cache.tar"}`))
+			return
+		}
+		_, _ = w.Write([]byte("archive"))
+	}))
+	defer proxy.Close()
+
+	proxyURL, err := parseProxyURL(strings.TrimPrefix(proxy.URL, "http://"))
+	if err != nil {
+		t.Fatalf("parseProxyURL() error = %v", err)
+	}
+	if proxyURL.String() != proxy.URL {
+		t.Errorf("parseProxyURL() = %s, want %s", proxyURL, proxy.URL)
+	}
+	proxyFunc = http.ProxyURL(proxyURL)
+
+	resp, err := getCacheDownloadURL("http://cache.invalid/api", "download_url")
+	if err != nil {
+		t.Fatalf("getCacheDownloadURL() error = %v", err)
+	}
+	body, _, err := performRequest(newDownloadClient(true), resp.DownloadURL)
+	if err != nil {
+		t.Fatalf("performRequest() error = %v", err)
+	}
+	_ = closeBody(body)
+
+	if want := []string{"http://cache.invalid/api", "http://storage.invalid/cache.tar"}; !reflect.DeepEqual(proxied, want) {
+		t.Errorf("proxied requests = %v, want %v", proxied, want)
+	}
+
+	if _, err := parseProxyURL("http://"); err == nil {
+		t.Errorf("parseProxyURL() error = nil, want a missing host error")
+	}
+}
+
+func TestNewDownloadClient_StallTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { downloadStallTimeout = timeout }(downloadStallTimeout)
+	downloadStallTimeout = 100 * time.Millisecond
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		_, _ = w.Write([]byte("12345"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	resp, err := newDownloadClient(true).Get(server.URL)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	var stallErr *stallError
+	if !errors.As(err, &stallErr) {
+		t.Fatalf("ReadAll() error = %v, want a stall error", err)
+	}
+	if string(b) != "12345" {
+		t.Errorf("ReadAll() = %q, want the bytes received before the stall", b)
+	}
+	if !isConnectionError(err) {
+		t.Errorf("isConnectionError(%v) = false, want a retried connection error", err)
+	}
+}
+
+func TestExtractWithFallbacks_StreamErr(t *testing.T) {
+	dir := t.TempDir()
+	pth := filepath.Join(dir, "cache.tar")
+	archive := createTestArchive(t, testEntry{hdr: tar.Header{Name: "a/file", Typeflag: tar.TypeReg}, body: "content"})
+	if err := ioutil.WriteFile(pth, archive.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "root")
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// the stream is not read, the archive file is extracted
+	src := archiveSource{URI: "file://" + pth, StreamErr: &bufferLimitError{Limit: 1024}}
+	result, err := extractWithFallbacks(bytes.NewReader([]byte("not an archive")), src, extractOptions{Root: root})
+	if err != nil {
+		t.Fatalf("extractWithFallbacks() error = %v", err)
+	}
+	if result.Source != extractSourceFile {
+		t.Errorf("extractWithFallbacks() source = %s, want %s", result.Source, extractSourceFile)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(root, "a", "file")); err != nil || string(b) != "content" {
+		t.Errorf("extracted file = %q (%v), want content", b, err)
+	}
+}
+
+func TestFindCache(t *testing.T) {
+	miss := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer miss.Close()
+	hit := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"download_url":"https://cache.example.com/fallback.tar"}`))
+	}))
+	defer hit.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer failing.Close()
+
+	apiURL, resp, err := findCache([]string{miss.URL, hit.URL, failing.URL}, "download_url")
+	if err != nil {
+		t.Fatalf("findCache() error = %v", err)
+	}
+	if apiURL != hit.URL || resp.DownloadURL != "https://cache.example.com/fallback.tar" {
+		t.Errorf("findCache() = %s, %s, want the fallback's download URL", apiURL, resp.DownloadURL)
+	}
+
+	if _, _, err := findCache([]string{miss.URL, miss.URL}, "download_url"); err != errCacheMiss {
+		t.Errorf("findCache() error = %v, want %v if none of the URLs has a cache", err, errCacheMiss)
+	}
+	if apiURL, _, err := findCache([]string{failing.URL, hit.URL}, "download_url"); err == nil || err == errCacheMiss || apiURL != failing.URL {
+		t.Errorf("findCache() = %s, %v, want the failing URL's error, the fallbacks are only tried on a miss", apiURL, err)
+	}
+	if apiURL, _, err := findCache([]string{miss.URL, "file:///tmp/cache.tar", hit.URL}, "download_url"); err != nil || apiURL != "file:///tmp/cache.tar" {
+		t.Errorf("findCache() = %s, %v, want the local archive", apiURL, err)
+	}
+}
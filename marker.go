@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// archiveIdentity returns an identifier of the archive's content without downloading the whole archive.
+// For remote archives it is the ETag of the download URL, for local archives the file's size and modification time.
+// An empty identity means the archive can not be identified.
+func archiveIdentity(client *http.Client, uri string) (string, error) {
+	if strings.HasPrefix(uri, "file://") {
+		info, err := os.Stat(strings.TrimPrefix(uri, "file://"))
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d-%d", info.Size(), info.ModTime().UnixNano()), nil
+	}
+
+	// Presigned download URLs are usually signed for GET requests only,
+	// so a single byte GET is requested instead of a HEAD.
+	req, err := http.NewRequestWithContext(stepContext, "GET", uri, nil)
+	if err != nil {
+		return "", err
+	}
+	setHeaders(req, downloadHeaders)
+	req.Header.Set("Range", "bytes=0-0")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return "", fmt.Errorf("non success response code: %d", resp.StatusCode)
+	}
+
+	return resp.Header.Get("ETag"), nil
+}
+
+// markerMatches reports whether the marker at the given path records the given archive identity,
+// meaning the same archive was already restored by a previous build.
+func markerMatches(pth, identity string) (bool, error) {
+	if identity == "" {
+		return false, nil
+	}
+
+	b, err := ioutil.ReadFile(pth)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return strings.TrimSpace(string(b)) == identity, nil
+}
+
+// writeMarker records the restored archive's identity at the given path.
+// An unknown (empty) identity is not recorded, as it could never match.
+func writeMarker(pth, identity string) error {
+	if identity == "" {
+		log.Debugf("cache archive identity is unknown, not writing marker")
+		return nil
+	}
+	return ioutil.WriteFile(pth, []byte(identity), 0644)
+}
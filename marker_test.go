@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMarkerMatches(t *testing.T) {
+	etag := `"archive-v1"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusPartialContent)
+	}))
+	defer server.Close()
+
+	identity, err := archiveIdentity(http.DefaultClient, server.URL)
+	if err != nil {
+		t.Fatalf("archiveIdentity() error = %v", err)
+	}
+	if identity != etag {
+		t.Fatalf("archiveIdentity() = %s, want %s", identity, etag)
+	}
+
+	t.Log("marker match - skip")
+	{
+		pth := filepath.Join(t.TempDir(), "marker")
+		if err := writeMarker(pth, etag); err != nil {
+			t.Fatalf("writeMarker() error = %v", err)
+		}
+
+		match, err := markerMatches(pth, identity)
+		if err != nil {
+			t.Fatalf("markerMatches() error = %v", err)
+		}
+		if !match {
+			t.Errorf("markerMatches() = %v, want %v", match, true)
+		}
+	}
+
+	t.Log("marker mismatch - pull")
+	{
+		pth := filepath.Join(t.TempDir(), "marker")
+		if err := writeMarker(pth, `"archive-v0"`); err != nil {
+			t.Fatalf("writeMarker() error = %v", err)
+		}
+
+		match, err := markerMatches(pth, identity)
+		if err != nil {
+			t.Fatalf("markerMatches() error = %v", err)
+		}
+		if match {
+			t.Errorf("markerMatches() = %v, want %v", match, false)
+		}
+	}
+
+	t.Log("missing marker - pull")
+	{
+		match, err := markerMatches(filepath.Join(t.TempDir(), "marker"), identity)
+		if err != nil {
+			t.Fatalf("markerMatches() error = %v", err)
+		}
+		if match {
+			t.Errorf("markerMatches() = %v, want %v", match, false)
+		}
+	}
+}
+
+func TestArchiveIdentity_NoETag(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusPartialContent)
+	}))
+	defer server.Close()
+
+	identity, err := archiveIdentity(http.DefaultClient, server.URL)
+	if err != nil {
+		t.Fatalf("archiveIdentity() error = %v", err)
+	}
+	if identity != "" {
+		t.Fatalf("archiveIdentity() = %s, want empty identity", identity)
+	}
+
+	pth := filepath.Join(t.TempDir(), "marker")
+	if err := writeMarker(pth, identity); err != nil {
+		t.Fatalf("writeMarker() error = %v", err)
+	}
+	if _, err := os.Stat(pth); !os.IsNotExist(err) {
+		t.Errorf("marker written for an unknown archive identity")
+	}
+
+	match, err := markerMatches(pth, identity)
+	if err != nil {
+		t.Fatalf("markerMatches() error = %v", err)
+	}
+	if match {
+		t.Errorf("markerMatches() = %v, want %v", match, false)
+	}
+}
+
+func TestArchiveIdentity_LocalFile(t *testing.T) {
+	pth := filepath.Join(t.TempDir(), "archive.tar")
+	if err := ioutil.WriteFile(pth, []byte("archive"), 0644); err != nil {
+		t.Fatalf("failed to write archive: %s", err)
+	}
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(pth, modTime, modTime); err != nil {
+		t.Fatalf("failed to set modification time: %s", err)
+	}
+
+	identity, err := archiveIdentity(http.DefaultClient, "file://"+pth)
+	if err != nil {
+		t.Fatalf("archiveIdentity() error = %v", err)
+	}
+	want := fmt.Sprintf("7-%d", modTime.UnixNano())
+	if identity != want {
+		t.Fatalf("archiveIdentity() = %s, want %s", identity, want)
+	}
+
+	t.Log("unchanged archive - skip")
+	{
+		markerPth := filepath.Join(t.TempDir(), "marker")
+		if err := writeMarker(markerPth, identity); err != nil {
+			t.Fatalf("writeMarker() error = %v", err)
+		}
+
+		again, err := archiveIdentity(http.DefaultClient, "file://"+pth)
+		if err != nil {
+			t.Fatalf("archiveIdentity() error = %v", err)
+		}
+		match, err := markerMatches(markerPth, again)
+		if err != nil {
+			t.Fatalf("markerMatches() error = %v", err)
+		}
+		if !match {
+			t.Errorf("markerMatches() = %v, want %v", match, true)
+		}
+	}
+
+	t.Log("modified archive - pull")
+	{
+		markerPth := filepath.Join(t.TempDir(), "marker")
+		if err := writeMarker(markerPth, identity); err != nil {
+			t.Fatalf("writeMarker() error = %v", err)
+		}
+
+		if err := ioutil.WriteFile(pth, []byte("new archive"), 0644); err != nil {
+			t.Fatalf("failed to write archive: %s", err)
+		}
+		modified, err := archiveIdentity(http.DefaultClient, "file://"+pth)
+		if err != nil {
+			t.Fatalf("archiveIdentity() error = %v", err)
+		}
+		match, err := markerMatches(markerPth, modified)
+		if err != nil {
+			t.Fatalf("markerMatches() error = %v", err)
+		}
+		if match {
+			t.Errorf("markerMatches() = %v, want %v", match, false)
+		}
+	}
+
+	t.Log("missing archive")
+	{
+		if _, err := archiveIdentity(http.DefaultClient, "file://"+pth+".missing"); err == nil {
+			t.Errorf("archiveIdentity() error = nil, want error")
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// namedCache is one of the independent caches listed in cache_urls.
+type namedCache struct {
+	Key    string
+	APIURL string
+}
+
+// parseCacheURLs parses the newline separated `<key>=<Cache API URL>` list of the independent caches.
+// The keys name the caches in the summary, and their directories under the extraction root, so they have to be unique
+// and valid directory names.
+func parseCacheURLs(list string) ([]namedCache, error) {
+	var caches []namedCache
+	keys := map[string]bool{}
+	for _, item := range splitList(list) {
+		split := strings.SplitN(item, "=", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("invalid cache %s, expected <key>=<Cache API URL>", item)
+		}
+		key, apiURL := strings.TrimSpace(split[0]), strings.TrimSpace(split[1])
+		if key == "" || key == "." || key == ".." || strings.ContainsAny(key, `/\`) {
+			return nil, fmt.Errorf("invalid cache key: %q", key)
+		}
+		if apiURL == "" {
+			return nil, fmt.Errorf("cache %s has no Cache API URL", key)
+		}
+		if strings.HasPrefix(apiURL, "dir://") {
+			return nil, fmt.Errorf("cache %s: pre-extracted cache directories are not supported in cache_urls", key)
+		}
+		if keys[key] {
+			return nil, fmt.Errorf("duplicate cache key: %s", key)
+		}
+		keys[key] = true
+		caches = append(caches, namedCache{Key: key, APIURL: apiURL})
+	}
+	return caches, nil
+}
+
+// cachePullResult is the outcome of pulling one of the independent caches.
+type cachePullResult struct {
+	Key     string `json:"key"`
+	Hit     bool   `json:"hit"`
+	Entries int    `json:"entries"`
+	Error   string `json:"error,omitempty"`
+	// Failed is the number of the entries failed to extract and skipped, with continue_on_error.
+	Failed int `json:"failed_entries,omitempty"`
+	// Transient reports whether the failure might not happen again, if the cache failed.
+	Transient bool `json:"transient,omitempty"`
+}
+
+// multiPullOptions are the settings shared by the independent caches' pulls.
+type multiPullOptions struct {
+	Client           *http.Client
+	JSONPath         string
+	AcceptRelative   bool
+	IgnoreZeroLength bool
+	DecryptionKeys   []decryptionKey
+	PipeFallback     bool
+	// Extract are the extraction options, its Root is the parent of the caches' own extraction directories.
+	Extract extractOptions
+}
+
+// pullCaches pulls the independent caches one after the other. A failing cache does not stop pulling the rest,
+// its error is recorded in its result.
+func pullCaches(caches []namedCache, opts multiPullOptions) []cachePullResult {
+	var results []cachePullResult
+	for _, c := range caches {
+		fmt.Println()
+		log.Infof("Pulling cache: %s", c.Key)
+
+		result, err := pullNamedCache(c, opts)
+		if err != nil {
+			log.Warnf("Failed to pull cache %s: %s", c.Key, err)
+			result.Error = err.Error()
+			result.Transient = isTransientError(err)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// pullNamedCache resolves the cache's download URL and extracts its archive, with the file fallback of the single cache mode.
+// The archive is extracted to its own paths, or under the key's directory of the extraction root, if it is set.
+func pullNamedCache(c namedCache, opts multiPullOptions) (cachePullResult, error) {
+	result := cachePullResult{Key: c.Key}
+
+	src := archiveSource{
+		Client:           opts.Client,
+		URI:              c.APIURL,
+		IgnoreZeroLength: opts.IgnoreZeroLength,
+		DecryptionKeys:   opts.DecryptionKeys,
+		PipeFallback:     opts.PipeFallback,
+	}
+	var partURIs []string
+	if !strings.HasPrefix(c.APIURL, "file://") && !isBucketURL(c.APIURL) {
+		apiResp, err := lookupCacheDownloadURL(c.APIURL, opts.JSONPath)
+		if err == errCacheMiss {
+			log.Warnf("No cache found for %s", c.Key)
+			return result, nil
+		}
+		if err != nil {
+			return result, fmt.Errorf("failed to get cache download url: %s", err)
+		}
+		if src.URI, err = resolveDownloadURL(c.APIURL, apiResp.DownloadURL, opts.AcceptRelative); err != nil {
+			return result, fmt.Errorf("failed to resolve cache download url: %s", err)
+		}
+		for _, partURL := range apiResp.PartURLs {
+			partURI, err := resolveDownloadURL(c.APIURL, partURL, opts.AcceptRelative)
+			if err != nil {
+				return result, fmt.Errorf("failed to resolve archive part download url: %s", err)
+			}
+			partURIs = append(partURIs, partURI)
+		}
+		src.Checksum = apiResp.Checksum
+	}
+	result.Hit = true
+
+	extract := opts.Extract
+	if extract.Root != "" {
+		extract.Root = filepath.Join(extract.Root, c.Key)
+		if extract.DryRun {
+			log.Printf("%s: would extract to: %s", c.Key, extract.Root)
+		} else if err := os.MkdirAll(extract.Root, 0755); err != nil {
+			return result, fmt.Errorf("failed to create extraction directory: %s", err)
+		}
+		if extract.FreeSpacePath != "" {
+			extract.FreeSpacePath = extract.Root
+		}
+	}
+
+	var archive io.ReadCloser
+	if strings.HasPrefix(src.URI, "file://") {
+		f, err := os.Open(strings.TrimPrefix(src.URI, "file://"))
+		if err != nil {
+			return result, fmt.Errorf("failed to open cache archive file: %s", err)
+		}
+		archive = f
+	} else {
+		body, _, err := requestArchive(src.Client, src.URI, src.IgnoreZeroLength)
+		if err != nil {
+			return result, fmt.Errorf("failed to perform cache download request: %s", err)
+		}
+		archive = body
+	}
+	defer func() { _ = closeBody(archive) }()
+
+	checksum := newChecksumReader(archive, src.Checksum.newHash(), false)
+	r, _, err := newDecryptReader(checksum, src.DecryptionKeys)
+	if err != nil {
+		return result, fmt.Errorf("failed to decrypt cache archive: %s", err)
+	}
+	extracted, err := extractWithFallbacks(r, src, extract)
+	if err != nil {
+		return result, err
+	}
+	if extracted.Source == extractSourceStream && src.Checksum.isSet() {
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			return result, fmt.Errorf("failed to verify cache archive checksum: %s", err)
+		}
+		if err := src.Checksum.verify(checksum.Sum()); err != nil {
+			return result, err
+		}
+	}
+
+	if len(partURIs) > 0 {
+		parts := make([]archiveSource, 0, len(partURIs))
+		for _, partURI := range partURIs {
+			part := src
+			part.URI = partURI
+			part.Checksum = expectedChecksum{}
+			parts = append(parts, part)
+		}
+		partsResult, err := extractArchiveParts(parts, extract, nil)
+		extracted.add(partsResult)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	result.Entries = extracted.Entries
+	result.Failed = len(extracted.Errors)
+	log.Printf("%s: %d entries extracted, %d skipped, %d failed", c.Key, extracted.Entries, extracted.Skipped, len(extracted.Errors))
+	return result, nil
+}
+
+// logCachePullResults logs the per-cache and the aggregate summary, it returns the number of failed caches.
+func logCachePullResults(results []cachePullResult) int {
+	fmt.Println()
+	log.Infof("Cache summary")
+
+	var hits, misses, failed int
+	for _, result := range results {
+		switch {
+		case result.Error != "":
+			failed++
+			log.Printf("- %s: failed, %s", result.Key, result.Error)
+		case result.Hit:
+			hits++
+			log.Printf("- %s: hit, %d entries", result.Key, result.Entries)
+		default:
+			misses++
+			log.Printf("- %s: miss", result.Key)
+		}
+	}
+	log.Printf("%d caches: %d hit, %d miss, %d failed", len(results), hits, misses, failed)
+	return failed
+}
+
+// exportCachePullResults exports the per-cache results as JSON.
+func exportCachePullResults(export exportFunc, results []cachePullResult) error {
+	b, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+	return export(cacheResultsEnvKey, string(b))
+}
+
+// pullIndependentCaches pulls the caches listed in cache_urls, with the step's download and extraction settings,
+// then reports and exports their results. The step fails if any of the caches failed, misses are only failures with fail_on_cache_miss.
+func pullIndependentCaches(conf Config, caches []namedCache, client *http.Client, filter *pathFilter) {
+	keys, err := parseDecryptionKeys(string(conf.DecryptionKeys))
+	if err != nil {
+		failf("Failed to parse decryption keys: %s", err)
+	}
+	tmpDir, err := newArchiveTempDir(conf.TmpDir)
+	if err != nil {
+		failf("Failed to create temporary directory: %s", err)
+	}
+	removeTmpDir := func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			log.Warnf("Failed to remove temporary directory: %s", err)
+		}
+	}
+	onDeadline(removeTmpDir)
+	defer removeTmpDir()
+
+	extract := extractOptions{ExtractMetadata: conf.ExtractMetadata, ExistingSymlinks: conf.ExistingSymlinks, DirFileConflicts: conf.DirFileConflicts, LongPaths: conf.LongPaths, GzipResync: conf.GzipResync, ConfineRoot: conf.ConfineRoot, AcceptZip: conf.AcceptZip, VerifyPerFile: conf.VerifyPerFile, Filter: filter, DryRun: conf.DryRun, Root: conf.ExtractRoot, Concurrency: extractConcurrency(conf.ExtractConcurrency), SkipIdentical: conf.SkipIdentical, EntryTimeout: time.Duration(conf.EntryTimeout) * time.Second, StripComponents: conf.StripComponents, ContinueOnError: conf.ContinueOnError}
+	if conf.ConfineRoot && extract.Root == "" {
+		failf("confine_to_root requires extract_root, refusing to extract the archives to their own paths")
+	}
+	if conf.MonitorFreeSpace {
+		extract.MinFreeSpace = uint64(conf.MinFreeSpace) * 1024 * 1024
+		extract.FreeSpacePath = "."
+		if extract.Root != "" {
+			extract.FreeSpacePath = extract.Root
+		}
+	}
+
+	results := pullCaches(caches, multiPullOptions{
+		Client:           client,
+		JSONPath:         conf.DownloadURLJSONPath,
+		AcceptRelative:   conf.AcceptRelativeURL,
+		IgnoreZeroLength: conf.IgnoreZeroLength,
+		DecryptionKeys:   keys,
+		PipeFallback:     conf.FallbackMode == fallbackModePipe,
+		Extract:          extract,
+	})
+	failed := logCachePullResults(results)
+	var pulled extractResult
+	hits, failedEntries := 0, 0
+	for _, result := range results {
+		pulled.Entries += result.Entries
+		failedEntries += result.Failed
+		if result.Hit {
+			hits++
+		}
+	}
+	if hits > 0 {
+		stepSummary.setExtraction(pulled)
+	}
+	if err := exportCachePullResults(exportEnvironmentWithEnvman, results); err != nil {
+		log.Warnf("Failed to export cache results: %s", err)
+	}
+	if failed > 0 {
+		// the failure is transient only if each failed cache failed transiently
+		var cause error = &transientError{err: fmt.Errorf("failed to pull %d of the %d caches", failed, len(results))}
+		for _, result := range results {
+			if result.Error != "" && !result.Transient {
+				cause = errors.New(result.Error)
+			}
+		}
+		failWithf(cause, "Failed to pull %d of the %d caches", failed, len(results))
+	}
+	if misses := len(results) - hits - failed; misses > 0 && conf.FailOnMiss {
+		failf("No cache found for %d of the %d caches (fail_on_cache_miss is set)", misses, len(results))
+	}
+	if conf.ContinueOnError && !conf.DryRun {
+		if err := checkFailedEntries(failedEntries, conf.FailedPolicy); err != nil {
+			failf("%s", err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseCacheURLs(t *testing.T) {
+	caches, err := parseCacheURLs("gradle=https://cache.example.com/gradle?key=a=b\n\n npm = file:///tmp/npm.tar \n")
+	if err != nil {
+		t.Fatalf("parseCacheURLs() error = %v", err)
+	}
+	want := []namedCache{{Key: "gradle", APIURL: "https://cache.example.com/gradle?key=a=b"}, {Key: "npm", APIURL: "file:///tmp/npm.tar"}}
+	if !reflect.DeepEqual(caches, want) {
+		t.Errorf("parseCacheURLs() = %v, want %v", caches, want)
+	}
+
+	for _, list := range []string{"https://cache.example.com", "=https://cache.example.com", "../gradle=https://cache.example.com", "gradle=", "a=https://a\na=https://b", "dir=dir:///cache"} {
+		if _, err := parseCacheURLs(list); err == nil {
+			t.Errorf("parseCacheURLs(%q) error = nil, want an invalid list error", list)
+		}
+	}
+}
+
+func TestPullCaches(t *testing.T) {
+	root := t.TempDir()
+	archive := createTestArchive(t,
+		testEntry{hdr: tar.Header{Name: "/cache/File.txt", Typeflag: tar.TypeReg}, body: "gradle"},
+	).Bytes()
+
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(archive)
+	}))
+	defer storage.Close()
+	hitAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"download_url": "` + storage.URL + `/cache.tar"}`))
+	}))
+	defer hitAPI.Close()
+	missAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer missAPI.Close()
+
+	caches := []namedCache{{Key: "gradle", APIURL: hitAPI.URL}, {Key: "npm", APIURL: missAPI.URL}}
+	results := pullCaches(caches, multiPullOptions{Client: http.DefaultClient, JSONPath: "download_url", Extract: extractOptions{Root: root}})
+
+	want := []cachePullResult{{Key: "gradle", Hit: true, Entries: 1}, {Key: "npm"}}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("pullCaches() = %+v, want %+v", results, want)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(root, "gradle", "cache", "File.txt")); err != nil || string(b) != "gradle" {
+		t.Errorf("extracted file = %q (%v), want gradle", b, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "npm")); !os.IsNotExist(err) {
+		t.Errorf("the missing cache's directory is created: %v", err)
+	}
+	if failed := logCachePullResults(results); failed != 0 {
+		t.Errorf("logCachePullResults() = %d failed, want 0", failed)
+	}
+
+	exported := map[string]string{}
+	export := func(key, value string) error {
+		exported[key] = value
+		return nil
+	}
+	if err := exportCachePullResults(export, results); err != nil {
+		t.Fatalf("exportCachePullResults() error = %v", err)
+	}
+	var got []cachePullResult
+	if err := json.Unmarshal([]byte(exported[cacheResultsEnvKey]), &got); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("exported results = %s (%v)", exported[cacheResultsEnvKey], err)
+	}
+}
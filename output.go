@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/command"
+	"github.com/bitrise-io/go-utils/errorutil"
+)
+
+const (
+	archiveSizeEnvKey       = "BITRISE_CACHE_ARCHIVE_SIZE"
+	archiveEntryCountEnvKey = "BITRISE_CACHE_ARCHIVE_ENTRY_COUNT"
+	extractPathEnvKey       = "BITRISE_CACHE_EXTRACT_PATH"
+	breadcrumbEnvKey        = "BITRISE_CACHE_BREADCRUMB"
+	sizeReportEnvKey        = "BITRISE_CACHE_SIZE_REPORT"
+	cacheResultsEnvKey      = "BITRISE_CACHE_RESULTS"
+	downloadURLEnvKey       = "BITRISE_CACHE_DOWNLOAD_URL"
+)
+
+// exportFunc exports an output environment variable.
+type exportFunc func(key, value string) error
+
+// exportEnvironmentWithEnvman exports an output environment variable with envman for the subsequent steps.
+func exportEnvironmentWithEnvman(key, value string) error {
+	cmd := command.New("envman", "add", "--key", key)
+	cmd.SetStdin(strings.NewReader(value))
+	if out, err := cmd.RunAndReturnTrimmedCombinedOutput(); err != nil {
+		errMsg := err.Error()
+		if errorutil.IsExitStatusError(err) {
+			errMsg = out
+		}
+		return fmt.Errorf("%s failed: %s", cmd.PrintableCommandArgs(), errMsg)
+	}
+	return nil
+}
+
+// exportArchiveStats exports the expected archive size (in bytes) and entry count, if known (non-negative).
+func exportArchiveStats(export exportFunc, size int64, info *archiveInfo) error {
+	if size >= 0 {
+		if err := export(archiveSizeEnvKey, strconv.FormatInt(size, 10)); err != nil {
+			return err
+		}
+	}
+	if info != nil && info.EntryCount >= 0 {
+		if err := export(archiveEntryCountEnvKey, strconv.FormatInt(info.EntryCount, 10)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// breadcrumb describes a restored cache for the subsequent steps, to decide which work they can skip.
+type breadcrumb struct {
+	Hit bool `json:"hit"`
+	// Paths are the restored top-level paths.
+	Paths     []string `json:"paths"`
+	BuildSlug string   `json:"build_slug,omitempty"`
+}
+
+// newBreadcrumb creates the breadcrumb of a restored archive. The top-level paths are the archive's cache paths if recorded,
+// otherwise the archive's entries whose parent directory is not an entry of the archive.
+func newBreadcrumb(info *archiveInfo, index archiveIndex) breadcrumb {
+	crumb := breadcrumb{Hit: true, Paths: []string{}}
+	if info != nil {
+		crumb.BuildSlug = info.BuildSlug
+		if len(info.Paths) > 0 {
+			crumb.Paths = append(crumb.Paths, info.Paths...)
+			return crumb
+		}
+	}
+
+	entries := map[string]bool{}
+	for name, entry := range index {
+		if !entry.Metadata {
+			entries[filepath.Clean(name)] = true
+		}
+	}
+	for name := range entries {
+		if !entries[filepath.Dir(name)] {
+			crumb.Paths = append(crumb.Paths, name)
+		}
+	}
+	sort.Strings(crumb.Paths)
+	return crumb
+}
+
+// exportBreadcrumb exports the breadcrumb as JSON.
+func exportBreadcrumb(export exportFunc, crumb breadcrumb) error {
+	b, err := json.Marshal(crumb)
+	if err != nil {
+		return err
+	}
+	return export(breadcrumbEnvKey, string(b))
+}
+
+// downloadRecord describes where the cache was downloaded from, for the subsequent steps.
+type downloadRecord struct {
+	// DownloadURL is the resolved archive URL, its credentials redacted.
+	DownloadURL string `json:"download_url"`
+	StackID     string `json:"stack_id,omitempty"`
+	// ArchiveSize is the archive's size in bytes, 0 if unknown.
+	ArchiveSize int64 `json:"archive_size,omitempty"`
+}
+
+// newDownloadRecord creates the download record of the archive downloaded from the URL, of the size (-1 if unknown).
+func newDownloadRecord(rawURL string, info *archiveInfo, size int64) downloadRecord {
+	record := downloadRecord{DownloadURL: redactURL(rawURL)}
+	if info != nil {
+		record.StackID = info.StackID
+	}
+	if size > 0 {
+		record.ArchiveSize = size
+	}
+	return record
+}
+
+// exportDownloadRecord writes the download record to the path as JSON, and exports its URL.
+func exportDownloadRecord(export exportFunc, pth string, record downloadRecord) error {
+	b, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(pth, b, 0644); err != nil {
+		return err
+	}
+	return export(downloadURLEnvKey, record.DownloadURL)
+}
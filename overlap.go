@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// tailPollInterval is the wait before reading the staging file again, when the extraction caught up with the download.
+var tailPollInterval = 50 * time.Millisecond
+
+// tailReader reads a file while it is being written, like `tail -f`: at the end of the file it waits for more data,
+// until the writer finishes.
+type tailReader struct {
+	f *os.File
+
+	mu       sync.Mutex
+	finished bool
+	err      error
+}
+
+// finish marks the file as completely written, err is the writer's error.
+func (t *tailReader) finish(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.finished = true
+	t.err = err
+}
+
+func (t *tailReader) state() (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.finished, t.err
+}
+
+// Read implements the io.Reader interface.
+func (t *tailReader) Read(p []byte) (int, error) {
+	for {
+		// the state is checked before reading, so the data written before finishing is read before the EOF is returned
+		finished, werr := t.state()
+
+		n, err := t.f.Read(p)
+		if n > 0 || err != io.EOF {
+			return n, err
+		}
+		if finished {
+			if werr != nil {
+				return 0, werr
+			}
+			return 0, io.EOF
+		}
+		time.Sleep(tailPollInterval)
+	}
+}
+
+// overlappedFallback downloads the archive to the staging file at pth, and extracts the staging file while it is being written,
+// overlapping the download with the extraction.
+func overlappedFallback(src archiveSource, pth string, opts extractOptions) (extractResult, error) {
+	body, _, err := requestArchive(src.Client, src.URI, src.IgnoreZeroLength)
+	if err != nil {
+		return extractResult{}, withCause(fmt.Errorf("unable to download cache archive: %s", err), err)
+	}
+
+	out, err := os.Create(pth)
+	if err != nil {
+		_ = body.Close()
+		return extractResult{}, fmt.Errorf("failed to open the local cache file for write: %s", err)
+	}
+	in, err := os.Open(pth)
+	if err != nil {
+		_ = body.Close()
+		_ = out.Close()
+		return extractResult{}, fmt.Errorf("failed to open the local cache file for read: %s", err)
+	}
+	defer func() {
+		if err := in.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", pth, err)
+		}
+	}()
+
+	tail := &tailReader{f: in}
+	go func() {
+		written, err := io.Copy(io.MultiWriter(out, newSizeLimit()), body)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if cerr := body.Close(); cerr != nil {
+			log.Warnf("Failed to close response body: %s", cerr)
+		}
+		if err == nil && written == 0 {
+			err = errors.New("downloaded cache archive is empty")
+		}
+		tail.finish(err)
+	}()
+
+	r, _, err := newDecryptReader(tail, src.DecryptionKeys)
+	if err != nil {
+		return extractResult{}, fmt.Errorf("unable to decrypt cache archive file: %s", err)
+	}
+
+	result, err := extractCacheArchive(r, opts)
+	if err != nil {
+		return result, fmt.Errorf("unable to uncompress cache archive file: %s", err)
+	}
+	if src.Checksum.isSet() {
+		// the staging file is complete once the extraction read its end
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			return result, fmt.Errorf("unable to verify cache archive checksum: %s", err)
+		}
+		if err := verifyFileChecksum(pth, src.Checksum); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
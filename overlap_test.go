@@ -0,0 +1,76 @@
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOverlappedFallback(t *testing.T) {
+	dir := t.TempDir()
+	firstPth := filepath.Join(dir, "first.txt")
+	secondPth := filepath.Join(dir, "second.txt")
+	archive := createTestArchive(t,
+		testEntry{hdr: tar.Header{Name: firstPth, Typeflag: tar.TypeReg}, body: "first"},
+		testEntry{hdr: tar.Header{Name: secondPth, Typeflag: tar.TypeReg}, body: strings.Repeat("a", 64*1024)},
+	).Bytes()
+
+	// the server sends the first part of the archive, then holds back the rest until the first entry is extracted,
+	// or for stallTimeout
+	const stallTimeout = time.Second
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		split := 32 * 1024
+		_, _ = w.Write(archive[:split])
+		w.(http.Flusher).Flush()
+
+		for deadline := time.Now().Add(stallTimeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if _, err := os.Stat(firstPth); err == nil {
+				break
+			}
+		}
+		_, _ = w.Write(archive[split:])
+	}))
+	defer server.Close()
+
+	src := archiveSource{Client: server.Client(), URI: server.URL}
+
+	// sequential: the download stalls, as nothing is extracted till it finishes
+	start := time.Now()
+	pth := filepath.Join(t.TempDir(), "sequential.tar")
+	if err := downloadFile(src.Client, src.URI, pth); err != nil {
+		t.Fatalf("downloadFile() error = %v", err)
+	}
+	if _, err := uncompressArchive(pth, extractOptions{}); err != nil {
+		t.Fatalf("uncompressArchive() error = %v", err)
+	}
+	sequential := time.Since(start)
+
+	for _, pth := range []string{firstPth, secondPth} {
+		if err := os.Remove(pth); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start = time.Now()
+	result, err := overlappedFallback(src, filepath.Join(t.TempDir(), "overlapped.tar"), extractOptions{})
+	if err != nil {
+		t.Fatalf("overlappedFallback() error = %v", err)
+	}
+	overlapped := time.Since(start)
+
+	if result.Entries != 2 {
+		t.Errorf("overlappedFallback() entries = %d, want 2", result.Entries)
+	}
+	if b, err := ioutil.ReadFile(secondPth); err != nil || len(b) != 64*1024 {
+		t.Errorf("second entry not extracted: %v", err)
+	}
+	if overlapped >= stallTimeout || overlapped >= sequential {
+		t.Errorf("overlapped extraction took %s, sequential %s, want the overlap to avoid the %s stall", overlapped, sequential, stallTimeout)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"archive/tar"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// maxParallelFileSize is the largest regular file written by the parallel writer's workers:
+// a file is buffered in memory until a worker writes it, the larger files are written while they are read.
+const maxParallelFileSize = 1024 * 1024
+
+// extractConcurrency returns the number of the confined extraction's writers, the number of CPUs by default (not positive).
+func extractConcurrency(n int) int {
+	if n <= 0 {
+		return runtime.NumCPU()
+	}
+	return n
+}
+
+// fileJob is a regular file of the archive, read into memory, to be written by a worker.
+type fileJob struct {
+	name string
+	hdr  *tar.Header
+	body []byte
+}
+
+// parallelWriter writes the archive's small regular files beneath the confined root, with a pool of workers.
+// The archive is still read sequentially: the files are queued in the order of the archive,
+// and the entries depending on the files written so far wait for them (see wait).
+// The parent directories are created on demand, the created ones are cached.
+type parallelWriter struct {
+	root     confinedRoot
+	failures *entryFailures
+	jobs     chan fileJob
+	pending  sync.WaitGroup
+	workers  sync.WaitGroup
+
+	mu sync.Mutex
+	// queued are the names of the files queued and not written yet.
+	queued map[string]bool
+	dirs   map[string]bool
+	err    error
+}
+
+// newParallelWriter starts the given number of workers. The queue holds as many files as workers,
+// so at most twice the workers times maxParallelFileSize bytes are buffered.
+func newParallelWriter(root confinedRoot, workers int, failures *entryFailures) *parallelWriter {
+	w := parallelWriter{root: root, failures: failures, jobs: make(chan fileJob, workers), queued: map[string]bool{}, dirs: map[string]bool{}}
+	w.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go w.work()
+	}
+	return &w
+}
+
+func (w *parallelWriter) work() {
+	defer w.workers.Done()
+	for job := range w.jobs {
+		if w.failed() == nil {
+			if err := w.writeFile(job); err != nil && !w.failures.skip(job.hdr, err) {
+				w.fail(confinedEntryError(job.hdr.Name, err))
+			}
+		}
+		w.mu.Lock()
+		delete(w.queued, job.name)
+		w.mu.Unlock()
+		w.pending.Done()
+	}
+}
+
+func (w *parallelWriter) writeFile(job fileJob) error {
+	if dir := filepath.Dir(job.name); dir != "." {
+		if err := w.mkdirAll(dir); err != nil {
+			return err
+		}
+	}
+	mode := fileMode(uint32(job.hdr.Mode))
+	f, err := w.root.create(job.name, mode.Perm())
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(job.body)
+	if err == nil {
+		err = setFileMeta(f, mode, job.hdr.ModTime)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// mkdirAll creates the directory, unless it is already created.
+func (w *parallelWriter) mkdirAll(dir string) error {
+	w.mu.Lock()
+	created := w.dirs[dir]
+	w.mu.Unlock()
+	if created {
+		return nil
+	}
+	if err := w.root.mkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.dirs[dir] = true
+	w.mu.Unlock()
+	return nil
+}
+
+// write queues the file to be written by a worker. A file of the same name still queued is waited for first.
+func (w *parallelWriter) write(name string, hdr *tar.Header, body []byte) error {
+	if w.isQueued(name) {
+		if err := w.wait(); err != nil {
+			return err
+		}
+	}
+	if err := w.failed(); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.queued[name] = true
+	w.mu.Unlock()
+	w.pending.Add(1)
+	w.jobs <- fileJob{name: name, hdr: hdr, body: body}
+	return nil
+}
+
+// isQueued reports whether the file of the given name is queued and not written yet.
+func (w *parallelWriter) isQueued(name string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.queued[name]
+}
+
+// wait waits for the queued files to be written, and returns the first failure of the workers.
+// The cached directories are forgotten: the entry written next might replace them.
+func (w *parallelWriter) wait() error {
+	w.pending.Wait()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.dirs = map[string]bool{}
+	return w.err
+}
+
+// close stops the workers once the queued files are written, and returns the first failure of the workers.
+func (w *parallelWriter) close() error {
+	close(w.jobs)
+	w.workers.Wait()
+	return w.failed()
+}
+
+func (w *parallelWriter) fail(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *parallelWriter) failed() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// smallFilesArchive creates an archive of the given number of small files, spread over directories.
+func smallFilesArchive(files int) []testEntry {
+	var entries []testEntry
+	for i := 0; i < files; i++ {
+		dir := fmt.Sprintf("node_modules/pkg-%03d", i/20)
+		if i%20 == 0 {
+			entries = append(entries, testEntry{hdr: tar.Header{Name: dir + "/", Typeflag: tar.TypeDir, Mode: 0755}})
+		}
+		entries = append(entries, testEntry{hdr: tar.Header{Name: fmt.Sprintf("%s/file-%d.js", dir, i), Typeflag: tar.TypeReg}, body: strings.Repeat("x", 2048)})
+	}
+	return entries
+}
+
+func TestExtractConfined_Parallel(t *testing.T) {
+	entries := append(smallFilesArchive(500),
+		// depend on the queued files
+		testEntry{hdr: tar.Header{Name: "node_modules/pkg-000/hard", Typeflag: tar.TypeLink, Linkname: "node_modules/pkg-000/file-0.js"}},
+		testEntry{hdr: tar.Header{Name: "node_modules/pkg-001/link", Typeflag: tar.TypeSymlink, Linkname: "file-20.js"}},
+		testEntry{hdr: tar.Header{Name: "large.bin", Typeflag: tar.TypeReg}, body: strings.Repeat("l", maxParallelFileSize+1)},
+		// replaces a queued file
+		testEntry{hdr: tar.Header{Name: "node_modules/pkg-024/file-499.js", Typeflag: tar.TypeReg}, body: "replaced"},
+		// a directory first created as a parent, with its own mode at the end
+		testEntry{hdr: tar.Header{Name: "nested/deep/file.txt", Typeflag: tar.TypeReg}, body: "deep"},
+		testEntry{hdr: tar.Header{Name: "nested/", Typeflag: tar.TypeDir, Mode: 0700}},
+	)
+
+	for _, concurrency := range []int{1, 8} {
+		root := t.TempDir()
+		if err := extractConfined(createTestArchive(t, entries...), extractOptions{Root: root, Concurrency: concurrency}, nil); err != nil {
+			t.Fatalf("concurrency %d: extractConfined() error = %v", concurrency, err)
+		}
+
+		for i := 0; i < 499; i++ {
+			pth := filepath.Join(root, fmt.Sprintf("node_modules/pkg-%03d/file-%d.js", i/20, i))
+			if info, err := os.Stat(pth); err != nil || info.Size() != 2048 {
+				t.Fatalf("concurrency %d: %s not extracted (%v)", concurrency, pth, err)
+			}
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(root, "node_modules/pkg-024/file-499.js")); err != nil || string(b) != "replaced" {
+			t.Errorf("concurrency %d: replaced file = %q (%v), want the later entry", concurrency, b, err)
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(root, "node_modules/pkg-000/hard")); err != nil || len(b) != 2048 {
+			t.Errorf("concurrency %d: hard link = %d bytes (%v), want the linked file", concurrency, len(b), err)
+		}
+		if b, err := ioutil.ReadFile(filepath.Join(root, "node_modules/pkg-001/link")); err != nil || len(b) != 2048 {
+			t.Errorf("concurrency %d: symlink = %d bytes (%v), want the linked file", concurrency, len(b), err)
+		}
+		if info, err := os.Stat(filepath.Join(root, "large.bin")); err != nil || info.Size() != maxParallelFileSize+1 {
+			t.Errorf("concurrency %d: large file not extracted (%v)", concurrency, err)
+		}
+		if info, err := os.Stat(filepath.Join(root, "nested")); err != nil || info.Mode().Perm() != 0700 {
+			t.Errorf("concurrency %d: nested directory mode = %v (%v), want 0700", concurrency, info.Mode().Perm(), err)
+		}
+	}
+}
+
+func TestExtractConfined_ParallelFailure(t *testing.T) {
+	root := t.TempDir()
+	// a file can not be created under a regular file
+	entries := append([]testEntry{{hdr: tar.Header{Name: "file", Typeflag: tar.TypeReg}, body: "file"}}, smallFilesArchive(100)...)
+	entries = append(entries, testEntry{hdr: tar.Header{Name: "file/child", Typeflag: tar.TypeReg}, body: "child"})
+
+	err := extractConfined(createTestArchive(t, entries...), extractOptions{Root: root, Concurrency: 4}, nil)
+	if err == nil || !strings.Contains(err.Error(), "file/child") {
+		t.Errorf("extractConfined() error = %v, want the worker's failure", err)
+	}
+}
+
+func BenchmarkExtractConfined(b *testing.B) {
+	archive := createTestArchive(b, smallFilesArchive(5000)...).Bytes()
+	// the writes are I/O bound, there are more workers than CPUs
+	for name, concurrency := range map[string]int{"sequential": 1, "parallel": 8} {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(archive)))
+			for i := 0; i < b.N; i++ {
+				root := b.TempDir()
+				if err := extractConfined(bytes.NewReader(archive), extractOptions{Root: root, Concurrency: concurrency}, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
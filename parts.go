@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// offsetWriter writes to the file from the offset on, the parts of the archive are written to the file concurrently.
+type offsetWriter struct {
+	f   *os.File
+	off int64
+}
+
+// Write implements the io.Writer interface.
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.off)
+	w.off += int64(n)
+	return n, err
+}
+
+// downloadParts downloads the archive in n ranges concurrently to pth, each range written at its offset of the preallocated file.
+// Each range is retried on failure, and validated against its Content-MD5 header if the server sends one.
+// The archive is downloaded in a single request, if the server does not support range requests or does not report its size.
+func downloadParts(client *http.Client, url, pth string, n int) error {
+	state, rangesSupported, err := probeArchive(client, url)
+	if err != nil {
+		return err
+	}
+	if err := checkArchiveSize(state.Size); err != nil {
+		return err
+	}
+	if !rangesSupported || state.Size <= 0 {
+		log.Warnf("Download server does not support range requests, downloading the archive in one piece")
+		return downloadFile(client, url, pth)
+	}
+
+	f, err := os.Create(pth)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(state.Size); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	partSize := (state.Size + int64(n) - 1) / int64(n)
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	parts := 0
+	for start := int64(0); start < state.Size; start += partSize {
+		end := start + partSize - 1
+		if end >= state.Size {
+			end = state.Size - 1
+		}
+		parts++
+		wg.Add(1)
+		go func(start, end int64) {
+			defer wg.Done()
+			// a retried range is written again from its start
+			errs <- retryRange(start, end, func() error { return downloadRange(client, url, &offsetWriter{f: f, off: start}, start, end) })
+		}(start, end)
+	}
+	wg.Wait()
+	close(errs)
+
+	for perr := range errs {
+		if perr != nil && err == nil {
+			err = perr
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("downloaded in %d parts", parts)
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDownloadParts(t *testing.T) {
+	defer func(wait time.Duration) { chunkRetryWait = wait }(chunkRetryWait)
+	chunkRetryWait = 0
+
+	content := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(content)
+	s := &rangeServer{content: content, requests: map[string]int{}, failing: map[string]bool{}}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	single := filepath.Join(t.TempDir(), "single.tar")
+	if err := downloadFile(http.DefaultClient, server.URL, single); err != nil {
+		t.Fatalf("downloadFile() error = %v", err)
+	}
+	want, err := ioutil.ReadFile(single)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range []int{2, 3, 4, 2000} {
+		pth := filepath.Join(t.TempDir(), "cache-archive.tar")
+		if err := downloadParts(http.DefaultClient, server.URL, pth, n); err != nil {
+			t.Fatalf("downloadParts(%d) error = %v", n, err)
+		}
+		if got, err := ioutil.ReadFile(pth); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("downloadParts(%d) assembled %d bytes, %v, want the single download's bytes", n, len(got), err)
+		}
+	}
+	for _, rng := range []string{"bytes=0-249", "bytes=250-499", "bytes=500-749", "bytes=750-999"} {
+		if s.requests[rng] != 1 {
+			t.Errorf("%s requested %d times, want once in 4 parts", rng, s.requests[rng])
+		}
+	}
+
+	t.Log("failing part")
+	{
+		s.failing["bytes=500-999"] = true
+		s.requests = map[string]int{}
+		if err := downloadParts(http.DefaultClient, server.URL, filepath.Join(t.TempDir(), "cache-archive.tar"), 2); err == nil {
+			t.Errorf("downloadParts() error = nil, want the failing part's error")
+		}
+		if s.requests["bytes=500-999"] != chunkAttempts {
+			t.Errorf("the failing part is requested %d times, want %d attempts", s.requests["bytes=500-999"], chunkAttempts)
+		}
+	}
+
+	t.Log("ranges not supported")
+	{
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write(content)
+		}))
+		defer server.Close()
+		pth := filepath.Join(t.TempDir(), "cache-archive.tar")
+		if err := downloadParts(http.DefaultClient, server.URL, pth, 4); err != nil {
+			t.Fatalf("downloadParts() error = %v", err)
+		}
+		if got, err := ioutil.ReadFile(pth); err != nil || !bytes.Equal(got, content) {
+			t.Errorf("downloaded %d bytes, %v, want the archive in one piece", len(got), err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// permissionsManifest maps the archive's entry paths to their octal file modes (like "0755"),
+// recorded by the push step on filesystems not storing Unix modes in the archive.
+type permissionsManifest map[string]string
+
+// readPermissionsManifest reads the permissions manifest JSON file at pth.
+func readPermissionsManifest(pth string) (permissionsManifest, error) {
+	b, err := ioutil.ReadFile(pth)
+	if err != nil {
+		return nil, err
+	}
+	var manifest permissionsManifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse permissions manifest: %s", err)
+	}
+	return manifest, nil
+}
+
+// applyPermissions sets the modes of the extracted files listed in the manifest, under the given extraction root.
+// Files missing from the disk and symlinks are skipped. It returns the number of files whose mode was set.
+func applyPermissions(manifest permissionsManifest, root string) (int, error) {
+	names := make([]string, 0, len(manifest))
+	for name := range manifest {
+		names = append(names, name)
+	}
+	// the paths are applied in reverse order, so a directory's restricted mode is set after its content's
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	applied := 0
+	for _, name := range names {
+		mode, err := strconv.ParseUint(manifest[name], 8, 32)
+		if err != nil || mode > 07777 {
+			return applied, fmt.Errorf("invalid mode of %s: %s", name, manifest[name])
+		}
+
+		target := entryTarget(name, root)
+		info, err := os.Lstat(target)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return applied, err
+		}
+		// chmod follows symlinks, a symlink's target might be outside of the cache
+		if info.Mode()&os.ModeSymlink != 0 {
+			continue
+		}
+
+		if err := os.Chmod(target, fileMode(uint32(mode))); err != nil {
+			return applied, err
+		}
+		applied++
+	}
+	return applied, nil
+}
+
+// fileMode converts the Unix permission bits (including setuid, setgid and sticky) to an os.FileMode.
+func fileMode(mode uint32) os.FileMode {
+	m := os.FileMode(mode & 0777)
+	if mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
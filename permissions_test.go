@@ -0,0 +1,57 @@
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyPermissions(t *testing.T) {
+	root := t.TempDir()
+	archive := createTestArchive(t,
+		testEntry{hdr: tar.Header{Name: "/cache/bin", Typeflag: tar.TypeDir, Mode: 0755}},
+		testEntry{hdr: tar.Header{Name: "/cache/bin/tool", Typeflag: tar.TypeReg, Mode: 0644}, body: "#!/bin/sh"},
+		testEntry{hdr: tar.Header{Name: "/cache/config", Typeflag: tar.TypeReg, Mode: 0644}, body: "config"},
+	)
+	if _, err := extractCacheArchive(archive, extractOptions{Root: root}); err != nil {
+		t.Fatalf("extractCacheArchive() error = %v", err)
+	}
+
+	manifestPth := filepath.Join(t.TempDir(), "permissions.json")
+	manifest := `{"/cache/bin": "0700", "/cache/bin/tool": "0755", "/cache/config": "0600", "/cache/missing": "0644"}`
+	if err := ioutil.WriteFile(manifestPth, []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := readPermissionsManifest(manifestPth)
+	if err != nil {
+		t.Fatalf("readPermissionsManifest() error = %v", err)
+	}
+	applied, err := applyPermissions(m, root)
+	if err != nil {
+		t.Fatalf("applyPermissions() error = %v", err)
+	}
+	if applied != 3 {
+		t.Errorf("applyPermissions() = %d, want 3", applied)
+	}
+
+	for pth, want := range map[string]os.FileMode{
+		"cache/bin":      0700,
+		"cache/bin/tool": 0755,
+		"cache/config":   0600,
+	} {
+		info, err := os.Stat(filepath.Join(root, pth))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode().Perm(); got != want {
+			t.Errorf("%s mode = %o, want %o", pth, got, want)
+		}
+	}
+
+	if _, err := applyPermissions(permissionsManifest{"/cache/config": "rwx"}, root); err == nil {
+		t.Errorf("applyPermissions() expected an error for an invalid mode")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// prefetchWorkers is the number of goroutines reading directories concurrently during a prefetch.
+const prefetchWorkers = 8
+
+// prefetchTree walks the directory tree under root with concurrent workers and stats every entry,
+// which warms the filesystem's metadata (dentry and inode) cache before extracting over the tree.
+// It returns the number of entries visited.
+func prefetchTree(root string) int64 {
+	var visited int64
+	var wg sync.WaitGroup
+	dirs := make(chan string, prefetchWorkers)
+
+	var walk func(dir string)
+	walk = func(dir string) {
+		defer wg.Done()
+
+		f, err := os.Open(dir)
+		if err != nil {
+			log.Debugf("prefetch: %s", err)
+			return
+		}
+		infos, err := f.Readdir(-1)
+		if cerr := f.Close(); cerr != nil {
+			log.Debugf("prefetch: failed to close %s: %s", dir, cerr)
+		}
+		if err != nil {
+			log.Debugf("prefetch: %s", err)
+		}
+
+		for _, info := range infos {
+			atomic.AddInt64(&visited, 1)
+			if !info.IsDir() {
+				continue
+			}
+
+			wg.Add(1)
+			pth := filepath.Join(dir, info.Name())
+			select {
+			case dirs <- pth:
+			default:
+				// all workers are busy, continue on this goroutine
+				walk(pth)
+			}
+		}
+	}
+
+	for i := 0; i < prefetchWorkers; i++ {
+		go func() {
+			for dir := range dirs {
+				walk(dir)
+			}
+		}()
+	}
+
+	wg.Add(1)
+	walk(root)
+	wg.Wait()
+	close(dirs)
+
+	return atomic.LoadInt64(&visited)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// createTestTree creates dirs*files files in nested directories under root.
+func createTestTree(t testing.TB, root string, dirs, files int) {
+	for i := 0; i < dirs; i++ {
+		dir := filepath.Join(root, fmt.Sprintf("dir%d", i), "nested")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("failed to create dir: %s", err)
+		}
+		for j := 0; j < files; j++ {
+			if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d", j)), []byte("content"), 0644); err != nil {
+				t.Fatalf("failed to write file: %s", err)
+			}
+		}
+	}
+}
+
+func TestPrefetchTree(t *testing.T) {
+	root := t.TempDir()
+	createTestTree(t, root, 20, 10)
+
+	var want int64
+	if err := filepath.Walk(root, func(pth string, info os.FileInfo, err error) error {
+		if pth != root {
+			want++
+		}
+		return err
+	}); err != nil {
+		t.Fatalf("failed to walk tree: %s", err)
+	}
+
+	if got := prefetchTree(root); got != want {
+		t.Errorf("prefetchTree() = %d, want %d", got, want)
+	}
+
+	// extracting over a prefetched tree is not affected
+	pth := filepath.Join(root, "dir0", "nested", "file0")
+	archive := createTestArchive(t, testEntry{hdr: tar.Header{Name: pth, Typeflag: tar.TypeReg}, body: "restored"})
+	if _, err := extractCacheArchive(archive, extractOptions{}); err != nil {
+		t.Fatalf("extractCacheArchive() error = %v", err)
+	}
+	b, err := ioutil.ReadFile(pth)
+	if err != nil {
+		t.Fatalf("failed to read restored file: %s", err)
+	}
+	if string(b) != "restored" {
+		t.Errorf("restored file content = %s, want %s", b, "restored")
+	}
+}
+
+func BenchmarkPrefetchTree(b *testing.B) {
+	root := b.TempDir()
+	createTestTree(b, root, 200, 20)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		prefetchTree(root)
+	}
+}
+
+func BenchmarkPrefetchTree_SequentialWalk(b *testing.B) {
+	root := b.TempDir()
+	createTestTree(b, root, 200, 20)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := filepath.Walk(root, func(string, os.FileInfo, error) error { return nil }); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
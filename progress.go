@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// progressTick is the time between the debug progress log lines.
+var progressTick = time.Second
+
+// progressInterval is the time between the progress log lines of a normal run.
+var progressInterval = 10 * time.Second
+
+// progressAnnotations enables emitting the download's progress as Bitrise progress annotations, the build page renders them as a progress bar.
+var progressAnnotations = false
+
+// annotationOutput is where the progress annotations are written to.
+var annotationOutput io.Writer = os.Stdout
+
+// isOnBitrise reports whether the step runs on a Bitrise build machine.
+func isOnBitrise() bool {
+	return os.Getenv("BITRISE_IO") == "true"
+}
+
+// progressAnnotation returns the progress annotation line of the given percentage of the total.
+func progressAnnotation(percent int64) string {
+	return fmt.Sprintf("::bitrise-progress::cache-pull::%d", percent)
+}
+
+// progressWriter counts the bytes of a download written through it, and periodically logs the progress and the throughput.
+// The progress is logged in debug mode on every tick, otherwise every progressInterval.
+type progressWriter struct {
+	// size is the download's size, -1 if unknown.
+	size    int64
+	written int64
+
+	start    time.Time
+	lastTick time.Time
+	lastLog  time.Time
+	// tickWritten is the number of bytes written at the last tick, the throughput is measured since then.
+	tickWritten int64
+	// annotated is the last annotated percentage, -1 if none.
+	annotated int64
+}
+
+// newProgressWriter creates a new progressWriter for a download of the given size (-1 if unknown).
+func newProgressWriter(size int64) *progressWriter {
+	now := time.Now()
+	return &progressWriter{size: size, start: now, lastTick: now, lastLog: now, annotated: -1}
+}
+
+// Write implements the io.Writer interface.
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.written += int64(len(b))
+
+	now := time.Now()
+	if now.Sub(p.lastTick) < progressTick {
+		return len(b), nil
+	}
+	p.annotate()
+	status := p.status(now)
+	if now.Sub(p.lastLog) >= progressInterval {
+		log.Printf("%s", status)
+		p.lastLog = now
+	} else {
+		log.Debugf("%s", status)
+	}
+	return len(b), nil
+}
+
+// annotate emits the progress annotation, if enabled and the percentage changed since the last one.
+// Without a known size there is no percentage to annotate.
+func (p *progressWriter) annotate() {
+	if !progressAnnotations || p.size <= 0 {
+		return
+	}
+	percent := p.written * 100 / p.size
+	if percent > 100 {
+		percent = 100
+	}
+	if percent == p.annotated {
+		return
+	}
+	p.annotated = percent
+	_, _ = fmt.Fprintln(annotationOutput, progressAnnotation(percent))
+}
+
+// reset restarts the count, if the download starts over.
+func (p *progressWriter) reset() {
+	p.written = 0
+	p.tickWritten = 0
+}
+
+// status returns the progress line, with the throughput since the last tick, and starts a new tick.
+func (p *progressWriter) status(now time.Time) string {
+	rate := throughput(p.written-p.tickWritten, now.Sub(p.lastTick))
+	p.lastTick = now
+	p.tickWritten = p.written
+
+	if p.size > 0 {
+		return fmt.Sprintf("downloaded %.1f/%.1f MB (%d%%), %.1f MB/s", megabytes(p.written), megabytes(p.size), p.written*100/p.size, rate)
+	}
+	return fmt.Sprintf("downloaded %.1f MB, %.1f MB/s", megabytes(p.written), rate)
+}
+
+// summary returns the final line of the download, with the average throughput.
+func (p *progressWriter) summary(now time.Time) string {
+	elapsed := now.Sub(p.start)
+	return fmt.Sprintf("downloaded %.1f MB in %s (%.1f MB/s)", megabytes(p.written), elapsed.Round(time.Millisecond), throughput(p.written, elapsed))
+}
+
+// finish logs the download's summary, and annotates the final progress.
+func (p *progressWriter) finish() {
+	p.annotate()
+	log.Printf("%s", p.summary(time.Now()))
+}
+
+func megabytes(n int64) float64 {
+	return float64(n) / 1024 / 1024
+}
+
+// throughput returns the MB/s of n bytes transferred in d.
+func throughput(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return megabytes(n) / d.Seconds()
+}
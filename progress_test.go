@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestProgressWriter_Status(t *testing.T) {
+	p := newProgressWriter(4 * 1024 * 1024)
+	if _, err := io.Copy(p, bytes.NewReader(make([]byte, 1024*1024))); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := p.status(p.lastTick.Add(2*time.Second)), "downloaded 1.0/4.0 MB (25%), 0.5 MB/s"; got != want {
+		t.Errorf("status() = %q, want %q", got, want)
+	}
+	_, _ = p.Write(make([]byte, 1024*1024))
+	if got, want := p.status(p.lastTick.Add(time.Second)), "downloaded 2.0/4.0 MB (50%), 1.0 MB/s"; got != want {
+		t.Errorf("status() = %q, want the throughput since the last tick: %q", got, want)
+	}
+	if got, want := p.summary(p.start.Add(4*time.Second)), "downloaded 2.0 MB in 4s (0.5 MB/s)"; got != want {
+		t.Errorf("summary() = %q, want %q", got, want)
+	}
+
+	// unknown content length
+	p = newProgressWriter(-1)
+	_, _ = p.Write(make([]byte, 3*1024*1024))
+	if got, want := p.status(p.lastTick.Add(time.Second)), "downloaded 3.0 MB, 3.0 MB/s"; got != want {
+		t.Errorf("status() = %q, want %q", got, want)
+	}
+
+	p.reset()
+	if got, want := p.status(p.lastTick.Add(time.Second)), "downloaded 0.0 MB, 0.0 MB/s"; got != want {
+		t.Errorf("status() after reset = %q, want %q", got, want)
+	}
+}
+
+func TestProgressWriter_Annotate(t *testing.T) {
+	defer func(enabled bool, output io.Writer, tick time.Duration) {
+		progressAnnotations, annotationOutput, progressTick = enabled, output, tick
+	}(progressAnnotations, annotationOutput, progressTick)
+	var out bytes.Buffer
+	progressAnnotations, annotationOutput, progressTick = true, &out, 0
+
+	p := newProgressWriter(200)
+	for _, n := range []int{50, 1, 49, 100} {
+		_, _ = p.Write(make([]byte, n))
+	}
+	p.finish()
+	if got, want := out.String(), "::bitrise-progress::cache-pull::25\n::bitrise-progress::cache-pull::50\n::bitrise-progress::cache-pull::100\n"; got != want {
+		t.Errorf("annotations = %q, want %q", got, want)
+	}
+
+	// no percentage without a known size
+	out.Reset()
+	p = newProgressWriter(-1)
+	_, _ = p.Write(make([]byte, 100))
+	p.finish()
+	if out.Len() != 0 {
+		t.Errorf("annotations = %q, want none for an unknown size", out.String())
+	}
+}
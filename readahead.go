@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// readAheadChunkSize is the size of the reads of the read ahead goroutine.
+const readAheadChunkSize = 256 * 1024
+
+// errReadAheadClosed is returned by the reads of a closed readAheadReader.
+var errReadAheadClosed = errors.New("read ahead reader closed")
+
+// readAheadReader reads the download stream in a goroutine into a bounded buffer, while the stream is read
+// (decompressed and extracted) by the caller: the network reads do not wait for the decompression and the disk writes,
+// and the decompression does not wait for the network while the buffer has data.
+// The stream's read error is returned once the buffered data is read.
+type readAheadReader struct {
+	chunks chan []byte
+	free   chan []byte
+	done   chan struct{}
+	// err is the stream's read error, set before chunks is closed.
+	err error
+
+	cur       []byte
+	off       int
+	closed    bool
+	closeOnce sync.Once
+}
+
+// newReadAheadReader starts reading r ahead, buffering at most about size bytes.
+func newReadAheadReader(r io.Reader, size int) *readAheadReader {
+	n := size / readAheadChunkSize
+	if n < 1 {
+		n = 1
+	}
+	ra := readAheadReader{
+		chunks: make(chan []byte, n),
+		free:   make(chan []byte, n+1),
+		done:   make(chan struct{}),
+	}
+	go ra.fill(r)
+	return &ra
+}
+
+func (ra *readAheadReader) fill(r io.Reader) {
+	defer close(ra.chunks)
+	for {
+		var buf []byte
+		select {
+		case buf = <-ra.free:
+		default:
+			buf = make([]byte, readAheadChunkSize)
+		}
+
+		n, err := r.Read(buf)
+		if n > 0 {
+			select {
+			case ra.chunks <- buf[:n]:
+			case <-ra.done:
+				ra.err = errReadAheadClosed
+				return
+			}
+		}
+		if err != nil {
+			ra.err = err
+			return
+		}
+	}
+}
+
+// Read implements the io.Reader interface.
+func (ra *readAheadReader) Read(p []byte) (int, error) {
+	if ra.closed {
+		return 0, errReadAheadClosed
+	}
+	if ra.off == len(ra.cur) {
+		chunk, ok := <-ra.chunks
+		if !ok {
+			return 0, ra.err
+		}
+		ra.cur, ra.off = chunk, 0
+	}
+
+	n := copy(p, ra.cur[ra.off:])
+	ra.off += n
+	if ra.off == len(ra.cur) {
+		// the read chunk's buffer is reused by the next reads of the stream
+		select {
+		case ra.free <- ra.cur[:cap(ra.cur)]:
+		default:
+		}
+		ra.cur, ra.off = nil, 0
+	}
+	return n, nil
+}
+
+// close stops reading the stream ahead, the stream itself is closed by its owner.
+// A goroutine blocked in the stream's read exits once the read returns.
+func (ra *readAheadReader) close() {
+	ra.closeOnce.Do(func() {
+		ra.closed = true
+		close(ra.done)
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestReadAheadReader(t *testing.T) {
+	data := make([]byte, 3*readAheadChunkSize+123)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	t.Log("the stream is read as it is")
+	{
+		ra := newReadAheadReader(bytes.NewReader(data), 2*readAheadChunkSize)
+		defer ra.close()
+		// the small reads cross the chunks
+		b, err := ioutil.ReadAll(io.LimitReader(struct{ io.Reader }{ra}, int64(len(data))))
+		if err != nil || !bytes.Equal(b, data) {
+			t.Fatalf("ReadAll() = %d bytes, %v, want the stream", len(b), err)
+		}
+		if n, err := ra.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+			t.Errorf("Read() = %d, %v at the end of the stream, want io.EOF", n, err)
+		}
+	}
+
+	t.Log("the stream's error is returned after the buffered data")
+	{
+		streamErr := errors.New("connection reset")
+		ra := newReadAheadReader(io.MultiReader(bytes.NewReader(data[:1000]), failingReader{err: streamErr}), 0)
+		defer ra.close()
+		b, err := ioutil.ReadAll(ra)
+		if err != streamErr || !bytes.Equal(b, data[:1000]) {
+			t.Errorf("ReadAll() = %d bytes, %v, want the 1000 bytes and %v", len(b), err, streamErr)
+		}
+	}
+
+	t.Log("closing stops the read ahead")
+	{
+		pr, pw := io.Pipe()
+		ra := newReadAheadReader(pr, readAheadChunkSize)
+		written := make(chan error, 1)
+		go func() {
+			// the stream's writer gets blocked once the buffer is full, until the reader is closed
+			_, err := pw.Write(data)
+			written <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+		ra.close()
+		_ = pr.Close()
+		select {
+		case err := <-written:
+			if err != io.ErrClosedPipe {
+				t.Errorf("Write() error = %v, want %v", err, io.ErrClosedPipe)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the stream is still read after close")
+		}
+		if _, err := ra.Read(make([]byte, 1)); err != errReadAheadClosed {
+			t.Errorf("Read() error = %v, want %v", err, errReadAheadClosed)
+		}
+	}
+}
+
+// slowWriter simulates the extraction's decompression and disk writes with the given throughput.
+type slowWriter struct {
+	bytesPerSecond int
+}
+
+func (s slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(time.Duration(len(p)) * time.Second / time.Duration(s.bytesPerSecond))
+	return len(p), nil
+}
+
+// BenchmarkReadAhead downloads and decompresses a gzip stream, the network and the extraction are equally slow:
+// with the read ahead they overlap, and the stream is read in about half the time.
+func BenchmarkReadAhead(b *testing.B) {
+	var archive bytes.Buffer
+	gw := gzip.NewWriter(&archive)
+	data := make([]byte, 4*1024*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	_, _ = gw.Write(data)
+	_ = gw.Close()
+
+	extract := func(b *testing.B, readAhead bool) {
+		for i := 0; i < b.N; i++ {
+			var stream io.Reader = slowReader{r: bytes.NewReader(archive.Bytes()), bytesPerSecond: 64 * 1024 * 1024}
+			var ra *readAheadReader
+			if readAhead {
+				ra = newReadAheadReader(stream, 8*1024*1024)
+				stream = ra
+			}
+			gr, err := gzip.NewReader(stream)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := io.CopyBuffer(slowWriter{bytesPerSecond: 64 * 1024 * 1024}, gr, make([]byte, 64*1024)); err != nil {
+				b.Fatal(err)
+			}
+			if ra != nil {
+				ra.close()
+			}
+		}
+	}
+
+	b.Run("inline", func(b *testing.B) { extract(b, false) })
+	b.Run("read ahead", func(b *testing.B) { extract(b, true) })
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 
 	"github.com/bitrise-io/go-utils/log"
@@ -16,6 +17,21 @@ type RestoreReader struct {
 	tee  io.Reader
 
 	restore bool
+
+	// limit is the most bytes buffered before Restore, 0 is unlimited.
+	limit    int
+	limitErr *bufferLimitError
+}
+
+// bufferLimitError is returned by RestoreReader if a read before Restore would buffer more bytes than its limit.
+// The bytes buffered until then can still be restored.
+type bufferLimitError struct {
+	Limit int
+}
+
+// Error implements the error interface.
+func (e *bufferLimitError) Error() string {
+	return fmt.Sprintf("more than %d bytes read ahead from the archive stream", e.Limit)
 }
 
 // NewRestoreReader creates a new RestoreReader.
@@ -27,6 +43,16 @@ func NewRestoreReader(r io.Reader) *RestoreReader {
 	return &a
 }
 
+// SetBufferLimit limits the bytes buffered before Restore, reading more fails with a bufferLimitError. 0 is unlimited.
+func (a *RestoreReader) SetBufferLimit(limit int) {
+	a.limit = limit
+}
+
+// Buffered returns the number of the bytes buffered to be restored.
+func (a *RestoreReader) Buffered() int {
+	return a.buff.Len()
+}
+
 // Restore instructs the reader to restore previous read sequences.
 func (a *RestoreReader) Restore() {
 	a.restore = true
@@ -37,6 +63,19 @@ func (a *RestoreReader) Read(p []byte) (int, error) {
 	if a.restore && a.buff.Len() > 0 {
 		return a.restoreRead(p)
 	}
+	if a.limit > 0 && !a.restore && a.r == a.tee {
+		if a.limitErr != nil {
+			return 0, a.limitErr
+		}
+		room := a.limit - a.buff.Len()
+		if room == 0 {
+			a.limitErr = &bufferLimitError{Limit: a.limit}
+			return 0, a.limitErr
+		}
+		if len(p) > room {
+			p = p[:room]
+		}
+	}
 	return a.r.Read(p)
 }
 
@@ -49,7 +88,7 @@ func (a *RestoreReader) restoreRead(p []byte) (int, error) {
 	}
 	log.Debugf("%d bytes read from buffer", n)
 
-	if n >= a.buff.Len() {
+	if a.buff.Len() == 0 {
 		log.Debugf("buffer drained")
 
 		a.restore = false
@@ -76,3 +115,16 @@ func (a *RestoreReader) restoreRead(p []byte) (int, error) {
 
 	return n + m, nil
 }
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read implements the io.Reader interface.
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
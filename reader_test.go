@@ -125,4 +125,66 @@ func TestRestoreReader_Read(t *testing.T) {
 			return
 		}
 	}
+
+	t.Log("restore read - partial reads of the buffer")
+	{
+		content := bytes.Repeat([]byte("0123456789"), 100)
+		r := bytes.NewReader(content)
+		rr := NewRestoreReader(r)
+
+		p := make([]byte, 128)
+		if _, err := io.ReadFull(rr, p); err != nil {
+			t.Errorf("RestoreReader.Read() error = %v, wantErr %v", err, nil)
+			return
+		}
+
+		rr.Restore()
+
+		// read the buffer in chunks smaller than the buffered content
+		var got []byte
+		chunk := make([]byte, 48)
+		for {
+			n, err := rr.Read(chunk)
+			got = append(got, chunk[:n]...)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Errorf("RestoreReader.Read() error = %v, wantErr %v", err, nil)
+				return
+			}
+		}
+		if string(got) != string(content) {
+			t.Errorf("RestoreReader.Read() read %d bytes, want the original %d bytes", len(got), len(content))
+			return
+		}
+	}
+}
+
+func TestRestoreReader_BufferLimit(t *testing.T) {
+	content := []byte("0123456789")
+	rr := NewRestoreReader(bytes.NewReader(content))
+	rr.SetBufferLimit(4)
+
+	p := make([]byte, len(content))
+	n, err := rr.Read(p)
+	if err != nil || n != 4 {
+		t.Fatalf("RestoreReader.Read() = %d, %v, want the 4 bytes of the limit", n, err)
+	}
+	if _, err := rr.Read(p); err == nil {
+		t.Fatalf("RestoreReader.Read() error = nil, want the limit exceeded")
+	}
+	if rr.Buffered() != 4 {
+		t.Errorf("Buffered() = %d, want 4", rr.Buffered())
+	}
+
+	// the limit only applies before Restore
+	rr.Restore()
+	var restored bytes.Buffer
+	if _, err := io.Copy(&restored, rr); err != nil {
+		t.Fatalf("restored read error = %v", err)
+	}
+	if restored.String() != string(content) {
+		t.Errorf("restored = %s, want %s", restored.String(), content)
+	}
 }
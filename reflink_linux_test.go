@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyFile_Reflink(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(src, []byte("content"), 0644); err != nil {
+		t.Fatalf("failed to write file: %s", err)
+	}
+
+	// probe whether the test filesystem supports reflinks
+	supported := func() bool {
+		in, err := os.Open(src)
+		if err != nil {
+			t.Fatalf("failed to open: %s", err)
+		}
+		defer func() { _ = in.Close() }()
+		out, err := os.Create(filepath.Join(dir, "probe"))
+		if err != nil {
+			t.Fatalf("failed to create: %s", err)
+		}
+		defer func() { _ = out.Close() }()
+		return cloneFile(out, in) == nil
+	}()
+	t.Logf("reflink supported: %v", supported)
+
+	dst := filepath.Join(dir, "dst")
+	reflinked, err := copyFile(src, dst, 0640)
+	if err != nil {
+		t.Fatalf("copyFile() error = %v", err)
+	}
+	if reflinked != supported {
+		t.Errorf("copyFile() reflinked = %v, want %v", reflinked, supported)
+	}
+
+	b, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatalf("failed to read copy: %s", err)
+	}
+	if string(b) != "content" {
+		t.Errorf("copy content = %s, want content", b)
+	}
+	info, err := os.Stat(dst)
+	if err != nil {
+		t.Fatalf("failed to stat copy: %s", err)
+	}
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("copy mode = %s, want %s", info.Mode().Perm(), os.FileMode(0640))
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// cloneFile is only supported on Linux, callers fall back to copying the file.
+func cloneFile(dst, src *os.File) error {
+	return errors.New("reflink is not supported on this platform")
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// Handling of the required files missing after the extraction.
+const (
+	requiredFilesFail = "fail"
+	requiredFilesWarn = "warn"
+)
+
+// missingFiles returns the required paths which do not exist after the extraction.
+// The paths are resolved like the archive's entries: under the extraction root, if it is set.
+func missingFiles(pths []string, root string) []string {
+	var missing []string
+	for _, pth := range pths {
+		if _, err := os.Lstat(entryTarget(pth, root)); err != nil {
+			missing = append(missing, pth)
+		}
+	}
+	return missing
+}
+
+// checkRequiredFiles checks the required paths after the extraction. Every missing path is reported at once:
+// by the returned error with the fail policy, by a warning with the warn policy.
+func checkRequiredFiles(pths []string, root, policy string) error {
+	missing := missingFiles(pths, root)
+	if len(missing) == 0 {
+		log.Printf("required files present: %d", len(pths))
+		return nil
+	}
+	if policy == requiredFilesWarn {
+		log.Warnf("%d of the %d required files are missing after the extraction, the cache was partially restored:\n%s", len(missing), len(pths), strings.Join(missing, "\n"))
+		return nil
+	}
+	return fmt.Errorf("required files are missing after the extraction, the cache was partially restored:\n%s", strings.Join(missing, "\n"))
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMissingFiles(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "Users", "vagrant", ".gradle"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "Users", "vagrant", ".gradle", ".cache-valid"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	required := []string{"/Users/vagrant/.gradle/.cache-valid", "/Users/vagrant/.gradle", "/Users/vagrant/.m2/.cache-valid"}
+	if got, want := missingFiles(required, root), []string{"/Users/vagrant/.m2/.cache-valid"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("missingFiles() = %v, want %v", got, want)
+	}
+	if got := missingFiles(required[:2], root); len(got) != 0 {
+		t.Errorf("missingFiles() = %v, want none", got)
+	}
+
+	if got := missingFiles([]string{filepath.Join(root, "Users", "vagrant", ".gradle", ".cache-valid")}, ""); len(got) != 0 {
+		t.Errorf("missingFiles() without root = %v, want none", got)
+	}
+}
+
+func TestCheckRequiredFiles(t *testing.T) {
+	root := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(root, ".cache-valid"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkRequiredFiles([]string{"/.cache-valid"}, root, requiredFilesFail); err != nil {
+		t.Errorf("checkRequiredFiles() error = %v, want nil with every file present", err)
+	}
+
+	required := []string{"/.cache-valid", "/.gradle/caches", "/.m2/repository"}
+	err := checkRequiredFiles(required, root, requiredFilesFail)
+	if err == nil || !strings.Contains(err.Error(), "/.gradle/caches\n/.m2/repository") {
+		t.Errorf("checkRequiredFiles() error = %v, want every missing file reported", err)
+	}
+	if err := checkRequiredFiles(required, root, requiredFilesWarn); err != nil {
+		t.Errorf("checkRequiredFiles() error = %v, want only a warning with the warn policy", err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	peakRSSEnvKey      = "BITRISE_CACHE_PULL_PEAK_RSS"
+	peakChildRSSEnvKey = "BITRISE_CACHE_PULL_PEAK_TAR_RSS"
+	bytesReadEnvKey    = "BITRISE_CACHE_PULL_BYTES_READ"
+	bytesWrittenEnvKey = "BITRISE_CACHE_PULL_BYTES_WRITTEN"
+)
+
+// resourceSampleInterval is the interval of sampling the process' resource usage.
+const resourceSampleInterval = 500 * time.Millisecond
+
+// resourceUsage is the peak memory and the cumulative I/O of the pull.
+type resourceUsage struct {
+	// PeakRSS is the step's peak resident set size in bytes.
+	PeakRSS int64 `json:"peak_rss_bytes"`
+	// PeakChildRSS is the largest peak resident set size of the finished child processes (tar), in bytes.
+	PeakChildRSS int64 `json:"peak_child_rss_bytes"`
+	// BytesRead and BytesWritten are the bytes read and written by the step's I/O calls (network, files and pipes).
+	BytesRead    int64 `json:"bytes_read"`
+	BytesWritten int64 `json:"bytes_written"`
+}
+
+// resourceSampler samples the process' resource usage on a timer, in a background goroutine.
+type resourceSampler struct {
+	mu    sync.Mutex
+	usage resourceUsage
+
+	stopCh chan struct{}
+	done   chan struct{}
+}
+
+// startResourceSampler starts sampling the resource usage with the given interval.
+func startResourceSampler(interval time.Duration) *resourceSampler {
+	s := &resourceSampler{stopCh: make(chan struct{}), done: make(chan struct{})}
+	s.sample()
+
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.sample()
+			case <-s.stopCh:
+				return
+			}
+		}
+	}()
+
+	return s
+}
+
+func (s *resourceSampler) sample() {
+	rss := currentRSS()
+	read, written := processIO()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rss > s.usage.PeakRSS {
+		s.usage.PeakRSS = rss
+	}
+	s.usage.BytesRead = read
+	s.usage.BytesWritten = written
+}
+
+// stop stops sampling and returns the peak values.
+func (s *resourceSampler) stop() resourceUsage {
+	close(s.stopCh)
+	<-s.done
+	s.sample()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.usage.PeakChildRSS = childrenPeakRSS()
+	return s.usage
+}
+
+// exportResourceUsage exports the resource usage values.
+func exportResourceUsage(export exportFunc, usage resourceUsage) error {
+	for _, kv := range []struct {
+		key   string
+		value int64
+	}{
+		{peakRSSEnvKey, usage.PeakRSS},
+		{peakChildRSSEnvKey, usage.PeakChildRSS},
+		{bytesReadEnvKey, usage.BytesRead},
+		{bytesWrittenEnvKey, usage.BytesWritten},
+	} {
+		if err := export(kv.key, strconv.FormatInt(kv.value, 10)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// currentRSS returns the process' current resident set size in bytes, read from /proc/self/statm.
+func currentRSS() int64 {
+	b, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) < 2 {
+		return 0
+	}
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return pages * int64(os.Getpagesize())
+}
+
+// processIO returns the bytes read and written by the process' I/O calls, read from /proc/self/io.
+func processIO() (int64, int64) {
+	f, err := os.Open("/proc/self/io")
+	if err != nil {
+		return 0, 0
+	}
+	defer func() { _ = f.Close() }()
+
+	var read, written int64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		value, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "rchar:":
+			read = value
+		case "wchar:":
+			written = value
+		}
+	}
+	return read, written
+}
+
+// childrenPeakRSS returns the largest peak resident set size of the finished child processes in bytes.
+func childrenPeakRSS() int64 {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_CHILDREN, &usage); err != nil {
+		return 0
+	}
+	// Maxrss is in kilobytes on Linux
+	return int64(usage.Maxrss) * 1024
+}
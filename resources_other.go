@@ -0,0 +1,33 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+// currentRSS returns the process' peak resident set size in bytes, the current one is not available without procfs.
+func currentRSS() int64 {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+	// Maxrss is in bytes on macOS
+	return int64(usage.Maxrss)
+}
+
+// processIO returns the bytes read and written by the process, estimated from the block I/O operations.
+func processIO() (int64, int64) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0, 0
+	}
+	return int64(usage.Inblock) * 512, int64(usage.Oublock) * 512
+}
+
+// childrenPeakRSS returns the largest peak resident set size of the finished child processes in bytes.
+func childrenPeakRSS() int64 {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_CHILDREN, &usage); err != nil {
+		return 0
+	}
+	return int64(usage.Maxrss)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"archive/tar"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResourceSampler(t *testing.T) {
+	sampler := startResourceSampler(10 * time.Millisecond)
+
+	dir := t.TempDir()
+	archive := createTestArchive(t, testEntry{hdr: tar.Header{Name: filepath.Join(dir, "File.txt"), Typeflag: tar.TypeReg}, body: strings.Repeat("test", 256*1024)})
+	if _, err := extractCacheArchive(archive, extractOptions{}); err != nil {
+		t.Fatalf("extractCacheArchive() error = %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	usage := sampler.stop()
+	if usage.PeakRSS <= 0 {
+		t.Errorf("PeakRSS = %d, want > 0", usage.PeakRSS)
+	}
+	if usage.PeakChildRSS <= 0 {
+		t.Errorf("PeakChildRSS = %d, want > 0", usage.PeakChildRSS)
+	}
+	if usage.BytesRead <= 0 {
+		t.Errorf("BytesRead = %d, want > 0", usage.BytesRead)
+	}
+	if usage.BytesWritten <= 0 {
+		t.Errorf("BytesWritten = %d, want > 0", usage.BytesWritten)
+	}
+
+	exported := map[string]string{}
+	if err := exportResourceUsage(func(key, value string) error {
+		exported[key] = value
+		return nil
+	}, usage); err != nil {
+		t.Fatalf("exportResourceUsage() error = %v", err)
+	}
+	for _, key := range []string{peakRSSEnvKey, peakChildRSSEnvKey, bytesReadEnvKey, bytesWrittenEnvKey} {
+		if v, ok := exported[key]; !ok || v == "0" {
+			t.Errorf("%s = %q, want a non-zero value", key, v)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// resumeArchive requests the rest of the archive from offset, with a `Range: bytes=<offset>-` request.
+// It reports whether the server sent the requested range: a 200 response means the server does not support range requests,
+// and its body is the whole archive.
+func resumeArchive(client *http.Client, url string, offset int64) (io.ReadCloser, bool, error) {
+	req, err := http.NewRequestWithContext(stepContext, "GET", url, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	setHeaders(req, downloadHeaders)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+
+	resp, err := doWithRetry(client, req)
+	if err != nil {
+		return nil, false, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, false, nil
+	case http.StatusPartialContent:
+		start, _, _, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err == nil && start != offset {
+			err = fmt.Errorf("unexpected range start in response: %d, requested: %d", start, offset)
+		}
+		if err != nil {
+			_ = closeBody(resp.Body)
+			return nil, false, err
+		}
+		return resp.Body, true, nil
+	}
+	_ = closeBody(resp.Body)
+	return nil, false, fmt.Errorf("non success response code: %d", resp.StatusCode)
+}
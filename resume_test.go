@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// droppingServer serves the archive, dropping the connection after half of the body on the first request.
+// Range requests are served only if ranges is set.
+type droppingServer struct {
+	content []byte
+	ranges  bool
+
+	mu     sync.Mutex
+	served int
+	ranged []string
+}
+
+func (s *droppingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.served++
+	first := s.served == 1
+	if rng := r.Header.Get("Range"); rng != "" {
+		s.ranged = append(s.ranged, rng)
+	}
+	s.mu.Unlock()
+
+	if first {
+		w.Header().Set("Content-Length", strconv.Itoa(len(s.content)))
+		_, _ = w.Write(s.content[:len(s.content)/2])
+		w.(http.Flusher).Flush()
+		if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+			_ = conn.Close()
+		}
+		return
+	}
+	if !s.ranges {
+		_, _ = w.Write(s.content)
+		return
+	}
+	http.ServeContent(w, r, "cache.tar", time.Time{}, bytes.NewReader(s.content))
+}
+
+func TestDownloadCacheArchive_Resume(t *testing.T) {
+	defer func(delay time.Duration) { requestRetryBaseDelay = delay }(requestRetryBaseDelay)
+	requestRetryBaseDelay = time.Millisecond
+	defer func(pth string) { cacheArchivePath = pth }(cacheArchivePath)
+	if _, err := newArchiveTempDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	content := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	for _, ranges := range []bool{true, false} {
+		s := &droppingServer{content: content, ranges: ranges}
+		server := httptest.NewServer(s)
+
+		pth, err := downloadCacheArchive(http.DefaultClient, server.URL, false, expectedChecksum{})
+		server.Close()
+		if err != nil {
+			t.Fatalf("ranges = %v: downloadCacheArchive() error = %v", ranges, err)
+		}
+		b, err := ioutil.ReadFile(pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, content) {
+			t.Errorf("ranges = %v: downloaded %d bytes, want the %d bytes archive", ranges, len(b), len(content))
+		}
+		if s.served != 2 || len(s.ranged) != 1 || s.ranged[0] != "bytes=131072-" {
+			t.Errorf("ranges = %v: %d requests, ranges %v, want a single resume from the received bytes", ranges, s.served, s.ranged)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// requestRetries is the number of times a Cache API request or an archive download request is retried,
+// if it fails on a connection error or a 5xx or 429 response.
+var requestRetries = 3
+
+// requestRetryBaseDelay is the wait before the first retry, doubled on each further retry, with a random jitter.
+var requestRetryBaseDelay = time.Second
+
+// retryAfterMax is the longest wait honored from a Retry-After header, a longer one is clamped to it. 0 is unlimited.
+var retryAfterMax = 2 * time.Minute
+
+// isRetryableStatus reports whether the response status is worth retrying: server errors and rate limiting.
+// Other 4xx responses are returned right away.
+func isRetryableStatus(code int) bool {
+	return code >= 500 || code == http.StatusTooManyRequests
+}
+
+// isConnectionError reports whether the request failed on the connection (dial, reset, timeout or a dropped response),
+// not on the request itself (like an invalid URL). Once the step exceeded its max_duration, no failure is worth retrying.
+func isConnectionError(err error) bool {
+	if deadlineExceeded() {
+		return false
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		// url.Error implements net.Error, its wrapped error tells the cause
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// retryDelay returns the wait before the given retry (1 based): the base delay doubled for each earlier retry,
+// the second half of it randomized, so the retrying clients do not hit the server at once.
+func retryDelay(base time.Duration, retry int) time.Duration {
+	delay := base << uint(retry-1)
+	if half := int64(delay / 2); half > 0 {
+		delay = time.Duration(half + rand.Int63n(half))
+	}
+	return delay
+}
+
+// parseRetryAfter parses the Retry-After header's value, either the seconds to wait or the HTTP-date to wait until.
+// A date in the past is no wait.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		if seconds > int64(math.MaxInt64/time.Second) {
+			return time.Duration(math.MaxInt64), true
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if wait := date.Sub(now); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
+
+// responseRetryDelay returns the wait before retrying the response: the 429 and 503 responses' Retry-After header
+// (clamped to retryAfterMax, if it is set) if they set a valid one, the computed backoff otherwise.
+func responseRetryDelay(resp *http.Response, retry int) time.Duration {
+	if resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		if wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			if retryAfterMax > 0 && wait > retryAfterMax {
+				log.Warnf("Retry-After of %s exceeds the %s limit, waiting %s", wait, retryAfterMax, retryAfterMax)
+				wait = retryAfterMax
+			}
+			log.Printf("honoring the server's Retry-After: %s", wait)
+			return wait
+		}
+	}
+	return retryDelay(requestRetryBaseDelay, retry)
+}
+
+// doWithRetry sends the request with the client, retrying the connection errors and the 5xx and 429 responses.
+// Each attempt is bound by the client's timeout. The last attempt's response (or error) is returned.
+func doWithRetry(client *http.Client, req *http.Request) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := client.Do(req)
+		if attempt > requestRetries {
+			return resp, err
+		}
+
+		var reason string
+		delay := retryDelay(requestRetryBaseDelay, attempt)
+		switch {
+		case err != nil && isConnectionError(err):
+			reason = err.Error()
+		case err == nil && isRetryableStatus(resp.StatusCode):
+			reason = resp.Status
+			delay = responseRetryDelay(resp, attempt)
+			_ = closeBody(resp.Body)
+		default:
+			return resp, err
+		}
+
+		log.Warnf("Request to %s failed (attempt %d/%d): %s, retrying in %s", req.URL.Host, attempt, requestRetries+1, reason, delay)
+		if !sleepContext(req.Context(), delay) {
+			return nil, req.Context().Err()
+		}
+	}
+}
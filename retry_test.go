@@ -0,0 +1,229 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPerformRequest_Retry(t *testing.T) {
+	defer func(delay time.Duration) { requestRetryBaseDelay = delay }(requestRetryBaseDelay)
+	requestRetryBaseDelay = time.Millisecond
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("archive"))
+	}))
+	defer server.Close()
+
+	body, _, err := performRequest(http.DefaultClient, server.URL)
+	if err != nil {
+		t.Fatalf("performRequest() error = %v", err)
+	}
+	defer func() { _ = closeBody(body) }()
+	b, err := ioutil.ReadAll(body)
+	if err != nil || string(b) != "archive" {
+		t.Errorf("performRequest() body = %q (%v), want archive", b, err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("performRequest() sent %d requests, want 2", n)
+	}
+}
+
+func TestPerformRequest_NoRetryOnClientError(t *testing.T) {
+	defer func(delay time.Duration) { requestRetryBaseDelay = delay }(requestRetryBaseDelay)
+	requestRetryBaseDelay = time.Millisecond
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	if _, _, err := performRequest(http.DefaultClient, server.URL); err == nil {
+		t.Fatalf("performRequest() error = nil, want a non success response error")
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("performRequest() sent %d requests, want 1", n)
+	}
+}
+
+func TestGetCacheDownloadURL_Retry(t *testing.T) {
+	defer func(delay time.Duration) { requestRetryBaseDelay = delay }(requestRetryBaseDelay)
+	requestRetryBaseDelay = time.Millisecond
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&requests, 1) {
+		case 1:
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			// a dropped connection
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				_ = conn.Close()
+			}
+		default:
+			_, _ = w.Write([]byte(`{"download_url": "https://storage.com/cache.tar"}`))
+		}
+	}))
+	defer server.Close()
+
+	resp, err := getCacheDownloadURL(server.URL, "download_url")
+	if err != nil {
+		t.Fatalf("getCacheDownloadURL() error = %v", err)
+	}
+	if resp.DownloadURL != "https://storage.com/cache.tar" {
+		t.Errorf("getCacheDownloadURL() = %s", resp.DownloadURL)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("getCacheDownloadURL() sent %d requests, want 3", n)
+	}
+}
+
+func TestDoWithRetry_GivesUp(t *testing.T) {
+	defer func(retries int, delay time.Duration) { requestRetries, requestRetryBaseDelay = retries, delay }(requestRetries, requestRetryBaseDelay)
+	requestRetries, requestRetryBaseDelay = 2, time.Millisecond
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := doWithRetry(http.DefaultClient, req)
+	if err != nil {
+		t.Fatalf("doWithRetry() error = %v", err)
+	}
+	defer func() { _ = closeBody(resp.Body) }()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("doWithRetry() status = %d, want the last response's", resp.StatusCode)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("doWithRetry() sent %d requests, want 3", n)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for retry := 1; retry <= 4; retry++ {
+		max := time.Second << uint(retry-1)
+		for i := 0; i < 20; i++ {
+			if delay := retryDelay(time.Second, retry); delay < max/2 || delay >= max {
+				t.Fatalf("retryDelay(1s, %d) = %s, want in [%s, %s)", retry, delay, max/2, max)
+			}
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{value: "120", want: 2 * time.Minute, ok: true},
+		{value: " 0 ", want: 0, ok: true},
+		{value: now.Add(30 * time.Second).Format(http.TimeFormat), want: 30 * time.Second, ok: true},
+		{value: now.Add(-time.Minute).Format(http.TimeFormat), want: 0, ok: true},
+		{value: "Thu, 02 Jan 2020 03:05:05 GMT", want: time.Minute, ok: true},
+		{value: ""},
+		{value: "-1"},
+		{value: "soon"},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.value, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseRetryAfter(%q) = %s, %t, want %s, %t", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestResponseRetryDelay(t *testing.T) {
+	defer func(delay, max time.Duration) { requestRetryBaseDelay, retryAfterMax = delay, max }(requestRetryBaseDelay, retryAfterMax)
+	requestRetryBaseDelay, retryAfterMax = time.Hour, time.Minute
+
+	response := func(code int, retryAfter string) *http.Response {
+		resp := &http.Response{StatusCode: code, Header: http.Header{}}
+		if retryAfter != "" {
+			resp.Header.Set("Retry-After", retryAfter)
+		}
+		return resp
+	}
+
+	t.Log("seconds")
+	if delay := responseRetryDelay(response(http.StatusTooManyRequests, "5"), 1); delay != 5*time.Second {
+		t.Errorf("responseRetryDelay() = %s, want the Retry-After of 5s", delay)
+	}
+
+	t.Log("HTTP-date")
+	date := time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat)
+	if delay := responseRetryDelay(response(http.StatusServiceUnavailable, date), 1); delay < 28*time.Second || delay > 30*time.Second {
+		t.Errorf("responseRetryDelay() = %s, want the Retry-After date's 30s", delay)
+	}
+
+	t.Log("absurd value")
+	if delay := responseRetryDelay(response(http.StatusTooManyRequests, "86400"), 1); delay != time.Minute {
+		t.Errorf("responseRetryDelay() = %s, want clamped to 1m", delay)
+	}
+
+	t.Log("unlimited")
+	retryAfterMax = 0
+	if delay := responseRetryDelay(response(http.StatusTooManyRequests, "86400"), 1); delay != 24*time.Hour {
+		t.Errorf("responseRetryDelay() = %s, want the Retry-After of 24h without a limit", delay)
+	}
+	retryAfterMax = time.Minute
+
+	t.Log("other status")
+	if delay := responseRetryDelay(response(http.StatusBadGateway, "5"), 1); delay < 30*time.Minute {
+		t.Errorf("responseRetryDelay() = %s, want the computed backoff", delay)
+	}
+
+	t.Log("invalid header")
+	if delay := responseRetryDelay(response(http.StatusTooManyRequests, "soon"), 1); delay < 30*time.Minute {
+		t.Errorf("responseRetryDelay() = %s, want the computed backoff", delay)
+	}
+}
+
+func TestDoWithRetry_RetryAfter(t *testing.T) {
+	defer func(delay, max time.Duration) { requestRetryBaseDelay, retryAfterMax = delay, max }(requestRetryBaseDelay, retryAfterMax)
+	// the computed backoff would time the test out, the Retry-After (clamped) is honored
+	requestRetryBaseDelay, retryAfterMax = time.Hour, 10*time.Millisecond
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte("archive"))
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := doWithRetry(http.DefaultClient, req)
+	if err != nil {
+		t.Fatalf("doWithRetry() error = %v", err)
+	}
+	defer func() { _ = closeBody(resp.Body) }()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("doWithRetry() status = %d, want the retried response's", resp.StatusCode)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// shortReadError is returned if the archive download ended before the response's Content-Length bytes were received,
+// like on a proxy closing the connection early.
+type shortReadError struct {
+	Expected int64
+	Got      int64
+}
+
+// Error implements the error interface.
+func (e *shortReadError) Error() string {
+	return fmt.Sprintf("short read: expected %d bytes, got %d", e.Expected, e.Got)
+}
+
+// Is reports the short read as an unexpected EOF, so the download is resumed like an interrupted one.
+func (e *shortReadError) Is(target error) bool {
+	return target == io.ErrUnexpectedEOF
+}
+
+// checkReceived returns the error of the download which received written bytes of the size (-1 if unknown):
+// a download ending before the size, with or without an error, is a shortReadError.
+func checkReceived(written, size int64, err error) error {
+	if size < 0 || written >= size {
+		return err
+	}
+	if err == nil || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &shortReadError{Expected: size, Got: written}
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// shortTransport responds with the Content-Length of the content, but ends the body half way without an error.
+type shortTransport struct {
+	content string
+}
+
+func (s shortTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Status:        "200 OK",
+		Header:        http.Header{"Content-Length": []string{strconv.Itoa(len(s.content))}},
+		ContentLength: int64(len(s.content)),
+		Body:          ioutil.NopCloser(strings.NewReader(s.content[:len(s.content)/2])),
+		Request:       req,
+	}, nil
+}
+
+func TestDownloadCacheArchive_ShortRead(t *testing.T) {
+	defer func(retries int, delay time.Duration) { requestRetries, requestRetryBaseDelay = retries, delay }(requestRetries, requestRetryBaseDelay)
+	requestRetries, requestRetryBaseDelay = 1, time.Millisecond
+	defer func(pth string) { cacheArchivePath = pth }(cacheArchivePath)
+	if _, err := newArchiveTempDir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Repeat("archive ", 1024)
+
+	t.Log("connection closed early")
+	{
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			_, _ = w.Write([]byte(content[:len(content)/2]))
+			w.(http.Flusher).Flush()
+			if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+				_ = conn.Close()
+			}
+		}))
+		_, err := downloadCacheArchive(http.DefaultClient, server.URL, false, expectedChecksum{})
+		server.Close()
+		var shortErr *shortReadError
+		if !errors.As(err, &shortErr) || shortErr.Expected != int64(len(content)) || shortErr.Got >= shortErr.Expected {
+			t.Errorf("downloadCacheArchive() error = %v, want a short read of %d bytes", err, len(content))
+		}
+	}
+
+	t.Log("body ended early without an error")
+	{
+		client := &http.Client{Transport: shortTransport{content: content}}
+		_, err := downloadCacheArchive(client, "http://cache.example.com/cache.tar", false, expectedChecksum{})
+		want := "short read: expected " + strconv.Itoa(len(content)) + " bytes, got " + strconv.Itoa(len(content)/2)
+		if err == nil || err.Error() != want {
+			t.Errorf("downloadCacheArchive() error = %v, want %q", err, want)
+		}
+	}
+
+	t.Log("chunked response")
+	{
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// flushed before the end, the response is chunked, without a Content-Length
+			_, _ = w.Write([]byte(content[:len(content)/2]))
+			w.(http.Flusher).Flush()
+			_, _ = w.Write([]byte(content[len(content)/2:]))
+		}))
+		pth, err := downloadCacheArchive(http.DefaultClient, server.URL, false, expectedChecksum{})
+		server.Close()
+		if err != nil {
+			t.Fatalf("downloadCacheArchive() error = %v", err)
+		}
+		if b, err := ioutil.ReadFile(pth); err != nil || string(b) != content {
+			t.Errorf("downloaded %d bytes (%v), want the whole archive", len(b), err)
+		}
+	}
+}
+
+func TestCheckReceived(t *testing.T) {
+	failure := errors.New("connection reset")
+	tests := []struct {
+		written, size int64
+		err           error
+		wantShort     bool
+	}{
+		{written: 10, size: 10},
+		{written: 10, size: -1},
+		{written: 5, size: 10, wantShort: true},
+		{written: 5, size: 10, err: io.ErrUnexpectedEOF, wantShort: true},
+		{written: 5, size: 10, err: failure},
+	}
+	for _, tt := range tests {
+		err := checkReceived(tt.written, tt.size, tt.err)
+		if _, short := err.(*shortReadError); short != tt.wantShort || (!short && err != tt.err) {
+			t.Errorf("checkReceived(%d, %d, %v) = %v, want short read %t", tt.written, tt.size, tt.err, err, tt.wantShort)
+		}
+		if tt.wantShort && !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("checkReceived(%d, %d, %v) = %v, want it resumed as an unexpected EOF", tt.written, tt.size, tt.err, err)
+		}
+	}
+}
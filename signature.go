@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// parseSignaturePublicKey parses a base64 encoded ed25519 public key.
+func parseSignaturePublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature public key: %s", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid signature public key: %d bytes, %d bytes expected", len(key), ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// downloadSignature downloads the archive's detached signature, either as raw or as base64 encoded bytes.
+func downloadSignature(client *http.Client, url string) ([]byte, error) {
+	body, _, err := performRequest(client, url)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	b, err := ioutil.ReadAll(io.LimitReader(body, 1024))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == ed25519.SignatureSize {
+		return b, nil
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return nil, errors.New("invalid signature, raw or base64 encoded ed25519 signature expected")
+	}
+	return sig, nil
+}
+
+// verifyArchiveSignature verifies the detached signature of the archive file at pth.
+// Archives can be larger than the memory, so the signature is an Ed25519ph signature (over the archive's SHA-512 digest).
+func verifyArchiveSignature(pth string, sig []byte, key ed25519.PublicKey) error {
+	f, err := os.Open(pth)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			log.Warnf("Failed to close %s: %s", pth, err)
+		}
+	}()
+
+	h := sha512.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if err := ed25519.VerifyWithOptions(key, h.Sum(nil), sig, &ed25519.Options{Hash: crypto.SHA512}); err != nil {
+		return fmt.Errorf("archive signature verification failed: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifySignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := []byte("cache archive")
+	digest := sha512.Sum512(archive)
+	sig, err := priv.Sign(rand.Reader, digest[:], &ed25519.Options{Hash: crypto.SHA512})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pth := filepath.Join(t.TempDir(), "archive.tar")
+	if err := ioutil.WriteFile(pth, archive, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/valid.sig":
+			_, _ = w.Write([]byte(base64.StdEncoding.EncodeToString(sig)))
+		case "/raw.sig":
+			_, _ = w.Write(sig)
+		case "/invalid.sig":
+			invalid := append([]byte(nil), sig...)
+			invalid[0] ^= 0xff
+			_, _ = w.Write(invalid)
+		}
+	}))
+	defer server.Close()
+
+	publicKey := base64.StdEncoding.EncodeToString(pub)
+
+	tests := []struct {
+		name         string
+		signatureURL string
+		publicKey    string
+		wantErr      bool
+	}{
+		{name: "valid signature", signatureURL: server.URL + "/valid.sig", publicKey: publicKey},
+		{name: "valid raw signature", signatureURL: server.URL + "/raw.sig", publicKey: publicKey},
+		{name: "invalid signature", signatureURL: server.URL + "/invalid.sig", publicKey: publicKey, wantErr: true},
+		{name: "no signature", signatureURL: "", publicKey: publicKey, wantErr: true},
+		{name: "invalid public key", signatureURL: server.URL + "/valid.sig", publicKey: "key", wantErr: true},
+	}
+	for _, tt := range tests {
+		err := verifySignature(server.Client(), pth, tt.signatureURL, tt.publicKey)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: verifySignature() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	// a modified archive fails the verification
+	if err := ioutil.WriteFile(pth, []byte("modified archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifySignature(server.Client(), pth, server.URL+"/valid.sig", publicKey); err == nil {
+		t.Errorf("verifySignature() expected an error for a modified archive")
+	}
+}
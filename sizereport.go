@@ -0,0 +1,103 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// sizeReport attributes the restored bytes to the top-level and second-level directories of the archive,
+// the levels are counted below the directory all the entries share.
+type sizeReport struct {
+	Root        string          `json:"root"`
+	Directories []directorySize `json:"directories"`
+}
+
+// directorySize is the total size of the regular files under a directory.
+type directorySize struct {
+	Path  string `json:"path"`
+	Level int    `json:"level"`
+	Bytes int64  `json:"bytes"`
+}
+
+// newSizeReport aggregates the sizes of the archive's regular file entries by directory.
+// A file directly in the shared directory is attributed to itself, as a top-level entry.
+func newSizeReport(index archiveIndex) sizeReport {
+	var names []string
+	for name, entry := range index {
+		if entry.Typeflag == tar.TypeReg && !entry.Metadata {
+			names = append(names, path.Clean(name))
+		}
+	}
+	report := sizeReport{Root: commonDir(names), Directories: []directorySize{}}
+
+	sizes := map[string]*directorySize{}
+	add := func(pth string, level int, size int64) {
+		if sizes[pth] == nil {
+			sizes[pth] = &directorySize{Path: pth, Level: level}
+		}
+		sizes[pth].Bytes += size
+	}
+	for name, entry := range index {
+		if entry.Typeflag != tar.TypeReg || entry.Metadata {
+			continue
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(path.Clean(name), report.Root), "/")
+		parts := strings.Split(rel, "/")
+		add(path.Join(report.Root, parts[0]), 1, entry.Size)
+		if len(parts) > 2 {
+			add(path.Join(report.Root, parts[0], parts[1]), 2, entry.Size)
+		}
+	}
+
+	for _, size := range sizes {
+		report.Directories = append(report.Directories, *size)
+	}
+	sort.Slice(report.Directories, func(i, j int) bool { return report.Directories[i].Path < report.Directories[j].Path })
+	return report
+}
+
+// commonDir returns the deepest directory containing all the paths.
+func commonDir(pths []string) string {
+	if len(pths) == 0 {
+		return ""
+	}
+	dir := path.Dir(pths[0])
+	for _, pth := range pths[1:] {
+		for dir != "." && dir != "/" && !strings.HasPrefix(pth, dir+"/") {
+			dir = path.Dir(dir)
+		}
+	}
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+// logSizeReport logs the directories' sizes, the largest first within each level.
+func logSizeReport(report sizeReport) {
+	dirs := append([]directorySize(nil), report.Directories...)
+	sort.SliceStable(dirs, func(i, j int) bool {
+		if dirs[i].Level != dirs[j].Level {
+			return dirs[i].Level < dirs[j].Level
+		}
+		return dirs[i].Bytes > dirs[j].Bytes
+	})
+	log.Printf("restored size by directory (under %s):", report.Root)
+	for _, dir := range dirs {
+		log.Printf("%s- %s: %d KB", strings.Repeat("  ", dir.Level-1), dir.Path, dir.Bytes/1024)
+	}
+}
+
+// exportSizeReport exports the size report as JSON.
+func exportSizeReport(export exportFunc, report sizeReport) error {
+	b, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	return export(sizeReportEnvKey, string(b))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewSizeReport(t *testing.T) {
+	root := t.TempDir()
+	archive := createTestArchive(t,
+		testEntry{hdr: tar.Header{Name: "/" + archiveInfoFileName, Typeflag: tar.TypeReg}, body: strings.Repeat(" ", 100)},
+		testEntry{hdr: tar.Header{Name: "/Users/vagrant/.gradle/caches/jars/a.jar", Typeflag: tar.TypeReg}, body: strings.Repeat("a", 3000)},
+		testEntry{hdr: tar.Header{Name: "/Users/vagrant/.gradle/caches/jars/b.jar", Typeflag: tar.TypeReg}, body: strings.Repeat("b", 1000)},
+		testEntry{hdr: tar.Header{Name: "/Users/vagrant/.gradle/wrapper/gradle.zip", Typeflag: tar.TypeReg}, body: strings.Repeat("w", 500)},
+		testEntry{hdr: tar.Header{Name: "/Users/vagrant/.gradle/gradle.properties", Typeflag: tar.TypeReg}, body: strings.Repeat("p", 10)},
+		testEntry{hdr: tar.Header{Name: "/Users/vagrant/.m2/repository", Typeflag: tar.TypeDir}},
+		testEntry{hdr: tar.Header{Name: "/Users/vagrant/.m2/repository/lib.jar", Typeflag: tar.TypeReg}, body: strings.Repeat("m", 200)},
+		testEntry{hdr: tar.Header{Name: "/Users/vagrant/.bashrc", Typeflag: tar.TypeReg}, body: strings.Repeat("r", 5)},
+	)
+	result, err := extractCacheArchive(archive, extractOptions{Root: root})
+	if err != nil {
+		t.Fatalf("extractCacheArchive() error = %v", err)
+	}
+
+	report := newSizeReport(result.Index)
+	want := sizeReport{
+		Root: "/Users/vagrant",
+		Directories: []directorySize{
+			{Path: "/Users/vagrant/.bashrc", Level: 1, Bytes: 5},
+			{Path: "/Users/vagrant/.gradle", Level: 1, Bytes: 4510},
+			{Path: "/Users/vagrant/.gradle/caches", Level: 2, Bytes: 4000},
+			{Path: "/Users/vagrant/.gradle/wrapper", Level: 2, Bytes: 500},
+			{Path: "/Users/vagrant/.m2", Level: 1, Bytes: 200},
+			{Path: "/Users/vagrant/.m2/repository", Level: 2, Bytes: 200},
+		},
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("newSizeReport() = %+v, want %+v", report, want)
+	}
+
+	exported := map[string]string{}
+	export := func(key, value string) error {
+		exported[key] = value
+		return nil
+	}
+	if err := exportSizeReport(export, report); err != nil {
+		t.Fatalf("exportSizeReport() error = %v", err)
+	}
+	var got sizeReport
+	if err := json.Unmarshal([]byte(exported[sizeReportEnvKey]), &got); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("exported size report = %s (%v)", exported[sizeReportEnvKey], err)
+	}
+}
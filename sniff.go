@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// sniffSize is the size of the response body's start checked by sniffArchive, the size http.DetectContentType reads.
+const sniffSize = 512
+
+// snippetSize is the most bytes of the response body quoted by the not an archive error.
+const snippetSize = 200
+
+// notArchiveError is returned if the archive response's body is clearly not an archive,
+// like the HTML error page of a misconfigured proxy sent with a 200 status code.
+type notArchiveError struct {
+	Type    string
+	Snippet string
+}
+
+// Error implements the error interface.
+func (e *notArchiveError) Error() string {
+	return fmt.Sprintf("expected archive, got %s: %q", e.Type, e.Snippet)
+}
+
+// sniffArchive checks the start of the archive response's body, and returns a body replaying the checked bytes.
+// The tar, compressed and encrypted archives' headers are binary, a body starting with an HTML, XML or JSON document is not an archive.
+func sniffArchive(body io.ReadCloser) (io.ReadCloser, error) {
+	br := bufio.NewReaderSize(body, sniffSize)
+	b, err := br.Peek(sniffSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		_ = closeBody(body)
+		return nil, err
+	}
+	if kind := textKind(b); kind != "" {
+		_ = closeBody(body)
+		snippet := b
+		if len(snippet) > snippetSize {
+			snippet = snippet[:snippetSize]
+		}
+		return nil, &notArchiveError{Type: kind, Snippet: strings.TrimSpace(string(snippet))}
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{br, body}, nil
+}
+
+// textKind returns the kind of the error document the body starts with (HTML, XML or JSON), or empty if it is not one.
+func textKind(b []byte) string {
+	// a tar header's name is text too, followed by the NUL padding
+	if len(b) == 0 || bytes.IndexByte(b, 0) >= 0 {
+		return ""
+	}
+	contentType := http.DetectContentType(b)
+	if !strings.HasPrefix(contentType, "text/") {
+		return ""
+	}
+	switch trimmed := bytes.TrimSpace(b); {
+	case strings.HasPrefix(contentType, "text/html"):
+		return "HTML"
+	case strings.HasPrefix(contentType, "text/xml"):
+		return "XML"
+	case bytes.HasPrefix(trimmed, []byte("{")) || bytes.HasPrefix(trimmed, []byte("[")):
+		return "JSON"
+	}
+	// other text might still be the start of a (broken) archive, the extraction reports it
+	return ""
+}
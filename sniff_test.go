@@ -0,0 +1,73 @@
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSniffArchive(t *testing.T) {
+	archive := createTestArchive(t, testEntry{hdr: tar.Header{Name: "file.txt", Typeflag: tar.TypeReg}, body: "content"}).Bytes()
+	const errorPage = "<!DOCTYPE html>\n<html><head><title>Access Denied</title></head><body>Request has expired</body></html>"
+
+	tests := []struct {
+		name     string
+		body     string
+		wantType string
+	}{
+		{name: "archive", body: string(archive)},
+		{name: "empty", body: ""},
+		{name: "HTML error page", body: errorPage, wantType: "HTML"},
+		{name: "JSON error", body: `{"error": "expired"}`, wantType: "JSON"},
+		{name: "XML error", body: `<?xml version="1.0"?><Error><Code>AccessDenied</Code></Error>`, wantType: "XML"},
+		{name: "text", body: "Forbidden"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			body, _, err := requestArchive(http.DefaultClient, server.URL, false)
+			if tt.wantType != "" {
+				notArchive, ok := err.(*notArchiveError)
+				if !ok || notArchive.Type != tt.wantType || !strings.HasPrefix(err.Error(), "expected archive, got "+tt.wantType) {
+					t.Fatalf("requestArchive() error = %v, want the not an archive error of %s", err, tt.wantType)
+				}
+				if !strings.HasPrefix(tt.body, notArchive.Snippet) {
+					t.Errorf("snippet = %q, want the body's start", notArchive.Snippet)
+				}
+				if isFallbackError(err) {
+					t.Errorf("isFallbackError() = true, want false")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("requestArchive() error = %v", err)
+			}
+			// the sniffed bytes are replayed
+			b, err := ioutil.ReadAll(body)
+			if err != nil || string(b) != tt.body {
+				t.Errorf("read %d bytes, %v, want the whole body", len(b), err)
+			}
+		})
+	}
+
+	t.Log("downloaded to a file")
+	{
+		defer func(pth string) { cacheArchivePath = pth }(cacheArchivePath)
+		cacheArchivePath = filepath.Join(t.TempDir(), "cache-archive.tar")
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(errorPage))
+		}))
+		defer server.Close()
+		if _, err := downloadCacheArchive(http.DefaultClient, server.URL, false, expectedChecksum{}); err == nil || !strings.Contains(err.Error(), "Access Denied") {
+			t.Errorf("downloadCacheArchive() error = %v, want the not an archive error", err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sparseBlockSize is the granularity of the holes written for the sparse entries.
+const sparseBlockSize = 4096
+
+// sparseRecord is the PAX record marking a sparse file stored as a regular one by a re-encoded stream,
+// so the file is still written with holes by the step.
+const sparseRecord = "BITRISE.sparse"
+
+// isSparseEntry reports whether the entry is a GNU sparse file: an old GNU format sparse entry, or a PAX one.
+// archive/tar reads the sparse entries expanded, the holes read as zeros.
+func isSparseEntry(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse || hdr.PAXRecords[sparseRecord] != "" {
+		return true
+	}
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeSparseHeader turns a sparse entry's header into a regular file's, for the expanded content:
+// archive/tar does not write sparse entries, the re-encoded streams store the sparse files as regular ones, marked by the sparseRecord.
+// The header's size is the file's logical size already.
+func normalizeSparseHeader(hdr *tar.Header) {
+	if !isSparseEntry(hdr) {
+		return
+	}
+	if hdr.PAXRecords == nil {
+		hdr.PAXRecords = map[string]string{}
+	}
+	hdr.PAXRecords[sparseRecord] = "1"
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		hdr.Typeflag = tar.TypeReg
+		hdr.Format = tar.FormatUnknown
+	}
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			delete(hdr.PAXRecords, key)
+		}
+	}
+}
+
+// writeSparse writes the expanded content of the sparse entry read from r to f, seeking over its zero blocks instead of
+// writing them, so the holes are kept. The file is truncated to its size at the end, for a trailing hole.
+// It returns the content's size.
+func writeSparse(f *os.File, r io.Reader) (int64, error) {
+	buf := make([]byte, sparseBlockSize)
+	var size int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if isZeroBlock(buf[:n]) {
+				if _, serr := f.Seek(int64(n), io.SeekCurrent); serr != nil {
+					return size, serr
+				}
+			} else if _, werr := f.Write(buf[:n]); werr != nil {
+				return size, werr
+			}
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return size, f.Truncate(size)
+		}
+		if err != nil {
+			return size, err
+		}
+	}
+}
+
+func isZeroBlock(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// writeSparseEntry writes the sparse entry read from r to its target by the step, with its holes:
+// tar would write the zeros of the sparse file stored as a regular one by a re-encoded stream.
+// An existing file or symlink at the target is replaced, like tar does.
+func writeSparseEntry(target string, hdr *tar.Header, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	mode := hdr.FileInfo().Mode().Perm()
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	_, err = writeSparse(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(target, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(target, hdr.ModTime, hdr.ModTime)
+}
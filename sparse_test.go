@@ -0,0 +1,99 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// createSparseArchive creates a tar archive of a 16 MB sparse file with the tar tool, in the given format:
+// archive/tar does not write sparse entries. It returns the archive's path.
+func createSparseArchive(t *testing.T, format string) string {
+	if !isGNUTar() {
+		t.Skip("creating a sparse archive needs GNU tar")
+	}
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("head"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("middle"), 8*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	// the file ends with a hole
+	if err := f.Truncate(16 * 1024 * 1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pth := filepath.Join(t.TempDir(), "sparse.tar")
+	if out, err := exec.Command("tar", "-cS", "--format="+format, "-f", pth, "-C", dir, "disk.img").CombinedOutput(); err != nil {
+		t.Fatalf("tar: %s: %s", err, out)
+	}
+	return pth
+}
+
+// checkSparseFile checks the restored file's content, and that its holes are kept.
+func checkSparseFile(t *testing.T, pth string) {
+	b, err := ioutil.ReadFile(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 16*1024*1024 || !bytes.HasPrefix(b, []byte("head")) || !bytes.Equal(b[8*1024*1024:8*1024*1024+6], []byte("middle")) {
+		t.Fatalf("restored %d bytes, want the sparse file's content", len(b))
+	}
+	info, err := os.Stat(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocated := info.Sys().(*syscall.Stat_t).Blocks * 512
+	if allocated > 1024*1024 {
+		t.Errorf("%d bytes allocated for the %d bytes file, want the holes kept", allocated, info.Size())
+	}
+}
+
+func TestExtractCacheArchive_Sparse(t *testing.T) {
+	for _, format := range []string{"gnu", "pax"} {
+		archive := createSparseArchive(t, format)
+		tests := []struct {
+			name string
+			opts extractOptions
+		}{
+			// the extraction root's stream is guarded, re-encoded: the step writes the sparse file
+			{name: "extraction root", opts: extractOptions{}},
+			{name: "filtered", opts: extractOptions{Filter: &pathFilter{}}},
+			{name: "confined", opts: extractOptions{ConfineRoot: true}},
+			{name: "filtered then confined", opts: extractOptions{ConfineRoot: true, Filter: &pathFilter{}}},
+		}
+		for _, tt := range tests {
+			t.Run(format+" "+tt.name, func(t *testing.T) {
+				root := t.TempDir()
+				tt.opts.Root = root
+				f, err := os.Open(archive)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer func() { _ = f.Close() }()
+
+				result, err := extractCacheArchive(f, tt.opts)
+				if err != nil || len(result.Errors) > 0 {
+					t.Fatalf("extractCacheArchive() = %+v, %v", result.Errors, err)
+				}
+				if entry := result.Index["disk.img"]; entry.Typeflag != tar.TypeReg || entry.Size != 16*1024*1024 {
+					t.Errorf("indexed %+v, want a regular file of the logical size", entry)
+				}
+				checkSparseFile(t, filepath.Join(root, "disk.img"))
+			})
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// add merges the summary of another archive's extraction into the result.
+func (r *extractResult) add(other extractResult) {
+	r.Entries += other.Entries
+	r.Skipped += other.Skipped
+	r.Errors = append(r.Errors, other.Errors...)
+	if r.Index == nil {
+		r.Index = archiveIndex{}
+	}
+	for name, entry := range other.Index {
+		r.Index[name] = entry
+	}
+	r.CompressedBytes += other.CompressedBytes
+	r.UncompressedBytes += other.UncompressedBytes
+	r.Empty = r.Empty && other.Empty
+}
+
+// extractArchiveParts extracts the further parts of a split cache archive, after its first part.
+// Each part may carry its own archive_info.json, but only the first part's metadata drives the stack check
+// and is extracted: the parts' metadata entries are skipped, without reading them.
+// With a prefetcher, the parts are extracted from the files it downloads, otherwise they are streamed one after the other.
+func extractArchiveParts(parts []archiveSource, opts extractOptions, prefetcher *partPrefetcher) (extractResult, error) {
+	var result extractResult
+	opts.ExtractMetadata = false
+
+	for i, src := range parts {
+		log.Printf("extracting archive part %d/%d", i+2, len(parts)+1)
+
+		var body io.ReadCloser
+		var err error
+		if prefetcher != nil {
+			var pth string
+			if pth, err = prefetcher.get(i); err == nil {
+				body, err = os.Open(pth)
+				// the fallbacks read the downloaded file too, instead of downloading the part again
+				src.URI = "file://" + pth
+			}
+		} else {
+			body, _, err = requestArchive(src.Client, src.URI, src.IgnoreZeroLength)
+		}
+		if err != nil {
+			return result, fmt.Errorf("failed to download archive part %d: %s", i+2, err)
+		}
+
+		var partResult extractResult
+		r, _, err := newDecryptReader(body, src.DecryptionKeys)
+		if err == nil {
+			partResult, err = extractWithFallbacks(r, src, opts)
+		}
+		if cerr := body.Close(); cerr != nil {
+			log.Warnf("Failed to close response body: %s", cerr)
+		}
+		if prefetcher != nil {
+			prefetcher.remove(i)
+		}
+		result.add(partResult)
+		if err != nil {
+			return result, fmt.Errorf("failed to extract archive part %d: %s", i+2, err)
+		}
+	}
+	return result, nil
+}
+
+// partFetch is a part's download to a temporary file.
+type partFetch struct {
+	pth  string
+	err  error
+	done chan struct{}
+}
+
+// partPrefetcher downloads the next part of a split archive to a temporary file, while the current one is extracted.
+// At most two parts are on the disk at a time: the one being extracted, and the one being downloaded.
+type partPrefetcher struct {
+	parts   []archiveSource
+	fetches []*partFetch
+}
+
+// newPartPrefetcher starts downloading the first part, so it overlaps with the extraction of the archive before the parts.
+func newPartPrefetcher(parts []archiveSource) *partPrefetcher {
+	p := &partPrefetcher{parts: parts, fetches: make([]*partFetch, len(parts))}
+	p.start(0)
+	return p
+}
+
+// start starts downloading the i-th part, if it is not started yet.
+func (p *partPrefetcher) start(i int) {
+	if i >= len(p.parts) || p.fetches[i] != nil {
+		return
+	}
+	fetch := &partFetch{done: make(chan struct{})}
+	p.fetches[i] = fetch
+	go func() {
+		defer close(fetch.done)
+		fetch.pth, fetch.err = downloadArchivePart(p.parts[i])
+	}()
+}
+
+// get waits for the i-th part's download and returns its file, the next part's download is started meanwhile.
+func (p *partPrefetcher) get(i int) (string, error) {
+	p.start(i)
+	p.start(i + 1)
+	<-p.fetches[i].done
+	return p.fetches[i].pth, p.fetches[i].err
+}
+
+// remove removes the i-th part's downloaded file.
+func (p *partPrefetcher) remove(i int) {
+	if fetch := p.fetches[i]; fetch != nil && fetch.pth != "" {
+		if err := os.Remove(fetch.pth); err != nil {
+			log.Warnf("Failed to remove archive part file: %s", err)
+		}
+	}
+}
+
+// downloadArchivePart downloads the part to a new temporary file, and returns the file's path.
+func downloadArchivePart(src archiveSource) (string, error) {
+	body, _, err := requestArchive(src.Client, src.URI, src.IgnoreZeroLength)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	f, err := ioutil.TempFile("", "cache-archive-part-*.tar")
+	if err != nil {
+		return "", fmt.Errorf("failed to open the local archive part file for write: %s", err)
+	}
+	written, err := io.Copy(f, body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && written == 0 {
+		err = errors.New("downloaded archive part is empty")
+	}
+	if err != nil {
+		if rerr := os.Remove(f.Name()); rerr != nil {
+			log.Warnf("Failed to remove archive part file: %s", rerr)
+		}
+		return "", err
+	}
+	return f.Name(), nil
+}
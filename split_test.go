@@ -0,0 +1,127 @@
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExtractArchiveParts_DuplicateMetadata(t *testing.T) {
+	dir := t.TempDir()
+	infoPth := filepath.Join(dir, archiveInfoFileName)
+	firstPth := filepath.Join(dir, "first.txt")
+	secondPth := filepath.Join(dir, "second.txt")
+
+	first := createTestArchive(t,
+		testEntry{hdr: tar.Header{Name: infoPth, Typeflag: tar.TypeReg}, body: `{"stack_id":"osx"}`},
+		testEntry{hdr: tar.Header{Name: firstPth, Typeflag: tar.TypeReg}, body: "first"},
+	)
+	second := createTestArchive(t,
+		testEntry{hdr: tar.Header{Name: infoPth, Typeflag: tar.TypeReg}, body: `{"stack_id":"linux"}`},
+		testEntry{hdr: tar.Header{Name: secondPth, Typeflag: tar.TypeReg}, body: "second"},
+	).Bytes()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(second)
+	}))
+	defer server.Close()
+
+	// the first part drives the stack check
+	reader := NewRestoreReader(first)
+	info, err := readArchiveInfo(reader)
+	if err != nil {
+		t.Fatalf("readArchiveInfo() error = %v", err)
+	}
+	if shouldSkipForStack(info, "osx", false) {
+		t.Fatalf("first part skipped for the stack")
+	}
+	opts := extractOptions{ExtractMetadata: true}
+	if _, err := extractCacheArchive(reader, opts); err != nil {
+		t.Fatalf("extractCacheArchive() error = %v", err)
+	}
+
+	// the second part's metadata, from a different stack, is ignored
+	result, err := extractArchiveParts([]archiveSource{{Client: server.Client(), URI: server.URL}}, opts, nil)
+	if err != nil {
+		t.Fatalf("extractArchiveParts() error = %v", err)
+	}
+	if result.Entries != 1 || result.Skipped != 1 {
+		t.Errorf("extractArchiveParts() entries = %d, skipped = %d, want 1, 1", result.Entries, result.Skipped)
+	}
+	if _, err := os.Stat(secondPth); err != nil {
+		t.Errorf("second part's file not extracted: %s", err)
+	}
+	if b, err := ioutil.ReadFile(infoPth); err != nil || string(b) != `{"stack_id":"osx"}` {
+		t.Errorf("%s = %q (%v), want the first part's metadata", archiveInfoFileName, b, err)
+	}
+}
+
+func TestGetCacheDownloadURL_PartURLs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"download_url": "https://storage.com/cache.tar", "part_urls": ["https://storage.com/cache.1.tar", "https://storage.com/cache.2.tar"]}`))
+	}))
+	defer server.Close()
+
+	resp, err := getCacheDownloadURL(server.URL, "download_url")
+	if err != nil {
+		t.Fatalf("getCacheDownloadURL() error = %v", err)
+	}
+	if len(resp.PartURLs) != 2 || resp.PartURLs[0] != "https://storage.com/cache.1.tar" || resp.PartURLs[1] != "https://storage.com/cache.2.tar" {
+		t.Errorf("getCacheDownloadURL() part urls = %v", resp.PartURLs)
+	}
+}
+
+func TestExtractArchiveParts_Prefetch(t *testing.T) {
+	const delay = 300 * time.Millisecond
+	dir := t.TempDir()
+	archives := map[string][]byte{}
+	for _, name := range []string{"first", "second"} {
+		archives["/"+name] = createTestArchive(t,
+			testEntry{hdr: tar.Header{Name: filepath.Join(dir, name+".txt"), Typeflag: tar.TypeReg}, body: name},
+		).Bytes()
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		_, _ = w.Write(archives[r.URL.Path])
+	}))
+	defer server.Close()
+	parts := []archiveSource{
+		{Client: server.Client(), URI: server.URL + "/first"},
+		{Client: server.Client(), URI: server.URL + "/second"},
+	}
+
+	extract := func(prefetcher *partPrefetcher) time.Duration {
+		start := time.Now()
+		result, err := extractArchiveParts(parts, extractOptions{}, prefetcher)
+		if err != nil {
+			t.Fatalf("extractArchiveParts() error = %v", err)
+		}
+		if result.Entries != 2 {
+			t.Errorf("extractArchiveParts() entries = %d, want 2", result.Entries)
+		}
+		return time.Since(start)
+	}
+
+	sequential := extract(nil)
+	prefetched := extract(newPartPrefetcher(parts))
+	if sequential < 2*delay {
+		t.Fatalf("sequential extraction took %s, want at least %s", sequential, 2*delay)
+	}
+	if prefetched >= sequential-delay/2 {
+		t.Errorf("prefetched extraction took %s, sequential %s, want the downloads overlapped", prefetched, sequential)
+	}
+
+	for _, name := range []string{"first", "second"} {
+		if b, err := ioutil.ReadFile(filepath.Join(dir, name+".txt")); err != nil || string(b) != name {
+			t.Errorf("%s part not extracted: %q, %v", name, b, err)
+		}
+	}
+	if matches, _ := filepath.Glob(filepath.Join(os.TempDir(), "cache-archive-part-*.tar")); len(matches) > 0 {
+		t.Errorf("archive part files left: %v", matches)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// streamSpool writes the archive download's bytes to a file while the stream is extracted,
+// so the fallback extracts the file instead of downloading the archive again: the bytes read by the stream extraction,
+// and the ones read ahead to read the archive info are not downloaded twice.
+// Failing to write the file only drops the spool, the stream extraction is not affected.
+type streamSpool struct {
+	r   io.Reader
+	f   *os.File
+	pth string
+
+	mu      sync.Mutex
+	written int64
+	// writeErr is the spool file's write error, the file is incomplete then.
+	writeErr error
+	// readErr is the download's read error, io.EOF once the download is read till its end.
+	readErr error
+	closed  bool
+}
+
+// newStreamSpool starts spooling the download read from r to the file at pth.
+func newStreamSpool(r io.Reader, pth string) (*streamSpool, error) {
+	f, err := os.Create(pth)
+	if err != nil {
+		return nil, err
+	}
+	return &streamSpool{r: r, f: f, pth: pth}, nil
+}
+
+// Read implements the io.Reader interface.
+func (s *streamSpool) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.readErr != nil {
+		return 0, s.readErr
+	}
+	n, err := s.r.Read(p)
+	s.write(p[:n])
+	if err != nil {
+		s.readErr = err
+	}
+	return n, err
+}
+
+func (s *streamSpool) write(b []byte) {
+	if len(b) == 0 || s.writeErr != nil || s.closed {
+		return
+	}
+	n, err := s.f.Write(b)
+	s.written += int64(n)
+	if err != nil {
+		log.Warnf("Failed to spool the archive stream, the fallback downloads the archive again: %s", err)
+		s.writeErr = err
+	}
+}
+
+// complete reads the rest of the download into the file, and returns the file's path.
+// A download interrupted by a connection error is resumed from the spooled bytes with a range request.
+// The stream is not read any more.
+func (s *streamSpool) complete(client *http.Client, url string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readErr == nil {
+		s.readErr = s.drain(s.r)
+	}
+	if s.readErr != io.EOF && s.writeErr == nil && isConnectionError(s.readErr) {
+		log.Warnf("The archive stream was interrupted after %d bytes: %s, resuming the download", s.written, s.readErr)
+		body, partial, err := resumeArchive(client, url, s.written)
+		if err != nil {
+			return "", fmt.Errorf("failed to resume the download: %s", err)
+		}
+		defer func() { _ = closeBody(body) }()
+		if !partial {
+			return "", fmt.Errorf("the download server does not support range requests")
+		}
+		s.readErr = s.drain(body)
+	}
+
+	if s.writeErr != nil {
+		return "", s.writeErr
+	}
+	if s.readErr != io.EOF {
+		return "", fmt.Errorf("failed to read the archive stream: %s", s.readErr)
+	}
+	s.closed = true
+	if err := s.f.Close(); err != nil {
+		return "", err
+	}
+	return s.pth, nil
+}
+
+// drain copies the rest of r to the file, it returns io.EOF once r is read till its end.
+func (s *streamSpool) drain(r io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		s.write(buf[:n])
+		if s.writeErr != nil {
+			return s.writeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// close closes the spool file, if it is not completed.
+func (s *streamSpool) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		_ = s.f.Close()
+	}
+}
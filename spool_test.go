@@ -0,0 +1,117 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingReader fails the reads with err.
+type failingReader struct{ err error }
+
+func (r failingReader) Read([]byte) (int, error) { return 0, r.err }
+
+func TestExtractWithFallbacks_Spool(t *testing.T) {
+	archive := createTestArchive(t,
+		testEntry{hdr: tar.Header{Name: "dir/file.txt", Typeflag: tar.TypeReg, Mode: 0644}, body: strings.Repeat("content", 1024)},
+	).Bytes()
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_, _ = w.Write(archive)
+	}))
+	defer server.Close()
+
+	body, _, err := requestArchive(http.DefaultClient, server.URL, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = body.Close() }()
+	spool, err := newStreamSpool(body, filepath.Join(t.TempDir(), "cache-archive.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the head of the stream is read ahead, as the archive info is
+	if _, err := io.CopyN(ioutil.Discard, spool, 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	root := t.TempDir()
+	src := archiveSource{Client: http.DefaultClient, URI: server.URL, StreamErr: errors.New("stream refused"), Spool: spool}
+	result, err := extractWithFallbacks(spool, src, extractOptions{Root: root})
+	if err != nil {
+		t.Fatalf("extractWithFallbacks() error = %v", err)
+	}
+	if result.Source != extractSourceFile {
+		t.Errorf("Source = %s, want %s", result.Source, extractSourceFile)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(root, "dir/file.txt")); err != nil || len(b) != 7*1024 {
+		t.Errorf("dir/file.txt = %d bytes, %v, want the file extracted", len(b), err)
+	}
+	if requests != 1 {
+		t.Errorf("%d archive requests, want the archive downloaded once", requests)
+	}
+}
+
+func TestStreamSpool_Resume(t *testing.T) {
+	archive := bytes.Repeat([]byte("0123456789"), 1000)
+
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "archive.tar", time.Time{}, bytes.NewReader(archive))
+	}))
+	defer server.Close()
+
+	t.Log("interrupted stream")
+	{
+		// the connection drops after 4000 bytes
+		body := io.MultiReader(bytes.NewReader(archive[:4000]), failingReader{err: io.ErrUnexpectedEOF})
+		pth := filepath.Join(t.TempDir(), "cache-archive.tar")
+		spool, err := newStreamSpool(body, pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(spool); err != io.ErrUnexpectedEOF {
+			t.Fatalf("ReadAll() error = %v, want %v", err, io.ErrUnexpectedEOF)
+		}
+
+		got, err := spool.complete(http.DefaultClient, server.URL)
+		if err != nil || got != pth {
+			t.Fatalf("complete() = %s, %v, want %s", got, err, pth)
+		}
+		if b, err := ioutil.ReadFile(pth); err != nil || !bytes.Equal(b, archive) {
+			t.Errorf("spooled %d bytes, %v, want the archive", len(b), err)
+		}
+		if len(ranges) != 1 || ranges[0] != "bytes=4000-" {
+			t.Errorf("requested ranges = %q, want the rest of the archive requested once", ranges)
+		}
+	}
+
+	t.Log("failing spool file")
+	{
+		pth := filepath.Join(t.TempDir(), "cache-archive.tar")
+		spool, err := newStreamSpool(bytes.NewReader(archive), pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the stream is still extracted, the spool is dropped
+		_ = spool.f.Close()
+		if b, err := ioutil.ReadAll(spool); err != nil || !bytes.Equal(b, archive) {
+			t.Errorf("ReadAll() = %d bytes, %v, want the stream read", len(b), err)
+		}
+		if _, err := spool.complete(http.DefaultClient, server.URL); !errors.Is(err, os.ErrClosed) {
+			t.Errorf("complete() error = %v, want the write error", err)
+		}
+	}
+}
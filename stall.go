@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// downloadStallTimeout is the longest time the archive download may receive no bytes, 0 disables it.
+// The download's total time is not limited, a huge archive may download for long.
+var downloadStallTimeout = 10 * time.Minute
+
+// responseHeaderTimeout is the longest wait for the archive download's response headers, once the request is sent.
+var responseHeaderTimeout = time.Minute
+
+// stallError is returned by a read on the download's connection, if no bytes arrived for the stall timeout.
+type stallError struct {
+	// After is the stall timeout.
+	After time.Duration
+}
+
+// Error implements the error interface.
+func (e *stallError) Error() string {
+	return fmt.Sprintf("download stalled: no data received for %s", e.After)
+}
+
+// Timeout implements the net.Error interface, a stalled download is a connection timeout.
+func (e *stallError) Timeout() bool { return true }
+
+// Temporary implements the net.Error interface.
+func (e *stallError) Temporary() bool { return true }
+
+// stallConn fails a read on the connection, if it gets no bytes for the timeout.
+// The deadline is extended on each read, so the time the reader spends between the reads (like a slow extraction) does not count.
+type stallConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+// Read implements the io.Reader interface.
+func (c *stallConn) Read(p []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Read(p)
+	var netErr net.Error
+	if err != nil && errors.As(err, &netErr) && netErr.Timeout() {
+		err = &stallError{After: c.timeout}
+	}
+	return n, err
+}
+
+// withStallTimeout wraps the connection with the stall timeout, if it is set.
+func withStallTimeout(conn net.Conn, timeout time.Duration) net.Conn {
+	if timeout <= 0 {
+		return conn
+	}
+	return &stallConn{Conn: conn, timeout: timeout}
+}
+
+// stallDialContext returns a dial function, whose connections fail the reads stalling for the timeout.
+func stallDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error), timeout time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return withStallTimeout(conn, timeout), nil
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// restoreSummary is the machine readable summary of the pull, written to summary_path once the step completes, successfully or not.
+type restoreSummary struct {
+	DownloadURL string `json:"download_url,omitempty"`
+	// ArchiveBytes is the size of the (compressed) archive read.
+	ArchiveBytes int64 `json:"archive_bytes"`
+	// FileCount is the number of the entries extracted.
+	FileCount int `json:"file_count"`
+	// IdenticalFiles is the number of the files not written, because they already existed identical.
+	IdenticalFiles int `json:"identical_files,omitempty"`
+	// StackMatched is null if the stacks were not compared.
+	StackMatched *bool  `json:"stack_matched"`
+	CacheHit     bool   `json:"cache_hit"`
+	UsedFallback bool   `json:"used_fallback"`
+	Source       string `json:"extraction_source,omitempty"`
+	DryRun       bool   `json:"dry_run,omitempty"`
+	DurationMS   int64  `json:"duration_ms"`
+	Success      bool   `json:"success"`
+	Error        string `json:"error,omitempty"`
+	// Phases are the durations of the pull's phases, see phaseTimings.
+	Phases phaseDurations `json:"phases"`
+
+	pth   string
+	start time.Time
+	mu    sync.Mutex
+}
+
+// stepSummary is the summary of the pull, nil if it is not written.
+// It is a package variable like stepTracer, so that the summary is written on the os.Exit paths too.
+var stepSummary *restoreSummary
+
+func newRestoreSummary(pth string) *restoreSummary {
+	return &restoreSummary{pth: pth, start: time.Now()}
+}
+
+// setDownloadURL records the archive's download URL, without its query: a presigned URL's signature is not written to the disk.
+func (s *restoreSummary) setDownloadURL(rawURL string) {
+	if s == nil {
+		return
+	}
+	if u, err := url.Parse(rawURL); err == nil {
+		u.RawQuery = ""
+		u.User = nil
+		rawURL = u.String()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.DownloadURL = rawURL
+}
+
+// setStackMatched records the result of the stack check.
+func (s *restoreSummary) setStackMatched(matched bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.StackMatched = &matched
+}
+
+// setExtraction records the extraction's counters, as reported by the extraction.
+func (s *restoreSummary) setExtraction(result extractResult) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.CacheHit = true
+	s.ArchiveBytes = result.CompressedBytes
+	s.FileCount = result.Entries
+	s.IdenticalFiles = result.Identical
+	s.Source = result.Source
+	s.UsedFallback = result.Source != "" && result.Source != extractSourceStream
+	s.DryRun = result.DryRun
+}
+
+// setError records the step's failure.
+func (s *restoreSummary) setError(msg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Error = msg
+}
+
+// write writes the summary with the step's outcome, a failing write is only a warning.
+func (s *restoreSummary) write(success bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Success = success
+	s.DurationMS = time.Since(s.start).Milliseconds()
+	s.Phases = stepTimings.durations()
+
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(s.pth, b, 0644)
+	}
+	if err != nil {
+		log.Warnf("Failed to write the restore summary: %s", err)
+	}
+}
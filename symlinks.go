@@ -0,0 +1,227 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// Handling of the archive's regular file entries, whose target path is an existing symlink.
+const (
+	// symlinksReplace removes the symlink and extracts a regular file in its place.
+	symlinksReplace = "replace"
+	// symlinksFollow writes the file's content through the symlink.
+	symlinksFollow = "follow"
+	// symlinksFail fails the extraction.
+	symlinksFail = "fail"
+)
+
+// symlinkError is returned if a regular file entry's target is a symlink, and the extraction is configured to fail.
+type symlinkError struct {
+	Path string
+	Link string
+}
+
+// Error implements the error interface.
+func (e *symlinkError) Error() string {
+	return fmt.Sprintf("%s is a symlink (to %s), refusing to extract a regular file over it", e.Path, e.Link)
+}
+
+// entryTarget returns the path the tar tool extracts the entry to.
+// The path is resolved lexically: only its final component is checked for being a symlink (with an Lstat,
+// which does not open a descriptor), so deep trees extract without descriptor pressure.
+// Under an extraction root, tar strips the leading / and refuses the entries with a .. component: those have no target,
+// an empty path is returned (which does not exist), so the step does not touch the paths outside the root either.
+func entryTarget(name, root string) string {
+	if root == "" {
+		return filepath.Clean(name)
+	}
+	if hasParentComponent(name) {
+		return ""
+	}
+	return filepath.Join(root, name)
+}
+
+// hasParentComponent reports whether the entry name has a .. component.
+func hasParentComponent(name string) bool {
+	for _, component := range strings.Split(filepath.ToSlash(name), "/") {
+		if component == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// errEmptyArchive is returned if the archive stream has no bytes at all.
+var errEmptyArchive = errors.New("the archive is empty, it does not look like a tar archive")
+
+// entryGuard streams the archive to the tar tool, and handles the entries with too long paths, and the regular file entries
+// targeting an existing symlink or directory before tar gets them: tar replaces such symlinks, but can not be told to follow them or to refuse extracting over them.
+// Under an extraction root, the entries traversing out of the root are refused too, see traversalCheck.
+// The archive is re-encoded as an uncompressed tar stream, the entries written through a symlink or skipped are left out of it.
+type entryGuard struct {
+	mode           string
+	dirPolicy      string
+	longPathPolicy string
+	maxPath        int
+	root           string
+	traversal      *traversalCheck
+	// Written indexes the regular files written by the guard instead of tar, it is final once the stream is closed.
+	Written archiveIndex
+
+	pr   *io.PipeReader
+	err  error
+	done chan struct{}
+}
+
+// newEntryGuard starts streaming the archive read from r, with the given symlink and directory conflict handling.
+func newEntryGuard(r io.Reader, opts extractOptions) *entryGuard {
+	pr, pw := io.Pipe()
+	g := entryGuard{mode: opts.ExistingSymlinks, dirPolicy: opts.DirFileConflicts, longPathPolicy: opts.LongPaths, root: opts.Root, Written: archiveIndex{}, pr: pr, done: make(chan struct{})}
+	if opts.Root != "" {
+		g.traversal = newTraversalCheck()
+	}
+	if g.longPathPolicy != "" {
+		root := opts.Root
+		if root == "" {
+			root = "/"
+		}
+		g.maxPath = pathMax(root)
+	}
+	go func() {
+		defer close(g.done)
+		g.err = g.copyArchive(r, tar.NewWriter(pw))
+		// tar gets a truncated archive on error
+		_ = pw.CloseWithError(g.err)
+	}()
+	return &g
+}
+
+// Read implements the io.Reader interface.
+func (g *entryGuard) Read(p []byte) (int, error) {
+	return g.pr.Read(p)
+}
+
+// close stops the streaming, and returns its error. A stream stopped before its end, because tar exited, is not an error.
+func (g *entryGuard) close() error {
+	_ = g.pr.Close()
+	<-g.done
+	if g.err == io.ErrClosedPipe {
+		return nil
+	}
+	return g.err
+}
+
+func (g *entryGuard) copyArchive(r io.Reader, tw *tar.Writer) error {
+	counter := &countingReader{r: r}
+	tr, err := newArchiveReader(counter)
+	if err != nil {
+		return err
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF && counter.n == 0 {
+			// tar refuses an empty input, the re-encoded stream would be a valid empty archive
+			return errEmptyArchive
+		}
+		if err == io.EOF {
+			return tw.Close()
+		}
+		if err != nil {
+			return err
+		}
+
+		normalizeSparseHeader(hdr)
+		if g.traversal != nil {
+			if err := g.traversal.check(hdr); err != nil {
+				return err
+			}
+		}
+		if g.longPathPolicy != "" {
+			skip, err := resolveLongPath(hdr, g.root, g.longPathPolicy, g.maxPath)
+			if err != nil {
+				return err
+			}
+			if skip {
+				continue
+			}
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			target := entryTarget(hdr.Name, g.root)
+			info, err := os.Lstat(target)
+			if err == nil && info.IsDir() && g.dirPolicy != "" {
+				skip, err := resolveDirConflict(target, g.dirPolicy)
+				if err != nil {
+					return err
+				}
+				if skip {
+					continue
+				}
+			}
+			// an empty mode replaces the symlinks too
+			if err == nil && info.Mode()&os.ModeSymlink != 0 && (g.mode == symlinksFollow || g.mode == symlinksFail) {
+				link, err := os.Readlink(target)
+				if err != nil {
+					return err
+				}
+				if g.mode == symlinksFail {
+					return &symlinkError{Path: target, Link: link}
+				}
+
+				log.Debugf("writing %s through the symlink to %s", target, link)
+				if err := writeThroughSymlink(target, hdr, tr); err != nil {
+					return fmt.Errorf("failed to write %s: %s", target, err)
+				}
+				g.Written[hdr.Name] = indexEntry{Typeflag: hdr.Typeflag, Size: hdr.Size}
+				continue
+			}
+			if isSparseEntry(hdr) {
+				log.Debugf("writing the sparse file %s with its holes", target)
+				if err := writeSparseEntry(target, hdr, tr); err != nil {
+					return fmt.Errorf("failed to write %s: %s", target, err)
+				}
+				g.Written[hdr.Name] = indexEntry{Typeflag: hdr.Typeflag, Size: hdr.Size}
+				continue
+			}
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// writeThroughSymlink writes the entry's content to the file the symlink at pth points to, and sets the entry's mode on it:
+// the mode only applies on creation, an existing file would keep its own.
+func writeThroughSymlink(pth string, hdr *tar.Header, r io.Reader) error {
+	f, err := os.OpenFile(pth, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, hdr.FileInfo().Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if isSparseEntry(hdr) {
+		_, err = writeSparse(f, r)
+	} else {
+		_, err = io.Copy(f, r)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(pth, hdr.FileInfo().Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(pth, hdr.ModTime, hdr.ModTime)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openFDs returns the number of open file descriptors of the process.
+func openFDs(t *testing.T) int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("open file descriptors are not available: %s", err)
+	}
+	return len(fds)
+}
+
+func TestEntryGuard_NestedDirectories(t *testing.T) {
+	root := t.TempDir()
+	rel := strings.Repeat("dir/", 64)
+	if err := os.MkdirAll(filepath.Join(root, rel), 0755); err != nil {
+		t.Fatal(err)
+	}
+	external := filepath.Join(t.TempDir(), "external.txt")
+	if err := ioutil.WriteFile(external, []byte("external"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(external, filepath.Join(root, rel, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []testEntry
+	for i := 0; i < 64; i++ {
+		entries = append(entries, testEntry{hdr: tar.Header{Name: "/" + strings.Repeat("dir/", i+1) + "file.txt", Typeflag: tar.TypeReg}, body: "cache"})
+	}
+	entries = append(entries, testEntry{hdr: tar.Header{Name: "/" + rel + "link.txt", Typeflag: tar.TypeReg}, body: "followed"})
+	archive := createTestArchive(t, entries...)
+
+	before := openFDs(t)
+	if _, err := extractCacheArchive(archive, extractOptions{Root: root, ExistingSymlinks: symlinksFollow}); err != nil {
+		t.Fatalf("extractCacheArchive() error = %v", err)
+	}
+	if after := openFDs(t); after > before {
+		t.Errorf("open file descriptors: %d after the extraction, %d before", after, before)
+	}
+
+	for i := 0; i < 64; i++ {
+		if b, err := ioutil.ReadFile(filepath.Join(root, strings.Repeat("dir/", i+1), "file.txt")); err != nil || string(b) != "cache" {
+			t.Errorf("nested file %d not extracted: %v", i, err)
+		}
+	}
+	if b, err := ioutil.ReadFile(external); err != nil || string(b) != "followed" {
+		t.Errorf("symlink in the nested directory not followed: %q, %v", b, err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// phaseTimings are the durations of the pull's phases, logged at the end of the pull and written to the summary.
+// The download phase ends once the archive can be read: a streamed archive is still downloaded during the extraction,
+// so a network-bound streamed pull shows a long extraction too.
+type phaseTimings struct {
+	mu            sync.Mutex
+	urlResolution time.Duration
+	download      time.Duration
+	stackCheck    time.Duration
+	extraction    time.Duration
+}
+
+// phaseDurations are the phases' durations in milliseconds, as written to the summary.
+type phaseDurations struct {
+	URLResolutionMS float64 `json:"url_resolution_ms"`
+	DownloadMS      float64 `json:"download_ms"`
+	StackCheckMS    float64 `json:"stack_check_ms"`
+	ExtractionMS    float64 `json:"extraction_ms"`
+}
+
+// stepTimings are the phase timings of the pull.
+// It is a package variable like stepSummary, so that the summary written on the os.Exit paths has them too.
+var stepTimings = &phaseTimings{}
+
+// measure starts timing the phase, the returned func adds the elapsed time to it.
+// A phase measured more than once (like the extraction of the archive's parts) adds up.
+func (t *phaseTimings) measure(phase *time.Duration) func() {
+	start := time.Now()
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		*phase += time.Since(start)
+	}
+}
+
+// durations returns the phases' durations in milliseconds.
+func (t *phaseTimings) durations() phaseDurations {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	return phaseDurations{
+		URLResolutionMS: ms(t.urlResolution),
+		DownloadMS:      ms(t.download),
+		StackCheckMS:    ms(t.stackCheck),
+		ExtractionMS:    ms(t.extraction),
+	}
+}
+
+// log logs the phases' durations.
+func (t *phaseTimings) log() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	round := func(d time.Duration) string { return d.Round(time.Millisecond).String() }
+	log.Printf("url resolution: %s, download: %s, stack check: %s, extraction: %s",
+		round(t.urlResolution), round(t.download), round(t.stackCheck), round(t.extraction))
+}
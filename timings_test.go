@@ -0,0 +1,96 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPhaseTimings(t *testing.T) {
+	defer func(timings *phaseTimings, summary *restoreSummary) { stepTimings, stepSummary = timings, summary }(stepTimings, stepSummary)
+	stepTimings = &phaseTimings{}
+	stepSummary = newRestoreSummary(filepath.Join(t.TempDir(), "summary.json"))
+
+	archive := createTestArchive(t,
+		testEntry{hdr: tar.Header{Name: archiveInfoFileName, Typeflag: tar.TypeReg, Mode: 0644}, body: `{"stack_id": "s1"}`},
+		testEntry{hdr: tar.Header{Name: "file.txt", Typeflag: tar.TypeReg, Mode: 0644}, body: "content"},
+	).Bytes()
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api" {
+			_, _ = w.Write([]byte(`{"download_url": "` + server.URL + `/archive"}`))
+			return
+		}
+		_, _ = w.Write(archive)
+	}))
+	defer server.Close()
+
+	// the fixture run's phases, measured the way the pull measures them
+	apiResp, err := getCacheDownloadURL(server.URL+"/api", "download_url")
+	if err != nil {
+		t.Fatalf("getCacheDownloadURL() error = %v", err)
+	}
+	stop := stepTimings.measure(&stepTimings.download)
+	body, _, err := requestArchive(http.DefaultClient, apiResp.DownloadURL, false)
+	stop()
+	if err != nil {
+		t.Fatalf("requestArchive() error = %v", err)
+	}
+	recorder := NewRestoreReader(body)
+	stop = stepTimings.measure(&stepTimings.stackCheck)
+	info, err := readArchiveInfo(recorder)
+	stop()
+	if err != nil || info == nil || info.StackID != "s1" {
+		t.Fatalf("readArchiveInfo() = %+v, %v, want the archive info", info, err)
+	}
+	stop = stepTimings.measure(&stepTimings.extraction)
+	_, err = extractCacheArchive(recorder, extractOptions{Root: t.TempDir()})
+	stop()
+	if err != nil {
+		t.Fatalf("extractCacheArchive() error = %v", err)
+	}
+
+	durations := stepTimings.durations()
+	for name, ms := range map[string]float64{
+		"url resolution": durations.URLResolutionMS,
+		"download":       durations.DownloadMS,
+		"stack check":    durations.StackCheckMS,
+		"extraction":     durations.ExtractionMS,
+	} {
+		if ms <= 0 {
+			t.Errorf("%s duration = %f ms, want it measured", name, ms)
+		}
+	}
+
+	stepSummary.write(true)
+	b, err := ioutil.ReadFile(stepSummary.pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary struct {
+		Phases phaseDurations `json:"phases"`
+	}
+	if err := json.Unmarshal(b, &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Phases != durations {
+		t.Errorf("summary phases = %+v, want %+v", summary.Phases, durations)
+	}
+}
+
+func TestPhaseTimings_AddsUp(t *testing.T) {
+	timings := &phaseTimings{}
+	for i := 0; i < 2; i++ {
+		stop := timings.measure(&timings.extraction)
+		time.Sleep(5 * time.Millisecond)
+		stop()
+	}
+	if d := timings.durations(); d.ExtractionMS < 10 || d.DownloadMS != 0 {
+		t.Errorf("durations() = %+v, want the extractions added up and the rest unmeasured", d)
+	}
+}
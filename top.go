@@ -0,0 +1,104 @@
+package main
+
+import (
+	"archive/tar"
+	"sort"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// entryCounts are the numbers of the archive's entries by type, and the regular files' total size.
+type entryCounts struct {
+	Files     int
+	Dirs      int
+	Symlinks  int
+	HardLinks int
+	Other     int
+	Bytes     int64
+}
+
+// countEntries counts the entries of the index, apart from the metadata entry.
+func countEntries(index archiveIndex) entryCounts {
+	var c entryCounts
+	for _, entry := range index {
+		if entry.Metadata {
+			continue
+		}
+		switch entry.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			c.Files++
+			c.Bytes += entry.Size
+		case tar.TypeDir:
+			c.Dirs++
+		case tar.TypeSymlink:
+			c.Symlinks++
+		case tar.TypeLink:
+			c.HardLinks++
+		default:
+			c.Other++
+		}
+	}
+	return c
+}
+
+// topEntry is an entry of the largest or slowest entries report.
+type topEntry struct {
+	Name     string
+	Size     int64
+	Duration time.Duration
+}
+
+// topEntries returns the n largest regular file entries, and the n entries taking the longest to extract, in decreasing order.
+// The write times are only known for the archive streams, the slowest entries of an extracted archive file are not reported.
+func topEntries(index archiveIndex, n int) ([]topEntry, []topEntry) {
+	var entries []topEntry
+	for name, entry := range index {
+		if entry.Metadata {
+			continue
+		}
+		entries = append(entries, topEntry{Name: name, Size: entry.Size, Duration: entry.Duration})
+	}
+
+	top := func(key func(e topEntry) int64) []topEntry {
+		sort.Slice(entries, func(i, j int) bool {
+			if ki, kj := key(entries[i]), key(entries[j]); ki != kj {
+				return ki > kj
+			}
+			// ties are ordered by name, for a stable report
+			return entries[i].Name < entries[j].Name
+		})
+		var selected []topEntry
+		for _, e := range entries {
+			if len(selected) == n || key(e) <= 0 {
+				break
+			}
+			selected = append(selected, e)
+		}
+		return selected
+	}
+
+	largest := top(func(e topEntry) int64 {
+		if index[e.Name].Typeflag != tar.TypeReg {
+			return 0
+		}
+		return e.Size
+	})
+	slowest := top(func(e topEntry) int64 { return int64(e.Duration) })
+	return largest, slowest
+}
+
+// logTopEntries logs the n largest and slowest entries of the archive.
+func logTopEntries(index archiveIndex, n int) {
+	largest, slowest := topEntries(index, n)
+	log.Printf("largest entries:")
+	for _, e := range largest {
+		log.Printf("- %s: %d KB", e.Name, e.Size/1024)
+	}
+	if len(slowest) > 0 {
+		log.Printf("slowest entries to write:")
+		for _, e := range slowest {
+			log.Printf("- %s: %s", e.Name, e.Duration.Round(time.Millisecond))
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowEntryReader delays reading the body of an entry, as a slow disk would delay tar.
+type slowEntryReader struct {
+	r     io.Reader
+	delay time.Duration
+	slow  string
+}
+
+func (s *slowEntryReader) Read(p []byte) (int, error) {
+	if len(p) > 512 {
+		p = p[:512]
+	}
+	n, err := s.r.Read(p)
+	if strings.Contains(string(p[:n]), s.slow) {
+		time.Sleep(s.delay)
+	}
+	return n, err
+}
+
+func TestTopEntries(t *testing.T) {
+	root := t.TempDir()
+	archive := createTestArchive(t,
+		testEntry{hdr: tar.Header{Name: "/" + archiveInfoFileName, Typeflag: tar.TypeReg}, body: strings.Repeat(" ", 8*1024)},
+		testEntry{hdr: tar.Header{Name: "/cache", Typeflag: tar.TypeDir}},
+		testEntry{hdr: tar.Header{Name: "/cache/small.txt", Typeflag: tar.TypeReg}, body: "small"},
+		testEntry{hdr: tar.Header{Name: "/cache/medium.txt", Typeflag: tar.TypeReg}, body: strings.Repeat("m", 2*1024)},
+		testEntry{hdr: tar.Header{Name: "/cache/large.txt", Typeflag: tar.TypeReg}, body: strings.Repeat("l", 4*1024)},
+		testEntry{hdr: tar.Header{Name: "/cache/slow.txt", Typeflag: tar.TypeReg}, body: strings.Repeat("slow", 64)},
+	)
+
+	// the slow entry's body takes 200ms to pass on to tar
+	result, err := extractCacheArchive(&slowEntryReader{r: archive, delay: 200 * time.Millisecond, slow: "slowslow"}, extractOptions{Root: root})
+	if err != nil {
+		t.Fatalf("extractCacheArchive() error = %v", err)
+	}
+
+	largest, slowest := topEntries(result.Index, 2)
+	if len(largest) != 2 || largest[0].Name != "/cache/large.txt" || largest[1].Name != "/cache/medium.txt" {
+		t.Errorf("largest entries = %+v, want large.txt, medium.txt", largest)
+	}
+	// only the order is asserted, the measured durations depend on the scheduling of tar and the index
+	if len(slowest) != 2 || slowest[0].Name != "/cache/slow.txt" || slowest[0].Duration <= 0 || slowest[1].Duration > slowest[0].Duration {
+		t.Errorf("slowest entries = %+v, want slow.txt first", slowest)
+	}
+
+	// the write times are not known for an indexed archive file
+	index := archiveIndex{"/cache/large.txt": {Typeflag: tar.TypeReg, Size: 4096}, "/cache": {Typeflag: tar.TypeDir}}
+	largest, slowest = topEntries(index, 10)
+	if len(largest) != 1 || len(slowest) != 0 {
+		t.Errorf("topEntries() = %+v, %+v, want the regular file as the only largest entry, no slowest entries", largest, slowest)
+	}
+}
+
+func TestCountEntries(t *testing.T) {
+	archive := createTestArchive(t,
+		testEntry{hdr: tar.Header{Name: archiveInfoFileName, Typeflag: tar.TypeReg}, body: `{"stack_id":"linux"}`},
+		testEntry{hdr: tar.Header{Name: "cache/", Typeflag: tar.TypeDir, Mode: 0755}},
+		testEntry{hdr: tar.Header{Name: "cache/nested/", Typeflag: tar.TypeDir, Mode: 0755}},
+		testEntry{hdr: tar.Header{Name: "cache/a.txt", Typeflag: tar.TypeReg}, body: strings.Repeat("a", 300)},
+		testEntry{hdr: tar.Header{Name: "cache/nested/b.txt", Typeflag: tar.TypeReg}, body: strings.Repeat("b", 200)},
+		testEntry{hdr: tar.Header{Name: "cache/c.txt", Typeflag: tar.TypeReg}, body: strings.Repeat("c", 100)},
+		testEntry{hdr: tar.Header{Name: "cache/link", Typeflag: tar.TypeSymlink, Linkname: "a.txt"}},
+		testEntry{hdr: tar.Header{Name: "cache/hard", Typeflag: tar.TypeLink, Linkname: "cache/a.txt"}},
+	)
+	result, err := extractCacheArchive(archive, extractOptions{Root: t.TempDir()})
+	if err != nil {
+		t.Fatalf("extractCacheArchive() error = %v", err)
+	}
+
+	want := entryCounts{Files: 3, Dirs: 2, Symlinks: 1, HardLinks: 1, Bytes: 600}
+	if got := countEntries(result.Index); got != want {
+		t.Errorf("countEntries() = %+v, want %+v", got, want)
+	}
+	largest, _ := topEntries(result.Index, 2)
+	if len(largest) != 2 || largest[0].Name != "cache/a.txt" || largest[1].Name != "cache/nested/b.txt" {
+		t.Errorf("largest entries = %+v, want a.txt, b.txt", largest)
+	}
+}
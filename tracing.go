@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// tracingServiceName is the service name reported with the exported spans.
+const tracingServiceName = "steps-cache-pull"
+
+// span is a timed operation of the step, like the download or the extraction.
+// A nil span is a no-op, so instrumentation costs nothing when tracing is not configured.
+// It can be ended and annotated from any goroutine, also while the tracer flushes it.
+type span struct {
+	name     string
+	id       [8]byte
+	parentID [8]byte
+	start    time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes map[string]interface{}
+}
+
+// setAttribute sets a string, int, int64 or bool attribute of the span.
+func (s *span) setAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+// finish ends the span.
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.end.IsZero() {
+		s.end = time.Now()
+	}
+}
+
+// spanExporter sends the finished spans of a trace.
+type spanExporter interface {
+	exportSpans(traceID [16]byte, spans []*span) error
+}
+
+// tracer records the spans of a single step run, as the children of a root span.
+// A nil tracer is a no-op.
+type tracer struct {
+	exporter spanExporter
+	traceID  [16]byte
+	root     *span
+
+	mu    sync.Mutex
+	spans []*span
+}
+
+// newTracer creates a tracer and starts its root span.
+func newTracer(exporter spanExporter) *tracer {
+	t := tracer{exporter: exporter}
+	if _, err := rand.Read(t.traceID[:]); err != nil {
+		log.Debugf("tracing: failed to generate trace id: %s", err)
+	}
+	t.root = t.newSpan("cache pull", [8]byte{})
+	return &t
+}
+
+func (t *tracer) newSpan(name string, parentID [8]byte) *span {
+	s := &span{name: name, parentID: parentID, start: time.Now(), attributes: map[string]interface{}{}}
+	if _, err := rand.Read(s.id[:]); err != nil {
+		log.Debugf("tracing: failed to generate span id: %s", err)
+	}
+
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+
+	return s
+}
+
+// start starts a child span of the root span.
+func (t *tracer) start(name string) *span {
+	if t == nil {
+		return nil
+	}
+	return t.newSpan(name, t.root.id)
+}
+
+// rootSpan returns the root span, to set attributes of the whole run.
+func (t *tracer) rootSpan() *span {
+	if t == nil {
+		return nil
+	}
+	return t.root
+}
+
+// flush finishes the open spans and exports the trace. Further calls are no-op.
+func (t *tracer) flush() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mu.Unlock()
+
+	if len(spans) == 0 {
+		return
+	}
+	for _, s := range spans {
+		s.finish()
+	}
+	if err := t.exporter.exportSpans(t.traceID, spans); err != nil {
+		log.Warnf("Failed to export trace: %s", err)
+	}
+}
+
+// otlpExporter exports spans to an OTLP/HTTP traces endpoint, using the JSON encoding.
+type otlpExporter struct {
+	client   *http.Client
+	endpoint string
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+}
+
+// otlpAttributeValue converts an attribute value to an OTLP AnyValue.
+func otlpAttributeValue(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprintf("%v", v)}
+	}
+}
+
+// otlpTraceRequest builds the OTLP ExportTraceServiceRequest of the given spans.
+func otlpTraceRequest(traceID [16]byte, spans []*span) map[string]interface{} {
+	var otlpSpans []otlpSpan
+	for _, s := range spans {
+		s.mu.Lock()
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(traceID[:]),
+			SpanID:            hex.EncodeToString(s.id[:]),
+			Name:              s.name,
+			Kind:              1, // SPAN_KIND_INTERNAL
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for key, value := range s.attributes {
+			o.Attributes = append(o.Attributes, otlpAttribute{Key: key, Value: otlpAttributeValue(value)})
+		}
+		s.mu.Unlock()
+		otlpSpans = append(otlpSpans, o)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{{Key: "service.name", Value: otlpAttributeValue(tracingServiceName)}},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": tracingServiceName},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	}
+}
+
+func (e otlpExporter) exportSpans(traceID [16]byte, spans []*span) error {
+	b, err := json.Marshal(otlpTraceRequest(traceID, spans))
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			log.Warnf("Failed to close response body: %s", err)
+		}
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("non success response code: %d, body: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// spanRecorder is an in-memory spanExporter.
+type spanRecorder struct {
+	spans []*span
+}
+
+func (r *spanRecorder) exportSpans(traceID [16]byte, spans []*span) error {
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func TestTracer(t *testing.T) {
+	recorder := &spanRecorder{}
+	tr := newTracer(recorder)
+
+	download := tr.start("download")
+	download.setAttribute("archive.size", int64(1024))
+	download.finish()
+
+	extraction := tr.start("extraction")
+	extraction.setAttribute("extraction.entries", 42)
+	// left open, flush finishes it
+
+	tr.rootSpan().setAttribute("cache.hit", true)
+	tr.flush()
+	tr.flush()
+
+	if len(recorder.spans) != 3 {
+		t.Fatalf("exported %d spans, want 3", len(recorder.spans))
+	}
+
+	wantAttributes := map[string]map[string]interface{}{
+		"cache pull": {"cache.hit": true},
+		"download":   {"archive.size": int64(1024)},
+		"extraction": {"extraction.entries": 42},
+	}
+	for _, s := range recorder.spans {
+		if want, ok := wantAttributes[s.name]; !ok {
+			t.Errorf("unexpected span: %s", s.name)
+		} else if !reflect.DeepEqual(s.attributes, want) {
+			t.Errorf("span %s attributes = %v, want %v", s.name, s.attributes, want)
+		}
+		if s.end.IsZero() {
+			t.Errorf("span %s is not finished", s.name)
+		}
+		if s.name != "cache pull" && s.parentID != tr.root.id {
+			t.Errorf("span %s is not a child of the root span", s.name)
+		}
+	}
+}
+
+func TestTracer_Concurrent(t *testing.T) {
+	recorder := &spanRecorder{}
+	tr := newTracer(recorder)
+
+	t.Log("spans are started, annotated and finished from several goroutines")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				s := tr.start(fmt.Sprintf("part %d", i))
+				s.setAttribute("part.index", j)
+				tr.rootSpan().setAttribute(fmt.Sprintf("part.%d", i), j)
+				s.finish()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	t.Log("an open span is finished by its goroutine while the tracer flushes it")
+	open := tr.start("open")
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		open.setAttribute("open.finished", true)
+		open.finish()
+	}()
+	tr.flush()
+	<-finished
+
+	if len(recorder.spans) != 82 {
+		t.Fatalf("exported %d spans, want 82", len(recorder.spans))
+	}
+	for _, s := range recorder.spans {
+		if s.end.IsZero() {
+			t.Errorf("span %s is not finished", s.name)
+		}
+	}
+	if n := len(tr.root.attributes); n != 8 {
+		t.Errorf("root span has %d attributes, want 8", n)
+	}
+}
+
+func TestTracer_Nil(t *testing.T) {
+	var tr *tracer
+	s := tr.start("download")
+	s.setAttribute("archive.size", int64(1024))
+	s.finish()
+	tr.rootSpan().setAttribute("cache.hit", true)
+	tr.flush()
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var request struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string `json:"traceId"`
+					ParentSpanID string `json:"parentSpanId"`
+					Name         string `json:"name"`
+					Attributes   []struct {
+						Key   string                 `json:"key"`
+						Value map[string]interface{} `json:"value"`
+					} `json:"attributes"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Content-Type = %s, want application/json", ct)
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("failed to read request: %s", err)
+		}
+		if err := json.Unmarshal(b, &request); err != nil {
+			t.Errorf("failed to parse request: %s", err)
+		}
+	}))
+	defer server.Close()
+
+	tr := newTracer(otlpExporter{client: http.DefaultClient, endpoint: server.URL})
+	tr.start("download").setAttribute("archive.size", int64(1024))
+	tr.flush()
+
+	if len(request.ResourceSpans) != 1 || len(request.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected request: %+v", request)
+	}
+	spans := request.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(spans))
+	}
+	download := spans[1]
+	if download.Name != "download" || download.ParentSpanID == "" || len(download.TraceID) != 32 {
+		t.Errorf("unexpected download span: %+v", download)
+	}
+	if len(download.Attributes) != 1 || download.Attributes[0].Key != "archive.size" || download.Attributes[0].Value["intValue"] != "1024" {
+		t.Errorf("unexpected download span attributes: %+v", download.Attributes)
+	}
+}
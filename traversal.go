@@ -0,0 +1,119 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// maxSymlinkHops is the most symlinks followed resolving an entry's path, like the kernel's ELOOP limit.
+const maxSymlinkHops = 40
+
+// traversalError is returned if an archive entry would be written outside the extraction root.
+type traversalError struct {
+	Name   string
+	Reason string
+}
+
+// Error implements the error interface.
+func (e *traversalError) Error() string {
+	return fmt.Sprintf("refusing to extract %s outside the extraction root: %s", e.Name, e.Reason)
+}
+
+// traversalCheck validates the archive's entries against the extraction root: an entry must not have a .. component,
+// and its parent directories must not resolve outside the root through the symlinks extracted earlier from the archive.
+// The symlinks themselves may point outside the root (a rebased cache might have such links), they are just not written through.
+// The existing symlinks of the disk are not resolved, confine_to_root guarantees the writes beneath the root regardless of them.
+type traversalCheck struct {
+	// links maps the archive's symlink entries (rooted, cleaned paths) to their resolved targets, empty if pointing outside the root.
+	links map[string]string
+}
+
+func newTraversalCheck() *traversalCheck {
+	return &traversalCheck{links: map[string]string{}}
+}
+
+// check validates the entry, and records it if it is a symlink.
+func (c *traversalCheck) check(hdr *tar.Header) error {
+	if hasParentComponent(hdr.Name) {
+		return &traversalError{Name: hdr.Name, Reason: "its path has a .. component"}
+	}
+	name := path.Clean("/" + hdr.Name)
+	if _, err := c.resolve(name); err != nil {
+		return &traversalError{Name: hdr.Name, Reason: err.Error()}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeSymlink:
+		c.links[name] = resolveLinkTarget(name, hdr.Linkname)
+	case tar.TypeLink:
+		if hasParentComponent(hdr.Linkname) {
+			return &traversalError{Name: hdr.Name, Reason: fmt.Sprintf("its hard link target %s has a .. component", hdr.Linkname)}
+		}
+		if _, err := c.resolve(path.Clean("/" + hdr.Linkname)); err != nil {
+			return &traversalError{Name: hdr.Name, Reason: fmt.Sprintf("its hard link target %s: %s", hdr.Linkname, err)}
+		}
+		delete(c.links, name)
+	default:
+		// the entry replaces an earlier symlink entry at its path
+		delete(c.links, name)
+	}
+	return nil
+}
+
+// resolve returns the rooted path the name's parent directories resolve to, following the archive's symlinks.
+// The name's final component is not resolved: an entry replaces a symlink at its path.
+func (c *traversalCheck) resolve(name string) (string, error) {
+	for hops := 0; ; hops++ {
+		if hops > maxSymlinkHops {
+			return "", errors.New("too many levels of symlinks")
+		}
+		dir, target, ok := c.firstLink(name)
+		if !ok {
+			return name, nil
+		}
+		if target == "" {
+			return "", fmt.Errorf("its parent %s is a symlink pointing outside the extraction root", dir)
+		}
+		name = path.Join(target, strings.TrimPrefix(name, dir))
+	}
+}
+
+// firstLink returns the shallowest parent directory of the name which is a symlink entry, and its resolved target.
+func (c *traversalCheck) firstLink(name string) (string, string, bool) {
+	components := strings.Split(strings.TrimPrefix(name, "/"), "/")
+	for i := 1; i < len(components); i++ {
+		dir := "/" + strings.Join(components[:i], "/")
+		if target, ok := c.links[dir]; ok {
+			return dir, target, true
+		}
+	}
+	return "", "", false
+}
+
+// resolveLinkTarget returns the rooted path of the symlink's target, empty if it points outside the root:
+// if it is absolute, or has more .. components than the depth of the symlink's directory.
+func resolveLinkTarget(name, linkname string) string {
+	if path.IsAbs(linkname) {
+		return ""
+	}
+	resolved := strings.Split(strings.TrimPrefix(path.Dir(name), "/"), "/")
+	if resolved[0] == "" {
+		resolved = nil
+	}
+	for _, component := range strings.Split(linkname, "/") {
+		switch component {
+		case "", ".":
+		case "..":
+			if len(resolved) == 0 {
+				return ""
+			}
+			resolved = resolved[:len(resolved)-1]
+		default:
+			resolved = append(resolved, component)
+		}
+	}
+	return "/" + strings.Join(resolved, "/")
+}
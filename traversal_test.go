@@ -0,0 +1,86 @@
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtractCacheArchive_Traversal(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	outside := filepath.Join(parent, "outside")
+	for _, dir := range []string{root, outside} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file := func(name string) testEntry {
+		return testEntry{hdr: tar.Header{Name: name, Typeflag: tar.TypeReg}, body: "escaped"}
+	}
+	link := func(name, target string) testEntry {
+		return testEntry{hdr: tar.Header{Name: name, Linkname: target, Typeflag: tar.TypeSymlink, Mode: 0777}}
+	}
+
+	tests := []struct {
+		name    string
+		entries []testEntry
+	}{
+		{name: "parent components", entries: []testEntry{file("../outside/x.txt")}},
+		{name: "rooted parent components", entries: []testEntry{file("/../../outside/x.txt")}},
+		{name: "absolute symlink", entries: []testEntry{link("abs", outside), file("abs/x.txt")}},
+		{name: "relative symlink", entries: []testEntry{link("dir/rel", "../../outside"), file("dir/rel/x.txt")}},
+		{name: "symlink chain", entries: []testEntry{link("in", "sub/up"), link("sub/up", "../.."), file("in/outside/x.txt")}},
+		{name: "hard link", entries: []testEntry{{hdr: tar.Header{Name: "hard", Linkname: "../outside/x.txt", Typeflag: tar.TypeLink}}}},
+	}
+	for _, tt := range tests {
+		_, err := extractCacheArchive(createTestArchive(t, tt.entries...), extractOptions{Root: root})
+		if _, ok := err.(*traversalError); !ok {
+			t.Errorf("%s: extractCacheArchive() error = %v, want a traversal error", tt.name, err)
+		}
+		if files, err := ioutil.ReadDir(outside); err != nil || len(files) != 0 {
+			t.Fatalf("%s: written outside the root: %v, %v", tt.name, files, err)
+		}
+	}
+
+	// symlinks pointing outside are kept, the symlinks inside the root are written through
+	root = t.TempDir()
+	archive := createTestArchive(t,
+		link("abs", outside),
+		testEntry{hdr: tar.Header{Name: "sub/lib/", Typeflag: tar.TypeDir, Mode: 0755}},
+		link("lib", "sub/lib"),
+		testEntry{hdr: tar.Header{Name: "lib/x.txt", Typeflag: tar.TypeReg}, body: "inside"},
+	)
+	if _, err := extractCacheArchive(archive, extractOptions{Root: root}); err != nil {
+		t.Fatalf("extractCacheArchive() error = %v", err)
+	}
+	if target, err := os.Readlink(filepath.Join(root, "abs")); err != nil || target != outside {
+		t.Errorf("abs = %q, %v, want a symlink to %s", target, err, outside)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(root, "sub/lib/x.txt")); err != nil || string(b) != "inside" {
+		t.Errorf("sub/lib/x.txt = %q, %v, want written through the symlink inside the root", b, err)
+	}
+}
+
+func TestResolveLinkTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		linkname string
+		want     string
+	}{
+		{name: "/lib", linkname: "sub/lib", want: "/sub/lib"},
+		{name: "/a/b/link", linkname: "../c", want: "/a/c"},
+		{name: "/a/link", linkname: "./../b/", want: "/b"},
+		{name: "/a/link", linkname: "../..", want: ""},
+		{name: "/link", linkname: "..", want: ""},
+		{name: "/link", linkname: ".", want: "/"},
+		{name: "/a/link", linkname: "/a/b", want: ""},
+	}
+	for _, tt := range tests {
+		if got := resolveLinkTarget(tt.name, tt.linkname); got != tt.want {
+			t.Errorf("resolveLinkTarget(%q, %q) = %q, want %q", tt.name, tt.linkname, got, tt.want)
+		}
+	}
+}
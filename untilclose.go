@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// untilCloseTransport sends each request on a dedicated connection, and reads the response's body until the server closes the connection,
+// regardless of its Content-Length header. net/http binds a response body to its declared length, a zero Content-Length reads as empty.
+// The connection is dialed by the base transport's dialer (with its stall timeout), through its proxy, and with its TLS settings.
+type untilCloseTransport struct {
+	base *http.Transport
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *untilCloseTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	proxyURL, err := t.proxy(req)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := t.dial(req.Context(), req.URL, proxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	req = req.Clone(req.Context())
+	req.Close = true
+	if proxyURL != nil && req.URL.Scheme == "http" {
+		setProxyAuthorization(req.Header, proxyURL)
+		err = req.WriteProxy(conn)
+	} else {
+		err = req.Write(conn)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to read response: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		// an error response is read by its length, closing it closes the connection
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{resp.Body, conn}
+		return resp, nil
+	}
+
+	// the archive is read from the connection directly, past the response body bound to the Content-Length
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{br, conn}
+	resp.ContentLength = -1
+	return resp, nil
+}
+
+// proxy returns the base transport's proxy of the request, nil if it is not proxied.
+func (t *untilCloseTransport) proxy(req *http.Request) (*url.URL, error) {
+	if t.base.Proxy == nil {
+		return nil, nil
+	}
+	proxyURL, err := t.base.Proxy(req)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL != nil && proxyURL.Scheme != "http" && proxyURL.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", proxyURL.Scheme)
+	}
+	return proxyURL, nil
+}
+
+// dial connects to the target, through the proxy if it is set: an https target is tunneled with a CONNECT request.
+// The returned connection to an https target is TLS handshaken.
+func (t *untilCloseTransport) dial(ctx context.Context, target, proxyURL *url.URL) (net.Conn, error) {
+	dial := t.base.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	addr := canonicalAddr(target)
+	if proxyURL != nil {
+		addr = canonicalAddr(proxyURL)
+	}
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL != nil && proxyURL.Scheme == "https" {
+		if conn, err = t.handshake(ctx, conn, proxyURL.Hostname()); err != nil {
+			return nil, err
+		}
+	}
+	if proxyURL != nil && target.Scheme == "https" {
+		if err := connectTunnel(conn, canonicalAddr(target), proxyURL); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	if target.Scheme == "https" {
+		return t.handshake(ctx, conn, target.Hostname())
+	}
+	return conn, nil
+}
+
+// handshake starts a TLS session with the host on the connection, with the base transport's TLS settings.
+func (t *untilCloseTransport) handshake(ctx context.Context, conn net.Conn, host string) (net.Conn, error) {
+	config := &tls.Config{}
+	if t.base.TLSClientConfig != nil {
+		config = t.base.TLSClientConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// connectTunnel opens a tunnel to the address through the proxy connected to by conn.
+func connectTunnel(conn net.Conn, addr string, proxyURL *url.URL) error {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	setProxyAuthorization(req.Header, proxyURL)
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	// the proxy sends nothing past its response, until the tunnel is used
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return fmt.Errorf("failed to read proxy response: %s", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy refused the tunnel: %s", resp.Status)
+	}
+	return nil
+}
+
+// setProxyAuthorization sets the proxy URL's credentials as the basic Proxy-Authorization header, if it has any.
+func setProxyAuthorization(header http.Header, proxyURL *url.URL) {
+	if proxyURL.User == nil {
+		return
+	}
+	password, _ := proxyURL.User.Password()
+	auth := proxyURL.User.Username() + ":" + password
+	header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+}
+
+// canonicalAddr returns the URL's host:port, with the scheme's default port if it has none.
+func canonicalAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// requestUntilClose requests the archive with the client's transport settings, and returns the response's body
+// read until the server closes the connection. The request is retried and timed out like the client's requests.
+func requestUntilClose(client *http.Client, rawURL string) (io.ReadCloser, error) {
+	base, ok := client.Transport.(*http.Transport)
+	if !ok {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+	untilClose := &http.Client{Timeout: client.Timeout, Transport: &untilCloseTransport{base: base}}
+
+	resp, err := requestOK(untilClose, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"container/list"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bitrise-io/go-utils/log"
+)
+
+// downloadURLCacheSize is the number of Cache API responses kept by the download URL cache.
+const downloadURLCacheSize = 32
+
+// downloadURLCache is an in-memory LRU of the recently resolved Cache API responses, keyed by the Cache API URL:
+// a pull of the same cache within the TTL reuses the download URL without a Cache API request.
+// A presigned download URL is not reused after its own expiry, even within the TTL.
+type downloadURLCache struct {
+	ttl  time.Duration
+	size int
+	now  func() time.Time
+
+	mu      sync.Mutex
+	order   *list.List // the most recently used entry is at the front
+	entries map[string]*list.Element
+}
+
+// downloadURLs is the cache of the resolved download URLs, nil if they are not cached.
+var downloadURLs *downloadURLCache
+
+// cachedAPIResponse is an entry of the download URL cache.
+type cachedAPIResponse struct {
+	apiURL  string
+	resp    cacheAPIResponse
+	expires time.Time
+}
+
+// newDownloadURLCache creates a cache keeping at most size responses for ttl.
+func newDownloadURLCache(size int, ttl time.Duration) *downloadURLCache {
+	return &downloadURLCache{
+		ttl:     ttl,
+		size:    size,
+		now:     time.Now,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+// get returns the cached response of the Cache API URL, if it is not expired.
+func (c *downloadURLCache) get(apiURL string) (cacheAPIResponse, bool) {
+	if c == nil {
+		return cacheAPIResponse{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[apiURL]
+	if !ok {
+		return cacheAPIResponse{}, false
+	}
+	entry := e.Value.(*cachedAPIResponse)
+	if !c.now().Before(entry.expires) {
+		c.order.Remove(e)
+		delete(c.entries, apiURL)
+		return cacheAPIResponse{}, false
+	}
+	c.order.MoveToFront(e)
+	return entry.resp, true
+}
+
+// put caches the response of the Cache API URL for the TTL, or until its first download URL expires if that is earlier.
+// The least recently used response is dropped if the cache is full.
+func (c *downloadURLCache) put(apiURL string, resp cacheAPIResponse) {
+	if c == nil {
+		return
+	}
+	now := c.now()
+	expires := now.Add(c.ttl)
+	for _, u := range append([]string{resp.DownloadURL}, resp.PartURLs...) {
+		if t, ok := presignedURLExpiry(u); ok && t.Before(expires) {
+			expires = t
+		}
+	}
+	if !now.Before(expires) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cachedAPIResponse{apiURL: apiURL, resp: resp, expires: expires}
+	if e, ok := c.entries[apiURL]; ok {
+		e.Value = entry
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[apiURL] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedAPIResponse).apiURL)
+	}
+}
+
+// presignedURLExpiry returns the expiry of a presigned URL: an S3 (X-Amz-Date and X-Amz-Expires) or GCS (X-Goog-Date and X-Goog-Expires)
+// V4 signature, or a V2 signature's Unix time Expires parameter. It returns false if the URL has no parseable expiry.
+func presignedURLExpiry(rawURL string) (time.Time, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return time.Time{}, false
+	}
+	query := u.Query()
+
+	for _, prefix := range []string{"X-Amz-", "X-Goog-"} {
+		date, expires := query.Get(prefix+"Date"), query.Get(prefix+"Expires")
+		if date == "" || expires == "" {
+			continue
+		}
+		signed, err := time.Parse("20060102T150405Z", date)
+		if err != nil {
+			return time.Time{}, false
+		}
+		seconds, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return signed.Add(time.Duration(seconds) * time.Second), true
+	}
+
+	if expires := query.Get("Expires"); expires != "" {
+		unix, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.Unix(unix, 0), true
+	}
+	return time.Time{}, false
+}
+
+// lookupCacheDownloadURL is getCacheDownloadURL through the download URL cache.
+func lookupCacheDownloadURL(cacheAPIURL, jsonPath string) (cacheAPIResponse, error) {
+	if resp, ok := downloadURLs.get(cacheAPIURL); ok {
+		log.Debugf("Using the cached download URL of %s", cacheAPIURL)
+		return resp, nil
+	}
+	resp, err := getCacheDownloadURL(cacheAPIURL, jsonPath)
+	if err != nil {
+		return cacheAPIResponse{}, err
+	}
+	downloadURLs.put(cacheAPIURL, resp)
+	return resp, nil
+}
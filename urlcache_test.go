@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newURLCacheServer returns a Cache API server responding with the download URL, and its request counter.
+func newURLCacheServer(t *testing.T, downloadURL string) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = fmt.Fprintf(w, `{"download_url": %q}`, downloadURL)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestLookupCacheDownloadURL_TTL(t *testing.T) {
+	defer func(c *downloadURLCache) { downloadURLs = c }(downloadURLs)
+
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	downloadURLs = newDownloadURLCache(downloadURLCacheSize, time.Minute)
+	downloadURLs.now = func() time.Time { return now }
+
+	server, requests := newURLCacheServer(t, "https://storage.com/cache.tar")
+
+	lookup := func(wantRequests int32) {
+		t.Helper()
+		resp, err := lookupCacheDownloadURL(server.URL, "download_url")
+		if err != nil {
+			t.Fatalf("lookupCacheDownloadURL() error = %v", err)
+		}
+		if resp.DownloadURL != "https://storage.com/cache.tar" {
+			t.Errorf("lookupCacheDownloadURL() = %s, want https://storage.com/cache.tar", resp.DownloadURL)
+		}
+		if n := atomic.LoadInt32(requests); n != wantRequests {
+			t.Errorf("lookupCacheDownloadURL() sent %d requests in total, want %d", n, wantRequests)
+		}
+	}
+
+	t.Log("first call resolves the URL")
+	lookup(1)
+
+	t.Log("second call within the TTL skips the Cache API")
+	now = now.Add(59 * time.Second)
+	lookup(1)
+
+	t.Log("call after the TTL resolves the URL again")
+	now = now.Add(time.Second)
+	lookup(2)
+}
+
+func TestLookupCacheDownloadURL_PresignedExpiry(t *testing.T) {
+	defer func(c *downloadURLCache) { downloadURLs = c }(downloadURLs)
+
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	downloadURLs = newDownloadURLCache(downloadURLCacheSize, time.Hour)
+	downloadURLs.now = func() time.Time { return now }
+
+	// Signed a minute ago, valid for 2 minutes: it expires long before the hour of the TTL.
+	server, requests := newURLCacheServer(t, "https://bucket.s3.amazonaws.com/cache.tar?X-Amz-Date=20210301T115900Z&X-Amz-Expires=120&X-Amz-Signature=abc")
+
+	for i, tt := range []struct {
+		elapsed      time.Duration
+		wantRequests int32
+	}{
+		{0, 1},
+		{59 * time.Second, 1},
+		{time.Second, 2},
+	} {
+		now = now.Add(tt.elapsed)
+		if _, err := lookupCacheDownloadURL(server.URL, "download_url"); err != nil {
+			t.Fatalf("%d: lookupCacheDownloadURL() error = %v", i, err)
+		}
+		if n := atomic.LoadInt32(requests); n != tt.wantRequests {
+			t.Errorf("%d: lookupCacheDownloadURL() sent %d requests in total, want %d", i, n, tt.wantRequests)
+		}
+	}
+}
+
+func TestLookupCacheDownloadURL_Disabled(t *testing.T) {
+	defer func(c *downloadURLCache) { downloadURLs = c }(downloadURLs)
+	downloadURLs = nil
+
+	server, requests := newURLCacheServer(t, "https://storage.com/cache.tar")
+	for i := 0; i < 2; i++ {
+		if _, err := lookupCacheDownloadURL(server.URL, "download_url"); err != nil {
+			t.Fatalf("lookupCacheDownloadURL() error = %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(requests); n != 2 {
+		t.Errorf("lookupCacheDownloadURL() sent %d requests, want 2 without a cache", n)
+	}
+}
+
+func TestDownloadURLCache_Evict(t *testing.T) {
+	c := newDownloadURLCache(2, time.Minute)
+	c.put("https://api/a", cacheAPIResponse{DownloadURL: "https://storage.com/a.tar"})
+	c.put("https://api/b", cacheAPIResponse{DownloadURL: "https://storage.com/b.tar"})
+	if _, ok := c.get("https://api/a"); !ok {
+		t.Fatalf("get(a) = false, want the cached response")
+	}
+	c.put("https://api/c", cacheAPIResponse{DownloadURL: "https://storage.com/c.tar"})
+
+	if _, ok := c.get("https://api/b"); ok {
+		t.Errorf("get(b) = true, want the least recently used response evicted")
+	}
+	for _, key := range []string{"https://api/a", "https://api/c"} {
+		if _, ok := c.get(key); !ok {
+			t.Errorf("get(%s) = false, want the cached response", key)
+		}
+	}
+}
+
+func TestPresignedURLExpiry(t *testing.T) {
+	for _, tt := range []struct {
+		url    string
+		want   time.Time
+		wantOK bool
+	}{
+		{"https://bucket.s3.amazonaws.com/cache.tar?X-Amz-Date=20210301T120000Z&X-Amz-Expires=3600", time.Date(2021, 3, 1, 13, 0, 0, 0, time.UTC), true},
+		{"https://storage.googleapis.com/bucket/cache.tar?X-Goog-Date=20210301T120000Z&X-Goog-Expires=60", time.Date(2021, 3, 1, 12, 1, 0, 0, time.UTC), true},
+		{"https://storage.googleapis.com/bucket/cache.tar?Expires=1614600000&Signature=abc", time.Unix(1614600000, 0), true},
+		{"https://storage.com/cache.tar", time.Time{}, false},
+		{"https://bucket.s3.amazonaws.com/cache.tar?X-Amz-Date=yesterday&X-Amz-Expires=3600", time.Time{}, false},
+		{"https://storage.com/cache.tar?Expires=tomorrow", time.Time{}, false},
+	} {
+		got, ok := presignedURLExpiry(tt.url)
+		if ok != tt.wantOK || !got.Equal(tt.want) {
+			t.Errorf("presignedURLExpiry(%s) = %v, %t, want %v, %t", tt.url, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+// urlPolicy restricts the download URLs of the Cache API's response, they are checked before any of them is requested:
+// a misconfigured or compromised Cache API could point the step to a plain HTTP or an unexpected host.
+type urlPolicy struct {
+	schemes []string
+	hosts   []string
+}
+
+// downloadURLPolicy is the policy of the resolved download URLs, nil if they are not restricted.
+var downloadURLPolicy *urlPolicy
+
+// parseURLPolicy parses the comma or newline separated schemes and hosts, without any of them the URLs are not restricted.
+// A host starting with *. allows the subdomains of the domain.
+func parseURLPolicy(schemes, hosts string) *urlPolicy {
+	split := func(list string) []string {
+		return strings.FieldsFunc(strings.ToLower(list), func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+	}
+	p := urlPolicy{schemes: split(schemes), hosts: split(hosts)}
+	if len(p.schemes) == 0 && len(p.hosts) == 0 {
+		return nil
+	}
+	return &p
+}
+
+// check returns an error if the download URL of the Cache API at cacheAPIURL is not allowed.
+// A local file:// download URL is only allowed from a local Cache API URL, whatever the policy.
+func (p *urlPolicy) check(cacheAPIURL string, u *url.URL) error {
+	if (u.Scheme == "http" || u.Scheme == "https") && u.Host == "" {
+		return fmt.Errorf("invalid download URL (%s): no host", u.Redacted())
+	}
+	if u.Scheme == "file" && !strings.HasPrefix(cacheAPIURL, "file://") {
+		return fmt.Errorf("local download URL (%s) of a remote Cache API is not allowed", u.Redacted())
+	}
+	if p == nil {
+		return nil
+	}
+	if len(p.schemes) > 0 && !containsString(p.schemes, strings.ToLower(u.Scheme)) {
+		return fmt.Errorf("download URL scheme %s is not allowed, allowed schemes: %s", u.Scheme, strings.Join(p.schemes, ", "))
+	}
+	if len(p.hosts) > 0 && !p.allowsHost(strings.ToLower(u.Hostname())) {
+		return fmt.Errorf("download URL host %s is not allowed, allowed hosts: %s", u.Hostname(), strings.Join(p.hosts, ", "))
+	}
+	return nil
+}
+
+func (p *urlPolicy) allowsHost(host string) bool {
+	for _, allowed := range p.hosts {
+		if host == allowed || strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(items []string, s string) bool {
+	for _, item := range items {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
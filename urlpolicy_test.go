@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestResolveDownloadURL_Policy(t *testing.T) {
+	defer func(policy *urlPolicy) { downloadURLPolicy = policy }(downloadURLPolicy)
+
+	const cacheAPIURL = "http://cache.example.com/api"
+	tests := []struct {
+		name        string
+		schemes     string
+		hosts       string
+		downloadURL string
+		wantErr     bool
+	}{
+		{"unrestricted", "", "", "http://storage.example.com/archive.tar", false},
+		{"allowed scheme", "https,gs,s3", "", "https://storage.example.com/archive.tar", false},
+		{"object URL", "https,gs,s3", "", "s3://bucket/archive.tar", false},
+		{"plain HTTP rejected", "https,gs,s3", "", "http://storage.example.com/archive.tar", true},
+		{"relative URL of a plain HTTP API rejected", "https", "", "/archive.tar", true},
+		{"scheme case insensitive", "HTTPS", "", "https://storage.example.com/archive.tar", false},
+		{"allowed host", "", "storage.example.com", "https://storage.example.com:8443/archive.tar", false},
+		{"allowed subdomain", "", "*.example.com", "https://eu.storage.example.com/archive.tar", false},
+		{"domain of the subdomain pattern rejected", "", "*.example.com", "https://example.com/archive.tar", true},
+		{"other host rejected", "", "storage.example.com\ncdn.example.com", "https://attacker.example.org/archive.tar", true},
+		{"local URL rejected", "", "", "file:///etc/passwd", true},
+		{"no host rejected", "", "", "https:///archive.tar", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			downloadURLPolicy = parseURLPolicy(tt.schemes, tt.hosts)
+			_, err := resolveDownloadURL(cacheAPIURL, tt.downloadURL, true)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("resolveDownloadURL(%s) error = %v, wantErr %v", tt.downloadURL, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseURLPolicy(t *testing.T) {
+	if p := parseURLPolicy(" ", ",\n"); p != nil {
+		t.Errorf("parseURLPolicy() = %+v, want nil without schemes and hosts", p)
+	}
+	p := parseURLPolicy("https, gs\ns3", "Storage.Example.com")
+	if len(p.schemes) != 3 || len(p.hosts) != 1 || p.hosts[0] != "storage.example.com" {
+		t.Errorf("parseURLPolicy() = %+v, want 3 schemes and the lower case host", p)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// The step's build info, set by the release build:
+//
+//	go build -ldflags "-X main.version=2.1.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// A build without them is a dev build, its commit is read from the Go build info if it has one.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// printVersionEnv makes the step print its build info and exit, without pulling the cache.
+const printVersionEnv = "BITRISE_CACHE_PULL_PRINT_VERSION"
+
+// versionInfo returns the step's build info line, with the Go runtime's version.
+func versionInfo() string {
+	rev := commit
+	if rev == "" {
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, setting := range info.Settings {
+				if setting.Key == "vcs.revision" {
+					rev = setting.Value
+				}
+			}
+		}
+	}
+
+	parts := []string{version}
+	if rev != "" {
+		parts = append(parts, "commit "+rev)
+	}
+	if buildDate != "" {
+		parts = append(parts, "built "+buildDate)
+	}
+	return fmt.Sprintf("steps-cache-pull %s (%s %s/%s)", strings.Join(parts, ", "), runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+// printVersionRequested reports whether the step is run to print its build info only:
+// with the --version argument, or the printVersionEnv set to true.
+func printVersionRequested(args []string, getenv func(string) string) bool {
+	for _, arg := range args {
+		if arg == "--version" || arg == "-version" {
+			return true
+		}
+	}
+	return getenv(printVersionEnv) == "true"
+}
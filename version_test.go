@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVersionInfo(t *testing.T) {
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+	version, commit, buildDate = "2.1.0", "0123abc", "2026-10-14T12:00:00Z"
+
+	got := versionInfo()
+	for _, want := range []string{"steps-cache-pull 2.1.0", "commit 0123abc", "built 2026-10-14T12:00:00Z", "go"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("versionInfo() = %s, want it to contain %s", got, want)
+		}
+	}
+}
+
+func TestPrintVersionRequested(t *testing.T) {
+	noEnv := func(string) string { return "" }
+	if !printVersionRequested([]string{"--version"}, noEnv) {
+		t.Errorf("printVersionRequested(--version) = false, want true")
+	}
+	if !printVersionRequested(nil, func(key string) string { return map[string]string{printVersionEnv: "true"}[key] }) {
+		t.Errorf("printVersionRequested() = false with %s set, want true", printVersionEnv)
+	}
+	if printVersionRequested(nil, noEnv) {
+		t.Errorf("printVersionRequested() = true, want false")
+	}
+}
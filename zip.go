@@ -0,0 +1,151 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// zipMagic is the signature of a zip archive's first local file header.
+var zipMagic = []byte{0x50, 0x4b, 0x03, 0x04}
+
+// zipArchiveError is returned if the cache archive is a zip archive. The zip format's index is at the end of the archive,
+// so an accepted zip archive is extracted from the archive file, not from the download stream.
+type zipArchiveError struct {
+	Accepted bool
+}
+
+// Error implements the error interface.
+func (e *zipArchiveError) Error() string {
+	if e.Accepted {
+		return "the cache archive is a zip archive, it can only be extracted from the archive file"
+	}
+	return "the cache archive is a zip archive, zip archives are only extracted if accept_zip is enabled"
+}
+
+// isZipFile reports whether the file starts with the zip magic bytes.
+func isZipFile(pth string) (bool, error) {
+	f, err := os.Open(pth)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = f.Close() }()
+
+	magic := make([]byte, len(zipMagic))
+	if _, err := io.ReadFull(f, magic); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return bytes.Equal(magic, zipMagic), nil
+}
+
+// zipTarReader is a tar stream of a zip archive file's entries.
+type zipTarReader struct {
+	zr   *zip.ReadCloser
+	pr   *io.PipeReader
+	done chan struct{}
+}
+
+// newZipTarReader starts converting the zip archive file to a tar stream, so it is extracted the same way as a tar archive.
+// The entries' paths, modes, modification times and symlinks are kept.
+func newZipTarReader(pth string) (*zipTarReader, error) {
+	zr, err := zip.OpenReader(pth)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	z := zipTarReader{zr: zr, pr: pr, done: make(chan struct{})}
+	go func() {
+		defer close(z.done)
+		_ = pw.CloseWithError(writeZipAsTar(&zr.Reader, tar.NewWriter(pw)))
+	}()
+	return &z, nil
+}
+
+// Read implements the io.Reader interface.
+func (z *zipTarReader) Read(p []byte) (int, error) {
+	return z.pr.Read(p)
+}
+
+// Close stops the conversion and closes the zip archive file.
+func (z *zipTarReader) Close() error {
+	_ = z.pr.Close()
+	<-z.done
+	return z.zr.Close()
+}
+
+func writeZipAsTar(zr *zip.Reader, tw *tar.Writer) error {
+	for _, f := range zr.File {
+		info := f.FileInfo()
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			// a zip symlink entry's content is its target
+			target, err := readZipFile(f)
+			if err != nil {
+				return err
+			}
+			link = string(target)
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = f.Name
+		if info.IsDir() && !strings.HasSuffix(hdr.Name, "/") {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, rc)
+		_ = rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rc.Close() }()
+	return ioutil.ReadAll(rc)
+}
+
+// uncompressZipArchive extracts the zip archive file, if zip archives are accepted.
+func uncompressZipArchive(pth string, opts extractOptions) (extractResult, error) {
+	if !opts.AcceptZip {
+		return extractResult{}, &zipArchiveError{}
+	}
+	r, err := newZipTarReader(pth)
+	if err != nil {
+		return extractResult{}, err
+	}
+	result, err := extractCacheArchive(r, opts)
+	if err != nil {
+		// extractCacheArchive only closes the archive on success
+		_ = r.Close()
+	}
+	if info, err := os.Stat(pth); err == nil {
+		result.CompressedBytes = info.Size()
+	}
+	return result, err
+}
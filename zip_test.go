@@ -0,0 +1,105 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testZipEntry struct {
+	name string
+	mode os.FileMode
+	body string
+}
+
+// createTestZip writes a zip archive of the given entries to a file, and returns its path.
+func createTestZip(t *testing.T, entries ...testZipEntry) string {
+	var buff bytes.Buffer
+	zw := zip.NewWriter(&buff)
+	for _, entry := range entries {
+		hdr := &zip.FileHeader{Name: entry.name, Method: zip.Deflate, Modified: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+		hdr.SetMode(entry.mode)
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatalf("failed to write header: %s", err)
+		}
+		if _, err := w.Write([]byte(entry.body)); err != nil {
+			t.Fatalf("failed to write body: %s", err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to close archive: %s", err)
+	}
+	pth := filepath.Join(t.TempDir(), "cache.zip")
+	if err := ioutil.WriteFile(pth, buff.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return pth
+}
+
+func TestUncompressArchive_Zip(t *testing.T) {
+	pth := createTestZip(t,
+		testZipEntry{name: "dir/", mode: os.ModeDir | 0750},
+		testZipEntry{name: "dir/run.sh", mode: 0755, body: "#!/bin/sh"},
+		testZipEntry{name: "dir/empty/", mode: os.ModeDir | 0755},
+		testZipEntry{name: "notes.txt", mode: 0644, body: "notes"},
+		testZipEntry{name: "link.txt", mode: os.ModeSymlink | 0777, body: "notes.txt"},
+	)
+
+	if _, err := uncompressArchive(pth, extractOptions{Root: t.TempDir()}); err == nil {
+		t.Fatalf("uncompressArchive() error = nil, want a not accepted zip archive error")
+	} else if zipErr, ok := err.(*zipArchiveError); !ok || zipErr.Accepted {
+		t.Fatalf("uncompressArchive() error = %v, want a not accepted zip archive error", err)
+	}
+
+	root := t.TempDir()
+	result, err := uncompressArchive(pth, extractOptions{Root: root, AcceptZip: true})
+	if err != nil {
+		t.Fatalf("uncompressArchive() error = %v", err)
+	}
+	if result.Entries != 5 {
+		t.Errorf("Entries = %d, want 5", result.Entries)
+	}
+
+	for name, want := range map[string]os.FileMode{"dir": os.ModeDir | 0750, "dir/run.sh": 0755, "dir/empty": os.ModeDir | 0755, "notes.txt": 0644} {
+		info, err := os.Lstat(filepath.Join(root, name))
+		if err != nil {
+			t.Errorf("%s not extracted: %s", name, err)
+			continue
+		}
+		if got := info.Mode() & (os.ModeDir | os.ModePerm); got != want {
+			t.Errorf("%s mode = %s, want %s", name, got, want)
+		}
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(root, "dir/run.sh")); err != nil || string(b) != "#!/bin/sh" {
+		t.Errorf("dir/run.sh = %q, %v", b, err)
+	}
+	if link, err := os.Readlink(filepath.Join(root, "link.txt")); err != nil || link != "notes.txt" {
+		t.Errorf("link.txt = %q, %v, want a symlink to notes.txt", link, err)
+	}
+}
+
+func TestExtractWithFallbacks_Zip(t *testing.T) {
+	pth := createTestZip(t, testZipEntry{name: "notes.txt", mode: 0644, body: "notes"})
+	stream, err := os.Open(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = stream.Close() }()
+
+	root := t.TempDir()
+	result, err := extractWithFallbacks(stream, archiveSource{URI: "file://" + pth, PipeFallback: true}, extractOptions{Root: root, AcceptZip: true})
+	if err != nil {
+		t.Fatalf("extractWithFallbacks() error = %v", err)
+	}
+	if result.Source != extractSourceFile {
+		t.Errorf("Source = %s, want %s", result.Source, extractSourceFile)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(root, "notes.txt")); err != nil || string(b) != "notes" {
+		t.Errorf("notes.txt = %q, %v", b, err)
+	}
+}